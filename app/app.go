@@ -1,6 +1,7 @@
 package app
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
@@ -36,6 +37,10 @@ func (a *App) Initialize() {
 		log.Fatalf("Error configuring the logger: %v", err)
 	}
 
+	if err := common.ValidateEncryptionKeys(); err != nil {
+		common.Fatal("Invalid encryption configuration: %v", err)
+	}
+
 	if common.GetConfigBool("smtp.enabled") &&
 		(common.GetConfigString("smtp.username") == "" ||
 			common.GetConfigString("smtp.password") == "") {
@@ -55,7 +60,7 @@ func (a *App) Initialize() {
 		common.Fatal("Error opening file: %v", err)
 	}
 
-	controller.InitializeRedis()
+	controller.InitializeTokenStore()
 	common.InitializeTranslations()
 
 	// Define logger
@@ -70,6 +75,16 @@ func (a *App) Initialize() {
 	a.handler = handlers.CORS(originsOk, headersOk, methodsOk, allowCredentials)(a.handler)
 }
 
+// Reencrypt encrypts again the members with the current encryption key and
+// exits, to run after a key rotation.
+func (a *App) Reencrypt(batchSize int) {
+	reencrypted, err := model.ReencryptMembers(context.Background(), batchSize)
+	if err != nil {
+		log.Fatalf("Error re-encrypting members after %d members: %v", reencrypted, err)
+	}
+	log.Printf("%d members re-encrypted", reencrypted)
+}
+
 func (a *App) Run(addr string) {
 	a.scheduler.Start()
 	log.Fatal(http.ListenAndServe(addr, a.handler))
@@ -3,11 +3,13 @@ package common
 import (
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 )
 
 const uuidSize = 40
 const codeSize = 16
+const tokenBytes = 32
 
 const AnswerYes = "yes"
 const AnswerNo = "no"
@@ -31,6 +33,24 @@ func GenerateCode() string {
 	return fmt.Sprintf("%x", sha256.Sum256(data))[:codeSize]
 }
 
+// GenerateToken returns a random secret suitable for long-lived tokens
+// (calendar feeds, API tokens). Only its hash should be persisted.
+func GenerateToken() string {
+	data := make([]byte, tokenBytes)
+	_, err := rand.Read(data)
+	if err != nil {
+		Fatal(err.Error())
+	}
+	return hex.EncodeToString(data)
+}
+
+// HashToken returns the hex encoded SHA-256 of a token, used to store and
+// look up tokens without keeping them in clear.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func StringInSlice(a string, list []string) bool {
 	for _, b := range list {
 		if b == a {
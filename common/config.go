@@ -2,6 +2,7 @@ package common
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -41,15 +42,55 @@ func ReadConfig() {
 	viper.SetDefault("reminder_time_before_event", 172800)   // 2 days
 	viper.SetDefault("summary_time_before_event", 86400)     // 1 day
 	viper.SetDefault("encryption.iterations", 10000)         // For hashing encryption key
+	viper.SetDefault("encryption.key_id", 1)                 // ID of encryption.key, prefixed to ciphertexts
+	viper.SetDefault("encryption.old_keys", "")              // Previous keys, to decrypt: "1:secret,2:secret"
+	viper.SetDefault("encryption.index_key", "")             // For blind indexes, the key 1 if empty
 	viper.SetDefault("encryption.password_hashing_cost", 10) // For hashing passwords
 	viper.SetDefault("redis_dsn", "localhost:6379")          // Redis connection
+	viper.SetDefault("token_store", "redis")                 // Where the tokens and sessions are kept: redis or sqlite
 	viper.SetDefault("jwt.access_ttl_minutes", 15)
 	viper.SetDefault("jwt.refresh_ttl_days", 15)
 	viper.SetDefault("jwt.reset_ttl_minutes", 60)
 	viper.SetDefault("jwt.participation_ttl_minutes", 2880)
 	viper.SetDefault("jwt.registration_ttl_minutes", 10080)
+	viper.SetDefault("mfa.required_for_admins", false)             // Admins must enroll a second factor to login
+	viper.SetDefault("mfa.issuer", "Castellers")                   // Name shown by the authenticator apps
+	viper.SetDefault("mfa.token_ttl_minutes", 5)                   // To send the code after the password
+	viper.SetDefault("mfa.max_attempts", 5)                        // Wrong codes before the password is asked again
+	viper.SetDefault("login_protection.free_attempts", 3)          // Failed logins of a username before the delays
+	viper.SetDefault("login_protection.delay_seconds", 1)          // First delay, doubled at each failure
+	viper.SetDefault("login_protection.max_delay_seconds", 60)     // Longest delay
+	viper.SetDefault("login_protection.max_attempts_username", 10) // Failed logins of a username before the lockout
+	viper.SetDefault("login_protection.max_attempts_ip", 50)       // Failed logins from an IP before the lockout
+	viper.SetDefault("login_protection.window_minutes", 15)        // Failures are forgotten after this time
+	viper.SetDefault("login_protection.lockout_minutes", 30)
+	viper.SetDefault("login_protection.max_password_resets", 3)     // Forgot password requests per email in the window
+	viper.SetDefault("login_protection.max_password_resets_ip", 10) // Forgot password requests per IP in the window
+	viper.SetDefault("login_protection.ip_header", "")              // Header with the client IP behind a proxy, e.g. X-Forwarded-For
+	viper.SetDefault("login_protection.trusted_proxies", 1)         // Proxies in front of the API, that append to the ip_header
+	viper.SetDefault("magic_link.enabled", false)                   // Members can ask for a link by email to login without password
+	viper.SetDefault("magic_link.ttl_minutes", 15)
+	viper.SetDefault("oidc.enabled", false)                         // Login with an OpenID Connect provider
+	viper.SetDefault("oidc.issuer", "")                             // e.g. https://accounts.google.com
+	viper.SetDefault("oidc.client_id", "")                          // Of the application registered with the provider
+	viper.SetDefault("oidc.client_secret", "")                      // Idem
+	viper.SetDefault("oidc.redirect_url", "")                       // Page of the frontend finishing the login, domain + /login/oidc if empty
+	viper.SetDefault("oidc.scopes", "openid,email,profile")         // Comma-separated
+	viper.SetDefault("oidc.email_verified_claim", "email_verified") // Claim of the ID token telling the email is verified, e.g. xms_edov for Microsoft Entra ID
+	viper.SetDefault("api_tokens.max_per_member", 10)               // Personal API tokens a member can have
+	viper.SetDefault("notification_retry.max_attempts", 5)          // Attempts to send an email before it fails, 1 to never retry
+	viper.SetDefault("notification_retry.delay_seconds", 60)        // Before the first retry, then doubled after each attempt
+	viper.SetDefault("notification_retry.max_delay_seconds", 3600)  // Between two attempts
 	viper.SetDefault("inactive_delay_days", 21)
+	viper.SetDefault("inactivity.delay_days.admin", -1) // Per member type, -1 for inactive_delay_days, 0 to never pause
+	viper.SetDefault("inactivity.delay_days.member", -1)
+	viper.SetDefault("inactivity.delay_days.canalla", -1)
+	viper.SetDefault("inactivity.delay_days.guest", -1)
+	viper.SetDefault("inactivity.warning_days", 7) // Days before the pause to warn the member, 0 to never warn
+	viper.SetDefault("purge_retention_days", 365)  // Days before the data of deleted members is purged, 0 to never purge
+	viper.SetDefault("season_start_month", 1)      // Month when a season starts, for the statistics
 	viper.SetDefault("otel_enable", false)
+	viper.SetDefault("timezone", "America/Montreal") // IANA name, used to display and repeat events
 
 	// read config file
 	err := viper.ReadInConfig()
@@ -64,6 +105,7 @@ func ReadConfig() {
 	viper.BindEnv("db_name")
 	viper.BindEnv("domain")
 	viper.BindEnv("cdn")
+	viper.BindEnv("api_url")
 	viper.BindEnv("debug")
 	viper.BindEnv("smtp.server", "APP_SMTP_SERVER")
 	viper.BindEnv("smtp.port", "APP_SMTP_PORT")
@@ -72,10 +114,14 @@ func ReadConfig() {
 	viper.BindEnv("smtp.enabled", "APP_SMTP_ENABLED")
 	viper.BindEnv("reply_to", "APP_REPLY_TO")
 	viper.BindEnv("redis_dsn")
+	viper.BindEnv("token_store", "APP_TOKEN_STORE")
 	viper.BindEnv("reminder_time_before_event")
 	viper.BindEnv("summary_time_before_event")
 	viper.BindEnv("encryption.key", "APP_KEY")
 	viper.BindEnv("encryption.key_salt", "APP_KEY_SALT")
+	viper.BindEnv("encryption.key_id", "APP_KEY_ID")
+	viper.BindEnv("encryption.old_keys", "APP_OLD_KEYS")
+	viper.BindEnv("encryption.index_key", "APP_INDEX_KEY")
 	viper.BindEnv("encryption.password_pepper", "APP_PASSWORD_PEPPER")
 	viper.BindEnv("jwt.access_secret", "APP_ACCESS_SECRET")
 	viper.BindEnv("jwt.refresh_secret", "APP_REFRESH_SECRET")
@@ -84,8 +130,44 @@ func ReadConfig() {
 	viper.BindEnv("jwt.reset_ttl_minutes", "APP_RESET_TTL_MINUTES")
 	viper.BindEnv("jwt.participation_ttl_minutes", "APP_PARTICIPATION_TTL_MINUTES")
 	viper.BindEnv("jwt.registration_ttl_minutes", "APP_REGISTRATION_TTL_MINUTES")
+	viper.BindEnv("mfa.required_for_admins", "APP_MFA_REQUIRED_FOR_ADMINS")
+	viper.BindEnv("mfa.issuer", "APP_MFA_ISSUER")
+	viper.BindEnv("mfa.token_ttl_minutes", "APP_MFA_TOKEN_TTL_MINUTES")
+	viper.BindEnv("mfa.max_attempts", "APP_MFA_MAX_ATTEMPTS")
+	viper.BindEnv("login_protection.free_attempts", "APP_LOGIN_PROTECTION_FREE_ATTEMPTS")
+	viper.BindEnv("login_protection.delay_seconds", "APP_LOGIN_PROTECTION_DELAY_SECONDS")
+	viper.BindEnv("login_protection.max_delay_seconds", "APP_LOGIN_PROTECTION_MAX_DELAY_SECONDS")
+	viper.BindEnv("login_protection.max_attempts_username", "APP_LOGIN_PROTECTION_MAX_ATTEMPTS_USERNAME")
+	viper.BindEnv("login_protection.max_attempts_ip", "APP_LOGIN_PROTECTION_MAX_ATTEMPTS_IP")
+	viper.BindEnv("login_protection.window_minutes", "APP_LOGIN_PROTECTION_WINDOW_MINUTES")
+	viper.BindEnv("login_protection.lockout_minutes", "APP_LOGIN_PROTECTION_LOCKOUT_MINUTES")
+	viper.BindEnv("login_protection.max_password_resets", "APP_LOGIN_PROTECTION_MAX_PASSWORD_RESETS")
+	viper.BindEnv("login_protection.max_password_resets_ip", "APP_LOGIN_PROTECTION_MAX_PASSWORD_RESETS_IP")
+	viper.BindEnv("login_protection.ip_header", "APP_LOGIN_PROTECTION_IP_HEADER")
+	viper.BindEnv("login_protection.trusted_proxies", "APP_LOGIN_PROTECTION_TRUSTED_PROXIES")
+	viper.BindEnv("magic_link.enabled", "APP_MAGIC_LINK_ENABLED")
+	viper.BindEnv("magic_link.ttl_minutes", "APP_MAGIC_LINK_TTL_MINUTES")
+	viper.BindEnv("oidc.enabled", "APP_OIDC_ENABLED")
+	viper.BindEnv("oidc.issuer", "APP_OIDC_ISSUER")
+	viper.BindEnv("oidc.client_id", "APP_OIDC_CLIENT_ID")
+	viper.BindEnv("oidc.client_secret", "APP_OIDC_CLIENT_SECRET")
+	viper.BindEnv("oidc.redirect_url", "APP_OIDC_REDIRECT_URL")
+	viper.BindEnv("oidc.scopes", "APP_OIDC_SCOPES")
+	viper.BindEnv("oidc.email_verified_claim", "APP_OIDC_EMAIL_VERIFIED_CLAIM")
+	viper.BindEnv("api_tokens.max_per_member", "APP_API_TOKENS_MAX_PER_MEMBER")
+	viper.BindEnv("notification_retry.max_attempts", "APP_NOTIFICATION_RETRY_MAX_ATTEMPTS")
+	viper.BindEnv("notification_retry.delay_seconds", "APP_NOTIFICATION_RETRY_DELAY_SECONDS")
+	viper.BindEnv("notification_retry.max_delay_seconds", "APP_NOTIFICATION_RETRY_MAX_DELAY_SECONDS")
 	viper.BindEnv("otel_enable", "APP_OTEL_ENABLE")
 	viper.BindEnv("inactive_delay_days", "APP_INACTIVE_DELAY_DAYS")
+	viper.BindEnv("inactivity.delay_days.admin", "APP_INACTIVITY_DELAY_DAYS_ADMIN")
+	viper.BindEnv("inactivity.delay_days.member", "APP_INACTIVITY_DELAY_DAYS_MEMBER")
+	viper.BindEnv("inactivity.delay_days.canalla", "APP_INACTIVITY_DELAY_DAYS_CANALLA")
+	viper.BindEnv("inactivity.delay_days.guest", "APP_INACTIVITY_DELAY_DAYS_GUEST")
+	viper.BindEnv("inactivity.warning_days", "APP_INACTIVITY_WARNING_DAYS")
+	viper.BindEnv("purge_retention_days", "APP_PURGE_RETENTION_DAYS")
+	viper.BindEnv("season_start_month", "APP_SEASON_START_MONTH")
+	viper.BindEnv("timezone", "APP_TIMEZONE")
 
 	var c config
 	err = viper.Unmarshal(&c)
@@ -93,9 +175,16 @@ func ReadConfig() {
 		panic(fmt.Errorf("unable to parse configuration, %v", err))
 	}
 
+	if _, err := time.LoadLocation(viper.GetString("timezone")); err != nil {
+		panic(fmt.Errorf("invalid timezone, %v", err))
+	}
+
 	if !viper.IsSet("cdn") {
 		viper.Set("cdn", viper.GetString("domain"))
 	}
+	if !viper.IsSet("api_url") {
+		viper.Set("api_url", viper.GetString("domain"))
+	}
 }
 
 func GetConfigString(key string) string {
@@ -109,3 +198,15 @@ func GetConfigBool(key string) bool {
 func GetConfigInt(key string) int {
 	return viper.GetInt(key)
 }
+
+// LoadLocation returns the location of the first non-empty timezone, or the
+// organisation timezone if they are all empty. Use it like
+// LoadLocation(member.Timezone, event.Timezone) to apply the overrides.
+func LoadLocation(timezones ...string) (*time.Location, error) {
+	for _, timezone := range timezones {
+		if timezone != "" {
+			return time.LoadLocation(timezone)
+		}
+	}
+	return time.LoadLocation(viper.GetString("timezone"))
+}
@@ -1,58 +1,234 @@
 package common
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"strconv"
+	"strings"
+	"sync"
 
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/pbkdf2"
 )
 
-var encryption_key []byte
+// Ciphertexts are prefixed with the ID of the key used, like $k2$, so that
+// the key can be rotated: the current key (encryption.key, ID
+// encryption.key_id) encrypts, the previous ones (encryption.old_keys,
+// "1:secret,2:secret") still decrypt. Ciphertexts without prefix were
+// written before key IDs existed, with key legacyKeyID.
+const legacyKeyID = 1
 
-func getKey() []byte {
-	if encryption_key == nil {
-		key := GetConfigString("encryption.key")
-		salt := GetConfigString("encryption.key_salt")
+type encryptionKeys struct {
+	signature string
+	current   int
+	keys      map[int][]byte
+}
+
+var encryption_keys encryptionKeys
+var blind_index_key encryptionKeys
+var keys_mutex sync.Mutex
+
+func deriveKey(secret string) []byte {
+	salt := GetConfigString("encryption.key_salt")
+	iterations := GetConfigInt("encryption.iterations")
+	return pbkdf2.Key([]byte(secret), []byte(salt), iterations, 32, sha256.New)
+}
+
+// parseOldKeys returns the secrets of encryption.old_keys by ID, and an
+// error for the first malformed entry, which is skipped.
+func parseOldKeys(oldKeys string) (map[int]string, error) {
+	secrets := map[int]string{}
+	var invalid error
+	for _, oldKey := range strings.Split(oldKeys, ",") {
+		if strings.TrimSpace(oldKey) == "" {
+			continue
+		}
+		id, oldSecret, found := strings.Cut(strings.TrimSpace(oldKey), ":")
+		keyID, err := strconv.Atoi(id)
+		if !found || err != nil || oldSecret == "" {
+			if invalid == nil {
+				invalid = fmt.Errorf("invalid old encryption key: %s", id)
+			}
+			continue
+		}
+		secrets[keyID] = oldSecret
+	}
+	return secrets, invalid
+}
+
+// ValidateEncryptionKeys checks encryption.old_keys, and that the blind
+// index key does not change with a key rotation: without
+// encryption.index_key, it is derived from the key legacyKeyID, which must
+// stay configured.
+func ValidateEncryptionKeys() error {
+	oldKeys, err := parseOldKeys(GetConfigString("encryption.old_keys"))
+	if err != nil {
+		return err
+	}
+	if GetConfigString("encryption.index_key") != "" || GetConfigInt("encryption.key_id") == legacyKeyID {
+		return nil
+	}
+	if _, found := oldKeys[legacyKeyID]; !found {
+		return fmt.Errorf("encryption.index_key is required without the key %d, set it to the secret of the key %d to keep the email indexes", legacyKeyID, legacyKeyID)
+	}
+	return nil
+}
+
+// getKeys returns the keys by ID, derived again only when the configuration
+// changes.
+func getKeys() encryptionKeys {
+	current := GetConfigInt("encryption.key_id")
+	secret := GetConfigString("encryption.key")
+	oldKeys := GetConfigString("encryption.old_keys")
+	signature := fmt.Sprintf("%d|%s|%s|%s|%d", current, secret, oldKeys,
+		GetConfigString("encryption.key_salt"), GetConfigInt("encryption.iterations"))
+	keys_mutex.Lock()
+	defer keys_mutex.Unlock()
+	if encryption_keys.signature == signature {
+		return encryption_keys
+	}
+	// The entries are validated at startup
+	oldSecrets, _ := parseOldKeys(oldKeys)
+	keys := map[int][]byte{}
+	for keyID, oldSecret := range oldSecrets {
+		keys[keyID] = deriveKey(oldSecret)
+	}
+	keys[current] = deriveKey(secret)
+	encryption_keys = encryptionKeys{signature: signature, current: current, keys: keys}
+	return encryption_keys
+}
+
+// indexSecret returns encryption.index_key, or the secret of the key
+// legacyKeyID, current or old, so that rotating the encryption key does not
+// change the blind indexes.
+func indexSecret() string {
+	if secret := GetConfigString("encryption.index_key"); secret != "" {
+		return secret
+	}
+	if GetConfigInt("encryption.key_id") != legacyKeyID {
+		oldSecrets, _ := parseOldKeys(GetConfigString("encryption.old_keys"))
+		if secret, found := oldSecrets[legacyKeyID]; found {
+			return secret
+		}
+	}
+	return GetConfigString("encryption.key")
+}
+
+// The blind index key is derived from indexSecret with a different salt
+// than the encryption keys, so that one does not give the other.
+func getBlindIndexKey() []byte {
+	secret := indexSecret()
+	signature := fmt.Sprintf("%s|%s|%d", secret, GetConfigString("encryption.key_salt"), GetConfigInt("encryption.iterations"))
+	keys_mutex.Lock()
+	defer keys_mutex.Unlock()
+	if blind_index_key.signature != signature {
+		salt := "blind_index:" + GetConfigString("encryption.key_salt")
 		iterations := GetConfigInt("encryption.iterations")
-		encryption_key = pbkdf2.Key([]byte(key), []byte(salt), iterations, 32, sha256.New)
+		blind_index_key = encryptionKeys{signature: signature, keys: map[int][]byte{
+			0: pbkdf2.Key([]byte(secret), []byte(salt), iterations, 32, sha256.New)}}
 	}
-	return encryption_key
+	return blind_index_key.keys[0]
 }
 
-func Encrypt(data string) []byte {
-	block, _ := aes.NewCipher(getKey())
+// BlindIndex returns a keyed hash of a value, trimmed and case-insensitive,
+// to look up encrypted values with an equality test without decrypting them.
+func BlindIndex(data string) string {
+	mac := hmac.New(sha256.New, getBlindIndexKey())
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(data))))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func keyPrefix(keyID int) []byte {
+	return []byte(fmt.Sprintf("$k%d$", keyID))
+}
+
+// splitKeyID returns the key ID of a ciphertext and the ciphertext without
+// its prefix. found is false for ciphertexts without prefix.
+func splitKeyID(data []byte) (keyID int, ciphertext []byte, found bool) {
+	if !bytes.HasPrefix(data, []byte("$k")) {
+		return legacyKeyID, data, false
+	}
+	end := bytes.IndexByte(data[2:], '$')
+	if end < 1 {
+		return legacyKeyID, data, false
+	}
+	keyID, err := strconv.Atoi(string(data[2 : 2+end]))
+	if err != nil {
+		return legacyKeyID, data, false
+	}
+	return keyID, data[3+end:], true
+}
+
+func newGCM(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err.Error())
+	}
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
 		panic(err.Error())
 	}
+	return gcm
+}
+
+func open(key, data []byte) (string, error) {
+	gcm := newGCM(key)
+	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize {
+		return "", fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	return string(plaintext), err
+}
+
+func Encrypt(data string) []byte {
+	keys := getKeys()
+	gcm := newGCM(keys.keys[keys.current])
 	nonce := make([]byte, gcm.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		panic(err.Error())
 	}
 	ciphertext := gcm.Seal(nonce, nonce, []byte(data), nil)
-	return ciphertext
+	return append(keyPrefix(keys.current), ciphertext...)
 }
 
 func Decrypt(data []byte) string {
-	block, err := aes.NewCipher(getKey())
-	if err != nil {
-		panic(err.Error())
+	keys := getKeys()
+	keyID, ciphertext, found := splitKeyID(data)
+	if key, ok := keys.keys[keyID]; ok && found {
+		if plaintext, err := open(key, ciphertext); err == nil {
+			return plaintext
+		}
 	}
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		panic(err.Error())
+	// A ciphertext without prefix, that might start like one by chance
+	key, ok := keys.keys[legacyKeyID]
+	if !ok {
+		panic(fmt.Sprintf("no encryption key with ID %d", keyID))
 	}
-	nonceSize := gcm.NonceSize()
-	nonce, ciphertext := []byte(data)[:nonceSize], []byte(data)[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, []byte(ciphertext), nil)
+	plaintext, err := open(key, data)
 	if err != nil {
 		panic(err.Error())
 	}
-	return string(plaintext)
+	return plaintext
+}
+
+// NeedsReencryption is true if data was not encrypted with the current key
+func NeedsReencryption(data []byte) bool {
+	keys := getKeys()
+	keyID, ciphertext, found := splitKeyID(data)
+	if !found || keyID != keys.current {
+		return true
+	}
+	_, err := open(keys.keys[keys.current], ciphertext)
+	return err != nil
 }
 
 func GenerateFromPassword(password string) ([]byte, error) {
@@ -0,0 +1,350 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Recurrence rules as described in RFC 5545 section 3.3.10. The supported
+// subset is FREQ (DAILY, WEEKLY, MONTHLY, YEARLY), INTERVAL, COUNT, UNTIL,
+// BYDAY, BYMONTHDAY, BYMONTH and WKST. Ordinal BYDAY values (2SA, -1SU) are
+// counted within the month.
+
+const (
+	FreqDaily   = "DAILY"
+	FreqWeekly  = "WEEKLY"
+	FreqMonthly = "MONTHLY"
+	FreqYearly  = "YEARLY"
+)
+
+// Safety limits: a rule that never matches must not loop forever
+const rruleMaxOccurrences = 1000
+const rruleMaxPeriods = 100 * 366
+
+var rruleWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+type WeekdayNum struct {
+	Weekday time.Weekday
+	N       int // 0 for every such day of the period
+}
+
+type RRule struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      time.Time
+	ByDay      []WeekdayNum
+	ByMonthDay []int
+	ByMonth    []time.Month
+	WeekStart  time.Weekday
+}
+
+// ParseRRule parses a recurrence rule like "FREQ=MONTHLY;BYDAY=2SA,4SA".
+// The RRULE: prefix is optional. A floating or date-only UNTIL is read in
+// location.
+func ParseRRule(rule string, location *time.Location) (RRule, error) {
+	r := RRule{Interval: 1, WeekStart: time.Monday}
+	rule = strings.TrimPrefix(strings.TrimSpace(rule), "RRULE:")
+	if rule == "" {
+		return r, fmt.Errorf("empty rule")
+	}
+	for _, part := range strings.Split(rule, ";") {
+		name, value, found := strings.Cut(part, "=")
+		if !found || value == "" {
+			return r, fmt.Errorf("invalid rule part: %s", part)
+		}
+		var err error
+		switch strings.ToUpper(name) {
+		case "FREQ":
+			r.Freq = strings.ToUpper(value)
+			switch r.Freq {
+			case FreqDaily, FreqWeekly, FreqMonthly, FreqYearly:
+			default:
+				err = fmt.Errorf("unsupported frequency: %s", value)
+			}
+		case "INTERVAL":
+			r.Interval, err = strconv.Atoi(value)
+			if err == nil && r.Interval < 1 {
+				err = fmt.Errorf("invalid interval: %s", value)
+			}
+		case "COUNT":
+			r.Count, err = strconv.Atoi(value)
+			if err == nil && r.Count < 1 {
+				err = fmt.Errorf("invalid count: %s", value)
+			}
+		case "UNTIL":
+			r.Until, err = parseRRuleDate(value, location)
+		case "BYDAY":
+			for _, day := range strings.Split(value, ",") {
+				var weekdayNum WeekdayNum
+				if weekdayNum, err = parseWeekdayNum(day); err != nil {
+					break
+				}
+				r.ByDay = append(r.ByDay, weekdayNum)
+			}
+		case "BYMONTHDAY":
+			for _, day := range strings.Split(value, ",") {
+				var monthDay int
+				monthDay, err = strconv.Atoi(day)
+				if err == nil && (monthDay == 0 || monthDay < -31 || monthDay > 31) {
+					err = fmt.Errorf("invalid month day: %s", day)
+				}
+				if err != nil {
+					break
+				}
+				r.ByMonthDay = append(r.ByMonthDay, monthDay)
+			}
+		case "BYMONTH":
+			for _, month := range strings.Split(value, ",") {
+				var m int
+				m, err = strconv.Atoi(month)
+				if err == nil && (m < 1 || m > 12) {
+					err = fmt.Errorf("invalid month: %s", month)
+				}
+				if err != nil {
+					break
+				}
+				r.ByMonth = append(r.ByMonth, time.Month(m))
+			}
+		case "WKST":
+			weekday, ok := rruleWeekdays[strings.ToUpper(value)]
+			if !ok {
+				err = fmt.Errorf("invalid week start: %s", value)
+			}
+			r.WeekStart = weekday
+		default:
+			err = fmt.Errorf("unsupported rule part: %s", name)
+		}
+		if err != nil {
+			return r, err
+		}
+	}
+	if r.Freq == "" {
+		return r, fmt.Errorf("missing frequency")
+	}
+	if r.Count != 0 && !r.Until.IsZero() {
+		return r, fmt.Errorf("COUNT and UNTIL cannot be used together")
+	}
+	if r.Freq == FreqWeekly && len(r.ByMonthDay) > 0 {
+		return r, fmt.Errorf("BYMONTHDAY cannot be used weekly")
+	}
+	for _, day := range r.ByDay {
+		if day.N != 0 && r.Freq != FreqMonthly && !(r.Freq == FreqYearly && len(r.ByMonth) > 0) {
+			return r, fmt.Errorf("ordinal days are only supported monthly")
+		}
+	}
+	return r, nil
+}
+
+func parseWeekdayNum(day string) (WeekdayNum, error) {
+	day = strings.ToUpper(strings.TrimSpace(day))
+	if len(day) < 2 {
+		return WeekdayNum{}, fmt.Errorf("invalid day: %s", day)
+	}
+	weekday, ok := rruleWeekdays[day[len(day)-2:]]
+	if !ok {
+		return WeekdayNum{}, fmt.Errorf("invalid day: %s", day)
+	}
+	n := 0
+	if ordinal := day[:len(day)-2]; ordinal != "" {
+		var err error
+		n, err = strconv.Atoi(ordinal)
+		if err != nil || n == 0 || n < -5 || n > 5 {
+			return WeekdayNum{}, fmt.Errorf("invalid day: %s", day)
+		}
+	}
+	return WeekdayNum{Weekday: weekday, N: n}, nil
+}
+
+func parseRRuleDate(value string, location *time.Location) (time.Time, error) {
+	if date, err := time.Parse("20060102T150405Z", value); err == nil {
+		return date, nil
+	}
+	if date, err := time.ParseInLocation("20060102T150405", value, location); err == nil {
+		return date, nil
+	}
+	date, err := time.ParseInLocation("20060102", value, location)
+	if err != nil {
+		return date, fmt.Errorf("invalid date: %s", value)
+	}
+	// A date-only UNTIL includes the whole day
+	return date.AddDate(0, 0, 1).Add(-time.Second), nil
+}
+
+// Expand returns the occurrences of the rule starting with start (the first
+// occurrence, DTSTART) and ending at the latest at until (included, ignored
+// if zero). Every occurrence keeps the wall-clock time of start in its
+// location, so that events do not move when switching to or from DST.
+// Occurrences on the same day as one of exdates are skipped (EXDATE).
+func (r RRule) Expand(start, until time.Time, exdates []time.Time) ([]time.Time, error) {
+	if !r.Until.IsZero() && (until.IsZero() || r.Until.Before(until)) {
+		until = r.Until
+	}
+	if until.IsZero() && r.Count == 0 {
+		return nil, fmt.Errorf("the rule must end")
+	}
+	location := start.Location()
+	skipped := map[string]bool{}
+	for _, exdate := range exdates {
+		skipped[exdate.In(location).Format("20060102")] = true
+	}
+
+	occurrences := []time.Time{}
+	count := 0
+	for period := 0; period < rruleMaxPeriods; period++ {
+		periodStart, days := r.periodDays(start, period)
+		// The day before, since periods are in UTC and occurrences in location
+		if !until.IsZero() && periodStart.AddDate(0, 0, -1).After(until) {
+			break
+		}
+		for _, day := range days {
+			occurrence := time.Date(day.Year(), day.Month(), day.Day(), start.Hour(), start.Minute(), start.Second(), 0, location)
+			if occurrence.Before(start) {
+				continue
+			}
+			if !until.IsZero() && occurrence.After(until) {
+				return occurrences, nil
+			}
+			count++
+			if !skipped[occurrence.Format("20060102")] {
+				occurrences = append(occurrences, occurrence)
+			}
+			if count == r.Count {
+				return occurrences, nil
+			}
+			if count >= rruleMaxOccurrences {
+				return nil, fmt.Errorf("too many occurrences")
+			}
+		}
+	}
+	return occurrences, nil
+}
+
+// periodDays returns the first day of a period of the rule and the sorted
+// days of the period matching its BY* parts, at midnight UTC.
+func (r RRule) periodDays(start time.Time, period int) (time.Time, []time.Time) {
+	first := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	var periodStart time.Time
+	candidates := []time.Time{}
+	switch r.Freq {
+	case FreqDaily:
+		periodStart = first.AddDate(0, 0, period*r.Interval)
+		candidates = append(candidates, periodStart)
+	case FreqWeekly:
+		offset := (int(first.Weekday()) - int(r.WeekStart) + 7) % 7
+		periodStart = first.AddDate(0, 0, period*r.Interval*7-offset)
+		for i := 0; i < 7; i++ {
+			day := periodStart.AddDate(0, 0, i)
+			if len(r.ByDay) == 0 && day.Weekday() == first.Weekday() || len(r.ByDay) > 0 && r.matchesWeekday(day) {
+				candidates = append(candidates, day)
+			}
+		}
+	case FreqMonthly:
+		periodStart = time.Date(first.Year(), first.Month()+time.Month(period*r.Interval), 1, 0, 0, 0, 0, time.UTC)
+		candidates = r.monthDays(periodStart, first)
+	case FreqYearly:
+		// Without BYMONTH, BYDAY and BYMONTHDAY match in every month
+		months := r.ByMonth
+		if len(months) == 0 && len(r.ByDay) == 0 && len(r.ByMonthDay) == 0 {
+			months = []time.Month{first.Month()}
+		} else if len(months) == 0 {
+			for m := time.January; m <= time.December; m++ {
+				months = append(months, m)
+			}
+		}
+		year := first.Year() + period*r.Interval
+		periodStart = time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+		for _, m := range months {
+			candidates = append(candidates, r.monthDays(time.Date(year, m, 1, 0, 0, 0, 0, time.UTC), first)...)
+		}
+	}
+
+	days := []time.Time{}
+	for _, day := range candidates {
+		if len(r.ByMonth) > 0 && !containsMonth(r.ByMonth, day.Month()) {
+			continue
+		}
+		if r.Freq == FreqDaily && (!r.matchesWeekday(day) || !r.matchesMonthDay(day)) {
+			continue
+		}
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return periodStart, days
+}
+
+// monthDays returns the days of the month (given by its first day) matching
+// BYDAY and BYMONTHDAY, or the day of the month of first if there is none.
+func (r RRule) monthDays(month, first time.Time) []time.Time {
+	days := []time.Time{}
+	for day := month; day.Month() == month.Month(); day = day.AddDate(0, 0, 1) {
+		if len(r.ByDay) == 0 && len(r.ByMonthDay) == 0 {
+			if day.Day() == first.Day() {
+				days = append(days, day)
+			}
+			continue
+		}
+		if r.matchesWeekday(day) && r.matchesMonthDay(day) {
+			days = append(days, day)
+		}
+	}
+	return days
+}
+
+// matchesWeekday is true if BYDAY is empty or contains the day. Ordinals are
+// counted within the month of the day, from the end if negative.
+func (r RRule) matchesWeekday(day time.Time) bool {
+	if len(r.ByDay) == 0 {
+		return true
+	}
+	daysInMonth := time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	for _, weekdayNum := range r.ByDay {
+		if weekdayNum.Weekday != day.Weekday() {
+			continue
+		}
+		switch {
+		case weekdayNum.N == 0:
+			return true
+		case weekdayNum.N > 0 && (day.Day()-1)/7+1 == weekdayNum.N:
+			return true
+		case weekdayNum.N < 0 && (daysInMonth-day.Day())/7+1 == -weekdayNum.N:
+			return true
+		}
+	}
+	return false
+}
+
+// matchesMonthDay is true if BYMONTHDAY is empty or contains the day, counted
+// from the end of the month if negative.
+func (r RRule) matchesMonthDay(day time.Time) bool {
+	if len(r.ByMonthDay) == 0 {
+		return true
+	}
+	daysInMonth := time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	for _, monthDay := range r.ByMonthDay {
+		if monthDay == day.Day() || monthDay < 0 && daysInMonth+monthDay+1 == day.Day() {
+			return true
+		}
+	}
+	return false
+}
+
+func containsMonth(months []time.Month, month time.Month) bool {
+	for _, m := range months {
+		if m == month {
+			return true
+		}
+	}
+	return false
+}
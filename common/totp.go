@@ -0,0 +1,84 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Time-based one-time passwords (RFC 6238), as generated by authenticator
+// apps: 6 digits, 30 seconds steps, HMAC-SHA1.
+const (
+	TOTPPeriod     = 30
+	totpDigits     = 6
+	totpSecretSize = 20
+	totpDrift      = 1 // Steps accepted before and after the current one
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a random base32 secret.
+func GenerateTOTPSecret() string {
+	data := make([]byte, totpSecretSize)
+	_, err := rand.Read(data)
+	if err != nil {
+		Fatal(err.Error())
+	}
+	return totpEncoding.EncodeToString(data)
+}
+
+// TOTPURL returns the otpauth URL of a secret, shown as a QR code to add it
+// to an authenticator app.
+func TOTPURL(issuer, account, secret string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", issuer)
+	values.Set("digits", fmt.Sprint(totpDigits))
+	values.Set("period", fmt.Sprint(TOTPPeriod))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + values.Encode()
+}
+
+// TOTPCode returns the code of the secret for the time step (Unix time
+// divided by TOTPPeriod).
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// ValidateTOTP checks a code against the secret at the given time, allowing
+// for a small clock drift. Returns the time step of the code, or -1 if the
+// code is not valid.
+func ValidateTOTP(secret, code string, t time.Time) int64 {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return -1
+	}
+	current := t.Unix() / TOTPPeriod
+	for step := current - totpDrift; step <= current+totpDrift; step++ {
+		expected, err := TOTPCode(secret, step)
+		if err != nil {
+			return -1
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return -1
+}
@@ -0,0 +1,229 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+const (
+	ERRORAPITOKENS           = "error with the API tokens"
+	ERRORAPITOKENNOTFOUND    = "API token not found"
+	ERRORAPITOKENNAME        = "the API token needs a name"
+	ERRORAPITOKENPERMISSIONS = "the API token needs permissions among the ones of the member"
+	ERRORAPITOKENEXPIRATION  = "the expiration of the API token is in the past"
+	ERRORAPITOKENSLIMIT      = "too many API tokens, revoke one first"
+	ERRORAPITOKENEXPIRED     = "API token is expired"
+)
+
+// APITokenPrefix starts the personal API tokens, to tell them from the JWTs.
+const APITokenPrefix = "cst_"
+
+// apiTokenRequest is the payload to create an API token.
+type apiTokenRequest struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+	ExpiresAt   int64    `json:"expiresAt"` // 0 if it does not expire
+}
+
+// apiTokenResponse is the created API token, the only time it is shown.
+type apiTokenResponse struct {
+	model.APIToken
+	Token string `json:"token"`
+}
+
+// extractAPIToken authenticates a request with a personal API token. The
+// token is limited to its permissions that the member still has, so it
+// loses them with the member and cannot be used once they are deleted.
+func extractAPIToken(ctx context.Context, tokenString string) (*AccessTokenDetails, error) {
+	ctx, span := tracer.Start(ctx, "extractAPIToken")
+	defer span.End()
+
+	token, err := model.GetAPITokenByHash(ctx, common.HashToken(tokenString))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New(ERRORTOKENREVOKED)
+		}
+		return nil, err
+	}
+	if token.ExpiresAt != 0 && token.ExpiresAt <= time.Now().Unix() {
+		return nil, errors.New(ERRORAPITOKENEXPIRED)
+	}
+	memberPermissions, err := getMemberPermissions(ctx, token.MemberUUID)
+	if err != nil {
+		return nil, err
+	}
+	permissions := []string{}
+	for _, permission := range token.Permissions {
+		if common.StringInSlice(permission, memberPermissions) {
+			permissions = append(permissions, permission)
+		}
+	}
+	if err := token.SetLastUsed(ctx); err != nil {
+		common.Warn("Cannot record the use of the API token %s: %s", token.ID, err.Error())
+	}
+	return &AccessTokenDetails{
+		TokenUuid:   token.ID,
+		UserId:      token.MemberUUID,
+		Permissions: permissions,
+		APIToken:    true,
+	}, nil
+}
+
+// GetAPITokens lists the API tokens of the member of the token, without
+// their secret.
+func GetAPITokens(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "GetAPITokens")
+	defer span.End()
+
+	tokenAuth, err := ExtractToken(ctx, r)
+	if err != nil {
+		common.Warn("Error reading token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAUTHENTICATION)
+		return
+	}
+	respondAPITokens(ctx, w, tokenAuth.UserId)
+}
+
+// CreateAPIToken creates an API token for the member of the token, with
+// some of their permissions. The token is only returned in this response.
+func CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "CreateAPIToken")
+	defer span.End()
+
+	tokenAuth, err := ExtractToken(ctx, r)
+	if err != nil {
+		common.Warn("Error reading token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAUTHENTICATION)
+		return
+	}
+	var request apiTokenRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+		return
+	}
+	defer r.Body.Close()
+	if request.Name == "" {
+		RespondWithError(w, http.StatusBadRequest, ERRORAPITOKENNAME)
+		return
+	}
+	if request.ExpiresAt != 0 && request.ExpiresAt <= time.Now().Unix() {
+		RespondWithError(w, http.StatusBadRequest, ERRORAPITOKENEXPIRATION)
+		return
+	}
+	memberPermissions, err := getMemberPermissions(ctx, tokenAuth.UserId)
+	if err != nil {
+		common.Warn("Error getting permissions of member %s: %s", tokenAuth.UserId, err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAPITOKENS)
+		return
+	}
+	if len(request.Permissions) == 0 {
+		RespondWithError(w, http.StatusBadRequest, ERRORAPITOKENPERMISSIONS)
+		return
+	}
+	for _, permission := range request.Permissions {
+		if !common.StringInSlice(permission, memberPermissions) {
+			RespondWithError(w, http.StatusBadRequest, ERRORAPITOKENPERMISSIONS)
+			return
+		}
+	}
+	tokens, err := model.GetMemberAPITokens(ctx, tokenAuth.UserId)
+	if err != nil {
+		common.Warn("Error getting API tokens: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAPITOKENS)
+		return
+	}
+	if len(tokens) >= common.GetConfigInt("api_tokens.max_per_member") {
+		RespondWithError(w, http.StatusBadRequest, ERRORAPITOKENSLIMIT)
+		return
+	}
+
+	secret := APITokenPrefix + common.GenerateToken()
+	token := model.APIToken{
+		ID:          common.GenerateUUID(),
+		MemberUUID:  tokenAuth.UserId,
+		Name:        request.Name,
+		Permissions: request.Permissions,
+		ExpiresAt:   request.ExpiresAt,
+	}
+	if err := token.Create(ctx, common.HashToken(secret)); err != nil {
+		common.Warn("Error creating API token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAPITOKENS)
+		return
+	}
+	common.Info("Member %s created the API token %s", tokenAuth.UserId, token.ID)
+	RespondWithJSON(w, http.StatusCreated, apiTokenResponse{APIToken: token, Token: secret})
+}
+
+// RevokeAPIToken revokes an API token of the member of the token.
+func RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "RevokeAPIToken")
+	defer span.End()
+
+	tokenAuth, err := ExtractToken(ctx, r)
+	if err != nil {
+		common.Warn("Error reading token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAUTHENTICATION)
+		return
+	}
+	respondRevokeAPIToken(ctx, w, tokenAuth.UserId, mux.Vars(r)["token_id"])
+}
+
+// GetMemberAPITokens lets an admin list the API tokens of a member.
+func GetMemberAPITokens(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "GetMemberAPITokens")
+	defer span.End()
+
+	member, found := getSessionsMember(ctx, w, r)
+	if !found {
+		return
+	}
+	respondAPITokens(ctx, w, member.UUID)
+}
+
+// RevokeMemberAPIToken lets an admin revoke an API token of a member.
+func RevokeMemberAPIToken(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "RevokeMemberAPIToken")
+	defer span.End()
+
+	member, found := getSessionsMember(ctx, w, r)
+	if !found {
+		return
+	}
+	respondRevokeAPIToken(ctx, w, member.UUID, mux.Vars(r)["token_id"])
+}
+
+func respondAPITokens(ctx context.Context, w http.ResponseWriter, memberUUID string) {
+	tokens, err := model.GetMemberAPITokens(ctx, memberUUID)
+	if err != nil {
+		common.Warn("Error getting API tokens: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAPITOKENS)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, tokens)
+}
+
+func respondRevokeAPIToken(ctx context.Context, w http.ResponseWriter, memberUUID, id string) {
+	token := model.APIToken{ID: id, MemberUUID: memberUUID}
+	if err := token.Delete(ctx); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			RespondWithError(w, http.StatusNotFound, ERRORAPITOKENNOTFOUND)
+		default:
+			common.Warn("Error revoking API token: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORAPITOKENS)
+		}
+		return
+	}
+	common.Info("API token %s of member %s revoked", id, memberUUID)
+	RespondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
@@ -0,0 +1,287 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+const (
+	ERRORCREATECALENDARTOKEN = "error creating the calendar token"
+	ERRORREVOKECALENDARTOKEN = "error revoking the calendar token"
+	ERRORCALENDARNOTFOUND    = "calendar not found"
+	ERRORGETCALENDAR         = "error getting calendar"
+)
+
+// Maximum number of upcoming events listed in a calendar feed
+const CALENDAR_EVENTS_LIMIT = 200
+
+const icalDateFormat = "20060102T150405Z"
+
+type calendarTokenResponse struct {
+	Token string `json:"token"`
+	URL   string `json:"url"`
+}
+
+// CreateCalendarToken generates a new calendar feed token for a member and
+// returns the subscription URL. Any previous token of the member is revoked.
+// The token is only returned once: we store its hash.
+func CreateCalendarToken(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "CreateCalendarToken")
+	defer span.End()
+
+	vars := mux.Vars(r)
+	memberUUID := vars["member_uuid"]
+
+	if !calendarTokenAllowed(ctx, w, r, memberUUID) {
+		return
+	}
+
+	token := common.GenerateToken()
+	m := model.Member{UUID: memberUUID}
+	if err := m.SetCalendarToken(ctx, common.HashToken(token)); err != nil {
+		common.Warn("Error saving calendar token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORCREATECALENDARTOKEN)
+		return
+	}
+	RespondWithJSON(w, http.StatusCreated, calendarTokenResponse{
+		Token: token,
+		URL:   common.GetConfigString("api_url") + "/api/v1/calendar/" + token + ".ics",
+	})
+}
+
+// RevokeCalendarToken deletes the calendar feed token of a member. Calendar
+// applications subscribed with the old URL will get a 404.
+func RevokeCalendarToken(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "RevokeCalendarToken")
+	defer span.End()
+
+	vars := mux.Vars(r)
+	memberUUID := vars["member_uuid"]
+
+	if !calendarTokenAllowed(ctx, w, r, memberUUID) {
+		return
+	}
+
+	m := model.Member{UUID: memberUUID}
+	deleted, err := m.RevokeCalendarToken(ctx)
+	if err != nil {
+		common.Warn("Error revoking calendar token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORREVOKECALENDARTOKEN)
+		return
+	}
+	if deleted == 0 {
+		RespondWithJSON(w, http.StatusNoContent, nil)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, nil)
+}
+
+// A member can manage their own calendar token, an admin can manage anybody's.
+func calendarTokenAllowed(ctx context.Context, w http.ResponseWriter, r *http.Request, memberUUID string) bool {
+	tokenAuth, err := ExtractToken(ctx, r)
+	if err != nil {
+		common.Warn("Error reading token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAUTHENTICATION)
+		return false
+	}
+	if !common.StringInSlice(model.MEMBERSTYPEADMIN, tokenAuth.Permissions) && tokenAuth.UserId != memberUUID {
+		common.Info("Member %s cannot manage the calendar token of %s", tokenAuth.UserId, memberUUID)
+		RespondWithError(w, http.StatusUnauthorized, ERRORUNAUTHORIZED)
+		return false
+	}
+	m := model.Member{UUID: memberUUID}
+	if err := m.Get(ctx); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			common.Debug("Member not found: %s", err.Error())
+			RespondWithError(w, http.StatusNotFound, ERRORMEMBERNOTFOUND)
+		default:
+			common.Warn("Error getting member: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORGETMEMBER)
+		}
+		return false
+	}
+	return true
+}
+
+// GetCalendarFeed returns the upcoming events of a member as an iCalendar
+// (RFC 5545) feed. The request is authenticated by the calendar token in the
+// URL, since calendar applications cannot send an Authorization header.
+func GetCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "GetCalendarFeed")
+	defer span.End()
+
+	vars := mux.Vars(r)
+	token := vars["token"]
+
+	memberUUID, err := model.GetMemberUUIDByCalendarToken(ctx, common.HashToken(token))
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			common.Debug("Calendar token not found")
+			RespondWithError(w, http.StatusNotFound, ERRORCALENDARNOTFOUND)
+		default:
+			common.Warn("Error getting calendar token: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORGETCALENDAR)
+		}
+		return
+	}
+	member := model.Member{UUID: memberUUID}
+	if err := member.Get(ctx); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			common.Debug("Member of calendar token not found: %s", err.Error())
+			RespondWithError(w, http.StatusNotFound, ERRORCALENDARNOTFOUND)
+		default:
+			common.Warn("Error getting member: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORGETCALENDAR)
+		}
+		return
+	}
+	// The token of a member who is not activated, e.g. paused or purged,
+	// does not show the events
+	if member.Status != model.MEMBERSSTATUSACTIVATED {
+		common.Debug("Member of calendar token is %s", member.Status)
+		RespondWithError(w, http.StatusNotFound, ERRORCALENDARNOTFOUND)
+		return
+	}
+
+	e := model.Event{}
+	events, err := e.GetAll(ctx, 0, CALENDAR_EVENTS_LIMIT, false)
+	if err != nil {
+		common.Warn("Error getting events: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORGETCALENDAR)
+		return
+	}
+	eventUUIDs := make([]string, len(events))
+	for index, event := range events {
+		eventUUIDs[index] = event.UUID
+	}
+	answers, err := member.GetAnswers(ctx, eventUUIDs)
+	if err != nil {
+		common.Warn("Error getting participation: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORGETCALENDAR)
+		return
+	}
+	for index, event := range events {
+		events[index].Participation = answers[event.UUID]
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", "inline; filename=\"castellers.ics\"")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(buildCalendar(member, events, time.Now())))
+}
+
+func buildCalendar(member model.Member, events []model.Event, now time.Time) string {
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Castellers de Montreal//Castellers API//EN",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:" + icalEscape(common.Translate("calendar_name", member.Language)),
+	}
+	stamp := now.UTC().Format(icalDateFormat)
+	for _, event := range events {
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			"UID:"+event.UUID+"@castellers",
+			"DTSTAMP:"+stamp,
+			"DTSTART:"+time.Unix(int64(event.StartDate), 0).UTC().Format(icalDateFormat),
+			"DTEND:"+time.Unix(int64(event.EndDate), 0).UTC().Format(icalDateFormat),
+			"SUMMARY:"+icalEscape(event.Name),
+			"CATEGORIES:"+icalEscape(common.Translate(event.Type, member.Language)),
+			"DESCRIPTION:"+icalEscape(calendarEventDescription(member, event)),
+			"URL:"+common.GetConfigString("domain")+"/eventShow/"+event.UUID,
+		)
+		if event.LocationName != "" {
+			lines = append(lines, "LOCATION:"+icalEscape(event.LocationName))
+		}
+		if event.Location.Lat != 0 || event.Location.Lng != 0 {
+			lines = append(lines, fmt.Sprintf("GEO:%f;%f", event.Location.Lat, event.Location.Lng))
+		}
+		// Events the member will not attend should not block their agenda
+		if event.Participation == common.AnswerNo {
+			lines = append(lines, "TRANSP:TRANSPARENT")
+		} else {
+			lines = append(lines, "TRANSP:OPAQUE")
+		}
+		lines = append(lines, "END:VEVENT")
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	var calendar strings.Builder
+	for _, line := range lines {
+		calendar.WriteString(icalFold(line))
+		calendar.WriteString("\r\n")
+	}
+	return calendar.String()
+}
+
+func calendarEventDescription(member model.Member, event model.Event) string {
+	parts := []string{}
+	if event.Description != "" {
+		parts = append(parts, event.Description)
+	}
+	if event.UniformRequired == 1 {
+		parts = append(parts,
+			common.Translate("reminder_uniform_title", member.Language)+": "+
+				common.Translate("reminder_uniform_text", member.Language))
+	}
+	var answer string
+	switch event.Participation {
+	case common.AnswerYes:
+		answer = common.Translate("reminder_answer_yes", member.Language)
+	case common.AnswerNo:
+		answer = common.Translate("reminder_answer_no", member.Language)
+	case common.AnswerMaybe:
+		answer = common.Translate("calendar_answer_maybe", member.Language)
+	default:
+		answer = common.Translate("calendar_no_answer", member.Language)
+	}
+	parts = append(parts, common.Translate("calendar_your_answer", member.Language)+" "+answer)
+	return strings.Join(parts, "\n\n")
+}
+
+// icalEscape escapes a TEXT value as described in RFC 5545 section 3.3.11.
+func icalEscape(s string) string {
+	replacer := strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	)
+	return replacer.Replace(s)
+}
+
+// icalFold splits content lines longer than 75 octets (RFC 5545 section 3.1),
+// without cutting a multi-byte UTF-8 character.
+func icalFold(line string) string {
+	const maxLength = 75
+	if len(line) <= maxLength {
+		return line
+	}
+	var folded strings.Builder
+	length := 0
+	for _, r := range line {
+		size := len(string(r))
+		if length+size > maxLength {
+			folded.WriteString("\r\n ")
+			length = 1
+		}
+		folded.WriteRune(r)
+		length += size
+	}
+	return folded.String()
+}
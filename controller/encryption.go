@@ -0,0 +1,41 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+const (
+	ERRORREENCRYPT = "error re-encrypting members"
+
+	ReencryptDefaultBatchSize = 100
+)
+
+// ReencryptMembers encrypts again the members with the current encryption
+// key, after a key rotation. The optional batch parameter sets the number of
+// members per transaction.
+func ReencryptMembers(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "ReencryptMembers")
+	defer span.End()
+
+	batchSize := ReencryptDefaultBatchSize
+	if r.FormValue("batch") != "" {
+		var err error
+		batchSize, err = strconv.Atoi(r.FormValue("batch"))
+		if err != nil || batchSize < 1 {
+			common.Debug("Invalid batch size: %s", r.FormValue("batch"))
+			RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+			return
+		}
+	}
+	reencrypted, err := model.ReencryptMembers(ctx, batchSize)
+	if err != nil {
+		common.Warn("Error re-encrypting members: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORREENCRYPT)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, map[string]int{"reencrypted": reencrypted})
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"regexp"
 	"strconv"
@@ -27,13 +28,14 @@ const (
 	ERRORGETTINGTIMEZONE      = "error getting timezone"
 	ERRORUPDATEEVENT          = "error updating event"
 	ERRORDELETEEVENT          = "error deleting event"
+	ERROREVENTNOTINSERIES     = "event is not part of a series"
+	ERRORGETRECURRINGEVENT    = "error getting recurring event"
+	ERRORUPDATERECURRINGEVENT = "error updating recurring event"
 )
 
 // Regex to match any positive number followed by w (week) or d (days)
 var intervalRegex = regexp.MustCompile(`^([1-9]\d*)(w|d)$`)
 
-const intervalDaySecond = 60 * 60 * 24
-const intervalWeekSecond = 60 * 60 * 24 * 7
 const DEFAULT_LIMIT = 10
 const MAX_LIMIT = 100
 
@@ -75,6 +77,7 @@ func GetEvent(w http.ResponseWriter, r *http.Request) {
 		}
 		common.Debug("Participation for User %s Event: %s is Answer: %s", p.MemberUUID, p.EventUUID, p.Answer)
 		e.Participation = p.Answer
+		e.Waitlisted = p.Waitlisted
 		if common.StringInSlice(model.MEMBERSTYPEADMIN, tokenAuth.Permissions) {
 			if err := e.GetAttendance(ctx); err != nil {
 				common.Warn("Error counting the number of people registered or the event: %s", err.Error())
@@ -134,6 +137,7 @@ func GetEvents(w http.ResponseWriter, r *http.Request) {
 					}
 				}
 				events[index].Participation = p.Answer
+				events[index].Waitlisted = p.Waitlisted
 			}
 			// if token contain permission admin
 			if common.StringInSlice(model.MEMBERSTYPEADMIN, tokenAuth.Permissions) {
@@ -175,72 +179,52 @@ func CreateEvent(w http.ResponseWriter, r *http.Request) {
 
 	// Compute all events
 	var events = make([]model.Event, 0)
-	if event.Recurring.Interval == "" || event.Recurring.Until == 0 {
+	if event.Recurring.RRule == "" && (event.Recurring.Interval == "" || event.Recurring.Until == 0) {
 		event.UUID = common.GenerateUUID()
 		events = append(events, event)
 	} else {
-		interval := intervalRegex.FindStringSubmatch(event.Recurring.Interval)
-		if len(interval) != 0 && event.Recurring.Until >= event.StartDate {
-			inter, err := strconv.ParseUint(interval[1], 10, 32)
-			intervalSeconds := uint(inter)
-			if err != nil {
-				common.Debug("Invalid request payload: %s", err.Error())
-				RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
-			}
-			switch interval[2] {
-			case "d":
-				intervalSeconds *= intervalDaySecond
-			case "w":
-				intervalSeconds *= intervalWeekSecond
-			}
-			// Create the recurringEvent
-			var recurringEvent model.RecurringEvent
-			recurringEvent.UUID = common.GenerateUUID()
-			recurringEvent.Name = event.Name
-			recurringEvent.Description = event.Description
-			recurringEvent.Interval = event.Recurring.Interval
-			if err := recurringEvent.CreateRecurringEvent(ctx); err != nil {
-				common.Warn("Error creating recurring event: %s", err.Error())
-				RespondWithError(w, http.StatusInternalServerError, ERRORCREATERECURRINGEVENT)
-				return
-			}
-			// Compute the list of events
-			for date := event.StartDate; date <= event.Recurring.Until; date += intervalSeconds {
-				var anEvent model.Event
-
-				anEvent.UUID = common.GenerateUUID()
-				anEvent.Name = recurringEvent.Name
-				anEvent.Description = recurringEvent.Description
-				anEvent.StartDate = date
-				anEvent.EndDate = date + event.EndDate - event.StartDate
-				anEvent.RecurringEvent = recurringEvent.UUID
-				anEvent.Type = event.Type
-				anEvent.Location = event.Location
-				anEvent.LocationName = event.LocationName
-				anEvent.UniformRequired = event.UniformRequired
-				events = append(events, anEvent)
-
-				// Adjust for Daylight Saving Time
-				var location, err = time.LoadLocation("America/Montreal")
-				if err != nil {
-					common.Warn("Error getting timezone data: %s", err.Error())
-					RespondWithError(w, http.StatusInternalServerError, ERRORGETTINGTIMEZONE)
-					return
-				}
-				// This gives the offset of the current Zone in Montreal
-				// In daylight Saving Time or Standard time accord to the time of year
-				_, thisEventZoneOffset := time.Unix(int64(date), 0).In(location).Zone()
-				_, nextEventZoneOffset := time.Unix(int64(date+intervalSeconds), 0).In(location).Zone()
-				// If the event switch between EST and EDT, offset will adjust the time
-				// So that the end user see always the event at the same time of day
-				offset := thisEventZoneOffset - nextEventZoneOffset
-				date = uint(int(date) + offset)
-			}
-		} else {
+		location, err := common.LoadLocation(event.Timezone)
+		if err != nil {
+			common.Warn("Error getting timezone data: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORGETTINGTIMEZONE)
+			return
+		}
+		rule, err := recurrenceRule(event.Recurring, location)
+		if err != nil || (event.Recurring.Until != 0 && event.Recurring.Until < event.StartDate) {
 			common.Debug("Invalid request payload")
 			RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
 			return
 		}
+		// Compute the list of events
+		dates, err := recurringDates(rule, event.StartDate, event.Recurring.Until, event.Recurring.ExDates, location)
+		if err != nil || len(dates) == 0 {
+			common.Debug("Invalid recurrence: %v", err)
+			RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+			return
+		}
+		if event.Recurring.Until == 0 {
+			event.Recurring.Until = dates[len(dates)-1]
+		}
+		if event.Recurring.RRule == "" {
+			event.Recurring.RRule = intervalRRule(event.Recurring.Interval)
+		}
+		// Create the recurringEvent
+		var recurringEvent model.RecurringEvent
+		recurringEvent.UUID = common.GenerateUUID()
+		recurringEvent.Name = event.Name
+		recurringEvent.Description = event.Description
+		recurringEvent.Interval = event.Recurring.Interval
+		recurringEvent.Until = event.Recurring.Until
+		recurringEvent.RRule = event.Recurring.RRule
+		recurringEvent.ExDates = event.Recurring.ExDates
+		if err := recurringEvent.CreateRecurringEvent(ctx); err != nil {
+			common.Warn("Error creating recurring event: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORCREATERECURRINGEVENT)
+			return
+		}
+		for _, date := range dates {
+			events = append(events, recurringOccurrence(event, recurringEvent.UUID, date))
+		}
 	}
 
 	// Create the events
@@ -305,6 +289,12 @@ func UpdateEvent(w http.ResponseWriter, r *http.Request) {
 		RespondWithError(w, http.StatusInternalServerError, ERRORUPDATEEVENT)
 		return
 	}
+	// The capacity might have been raised
+	if err := promoteFromWaitingList(ctx, e); err != nil {
+		common.Warn("Error promoting members from the waiting list: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORUPDATEEVENT)
+		return
+	}
 
 	// Send notification
 	if e.StartDate > uint(time.Now().Unix()) { // Do not send emails for events in the past
@@ -359,6 +349,330 @@ func DeleteEvent(w http.ResponseWriter, r *http.Request) {
 	RespondWithJSON(w, http.StatusOK, nil)
 }
 
+// UpdateEventSeries applies the details of the payload to an occurrence of a
+// series and to all the following ones. Times are moved by the same wall-clock
+// shift, so that a practice moved from 19:00 to 20:00 stays at 20:00 after a
+// DST change. A different recurring.until extends or shortens the series.
+// Members get a single notification for the whole series.
+func UpdateEventSeries(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "UpdateEventSeries")
+	defer span.End()
+
+	vars := mux.Vars(r)
+	UUID := vars["uuid"]
+	eventBeforeUpdate, recurringEvent, ok := getEventSeries(ctx, w, UUID)
+	if !ok {
+		return
+	}
+	var e model.Event
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&e); err != nil {
+		common.Debug("Invalid request payload: %s", err.Error())
+		RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+		return
+	}
+	defer r.Body.Close()
+
+	// Validation on events data
+	if !validEventData(ctx, e) {
+		common.Debug("Invalid request payload: %s", e)
+		RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+		return
+	}
+	if e.Recurring.Until != 0 && e.Recurring.Until < e.StartDate {
+		common.Debug("Series cannot end before the updated event")
+		RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+		return
+	}
+
+	occurrences, err := recurringEvent.GetEvents(ctx, eventBeforeUpdate.StartDate)
+	if err != nil {
+		common.Warn("Error getting events of the series: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORGETEVENTS)
+		return
+	}
+	location, err := common.LoadLocation(e.Timezone)
+	if err != nil {
+		common.Warn("Error getting timezone data: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORGETTINGTIMEZONE)
+		return
+	}
+	// The shift is expressed as a number of days and a new time of day
+	oldStart := time.Unix(int64(eventBeforeUpdate.StartDate), 0).In(location)
+	newStart := time.Unix(int64(e.StartDate), 0).In(location)
+	dayShift := int(time.Date(newStart.Year(), newStart.Month(), newStart.Day(), 0, 0, 0, 0, time.UTC).Sub(
+		time.Date(oldStart.Year(), oldStart.Month(), oldStart.Day(), 0, 0, 0, 0, time.UTC)).Hours() / 24)
+	duration := e.EndDate - e.StartDate
+	exdates := recurringEvent.ExDates
+	if e.Recurring.ExDates != nil {
+		exdates = e.Recurring.ExDates
+	}
+
+	updated := []model.Event{}
+	removed := []model.Event{}
+	for _, occurrence := range occurrences {
+		start := time.Unix(int64(occurrence.StartDate), 0).In(location)
+		start = time.Date(start.Year(), start.Month(), start.Day()+dayShift, newStart.Hour(), newStart.Minute(), newStart.Second(), 0, location)
+		occurrence.StartDate = uint(start.Unix())
+		occurrence.EndDate = occurrence.StartDate + duration
+		occurrence.Name = e.Name
+		occurrence.Description = e.Description
+		occurrence.Type = e.Type
+		occurrence.Location = e.Location
+		occurrence.LocationName = e.LocationName
+		occurrence.UniformRequired = e.UniformRequired
+		occurrence.Timezone = e.Timezone
+		occurrence.Capacity = e.Capacity
+		occurrence.AnswerDeadline = 0
+		if e.AnswerDeadline != 0 {
+			occurrence.AnswerDeadline = occurrence.StartDate - (e.StartDate - e.AnswerDeadline)
+		}
+		if e.Recurring.Until != 0 && occurrence.StartDate > e.Recurring.Until || isExDate(occurrence.StartDate, exdates, location) {
+			removed = append(removed, occurrence)
+		} else {
+			updated = append(updated, occurrence)
+		}
+	}
+	if len(updated) == 0 {
+		common.Debug("The updated event cannot be removed from its series")
+		RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+		return
+	}
+	// Without a new end date, the end of the series moves with its occurrences
+	until := updated[len(updated)-1].StartDate
+	if e.Recurring.Until != 0 {
+		until = e.Recurring.Until
+	}
+	added := []model.Event{}
+	if until > updated[len(updated)-1].StartDate {
+		rule, err := recurrenceRule(model.Recurring{Interval: recurringEvent.Interval, RRule: recurringEvent.RRule}, location)
+		if err != nil {
+			common.Warn("Invalid recurrence for series %s: %s", recurringEvent.UUID, err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORUPDATERECURRINGEVENT)
+			return
+		}
+		// The series now ends with until, whatever the initial rule said
+		rule.Count = 0
+		rule.Until = time.Time{}
+		last := updated[len(updated)-1]
+		dates, err := recurringDates(rule, last.StartDate, until, exdates, location)
+		if err != nil {
+			common.Debug("Invalid recurrence: %s", err.Error())
+			RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+			return
+		}
+		for _, date := range dates {
+			if date > last.StartDate {
+				added = append(added, recurringOccurrence(last, recurringEvent.UUID, date))
+			}
+		}
+	}
+
+	eventBeforeUpdate.Recurring = model.Recurring{Interval: recurringEvent.Interval, Until: recurringEvent.Until, RRule: recurringEvent.RRule, ExDates: recurringEvent.ExDates}
+	recurringEvent.Name = e.Name
+	recurringEvent.Description = e.Description
+	recurringEvent.Until = until
+	recurringEvent.ExDates = exdates
+	if err := recurringEvent.UpdateSeries(ctx, updated, removed, added); err != nil {
+		common.Warn("Error updating the series: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORUPDATERECURRINGEVENT)
+		return
+	}
+	// The capacity might have been raised
+	for _, event := range updated {
+		if err := promoteFromWaitingList(ctx, event); err != nil {
+			common.Warn("Error promoting members from the waiting list: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORUPDATEEVENT)
+			return
+		}
+	}
+	e = updated[0]
+	e.Recurring = model.Recurring{Interval: recurringEvent.Interval, Until: recurringEvent.Until, RRule: recurringEvent.RRule, ExDates: recurringEvent.ExDates}
+
+	// Send notification
+	changed := append(updated, added...)
+	if changed[len(changed)-1].StartDate > uint(time.Now().Unix()) { // Do not send emails for series in the past
+
+		// Encode payload
+		payload := mail.EmailModifiedPayload{EventBeforeUpdate: eventBeforeUpdate, EventAfterUpdate: e, Occurrences: len(changed)}
+		payloadBytes := new(bytes.Buffer)
+		json.NewEncoder(payloadBytes).Encode(payload)
+
+		n := model.Notification{NotificationType: model.TypeEventModified, SendDate: int(time.Now().Unix()), Payload: payloadBytes.Bytes()}
+		if err := n.CreateNotification(ctx); err != nil {
+			common.Warn("Error creating notification: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORNOTIFICATION)
+			return
+		}
+	} else {
+		common.Debug("Series %s is in the past, not sending the notification", recurringEvent.UUID)
+	}
+	RespondWithJSON(w, http.StatusOK, e)
+}
+
+// DeleteEventSeries deletes an occurrence of a series and all the following
+// ones. Members get a single notification for the whole series.
+func DeleteEventSeries(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "DeleteEventSeries")
+	defer span.End()
+
+	vars := mux.Vars(r)
+	UUID := vars["uuid"]
+	e, recurringEvent, ok := getEventSeries(ctx, w, UUID)
+	if !ok {
+		return
+	}
+	occurrences, err := recurringEvent.GetEvents(ctx, e.StartDate)
+	if err != nil {
+		common.Warn("Error getting events of the series: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORGETEVENTS)
+		return
+	}
+	// The series now ends with the last remaining occurrence
+	remaining, err := recurringEvent.GetEvents(ctx, 0)
+	if err != nil {
+		common.Warn("Error getting events of the series: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORGETEVENTS)
+		return
+	}
+	recurringEvent.Until = 0
+	for _, event := range remaining {
+		if event.StartDate < e.StartDate {
+			recurringEvent.Until = event.StartDate
+		}
+	}
+	if err := recurringEvent.UpdateSeries(ctx, nil, occurrences, nil); err != nil {
+		common.Warn("Error deleting events of the series: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORDELETEEVENT)
+		return
+	}
+	if occurrences[len(occurrences)-1].StartDate > uint(time.Now().Unix()) { // Do not send emails for series in the past
+		payload := mail.EmailDeletedEventPayload{EventDeleted: e, Occurrences: len(occurrences)}
+		payloadBytes := new(bytes.Buffer)
+		json.NewEncoder(payloadBytes).Encode(payload)
+		n := model.Notification{NotificationType: model.TypeEventDeleted, SendDate: int(time.Now().Unix()), Payload: payloadBytes.Bytes()}
+		if err := n.CreateNotification(ctx); err != nil {
+			common.Warn("Error creating notification: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORNOTIFICATION)
+			return
+		}
+	} else {
+		common.Debug("Series %s is in the past, not sending the notification", recurringEvent.UUID)
+	}
+	RespondWithJSON(w, http.StatusOK, nil)
+}
+
+// getEventSeries returns an event and the series it belongs to, or writes the
+// error response.
+func getEventSeries(ctx context.Context, w http.ResponseWriter, UUID string) (model.Event, model.RecurringEvent, bool) {
+	e := model.Event{UUID: UUID}
+	if err := e.Get(ctx); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			common.Debug("Event not found: %s", err.Error())
+			RespondWithError(w, http.StatusNotFound, ERROREVENTNOTFOUND)
+		default:
+			common.Warn("Error getting event: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORGETEVENT)
+		}
+		return e, model.RecurringEvent{}, false
+	}
+	if e.RecurringEvent == "" {
+		common.Debug("Event %s is not part of a series", e.UUID)
+		RespondWithError(w, http.StatusBadRequest, ERROREVENTNOTINSERIES)
+		return e, model.RecurringEvent{}, false
+	}
+	recurringEvent := model.RecurringEvent{UUID: e.RecurringEvent}
+	if err := recurringEvent.Get(ctx); err != nil {
+		common.Warn("Error getting recurring event: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORGETRECURRINGEVENT)
+		return e, recurringEvent, false
+	}
+	return e, recurringEvent, true
+}
+
+// recurrenceRule returns the RRULE of a series, or converts the legacy
+// interval (2w, 3d) to one.
+func recurrenceRule(recurring model.Recurring, location *time.Location) (common.RRule, error) {
+	if recurring.RRule != "" {
+		return common.ParseRRule(recurring.RRule, location)
+	}
+	if !intervalRegex.MatchString(recurring.Interval) {
+		return common.RRule{}, fmt.Errorf("invalid interval: %s", recurring.Interval)
+	}
+	return common.ParseRRule(intervalRRule(recurring.Interval), location)
+}
+
+// intervalRRule converts an interval like 2w or 3d to the equivalent RRULE.
+func intervalRRule(interval string) string {
+	matches := intervalRegex.FindStringSubmatch(interval)
+	if len(matches) == 0 {
+		return ""
+	}
+	frequency := common.FreqDaily
+	if matches[2] == "w" {
+		frequency = common.FreqWeekly
+	}
+	return fmt.Sprintf("FREQ=%s;INTERVAL=%s", frequency, matches[1])
+}
+
+// recurringDates returns the start dates of a series, from start to until
+// (included, or as limited by the rule), skipping the exception dates.
+// Occurrences keep the time of day of start in location across DST changes.
+func recurringDates(rule common.RRule, start, until uint, exdates []uint, location *time.Location) ([]uint, error) {
+	var untilTime time.Time
+	if until != 0 {
+		untilTime = time.Unix(int64(until), 0)
+	}
+	exdateTimes := make([]time.Time, 0, len(exdates))
+	for _, exdate := range exdates {
+		exdateTimes = append(exdateTimes, time.Unix(int64(exdate), 0))
+	}
+	occurrences, err := rule.Expand(time.Unix(int64(start), 0).In(location), untilTime, exdateTimes)
+	if err != nil {
+		return nil, err
+	}
+	dates := make([]uint, 0, len(occurrences))
+	for _, occurrence := range occurrences {
+		dates = append(dates, uint(occurrence.Unix()))
+	}
+	return dates, nil
+}
+
+// isExDate is true if date is on the same day as one of the exception dates.
+func isExDate(date uint, exdates []uint, location *time.Location) bool {
+	day := time.Unix(int64(date), 0).In(location).Format("20060102")
+	for _, exdate := range exdates {
+		if time.Unix(int64(exdate), 0).In(location).Format("20060102") == day {
+			return true
+		}
+	}
+	return false
+}
+
+// recurringOccurrence builds the occurrence of a series starting at date,
+// copying the details of the template event.
+func recurringOccurrence(template model.Event, recurringEventUUID string, date uint) model.Event {
+	var anEvent model.Event
+	anEvent.UUID = common.GenerateUUID()
+	anEvent.Name = template.Name
+	anEvent.Description = template.Description
+	anEvent.StartDate = date
+	anEvent.EndDate = date + template.EndDate - template.StartDate
+	anEvent.RecurringEvent = recurringEventUUID
+	anEvent.Type = template.Type
+	anEvent.Location = template.Location
+	anEvent.LocationName = template.LocationName
+	anEvent.UniformRequired = template.UniformRequired
+	anEvent.Timezone = template.Timezone
+	anEvent.Capacity = template.Capacity
+	// Every occurrence closes its answers as long before it starts
+	if template.AnswerDeadline != 0 {
+		anEvent.AnswerDeadline = date - (template.StartDate - template.AnswerDeadline)
+	}
+	return anEvent
+}
+
 func validEventData(ctx context.Context, event model.Event) bool {
 	_, span := tracer.Start(ctx, "validEventData")
 	defer span.End()
@@ -366,7 +680,9 @@ func validEventData(ctx context.Context, event model.Event) bool {
 	var valid = true
 	var validType = false
 	if event.StartDate > event.EndDate ||
-		event.Name == "" {
+		event.AnswerDeadline > event.StartDate ||
+		event.Name == "" ||
+		model.ValidateTimezone(event.Timezone) != nil {
 		valid = false
 	}
 	for _, eventType := range model.ValidEventTypes {
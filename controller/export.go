@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+const (
+	ERROREXPORTMEMBERDATA = "error exporting the member data"
+)
+
+type exportCredentials struct {
+	Username string `json:"username"`
+}
+
+type exportNotification struct {
+	Type      string `json:"type"`
+	Object    string `json:"object"`
+	SendDate  int    `json:"sendDate"`
+	Delivered int    `json:"delivered"`
+}
+
+// ExportMemberData returns a zip archive of JSON files with the personal
+// data stored about a member: profile, username, participation history,
+// badges, castell positions and the notifications about them.
+// A member can export their own data and the data of their dependents, an
+// admin can export anybody's.
+func ExportMemberData(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "ExportMemberData")
+	defer span.End()
+
+	vars := mux.Vars(r)
+	memberUUID := vars["member_uuid"]
+
+	if !exportAllowed(ctx, w, r, memberUUID) {
+		return
+	}
+
+	m := model.Member{UUID: memberUUID}
+	if err := m.Get(ctx); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			common.Debug("Member not found: %s", err.Error())
+			RespondWithError(w, http.StatusNotFound, ERRORMEMBERNOTFOUND)
+		default:
+			common.Warn("Error getting member: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORGETMEMBER)
+		}
+		return
+	}
+	credentials := model.Credentials{UUID: memberUUID}
+	if err := credentials.GetCredentialsByUUID(ctx); err != nil && err != sql.ErrNoRows {
+		common.Warn("Error getting credentials: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERROREXPORTMEMBERDATA)
+		return
+	}
+	participations, err := m.GetMemberParticipations(ctx)
+	if err != nil {
+		common.Warn("Error getting participations: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERROREXPORTMEMBERDATA)
+		return
+	}
+	badges, err := model.GetMemberBadges(ctx, memberUUID)
+	if err != nil {
+		common.Warn("Error getting member badges: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERROREXPORTMEMBERDATA)
+		return
+	}
+	castells, err := model.GetMemberCastellModels(ctx, memberUUID)
+	if err != nil {
+		common.Warn("Error getting castell positions: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERROREXPORTMEMBERDATA)
+		return
+	}
+	memberNotifications, err := model.GetMemberNotifications(ctx, memberUUID)
+	if err != nil {
+		common.Warn("Error getting notifications: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERROREXPORTMEMBERDATA)
+		return
+	}
+	// Payloads also hold data about other members, they are left out
+	notifications := []exportNotification{}
+	for _, n := range memberNotifications {
+		notifications = append(notifications, exportNotification{
+			Type: n.NotificationType, Object: n.ObjectUUID, SendDate: n.SendDate, Delivered: n.Delivered})
+	}
+
+	content := new(bytes.Buffer)
+	archive := zip.NewWriter(content)
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"profile.json", m},
+		{"credentials.json", exportCredentials{Username: credentials.Username}},
+		{"participations.json", participations},
+		{"badges.json", badges},
+		{"castells.json", castells},
+		{"notifications.json", notifications},
+	}
+	for _, file := range files {
+		f, err := archive.Create(file.name)
+		if err == nil {
+			encoder := json.NewEncoder(f)
+			encoder.SetIndent("", "  ")
+			err = encoder.Encode(file.content)
+		}
+		if err != nil {
+			common.Warn("Error writing %s: %s", file.name, err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERROREXPORTMEMBERDATA)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		common.Warn("Error writing archive: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERROREXPORTMEMBERDATA)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"castellers-"+memberUUID+".zip\"")
+	w.WriteHeader(http.StatusOK)
+	w.Write(content.Bytes())
+}
+
+// A member can export their own data and the data of their dependents, an
+// admin can export anybody's.
+func exportAllowed(ctx context.Context, w http.ResponseWriter, r *http.Request, memberUUID string) bool {
+	tokenAuth, err := ExtractToken(ctx, r)
+	if err != nil {
+		common.Warn("Error reading token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAUTHENTICATION)
+		return false
+	}
+	if common.StringInSlice(model.MEMBERSTYPEADMIN, tokenAuth.Permissions) || tokenAuth.UserId == memberUUID {
+		return true
+	}
+	responsible := model.Member{UUID: tokenAuth.UserId}
+	dependents, err := responsible.GetDependents(ctx)
+	if err != nil {
+		common.Warn("Error getting dependents: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERROREXPORTMEMBERDATA)
+		return false
+	}
+	for _, dependent := range dependents {
+		if dependent.UUID == memberUUID {
+			return true
+		}
+	}
+	common.Info("Member %s cannot export the data of %s", tokenAuth.UserId, memberUUID)
+	RespondWithError(w, http.StatusUnauthorized, ERRORUNAUTHORIZED)
+	return false
+}
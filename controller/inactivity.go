@@ -0,0 +1,177 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+const (
+	ERRORGETINACTIVITY = "error getting the inactivity of the member"
+	ERRORSETINACTIVITY = "error changing the inactivity exemption of the member"
+)
+
+// Decisions of the inactivity scan for an active member
+const (
+	inactivityDecisionExempt   = "exempt"    // Exempted by an admin
+	inactivityDecisionNoPolicy = "no policy" // The type of the member is never paused
+	inactivityDecisionActive   = "active"    // Recent activity
+	inactivityDecisionWarned   = "warned"    // Close to the pause, warning already sent
+	inactivityDecisionWarn     = "warn"      // Close to the pause, warning to send
+	inactivityDecisionPause    = "pause"
+)
+
+type memberInactivity struct {
+	model.Inactivity
+	DelayDays int   `json:"delayDays"` // Of the type of the member, 0 if never paused
+	PauseDate int64 `json:"pauseDate"` // If the member stays inactive, 0 if never paused
+}
+
+type setMemberInactivityPayload struct {
+	Exempt bool `json:"exempt"`
+}
+
+// inactiveDelayDays returns the days of inactivity after which the members
+// of the type are paused, 0 if they are never paused.
+func inactiveDelayDays(memberType string) int {
+	days := common.GetConfigInt("inactivity.delay_days." + memberType)
+	if days < 0 {
+		return common.GetConfigInt("inactive_delay_days")
+	}
+	return days
+}
+
+// inactivityReferenceDate returns the date of the last activity of the
+// member: the most recent of their last participated event and of their
+// last manual reactivation.
+func inactivityReferenceDate(ctx context.Context, member model.Member, inactivity model.Inactivity) int64 {
+	lastEvent, err := member.GetMemberLastParticipation(ctx)
+	if err != nil {
+		common.Error("%v\n", err)
+	}
+	if int64(lastEvent.StartDate) > inactivity.LastActivityDate {
+		return int64(lastEvent.StartDate)
+	}
+	return inactivity.LastActivityDate
+}
+
+// inactivityDecision decides what to do with an active member, given the
+// date of their last activity. Returns the decision and the date when the
+// member will be paused (0 if never).
+func inactivityDecision(now, referenceDate int64, inactivity model.Inactivity, delayDays, warningDays int) (string, int64) {
+	if inactivity.Exempt {
+		return inactivityDecisionExempt, 0
+	}
+	if delayDays <= 0 {
+		return inactivityDecisionNoPolicy, 0
+	}
+	pauseDate := referenceDate + int64(delayDays)*24*3600
+	switch {
+	case now > pauseDate:
+		return inactivityDecisionPause, pauseDate
+	case warningDays <= 0 || now <= pauseDate-int64(warningDays)*24*3600:
+		return inactivityDecisionActive, pauseDate
+	case inactivity.WarnedAt >= referenceDate:
+		// Warned since the last activity
+		return inactivityDecisionWarned, pauseDate
+	default:
+		return inactivityDecisionWarn, pauseDate
+	}
+}
+
+// warnInactiveMember queues the inactivity warning email of a member.
+func warnInactiveMember(ctx context.Context, member model.Member, pauseDate int64) error {
+	payloadBytes := new(bytes.Buffer)
+	if err := json.NewEncoder(payloadBytes).Encode(model.InactivityWarningPayload{PauseDate: pauseDate}); err != nil {
+		return err
+	}
+	n := model.Notification{
+		NotificationType: model.TypeInactivityWarning,
+		ObjectUUID:       member.UUID,
+		SendDate:         int(time.Now().Unix()),
+		Payload:          payloadBytes.Bytes(),
+	}
+	if err := n.CreateNotification(ctx); err != nil {
+		return err
+	}
+	return member.SetInactivityWarnedAt(ctx, time.Now().Unix())
+}
+
+// GetMemberInactivity returns what the inactivity scan knows about a member
+// and when they will be paused.
+func GetMemberInactivity(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "GetMemberInactivity")
+	defer span.End()
+
+	vars := mux.Vars(r)
+	m := model.Member{UUID: vars["member_uuid"]}
+	if err := m.Get(ctx); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			common.Debug("Member not found: %s", err.Error())
+			RespondWithError(w, http.StatusNotFound, ERRORMEMBERNOTFOUND)
+		default:
+			common.Warn("Error getting member: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORGETMEMBER)
+		}
+		return
+	}
+	inactivity, err := m.GetInactivity(ctx)
+	if err != nil {
+		common.Warn("Error getting inactivity: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORGETINACTIVITY)
+		return
+	}
+	result := memberInactivity{Inactivity: inactivity, DelayDays: inactiveDelayDays(m.Type)}
+	if m.Status == model.MEMBERSSTATUSACTIVATED {
+		_, result.PauseDate = inactivityDecision(time.Now().Unix(), inactivityReferenceDate(ctx, m, inactivity),
+			inactivity, result.DelayDays, common.GetConfigInt("inactivity.warning_days"))
+	}
+	RespondWithJSON(w, http.StatusOK, result)
+}
+
+// SetMemberInactivity lets an admin exempt a member from the inactivity
+// scan, or remove the exemption.
+func SetMemberInactivity(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "SetMemberInactivity")
+	defer span.End()
+
+	vars := mux.Vars(r)
+	m := model.Member{UUID: vars["member_uuid"]}
+
+	var payload setMemberInactivityPayload
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&payload); err != nil {
+		common.Debug("Invalid request payload: %s", err.Error())
+		RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+		return
+	}
+	defer r.Body.Close()
+
+	if err := m.Get(ctx); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			common.Debug("Member not found: %s", err.Error())
+			RespondWithError(w, http.StatusNotFound, ERRORMEMBERNOTFOUND)
+		default:
+			common.Warn("Error getting member: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORGETMEMBER)
+		}
+		return
+	}
+	if err := m.SetInactivityExempt(ctx, payload.Exempt); err != nil {
+		common.Warn("Error setting inactivity exemption: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORSETINACTIVITY)
+		return
+	}
+	common.Info("Inactivity exemption of member %s set to %t", m.UUID, payload.Exempt)
+	RespondWithJSON(w, http.StatusAccepted, payload)
+}
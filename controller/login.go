@@ -21,6 +21,7 @@ const (
 	ERRORTOKENEXPIRED     = "token has expired"
 	ERRORTOKENINVALID     = "token is invalid"
 	ERRORGUESTCANNOTLOGIN = "guests cannot login"
+	ERRORTOKENREVOKED     = "token has been revoked"
 )
 
 type TokenDetails struct {
@@ -37,6 +38,7 @@ type AccessTokenDetails struct {
 	RefreshUuid string
 	UserId      string
 	Permissions []string
+	APIToken    bool // Personal API token, without session
 }
 
 const ResetCredentialsPermission = "reset_credentials"
@@ -53,11 +55,16 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
 		return
 	}
+	ip := clientIP(r)
+	if !loginAllowed(ctx, w, credentialsInRequest.Username, ip) {
+		return
+	}
 	credentialsInDB := model.Credentials{Username: credentialsInRequest.Username}
 	if err := credentialsInDB.GetCredentials(ctx); err != nil {
 		switch err {
 		case sql.ErrNoRows:
 			common.Info("User has no credentials: %s", err.Error())
+			loginFailed(ctx, credentialsInRequest.Username, ip, "")
 			RespondWithError(w, http.StatusUnauthorized, ERRORUNAUTHORIZED)
 			return
 		default:
@@ -69,19 +76,37 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	err := common.CompareHashAndPassword(credentialsInDB.PasswordHashed, credentialsInRequest.Password)
 	if err != nil {
 		common.Debug("Wrong password: %s", err.Error())
+		loginFailed(ctx, credentialsInRequest.Username, ip, credentialsInDB.UUID)
 		RespondWithError(w, http.StatusUnauthorized, ERRORUNAUTHORIZED)
 		return
 	}
-	tokens, err := createMemberToken(ctx, credentialsInDB.UUID)
+	// With a second factor, the failed logins are reset by its step
+	if respondLoginTokens(ctx, w, r, credentialsInDB.UUID) {
+		loginSucceeded(ctx, credentialsInRequest.Username)
+	}
+}
+
+// respondLoginTokens responds to the first step of a login with the tokens
+// of the member. With a second factor, the tokens are only returned by
+// LoginMFA or ConfirmMFA. Returns true if the tokens were returned.
+func respondLoginTokens(ctx context.Context, w http.ResponseWriter, r *http.Request, uuid string) bool {
+	tokens, err := mfaLoginStep(ctx, uuid)
+	loggedIn := err == nil && tokens == nil
+	if loggedIn {
+		tokens, err = createMemberToken(ctx, uuid, newSession(r))
+	}
 	if err != nil {
 		common.Warn("Error creating the token: %s", err.Error())
 		RespondWithError(w, http.StatusInternalServerError, ERRORCREATETOKEN)
-		return
+		return false
 	}
 	RespondWithJSON(w, http.StatusOK, tokens)
+	return loggedIn
 }
 
-func createMemberToken(ctx context.Context, uuid string) (map[string]string, error) {
+// createMemberToken starts a session of the member, and returns its access
+// and refresh tokens.
+func createMemberToken(ctx context.Context, uuid string, session Session) (map[string]string, error) {
 	ctx, span := tracer.Start(ctx, "createMemberToken")
 	defer span.End()
 
@@ -93,6 +118,9 @@ func createMemberToken(ctx context.Context, uuid string) (map[string]string, err
 	if err != nil {
 		return nil, err
 	}
+	if err := saveSession(ctx, uuid, token, session); err != nil {
+		return nil, err
+	}
 	tokens := map[string]string{
 		"access_token":  token.AccessToken,
 		"refresh_token": token.RefreshToken,
@@ -110,15 +138,9 @@ func Logout(w http.ResponseWriter, r *http.Request) {
 		RespondWithError(w, http.StatusBadRequest, ERRORUNAUTHORIZED)
 		return
 	}
-	deleted, delErr := deleteTokenInCache(ctx, au.RefreshUuid)
-	if delErr != nil || deleted == 0 {
-		common.Warn("Cannot delete refresh token in cache: %s", err.Error())
-		RespondWithError(w, http.StatusBadRequest, ERRORUNAUTHORIZED)
-		return
-	}
-	deleted, delErr = deleteTokenInCache(ctx, au.TokenUuid)
-	if delErr != nil || deleted == 0 {
-		common.Warn("Cannot delete access token in cache: %s", err.Error())
+	revoked, err := revokeSession(ctx, au.UserId, au.RefreshUuid)
+	if err != nil || !revoked {
+		common.Warn("Cannot revoke the session of the token: %v", err)
 		RespondWithError(w, http.StatusBadRequest, ERRORUNAUTHORIZED)
 		return
 	}
@@ -215,6 +237,9 @@ func ExtractToken(ctx context.Context, r *http.Request) (*AccessTokenDetails, er
 	ctx, span := tracer.Start(ctx, "ExtractToken")
 	defer span.End()
 	tokenString := extractTokenString(ctx, r)
+	if strings.HasPrefix(tokenString, APITokenPrefix) {
+		return extractAPIToken(ctx, tokenString)
+	}
 	token, err := verifyToken(ctx, tokenString, "access")
 	if err != nil {
 		return nil, err
@@ -244,6 +269,10 @@ func ExtractToken(ctx context.Context, r *http.Request) (*AccessTokenDetails, er
 		if !ok {
 			return nil, err
 		}
+		// The refresh token is deleted when the session is revoked
+		if exists, err := tokenStore.Exists(ctx, refreshUuid); err != nil || !exists {
+			return nil, errors.New(ERRORTOKENREVOKED)
+		}
 		return &AccessTokenDetails{
 			TokenUuid:   tokenUuid,
 			RefreshUuid: refreshUuid,
@@ -258,10 +287,13 @@ func saveTokenInCache(ctx context.Context, uuid string, td *TokenDetails) error
 	ctx, span := tracer.Start(ctx, "saveTokenInCache")
 	defer span.End()
 
-	rt := time.Unix(td.RtExpires, 0)
-	now := time.Now()
-
-	errRefresh := RedisClient.Set(ctx, td.RefreshUuid, uuid, rt.Sub(now)).Err()
+	// Tokens without refresh, like the reset credentials tokens, are kept
+	// as long as the access token
+	expires := td.RtExpires
+	if td.AtExpires > expires {
+		expires = td.AtExpires
+	}
+	errRefresh := tokenStore.Set(ctx, td.RefreshUuid, uuid, time.Until(time.Unix(expires, 0)))
 	if errRefresh != nil {
 		return errRefresh
 	}
@@ -272,7 +304,7 @@ func deleteTokenInCache(ctx context.Context, uuid string) (int64, error) {
 	ctx, span := tracer.Start(ctx, "deleteTokenInCache")
 	defer span.End()
 
-	deleted, err := RedisClient.Del(ctx, uuid).Result()
+	deleted, err := tokenStore.Delete(ctx, uuid)
 	if err != nil {
 		return 0, err
 	}
@@ -290,7 +322,7 @@ func checkTokenInCache(ctx context.Context, token *jwt.Token) (string, error) {
 		if !ok {
 			return "", err
 		}
-		userUuid, err := RedisClient.Get(ctx, tokenUuid).Result()
+		userUuid, err := tokenStore.Get(ctx, tokenUuid)
 		if err != nil {
 			return "", err
 		}
@@ -337,15 +369,7 @@ func RefreshToken(w http.ResponseWriter, r *http.Request) {
 			RespondWithError(w, http.StatusUnprocessableEntity, ERRORTOKENINVALID)
 			return
 		}
-		// TODO: Link refresh token to a parent DEVICE ID.
-		//       After that, we only delete the refresh tokens
-		//       from this device ID when the device is logged out.
-		// deleted, delErr := deleteTokenInCache(ctx, refreshUuid)
-		// if delErr != nil || deleted == 0 { //if any goes wrong
-		// 	common.Warn("Error deleting token in cache: %s", delErr.Error())
-		// 	RespondWithError(w, http.StatusUnauthorized, ERRORUNAUTHORIZED)
-		// 	return
-		// }
+		refreshUuid, _ := claims["token_uuid"].(string)
 		permissions, err := getMemberPermissions(ctx, userUuid)
 		if err != nil {
 			common.Warn("Error getting permissions: %s", err.Error())
@@ -359,6 +383,23 @@ func RefreshToken(w http.ResponseWriter, r *http.Request) {
 			RespondWithError(w, http.StatusInternalServerError, ERRORINTERNAL)
 			return
 		}
+		// The session continues with the new refresh token
+		session, err := getSession(ctx, refreshUuid)
+		if err != nil {
+			common.Debug("No session for the refresh token: %s", err.Error())
+			session = newSession(r)
+		}
+		session.LastUsedAt = time.Now().Unix()
+		session.UserAgent = r.UserAgent()
+		session.IP = clientIP(r)
+		if err := saveSession(ctx, userUuid, ts, session); err != nil {
+			common.Warn("Error saving the session: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORINTERNAL)
+			return
+		}
+		if revoked, err := revokeSession(ctx, userUuid, refreshUuid); err != nil || !revoked {
+			deleteTokenInCache(ctx, refreshUuid)
+		}
 		tokens := map[string]string{
 			"access_token":  ts.AccessToken,
 			"refresh_token": ts.RefreshToken,
@@ -401,7 +442,12 @@ func getMemberPermissions(ctx context.Context, uuid string) ([]string, error) {
 	} else {
 		return []string{}, errors.New(ERRORGUESTCANNOTLOGIN)
 	}
-	return permissions, nil
+	// Permissions of the sets assigned to the member
+	setPermissions, err := member.GetPermissions(ctx)
+	if err != nil {
+		return []string{}, err
+	}
+	return append(permissions, setPermissions...), nil
 }
 
 func ForgotPassword(w http.ResponseWriter, r *http.Request) {
@@ -414,6 +460,9 @@ func ForgotPassword(w http.ResponseWriter, r *http.Request) {
 		RespondWithError(w, http.StatusUnprocessableEntity, ERRORINVALIDPAYLOAD)
 		return
 	}
+	if !passwordResetAllowed(ctx, w, member.Email, clientIP(r)) {
+		return
+	}
 	err := member.GetByEmail(ctx)
 	// Even if the member is not found, we cannot give an error because that will be a way to
 	// find which users are in the system
@@ -0,0 +1,214 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+const (
+	ERRORLOGINBLOCKED     = "too many failed attempts, try again later"
+	ERRORTOOMANYREQUESTS  = "too many requests, try again later"
+	ERRORLOGINPROTECTION  = "error checking the login attempts"
+	loginProtectionPrefix = "login_protection:"
+)
+
+// Failed logins are counted in Redis, per username and per IP:
+// - after login_protection.free_attempts failures of a username, each
+//   failure delays its next attempt, twice as long as the previous delay
+// - after login_protection.max_attempts_username or max_attempts_ip
+//   failures, the username or the IP is locked, and the admins are notified
+//   when a member is locked
+// A successful login resets the counter of the username, not of the IP.
+// With a second factor, the wrong codes are failed logins of the username
+// too, and only the second step resets the counter.
+
+// clientIP returns the IP of the request, read from
+// login_protection.ip_header behind a proxy. Each proxy appends the address
+// it received the request from to X-Forwarded-For, and the client chooses
+// the first entries, so the IP is the entry added by the first of the
+// login_protection.trusted_proxies proxies, counted from the right.
+func clientIP(r *http.Request) string {
+	if header := common.GetConfigString("login_protection.ip_header"); header != "" {
+		hops := common.GetConfigInt("login_protection.trusted_proxies")
+		var entries []string
+		for _, value := range r.Header.Values(header) {
+			entries = append(entries, strings.Split(value, ",")...)
+		}
+		if hops > 0 && hops <= len(entries) {
+			if ip := strings.TrimSpace(entries[len(entries)-hops]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func loginSubjects(username, ip string) []string {
+	return []string{"user:" + strings.ToLower(username), "ip:" + ip}
+}
+
+// loginBlockedFor returns how long the login is blocked for the subjects,
+// by a lockout or a delay. Zero if it is allowed.
+func loginBlockedFor(ctx context.Context, subjects []string) (time.Duration, error) {
+	var blocked time.Duration
+	for _, subject := range subjects {
+		for _, key := range []string{"lock:" + subject, "delay:" + subject} {
+			ttl, err := tokenStore.TTL(ctx, loginProtectionPrefix+key)
+			if err != nil {
+				return 0, err
+			}
+			if ttl > blocked {
+				blocked = ttl
+			}
+		}
+	}
+	return blocked, nil
+}
+
+// recordLoginFailure counts a failed login of the subject, and locks the
+// next attempts, or delays them if delay is true. Returns the number of
+// failures and whether the subject got locked.
+func recordLoginFailure(ctx context.Context, subject string, maxAttempts int, delay bool) (int64, bool, error) {
+	window := time.Duration(common.GetConfigInt("login_protection.window_minutes")) * time.Minute
+	failures, err := tokenStore.Incr(ctx, loginProtectionPrefix+"failures:"+subject, window)
+	if err != nil {
+		return 0, false, err
+	}
+	if maxAttempts > 0 && failures >= int64(maxAttempts) {
+		lockout := time.Duration(common.GetConfigInt("login_protection.lockout_minutes")) * time.Minute
+		if err := tokenStore.Set(ctx, loginProtectionPrefix+"lock:"+subject, strconv.FormatInt(failures, 10), lockout); err != nil {
+			return failures, false, err
+		}
+		// The counter starts again after the lockout
+		_, err := tokenStore.Delete(ctx, loginProtectionPrefix+"failures:"+subject)
+		return failures, true, err
+	}
+	if wait := loginDelay(failures); delay && wait > 0 {
+		return failures, false, tokenStore.Set(ctx, loginProtectionPrefix+"delay:"+subject, strconv.FormatInt(failures, 10), wait)
+	}
+	return failures, false, nil
+}
+
+// loginDelay returns the time to wait after a number of failures.
+func loginDelay(failures int64) time.Duration {
+	extra := failures - int64(common.GetConfigInt("login_protection.free_attempts"))
+	if extra <= 0 {
+		return 0
+	}
+	seconds := float64(common.GetConfigInt("login_protection.delay_seconds")) * math.Pow(2, float64(extra-1))
+	seconds = math.Min(seconds, float64(common.GetConfigInt("login_protection.max_delay_seconds")))
+	return time.Duration(seconds) * time.Second
+}
+
+// loginAllowed responds with an error and returns false if the login of the
+// username from the IP is blocked.
+func loginAllowed(ctx context.Context, w http.ResponseWriter, username, ip string) bool {
+	blocked, err := loginBlockedFor(ctx, loginSubjects(username, ip))
+	if err != nil {
+		common.Warn("Error checking login attempts: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORLOGINPROTECTION)
+		return false
+	}
+	if blocked > 0 {
+		common.Info("Login of %s from %s blocked for %s", username, ip, blocked)
+		respondTooManyRequests(w, blocked, ERRORLOGINBLOCKED)
+		return false
+	}
+	return true
+}
+
+// loginFailed records a failed login of the username from the IP.
+// memberUUID is empty if the username does not exist, it is locked like the
+// others but the admins are not notified.
+func loginFailed(ctx context.Context, username, ip, memberUUID string) {
+	subjects := loginSubjects(username, ip)
+	failures, locked, err := recordLoginFailure(ctx, subjects[0], common.GetConfigInt("login_protection.max_attempts_username"), true)
+	if err != nil {
+		common.Warn("Error recording a failed login: %s", err.Error())
+	}
+	if locked {
+		common.Warn("Login of %s locked after %d failed attempts, the last from %s", username, failures, ip)
+		if memberUUID != "" {
+			notifyAccountLocked(ctx, memberUUID, ip, failures)
+		}
+	}
+	if failures, locked, err := recordLoginFailure(ctx, subjects[1], common.GetConfigInt("login_protection.max_attempts_ip"), false); err != nil {
+		common.Warn("Error recording a failed login: %s", err.Error())
+	} else if locked {
+		common.Warn("Logins from %s locked after %d failed attempts", ip, failures)
+	}
+}
+
+// loginSucceeded resets the failed logins of the username.
+func loginSucceeded(ctx context.Context, username string) {
+	subject := loginSubjects(username, "")[0]
+	if _, err := tokenStore.Delete(ctx, loginProtectionPrefix+"failures:"+subject, loginProtectionPrefix+"delay:"+subject); err != nil {
+		common.Warn("Error resetting failed logins: %s", err.Error())
+	}
+}
+
+func notifyAccountLocked(ctx context.Context, memberUUID, ip string, failures int64) {
+	lockout := time.Duration(common.GetConfigInt("login_protection.lockout_minutes")) * time.Minute
+	payload, err := json.Marshal(model.AccountLockedPayload{IP: ip, Attempts: failures, LockedUntil: time.Now().Add(lockout).Unix()})
+	if err != nil {
+		common.Warn("Error creating the payload: %s", err.Error())
+		return
+	}
+	n := model.Notification{
+		NotificationType: model.TypeAccountLocked,
+		ObjectUUID:       memberUUID,
+		SendDate:         int(time.Now().Unix()),
+		Payload:          payload,
+	}
+	if err := n.CreateNotification(ctx); err != nil {
+		common.Warn("Error creating notification: %s", err.Error())
+	}
+}
+
+// passwordResetAllowed counts the forgot password requests for the email
+// and from the IP, and responds with an error and returns false once there
+// were too many.
+func passwordResetAllowed(ctx context.Context, w http.ResponseWriter, email, ip string) bool {
+	window := time.Duration(common.GetConfigInt("login_protection.window_minutes")) * time.Minute
+	limits := []struct {
+		key   string
+		limit int
+	}{
+		{"resets:ip:" + ip, common.GetConfigInt("login_protection.max_password_resets_ip")},
+		{"resets:email:" + strings.ToLower(email), common.GetConfigInt("login_protection.max_password_resets")},
+	}
+	for _, l := range limits {
+		key, limit := loginProtectionPrefix+l.key, l.limit
+		requests, err := tokenStore.Incr(ctx, key, window)
+		if err != nil {
+			common.Warn("Error counting password resets: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORLOGINPROTECTION)
+			return false
+		}
+		if limit > 0 && requests > int64(limit) {
+			ttl, _ := tokenStore.TTL(ctx, key)
+			common.Info("Too many password resets for %s", key)
+			respondTooManyRequests(w, ttl, ERRORTOOMANYREQUESTS)
+			return false
+		}
+	}
+	return true
+}
+
+func respondTooManyRequests(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	RespondWithError(w, http.StatusTooManyRequests, message)
+}
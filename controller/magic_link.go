@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+const (
+	ERRORMAGICLINKDISABLED = "login by email link is disabled"
+	ERRORMAGICLINKUSED     = "this link was already used"
+)
+
+const MagicLinkPermission = "magic_link"
+
+// MagicLinkToken returns a token to login once without password, sent by
+// email. Like the reset credentials token, its refresh UUID is deleted from
+// Redis when it is used.
+func MagicLinkToken(ctx context.Context, uuid string, ttl int) (string, error) {
+	ctx, span := tracer.Start(ctx, "MagicLinkToken")
+	defer span.End()
+	token, err := createToken(ctx, uuid, "", []string{MagicLinkPermission}, ttl, 0)
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// RequestMagicLink sends a link to login to the member with the email of
+// the request. Like ForgotPassword, it succeeds even if the email is
+// unknown.
+func RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "RequestMagicLink")
+	defer span.End()
+
+	if !common.GetConfigBool("magic_link.enabled") {
+		RespondWithError(w, http.StatusForbidden, ERRORMAGICLINKDISABLED)
+		return
+	}
+	var member model.Member
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&member); err != nil {
+		common.Debug("Cannot decode magic link request: %s", err.Error())
+		RespondWithError(w, http.StatusUnprocessableEntity, ERRORINVALIDPAYLOAD)
+		return
+	}
+	defer r.Body.Close()
+	// Shares the limits of the forgot password emails
+	if !passwordResetAllowed(ctx, w, member.Email, clientIP(r)) {
+		return
+	}
+	if err := member.GetByEmail(ctx); err != nil {
+		common.Info("Cannot get member by email: %s", err.Error())
+		RespondWithJSON(w, http.StatusAccepted, "")
+		return
+	}
+	if member.Type != model.MEMBERSTYPEREGULAR && member.Type != model.MEMBERSTYPEADMIN {
+		common.Info("Member %s of type %s cannot login", member.UUID, member.Type)
+		RespondWithJSON(w, http.StatusAccepted, "")
+		return
+	}
+	n := model.Notification{NotificationType: model.TypeMagicLink, ObjectUUID: member.UUID, SendDate: int(time.Now().Unix())}
+	if err := n.CreateNotification(ctx); err != nil {
+		common.Warn("Error creating notification: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORNOTIFICATION)
+		return
+	}
+	RespondWithJSON(w, http.StatusAccepted, "")
+}
+
+// LoginMagicLink logs in the member of a magic link token, with the same
+// response as Login. The token can only be used once.
+func LoginMagicLink(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "LoginMagicLink")
+	defer span.End()
+
+	if !common.GetConfigBool("magic_link.enabled") {
+		RespondWithError(w, http.StatusForbidden, ERRORMAGICLINKDISABLED)
+		return
+	}
+	tokenAuth, err := ExtractToken(ctx, r)
+	if err != nil {
+		common.Warn("Error reading token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAUTHENTICATION)
+		return
+	}
+	// Only the first request deletes the token
+	deleted, err := deleteTokenInCache(ctx, tokenAuth.RefreshUuid)
+	if err != nil {
+		common.Warn("Error deleting token in cache: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORINTERNAL)
+		return
+	}
+	if deleted == 0 {
+		RespondWithError(w, http.StatusUnauthorized, ERRORMAGICLINKUSED)
+		return
+	}
+	common.Info("Member %s logged in with a magic link", tokenAuth.UserId)
+	respondLoginTokens(ctx, w, r, tokenAuth.UserId)
+}
@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+const (
+	ERRORGETMEMBERAUDITLOG = "error getting the audit log"
+
+	memberAuditLogDefaultLimit = 100
+	memberAuditLogMaxLimit     = 1000
+)
+
+// auditMember adds the changes between two versions of a member to the
+// audit log. The change is already made, so a failure is only logged.
+func auditMember(ctx context.Context, actorUUID, action string, before, after model.Member) {
+	entry := model.MemberAuditEntry{
+		ActorUUID:  actorUUID,
+		MemberUUID: after.UUID,
+		Action:     action,
+		Changes:    model.MemberDiff(before, after),
+	}
+	if err := entry.Create(ctx); err != nil {
+		common.Error("Error adding %s of member %s to the audit log: %v", action, after.UUID, err)
+	}
+}
+
+// GetMemberAuditLog returns the changes made to members, most recent first.
+// Query parameters:
+// - member: UUID of a member, all members if empty
+// - before: ID of an entry, to get the next page
+// - limit: number of entries, 100 by default
+func GetMemberAuditLog(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "GetMemberAuditLog")
+	defer span.End()
+
+	var beforeID int64
+	if r.FormValue("before") != "" {
+		value, err := strconv.ParseInt(r.FormValue("before"), 10, 64)
+		if err != nil || value < 0 {
+			common.Debug("Invalid before: %s", r.FormValue("before"))
+			RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+			return
+		}
+		beforeID = value
+	}
+	limit := memberAuditLogDefaultLimit
+	if r.FormValue("limit") != "" {
+		value, err := strconv.Atoi(r.FormValue("limit"))
+		if err != nil || value < 1 || value > memberAuditLogMaxLimit {
+			common.Debug("Invalid limit: %s", r.FormValue("limit"))
+			RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+			return
+		}
+		limit = value
+	}
+	entries, err := model.GetMemberAuditLog(ctx, r.FormValue("member"), beforeID, limit)
+	if err != nil {
+		common.Warn("Error getting the audit log: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORGETMEMBERAUDITLOG)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, entries)
+}
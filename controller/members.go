@@ -26,6 +26,7 @@ const (
 	ERRORMEMBERWEIGHT           = "error with the provided weight"
 	ERRORMEMBERROLES            = "error with the roles provided"
 	ERRORMEMBERLANGUAGE         = "error with the language provided"
+	ERRORMEMBERTIMEZONE         = "error with the timezone provided"
 	ERRORMEMBERTYPE             = "error with the type provided"
 	ERRORUPDATEMEMBER           = "error updating member"
 	ERRORDELETEMEMBER           = "error deleting member"
@@ -48,7 +49,7 @@ func GetMember(w http.ResponseWriter, r *http.Request) {
 
 	// Any authenticated member can view any profile. What they see depends on
 	// who they are:
-	//   - admin: the full profile
+	//   - admin, or members:read-sensitive permission: the full profile
 	//   - themselves: full profile except roles/extra (kept admin-only)
 	//   - another member: only first name, last name and badges (badges are
 	//     fetched separately). Everything else is stripped for privacy.
@@ -73,10 +74,10 @@ func GetMember(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	isAdmin := common.StringInSlice(model.MEMBERSTYPEADMIN, tokenAuth.Permissions)
+	canReadSensitive := hasPermission(tokenAuth, model.PERMISSIONMEMBERSREADSENSITIVE)
 	isSelf := UUID == tokenAuth.UserId
 	switch {
-	case isAdmin:
+	case canReadSensitive:
 		// full profile
 	case isSelf:
 		m.Roles = []string{}
@@ -102,15 +103,16 @@ func GetMembers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Non-admin members may browse the list to find a profile, but only see
-	// names: strip every other (potentially sensitive) field.
+	// Members without the members:read-sensitive permission may browse the
+	// list to find a profile, but only see names: strip every other
+	// (potentially sensitive) field.
 	tokenAuth, err := ExtractToken(r.Context(), r)
 	if err != nil {
 		common.Warn("Error reading token: %s", err.Error())
 		RespondWithError(w, http.StatusInternalServerError, ERRORAUTHENTICATION)
 		return
 	}
-	if !common.StringInSlice(model.MEMBERSTYPEADMIN, tokenAuth.Permissions) {
+	if !hasPermission(tokenAuth, model.PERMISSIONMEMBERSREADSENSITIVE) {
 		sanitized := make([]model.Member, len(members))
 		for i, member := range members {
 			sanitized[i] = model.Member{UUID: member.UUID, FirstName: member.FirstName, LastName: member.LastName, Roles: []string{}}
@@ -132,85 +134,111 @@ func CreateMember(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
+	if errorMessage := validateNewMember(ctx, &m); errorMessage != "" {
+		RespondWithError(w, http.StatusBadRequest, errorMessage)
+		return
+	}
+	m.UUID = common.GenerateUUID()
+	// We will need admin info later for the email
+	tokenAuth, err := ExtractToken(r.Context(), r)
+	if err != nil {
+		common.Warn("Error reading token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAUTHENTICATION)
+		return
+	}
+	a := model.Member{UUID: tokenAuth.UserId}
+	if err := a.Get(ctx); err != nil {
+		common.Warn("Failed to get admin for CreateMember: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORCREATEMEMBER)
+		return
+	}
+	if errorMessage := createMember(ctx, &m, a, true); errorMessage != "" {
+		RespondWithError(w, http.StatusInternalServerError, errorMessage)
+		return
+	}
+	RespondWithJSON(w, http.StatusCreated, m)
+}
+
+// validateNewMember checks the fields of a member to create. The email of
+// guests and canallas is removed. Returns the error message to send, empty
+// if the member is valid.
+func validateNewMember(ctx context.Context, m *model.Member) string {
 	if err := model.ValidateType(m.Type); err != nil {
 		common.Info("Error validating language: " + err.Error())
-		RespondWithError(w, http.StatusBadRequest, ERRORMEMBERTYPE)
-		return
+		return ERRORMEMBERTYPE
 	}
 	if m.Type != model.MEMBERSTYPEGUEST && m.Type != model.MEMBERSTYPECANALLA {
-		if !emailAvailable(ctx, m) {
+		if !emailAvailable(ctx, *m) {
 			common.Info("Email not available: %s", m.Email)
-			RespondWithError(w, http.StatusBadRequest, ERROREMAILUNAVAILABLE)
-			return
+			return ERROREMAILUNAVAILABLE
 		}
 	} else {
 		m.Email = ""
 	}
-	if missingRequiredFields(m) {
+	if missingRequiredFields(*m) {
 		common.Info("Missing fields in request payload")
-		RespondWithError(w, http.StatusBadRequest, ERRORMISSINGFIELDS)
-		return
+		return ERRORMISSINGFIELDS
 	}
 	if err := model.ValidNumberOrEmpty(m.Height); err != nil {
 		common.Info("Error validating Height: " + m.Height)
-		RespondWithError(w, http.StatusBadRequest, ERRORMEMBERHEIGHT)
-		return
+		return ERRORMEMBERHEIGHT
 	}
 	if err := model.ValidNumberOrEmpty(m.Weight); err != nil {
 		common.Info("Error validating Weight: " + m.Weight)
-		RespondWithError(w, http.StatusBadRequest, ERRORMEMBERWEIGHT)
-		return
+		return ERRORMEMBERWEIGHT
 	}
 	if err := model.ValidateRoles(m.Roles); err != nil {
 		common.Info("Error validating roles: " + err.Error())
-		RespondWithError(w, http.StatusBadRequest, ERRORMEMBERROLES)
-		return
+		return ERRORMEMBERROLES
 	}
 	if err := model.ValidateLanguage(m.Language); err != nil {
 		common.Info("Error validating language: " + err.Error())
-		RespondWithError(w, http.StatusBadRequest, ERRORMEMBERLANGUAGE)
-		return
+		return ERRORMEMBERLANGUAGE
 	}
-	m.UUID = common.GenerateUUID()
-	// We will need admin info later for the email
-	tokenAuth, err := ExtractToken(r.Context(), r)
-	if err != nil {
-		common.Warn("Error reading token: %s", err.Error())
-		RespondWithError(w, http.StatusInternalServerError, ERRORAUTHENTICATION)
-		return
-	}
-	a := model.Member{UUID: tokenAuth.UserId}
-	if err := a.Get(ctx); err != nil {
-		common.Warn("Failed to get admin for CreateMember: %s", err.Error())
-		RespondWithError(w, http.StatusInternalServerError, ERRORCREATEMEMBER)
-		return
+	if err := model.ValidateTimezone(m.Timezone); err != nil {
+		common.Info("Error validating timezone: " + err.Error())
+		return ERRORMEMBERTIMEZONE
 	}
-	// Create the Member now
+	return ""
+}
+
+// createMember creates a validated member. Guests and canallas are
+// activated right away, the registration email of the others is queued if
+// sendRegistration is set. Returns the error message to send, empty on
+// success.
+func createMember(ctx context.Context, m *model.Member, author model.Member, sendRegistration bool) string {
 	if err := m.CreateMember(ctx); err != nil {
 		common.Warn("Error creating member: %s", err.Error())
-		RespondWithError(w, http.StatusInternalServerError, ERRORCREATEMEMBER)
-		return
+		return ERRORCREATEMEMBER
 	}
+	m.Status = model.MEMBERSSTATUSCREATED
 	// When a guest is converted to a regular, we need to set the status to created
 	if m.Type == model.MEMBERSTYPEGUEST || m.Type == model.MEMBERSTYPECANALLA {
-		err := m.SetStatus(ctx, model.MEMBERSSTATUSACTIVATED)
+		err := m.SetStatus(ctx, model.MEMBERSSTATUSACTIVATED, model.STATUSCAUSECREATION)
 		if err != nil {
 			common.Error(fmt.Sprintf("Error changing member status to %s", model.MEMBERSSTATUSCREATED))
-			RespondWithError(w, http.StatusInternalServerError, ERRORCHANGINGMEMBERSTATUS)
-			return
+			return ERRORCHANGINGMEMBERSTATUS
 		}
-	} else {
-		payload := mail.EmailRegisterPayload{Member: m, Author: a}
-		payloadBytes := new(bytes.Buffer)
-		json.NewEncoder(payloadBytes).Encode(payload)
-		n := model.Notification{NotificationType: model.TypeMemberRegistration, ObjectUUID: m.UUID, SendDate: int(time.Now().Unix()), Payload: payloadBytes.Bytes()}
+		m.Status = model.MEMBERSSTATUSACTIVATED
+	}
+	auditMember(ctx, author.UUID, model.MEMBERAUDITCREATE, model.Member{}, *m)
+	if m.Type != model.MEMBERSTYPEGUEST && m.Type != model.MEMBERSTYPECANALLA && sendRegistration {
+		n := registrationNotification(*m, author)
 		if err := n.CreateNotification(ctx); err != nil {
 			common.Warn("Error creating notification: %s", err.Error())
-			RespondWithError(w, http.StatusInternalServerError, ERRORNOTIFICATION)
-			return
+			return ERRORNOTIFICATION
 		}
 	}
-	RespondWithJSON(w, http.StatusCreated, m)
+	return ""
+}
+
+// registrationNotification returns the notification sending the
+// registration email to a new member.
+func registrationNotification(m model.Member, author model.Member) model.Notification {
+	payload := mail.EmailRegisterPayload{Member: m, Author: author}
+	payloadBytes := new(bytes.Buffer)
+	json.NewEncoder(payloadBytes).Encode(payload)
+	return model.Notification{NotificationType: model.TypeMemberRegistration, ObjectUUID: m.UUID, SendDate: int(time.Now().Unix()), Payload: payloadBytes.Bytes()}
 }
 
 func EditMember(w http.ResponseWriter, r *http.Request) {
@@ -284,6 +312,11 @@ func EditMember(w http.ResponseWriter, r *http.Request) {
 			RespondWithError(w, http.StatusBadRequest, err.Error())
 			return
 		}
+		if err := model.ValidateTimezone(m.Timezone); err != nil {
+			common.Info("Error validating timezone: " + err.Error())
+			RespondWithError(w, http.StatusBadRequest, ERRORMEMBERTIMEZONE)
+			return
+		}
 
 		// Check if we can change role
 		// If caller is admin, we can change the role
@@ -316,16 +349,19 @@ func EditMember(w http.ResponseWriter, r *http.Request) {
 			RespondWithError(w, http.StatusInternalServerError, ERRORUPDATEMEMBER)
 			return
 		}
+		m.Status = currentMember.Status
 		// When a guest is converted to a regular, we need to set the status to created
 		// Does not apply to canalla, they will stay activated and won't receive the welcome email
 		if currentMember.Type == model.MEMBERSTYPEGUEST && m.Type != model.MEMBERSTYPEGUEST && m.Type != model.MEMBERSTYPECANALLA {
-			err := m.SetStatus(ctx, model.MEMBERSSTATUSCREATED)
+			err := m.SetStatus(ctx, model.MEMBERSSTATUSCREATED, model.STATUSCAUSETYPECHANGE)
 			if err != nil {
 				common.Error(fmt.Sprintf("Error changing member status to %s", model.MEMBERSSTATUSCREATED))
 				RespondWithError(w, http.StatusInternalServerError, ERRORCHANGINGMEMBERSTATUS)
 				return
 			}
+			m.Status = model.MEMBERSSTATUSCREATED
 		}
+		auditMember(ctx, tokenAuth.UserId, model.MEMBERAUDITUPDATE, currentMember, m)
 		RespondWithJSON(w, http.StatusAccepted, m)
 		return
 	}
@@ -379,10 +415,33 @@ func SetMemberStatus(w http.ResponseWriter, r *http.Request) {
 		RespondWithError(w, http.StatusInternalServerError, ERRORCHANGINGMEMBERSTATUS)
 		return
 	}
+	before := m
 	m.Status = payload.Status
+	if tokenAuth, err := ExtractToken(ctx, r); err == nil {
+		auditMember(ctx, tokenAuth.UserId, model.MEMBERAUDITSTATUS, before, m)
+	} else {
+		common.Warn("Error reading token: %s", err.Error())
+	}
 	RespondWithJSON(w, http.StatusAccepted, m)
 }
 
+// GetMemberStatusHistory returns the changes of status of a member with
+// their cause, oldest first.
+func GetMemberStatusHistory(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "GetMemberStatusHistory")
+	defer span.End()
+
+	vars := mux.Vars(r)
+	m := model.Member{UUID: vars["member_uuid"]}
+	history, err := m.GetStatusHistory(ctx)
+	if err != nil {
+		common.Warn("Error getting status history: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORGETMEMBER)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, history)
+}
+
 func DeleteMember(w http.ResponseWriter, r *http.Request) {
 	ctx, span := tracer.Start(r.Context(), "DeleteMember")
 	defer span.End()
@@ -419,6 +478,9 @@ func DeleteMember(w http.ResponseWriter, r *http.Request) {
 		RespondWithError(w, http.StatusInternalServerError, ERRORDELETEMEMBER)
 		return
 	}
+	deleted := m
+	deleted.Status = model.MEMBERSSTATUSDELETED
+	auditMember(ctx, tokenAuth.UserId, model.MEMBERAUDITDELETE, m, deleted)
 	RespondWithJSON(w, http.StatusOK, nil)
 }
 
@@ -535,15 +597,23 @@ func ResetCredentials(w http.ResponseWriter, r *http.Request) {
 		RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
 		return
 	}
+	// The other sessions are logged out, they may use the old password.
 	// resetCredentialsToken should only be used once
+	except := tokenAuth.RefreshUuid
 	if common.StringInSlice(ResetCredentialsPermission, tokenAuth.Permissions) {
-		_, err = deleteTokenInCache(r.Context(), tokenAuth.TokenUuid)
+		except = ""
+		_, err = deleteTokenInCache(r.Context(), tokenAuth.RefreshUuid)
 		if err != nil {
 			common.Warn("Error deleting token in cache: %s", err.Error())
 			RespondWithError(w, http.StatusInternalServerError, ERRORINTERNAL)
 			return
 		}
 	}
+	if _, err := revokeMemberSessions(ctx, tokenAuth.UserId, except); err != nil {
+		common.Warn("Error revoking sessions: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORINTERNAL)
+		return
+	}
 	RespondWithJSON(w, http.StatusOK, "")
 }
 
@@ -584,9 +654,29 @@ func AddRemoveDependent(w http.ResponseWriter, r *http.Request) {
 	responsible_uuid := vars["responsible_uuid"]
 	dependent_uuid := vars["dependent_uuid"]
 
+	tokenAuth, err := ExtractToken(ctx, r)
+	if err != nil {
+		common.Warn("Error reading token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAUTHENTICATION)
+		return
+	}
 	// There is no validation on the type of the responsible and
-	// the dependent on purpose, to be allowed to have special cases
-	// like one person answering for 2 adults.
+	// the dependent for admins on purpose, to be allowed to have special
+	// cases like one person answering for 2 adults. The other members with
+	// the permission can only link canallas to someone else, or they could
+	// answer for and export the data of any member.
+	if !common.StringInSlice(model.MEMBERSTYPEADMIN, tokenAuth.Permissions) {
+		dependent := model.Member{UUID: dependent_uuid}
+		if err := dependent.Get(ctx); err != nil {
+			RespondWithError(w, http.StatusBadRequest, ERRORADDINGDEPENDENT)
+			return
+		}
+		if dependent.Type != model.MEMBERSTYPECANALLA || responsible_uuid == tokenAuth.UserId {
+			common.Info("Member %s is not allowed to link %s to %s", tokenAuth.UserId, dependent_uuid, responsible_uuid)
+			RespondWithError(w, http.StatusUnauthorized, ERRORUNAUTHORIZED)
+			return
+		}
+	}
 
 	responsible := model.Member{UUID: responsible_uuid}
 	dependent := model.Member{UUID: dependent_uuid}
@@ -0,0 +1,232 @@
+package controller
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+const (
+	ERRORIMPORTMEMBERS        = "error importing members"
+	ERRORIMPORTCOLUMN         = "unknown column in the header"
+	ERRORIMPORTDUPLICATEEMAIL = "this email is used by another row"
+	ERRORIMPORTRESPONSIBLE    = "responsible not found"
+)
+
+// Columns of a member import, in any order. Only the header is required.
+var memberImportColumns = []string{"firstName", "lastName", "email", "type", "roles", "language", "height", "weight", "responsible"}
+
+type memberImportRow struct {
+	Row         int          `json:"row"` // Line in the file, the header is line 1
+	Member      model.Member `json:"member"`
+	Responsible string       `json:"responsible"` // Email of a member, or of another row
+	Errors      []string     `json:"errors"`
+}
+
+type memberImportResult struct {
+	DryRun bool              `json:"dryRun"`
+	Valid  bool              `json:"valid"`
+	Rows   []memberImportRow `json:"rows"`
+}
+
+// ImportMembers creates members from a CSV file, sent as the request body.
+// Every row is validated like in CreateMember; if a row is invalid, no
+// member is created and the errors of each row are returned. The members
+// are created in a single transaction, so none is created if one fails.
+// Query parameters:
+// - dryRun: true to only validate the rows
+// - sendRegistration: true to queue the registration email of the new members
+func ImportMembers(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "ImportMembers")
+	defer span.End()
+
+	dryRun := r.FormValue("dryRun") == "true"
+	sendRegistration := r.FormValue("sendRegistration") == "true"
+
+	rows, errorMessage := readMemberImport(r.Body)
+	defer r.Body.Close()
+	if errorMessage != "" {
+		RespondWithError(w, http.StatusBadRequest, errorMessage)
+		return
+	}
+	result := memberImportResult{DryRun: dryRun, Valid: validateMemberImport(ctx, rows), Rows: rows}
+	if !result.Valid {
+		RespondWithJSON(w, http.StatusBadRequest, result)
+		return
+	}
+	if dryRun {
+		RespondWithJSON(w, http.StatusOK, result)
+		return
+	}
+
+	tokenAuth, err := ExtractToken(ctx, r)
+	if err != nil {
+		common.Warn("Error reading token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAUTHENTICATION)
+		return
+	}
+	a := model.Member{UUID: tokenAuth.UserId}
+	if err := a.Get(ctx); err != nil {
+		common.Warn("Failed to get admin for ImportMembers: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORIMPORTMEMBERS)
+		return
+	}
+	created := map[string]string{} // Email to UUID of the new members
+	for i := range rows {
+		rows[i].Member.UUID = common.GenerateUUID()
+		if rows[i].Member.Email != "" {
+			created[strings.ToLower(rows[i].Member.Email)] = rows[i].Member.UUID
+		}
+	}
+	imports := make([]model.MemberImport, len(rows))
+	for i := range rows {
+		m := &rows[i].Member
+		// Like createMember
+		m.Status = model.MEMBERSSTATUSCREATED
+		if m.Type == model.MEMBERSTYPEGUEST || m.Type == model.MEMBERSTYPECANALLA {
+			m.Status = model.MEMBERSSTATUSACTIVATED
+		}
+		imports[i] = model.MemberImport{
+			Member: *m,
+			Audit: model.MemberAuditEntry{
+				ActorUUID:  a.UUID,
+				MemberUUID: m.UUID,
+				Action:     model.MEMBERAUDITCREATE,
+				Changes:    model.MemberDiff(model.Member{}, *m),
+			},
+		}
+		if m.Type != model.MEMBERSTYPEGUEST && m.Type != model.MEMBERSTYPECANALLA && sendRegistration {
+			n := registrationNotification(*m, a)
+			imports[i].Notification = &n
+		}
+		if rows[i].Responsible == "" {
+			continue
+		}
+		responsible := model.Member{UUID: created[strings.ToLower(rows[i].Responsible)]}
+		if responsible.UUID == "" {
+			responsible.Email = rows[i].Responsible
+			if err := responsible.GetByEmail(ctx); err != nil {
+				common.Warn("Error getting responsible %s: %s", rows[i].Responsible, err.Error())
+				rows[i].Errors = append(rows[i].Errors, ERRORIMPORTRESPONSIBLE)
+				result.Valid = false
+				continue
+			}
+		}
+		imports[i].ResponsibleUUID = responsible.UUID
+	}
+	if !result.Valid {
+		RespondWithJSON(w, http.StatusBadRequest, result)
+		return
+	}
+	if err := model.ImportMembers(ctx, imports); err != nil {
+		common.Warn("Error importing members: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORIMPORTMEMBERS)
+		return
+	}
+	RespondWithJSON(w, http.StatusCreated, result)
+}
+
+// readMemberImport reads the rows of a member import. Returns the error
+// message to send, empty if the file can be read.
+func readMemberImport(body io.Reader) ([]memberImportRow, string) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		common.Debug("Invalid member import header: %s", err.Error())
+		return nil, ERRORINVALIDPAYLOAD
+	}
+	for i, column := range header {
+		header[i] = strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")) // Byte order mark added by spreadsheets
+		if !common.StringInSlice(header[i], memberImportColumns) {
+			common.Debug("Unknown column: %s", header[i])
+			return nil, ERRORIMPORTCOLUMN
+		}
+	}
+	rows := []memberImportRow{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			common.Debug("Invalid member import: %s", err.Error())
+			return nil, ERRORINVALIDPAYLOAD
+		}
+		line, _ := reader.FieldPos(0)
+		row := memberImportRow{Row: line, Errors: []string{}}
+		for i, column := range header {
+			value := strings.TrimSpace(record[i])
+			switch column {
+			case "firstName":
+				row.Member.FirstName = value
+			case "lastName":
+				row.Member.LastName = value
+			case "email":
+				row.Member.Email = value
+			case "type":
+				row.Member.Type = value
+			case "roles":
+				// The roles are separated by commas or semicolons
+				row.Member.Roles = []string{}
+				for _, role := range strings.FieldsFunc(value, func(c rune) bool { return c == ',' || c == ';' }) {
+					if role = strings.TrimSpace(role); role != "" {
+						row.Member.Roles = append(row.Member.Roles, role)
+					}
+				}
+			case "language":
+				row.Member.Language = value
+			case "height":
+				row.Member.Height = value
+			case "weight":
+				row.Member.Weight = value
+			case "responsible":
+				row.Responsible = value
+			}
+		}
+		if row.Member.Roles == nil {
+			row.Member.Roles = []string{}
+		}
+		rows = append(rows, row)
+	}
+	return rows, ""
+}
+
+// validateMemberImport validates every row like CreateMember, checks that
+// emails are not repeated in the file and that the responsibles exist.
+// Returns true if all rows are valid.
+func validateMemberImport(ctx context.Context, rows []memberImportRow) bool {
+	valid := true
+	emails := map[string]int{}
+	for i := range rows {
+		if errorMessage := validateNewMember(ctx, &rows[i].Member); errorMessage != "" {
+			rows[i].Errors = append(rows[i].Errors, errorMessage)
+		}
+		if email := strings.ToLower(rows[i].Member.Email); email != "" {
+			if _, found := emails[email]; found {
+				rows[i].Errors = append(rows[i].Errors, ERRORIMPORTDUPLICATEEMAIL)
+			}
+			emails[email] = i
+		}
+	}
+	for i, row := range rows {
+		if row.Responsible != "" {
+			if _, found := emails[strings.ToLower(row.Responsible)]; !found {
+				responsible := model.Member{Email: row.Responsible}
+				if err := responsible.GetByEmail(ctx); err != nil {
+					common.Debug("Responsible %s not found: %s", row.Responsible, err.Error())
+					rows[i].Errors = append(rows[i].Errors, ERRORIMPORTRESPONSIBLE)
+				}
+			}
+		}
+		if len(rows[i].Errors) > 0 {
+			valid = false
+		}
+	}
+	return valid
+}
@@ -0,0 +1,472 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+const (
+	ERRORMFA                = "error with the second factor"
+	ERRORMFAINVALIDCODE     = "invalid code"
+	ERRORMFATOOMANYATTEMPTS = "too many attempts, please login again"
+	ERRORMFAALREADYENABLED  = "the second factor is already enabled"
+	ERRORMFANOTENROLLED     = "no second factor to confirm"
+	ERRORMFAREQUIRED        = "the second factor is mandatory for this member"
+)
+
+// Permissions of the tokens of the second step of the login
+const MFAPermission = "mfa"              // Send the code of the second factor
+const MFAEnrollPermission = "mfa_enroll" // Enroll a mandatory second factor
+
+// Second step of the login, in the "mfa" field of the response to Login
+const (
+	mfaStepCode       = "code_required"
+	mfaStepEnrollment = "enrollment_required"
+)
+
+const recoveryCodesCount = 10
+
+type mfaCodePayload struct {
+	Code         string `json:"code"`          // From the authenticator app
+	RecoveryCode string `json:"recovery_code"` // Instead of the code
+}
+
+type mfaStatus struct {
+	Enabled       bool `json:"enabled"`
+	Required      bool `json:"required"`
+	RecoveryCodes int  `json:"recoveryCodes"` // Left, not used yet
+}
+
+// mfaRequired returns true if the member must have a second factor to
+// login.
+func mfaRequired(member model.Member) bool {
+	return member.Type == model.MEMBERSTYPEADMIN && common.GetConfigBool("mfa.required_for_admins")
+}
+
+// mfaLoginStep returns the response to a valid password when the member
+// must use a second factor: a short-lived token to send the code, or to
+// enroll the second factor if it is mandatory. Returns nil if the member
+// gets their tokens directly.
+func mfaLoginStep(ctx context.Context, uuid string) (map[string]string, error) {
+	ctx, span := tracer.Start(ctx, "mfaLoginStep")
+	defer span.End()
+
+	member := model.Member{UUID: uuid}
+	if err := member.Get(ctx); err != nil {
+		return nil, err
+	}
+	totp := model.TOTP{MemberUUID: uuid}
+	err := totp.Get(ctx)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	step, permission := "", ""
+	switch {
+	case err == nil && totp.Enabled:
+		step, permission = mfaStepCode, MFAPermission
+	case mfaRequired(member):
+		step, permission = mfaStepEnrollment, MFAEnrollPermission
+	default:
+		return nil, nil
+	}
+	token, err := createToken(ctx, uuid, "", []string{permission}, common.GetConfigInt("mfa.token_ttl_minutes"), 0)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"mfa": step, "mfa_token": token.AccessToken}, nil
+}
+
+// mfaAttemptAllowed counts the attempts made with a token of the second
+// step, and returns false once there were too many.
+func mfaAttemptAllowed(ctx context.Context, tokenAuth *AccessTokenDetails) (bool, error) {
+	if !common.StringInBothSlices([]string{MFAPermission, MFAEnrollPermission}, tokenAuth.Permissions) {
+		return true, nil
+	}
+	key := "mfa_attempts:" + tokenAuth.TokenUuid
+	attempts, err := tokenStore.Incr(ctx, key, time.Duration(common.GetConfigInt("mfa.token_ttl_minutes"))*time.Minute)
+	if err != nil {
+		return false, err
+	}
+	return attempts <= int64(common.GetConfigInt("mfa.max_attempts")), nil
+}
+
+// mfaLoginUsername returns the username of a member for the login
+// protection of the second step, their UUID if they have no password.
+func mfaLoginUsername(ctx context.Context, uuid string) (string, error) {
+	credentials := model.Credentials{UUID: uuid}
+	if err := credentials.GetCredentialsByUUID(ctx); err != nil {
+		if err == sql.ErrNoRows {
+			return uuid, nil
+		}
+		return "", err
+	}
+	return credentials.Username, nil
+}
+
+// verifySecondFactor checks a code of the authenticator app, or a recovery
+// code. Each code can only be used once.
+func verifySecondFactor(ctx context.Context, uuid string, payload mfaCodePayload) (bool, error) {
+	if payload.RecoveryCode != "" {
+		code := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(payload.RecoveryCode), "-", ""))
+		return model.UseRecoveryCode(ctx, uuid, common.HashToken(code))
+	}
+	totp := model.TOTP{MemberUUID: uuid}
+	if err := totp.Get(ctx); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	step := common.ValidateTOTP(totp.Secret, payload.Code, time.Now())
+	if !totp.Enabled || step < 0 {
+		return false, nil
+	}
+	return totp.UseStep(ctx, step)
+}
+
+// newRecoveryCodes returns new recovery codes, and their hashes to store.
+func newRecoveryCodes() ([]string, []string) {
+	codes := make([]string, recoveryCodesCount)
+	hashes := make([]string, recoveryCodesCount)
+	for i := range codes {
+		codes[i] = common.GenerateCode()
+		hashes[i] = common.HashToken(codes[i])
+	}
+	return codes, hashes
+}
+
+// readSecondFactor reads and verifies the code of the request. Responds
+// with an error and returns false if it is not valid.
+func readSecondFactor(ctx context.Context, w http.ResponseWriter, r *http.Request, tokenAuth *AccessTokenDetails) bool {
+	var payload mfaCodePayload
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&payload); err != nil {
+		common.Debug("Invalid request payload: %s", err.Error())
+		RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+		return false
+	}
+	defer r.Body.Close()
+	// Another login gives a new token, the wrong codes of the second step of
+	// the login are also counted for the member, like wrong passwords
+	loginStep := common.StringInBothSlices([]string{MFAPermission, MFAEnrollPermission}, tokenAuth.Permissions)
+	username, ip := "", clientIP(r)
+	if loginStep {
+		var err error
+		if username, err = mfaLoginUsername(ctx, tokenAuth.UserId); err != nil {
+			common.Warn("Error getting credentials: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORMFA)
+			return false
+		}
+		if !loginAllowed(ctx, w, username, ip) {
+			return false
+		}
+	}
+	allowed, err := mfaAttemptAllowed(ctx, tokenAuth)
+	if err != nil {
+		common.Warn("Error counting second factor attempts: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORMFA)
+		return false
+	}
+	if !allowed {
+		common.Info("Too many second factor attempts for member %s", tokenAuth.UserId)
+		RespondWithError(w, http.StatusUnauthorized, ERRORMFATOOMANYATTEMPTS)
+		return false
+	}
+	valid, err := verifySecondFactor(ctx, tokenAuth.UserId, payload)
+	if err != nil {
+		common.Warn("Error verifying the second factor: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORMFA)
+		return false
+	}
+	if !valid {
+		common.Info("Invalid second factor for member %s", tokenAuth.UserId)
+		if loginStep {
+			loginFailed(ctx, username, ip, tokenAuth.UserId)
+		}
+		RespondWithError(w, http.StatusUnauthorized, ERRORMFAINVALIDCODE)
+		return false
+	}
+	if loginStep {
+		loginSucceeded(ctx, username)
+	}
+	return true
+}
+
+// LoginMFA is the second step of the login of a member with a second
+// factor: it takes the token returned by Login and a code, and returns the
+// access and refresh tokens.
+func LoginMFA(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "LoginMFA")
+	defer span.End()
+
+	tokenAuth, err := ExtractToken(ctx, r)
+	if err != nil {
+		common.Warn("Error reading token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAUTHENTICATION)
+		return
+	}
+	if !readSecondFactor(ctx, w, r, tokenAuth) {
+		return
+	}
+	tokens, err := createMemberToken(ctx, tokenAuth.UserId, newSession(r))
+	if err != nil {
+		common.Warn("Error creating the token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORCREATETOKEN)
+		return
+	}
+	// The token of the second step is only used once
+	if _, err := deleteTokenInCache(ctx, tokenAuth.RefreshUuid); err != nil {
+		common.Warn("Error deleting token in cache: %s", err.Error())
+	}
+	RespondWithJSON(w, http.StatusOK, tokens)
+}
+
+// GetMFA returns whether the second factor of the member is enabled or
+// mandatory, and the number of recovery codes left.
+func GetMFA(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "GetMFA")
+	defer span.End()
+
+	tokenAuth, err := ExtractToken(ctx, r)
+	if err != nil {
+		common.Warn("Error reading token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAUTHENTICATION)
+		return
+	}
+	member := model.Member{UUID: tokenAuth.UserId}
+	if err := member.Get(ctx); err != nil {
+		common.Warn("Error getting member: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORGETMEMBER)
+		return
+	}
+	status := mfaStatus{Required: mfaRequired(member)}
+	totp := model.TOTP{MemberUUID: member.UUID}
+	if err := totp.Get(ctx); err != nil && err != sql.ErrNoRows {
+		common.Warn("Error getting the second factor: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORMFA)
+		return
+	}
+	status.Enabled = totp.Enabled
+	if status.RecoveryCodes, err = model.CountRecoveryCodes(ctx, member.UUID); err != nil {
+		common.Warn("Error counting recovery codes: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORMFA)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, status)
+}
+
+// EnrollMFA starts the enrollment of a second factor: it returns a new
+// secret, and the otpauth URL to show as a QR code. The second factor is
+// enabled by ConfirmMFA.
+func EnrollMFA(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "EnrollMFA")
+	defer span.End()
+
+	tokenAuth, err := ExtractToken(ctx, r)
+	if err != nil {
+		common.Warn("Error reading token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAUTHENTICATION)
+		return
+	}
+	totp := model.TOTP{MemberUUID: tokenAuth.UserId}
+	if err := totp.Get(ctx); err != nil && err != sql.ErrNoRows {
+		common.Warn("Error getting the second factor: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORMFA)
+		return
+	}
+	if totp.Enabled {
+		RespondWithError(w, http.StatusConflict, ERRORMFAALREADYENABLED)
+		return
+	}
+	credentials := model.Credentials{UUID: tokenAuth.UserId}
+	if err := credentials.GetCredentialsByUUID(ctx); err != nil {
+		common.Warn("Error getting credentials: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORMFA)
+		return
+	}
+	totp.Secret = common.GenerateTOTPSecret()
+	if err := totp.CreatePending(ctx); err != nil {
+		common.Warn("Error creating the second factor: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORMFA)
+		return
+	}
+	RespondWithJSON(w, http.StatusCreated, map[string]string{
+		"secret": totp.Secret,
+		"url":    common.TOTPURL(common.GetConfigString("mfa.issuer"), credentials.Username, totp.Secret),
+	})
+}
+
+// ConfirmMFA enables the second factor being enrolled with a first code,
+// and returns the recovery codes, only shown once. When the enrollment is
+// the second step of the login, the access and refresh tokens are returned
+// too.
+func ConfirmMFA(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "ConfirmMFA")
+	defer span.End()
+
+	tokenAuth, err := ExtractToken(ctx, r)
+	if err != nil {
+		common.Warn("Error reading token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAUTHENTICATION)
+		return
+	}
+	var payload mfaCodePayload
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&payload); err != nil {
+		common.Debug("Invalid request payload: %s", err.Error())
+		RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+		return
+	}
+	defer r.Body.Close()
+	totp := model.TOTP{MemberUUID: tokenAuth.UserId}
+	if err := totp.Get(ctx); err != nil {
+		if err == sql.ErrNoRows {
+			RespondWithError(w, http.StatusBadRequest, ERRORMFANOTENROLLED)
+			return
+		}
+		common.Warn("Error getting the second factor: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORMFA)
+		return
+	}
+	if totp.Enabled {
+		RespondWithError(w, http.StatusConflict, ERRORMFAALREADYENABLED)
+		return
+	}
+	allowed, err := mfaAttemptAllowed(ctx, tokenAuth)
+	if err != nil {
+		common.Warn("Error counting second factor attempts: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORMFA)
+		return
+	}
+	if !allowed {
+		RespondWithError(w, http.StatusUnauthorized, ERRORMFATOOMANYATTEMPTS)
+		return
+	}
+	step := common.ValidateTOTP(totp.Secret, payload.Code, time.Now())
+	if step < 0 {
+		RespondWithError(w, http.StatusBadRequest, ERRORMFAINVALIDCODE)
+		return
+	}
+	codes, hashes := newRecoveryCodes()
+	if err := totp.Enable(ctx, step, hashes); err != nil {
+		common.Warn("Error enabling the second factor: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORMFA)
+		return
+	}
+	common.Info("Second factor enabled for member %s", tokenAuth.UserId)
+	response := map[string]interface{}{"recovery_codes": codes}
+	if common.StringInSlice(MFAEnrollPermission, tokenAuth.Permissions) {
+		tokens, err := createMemberToken(ctx, tokenAuth.UserId, newSession(r))
+		if err != nil {
+			common.Warn("Error creating the token: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORCREATETOKEN)
+			return
+		}
+		if _, err := deleteTokenInCache(ctx, tokenAuth.RefreshUuid); err != nil {
+			common.Warn("Error deleting token in cache: %s", err.Error())
+		}
+		for name, token := range tokens {
+			response[name] = token
+		}
+	}
+	RespondWithJSON(w, http.StatusOK, response)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the member, after
+// checking a code.
+func RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "RegenerateRecoveryCodes")
+	defer span.End()
+
+	tokenAuth, err := ExtractToken(ctx, r)
+	if err != nil {
+		common.Warn("Error reading token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAUTHENTICATION)
+		return
+	}
+	if !readSecondFactor(ctx, w, r, tokenAuth) {
+		return
+	}
+	codes, hashes := newRecoveryCodes()
+	if err := model.SetRecoveryCodes(ctx, tokenAuth.UserId, hashes); err != nil {
+		common.Warn("Error setting recovery codes: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORMFA)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, map[string][]string{"recovery_codes": codes})
+}
+
+// DisableMFA removes the second factor of the member, after checking a
+// code, unless it is mandatory for them.
+func DisableMFA(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "DisableMFA")
+	defer span.End()
+
+	tokenAuth, err := ExtractToken(ctx, r)
+	if err != nil {
+		common.Warn("Error reading token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAUTHENTICATION)
+		return
+	}
+	member := model.Member{UUID: tokenAuth.UserId}
+	if err := member.Get(ctx); err != nil {
+		common.Warn("Error getting member: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORGETMEMBER)
+		return
+	}
+	if mfaRequired(member) {
+		RespondWithError(w, http.StatusBadRequest, ERRORMFAREQUIRED)
+		return
+	}
+	if !readSecondFactor(ctx, w, r, tokenAuth) {
+		return
+	}
+	totp := model.TOTP{MemberUUID: member.UUID}
+	if err := totp.Delete(ctx); err != nil {
+		common.Warn("Error deleting the second factor: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORMFA)
+		return
+	}
+	common.Info("Second factor disabled by member %s", member.UUID)
+	RespondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// ResetMemberMFA lets an admin remove the second factor of a member who
+// lost it and their recovery codes. If it is mandatory, the member enrolls
+// a new one at their next login.
+func ResetMemberMFA(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "ResetMemberMFA")
+	defer span.End()
+
+	vars := mux.Vars(r)
+	member := model.Member{UUID: vars["member_uuid"]}
+	if err := member.Get(ctx); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			RespondWithError(w, http.StatusNotFound, ERRORMEMBERNOTFOUND)
+		default:
+			common.Warn("Error getting member: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORGETMEMBER)
+		}
+		return
+	}
+	totp := model.TOTP{MemberUUID: member.UUID}
+	if err := totp.Delete(ctx); err != nil {
+		common.Warn("Error deleting the second factor: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORMFA)
+		return
+	}
+	if tokenAuth, err := ExtractToken(ctx, r); err == nil {
+		common.Info("Second factor of member %s reset by %s", totp.MemberUUID, tokenAuth.UserId)
+	}
+	RespondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
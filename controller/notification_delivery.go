@@ -0,0 +1,126 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/mail"
+	"github.com/vilisseranen/castellers/model"
+)
+
+// notificationDelivery sends a notification to its recipients and records
+// the result for each of them, so a failed email is retried with an
+// exponential backoff, only to the members who did not receive it.
+type notificationDelivery struct {
+	notification *model.Notification
+	recipients   map[string]model.NotificationRecipient // By member
+	current      map[string]bool                        // Recipients of this attempt
+	now          int64
+	lastError    string
+}
+
+func newNotificationDelivery(ctx context.Context, notification *model.Notification) (*notificationDelivery, error) {
+	recipients, err := notification.GetRecipients(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &notificationDelivery{
+		notification: notification,
+		recipients:   recipients,
+		current:      map[string]bool{},
+		now:          time.Now().Unix(),
+	}, nil
+}
+
+// notificationRetryDelay returns the time to wait after a number of failed
+// attempts: notification_retry.delay_seconds, doubled after each attempt,
+// up to notification_retry.max_delay_seconds.
+func notificationRetryDelay(attempts int) int64 {
+	delay := int64(common.GetConfigInt("notification_retry.delay_seconds"))
+	maxDelay := int64(common.GetConfigInt("notification_retry.max_delay_seconds"))
+	for i := 1; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		return maxDelay
+	}
+	return delay
+}
+
+// send calls sendTo to send the notification to the member, unless they
+// already received it or their next attempt is later. A failure is retried
+// unless it is permanent or the member reached
+// notification_retry.max_attempts.
+func (d *notificationDelivery) send(ctx context.Context, memberUUID string, sendTo func() error) {
+	d.sendChanges(ctx, memberUUID, 0, sendTo)
+}
+
+// sendChanges is send for the late participation changes up to
+// lastChangeID, recorded with the delivery to the member.
+func (d *notificationDelivery) sendChanges(ctx context.Context, memberUUID string, lastChangeID int64, sendTo func() error) {
+	d.current[memberUUID] = true
+	recipient, found := d.recipients[memberUUID]
+	if !found {
+		recipient = model.NotificationRecipient{NotificationID: d.notification.ID, MemberUUID: memberUUID}
+	}
+	if recipient.Delivered != model.NotificationNotDelivered || recipient.NextAttemptAt > d.now {
+		return
+	}
+	recipient.LastChangeID = lastChangeID
+	if err := sendTo(); err != nil {
+		common.Error("Error sending notification %d to %s: %v\n", d.notification.ID, memberUUID, err)
+		recipient.Attempts++
+		recipient.LastError = err.Error()
+		d.lastError = recipient.LastError
+		if mail.IsPermanent(err) || recipient.Attempts >= common.GetConfigInt("notification_retry.max_attempts") {
+			recipient.Delivered = model.NotificationDeliveryFailure
+		} else {
+			recipient.NextAttemptAt = d.now + notificationRetryDelay(recipient.Attempts)
+		}
+	} else {
+		recipient.Delivered = model.NotificationDeliverySuccess
+	}
+	if err := recipient.Save(ctx); err != nil {
+		common.Error("%v\n", err)
+	}
+	d.recipients[memberUUID] = recipient
+}
+
+// finish sets the status of the notification from its recipients. It is
+// not delivered while some of them wait for a retry, then it is a success,
+// a failure or a partial failure. The recipients of the previous attempts
+// who are not recipients anymore, e.g. deleted members, are left out.
+func (d *notificationDelivery) finish(ctx context.Context) {
+	succeeded, failed := 0, 0
+	var nextAttempt int64
+	for memberUUID, recipient := range d.recipients {
+		switch recipient.Delivered {
+		case model.NotificationDeliverySuccess:
+			succeeded++
+		case model.NotificationDeliveryFailure:
+			failed++
+		default:
+			if d.current[memberUUID] && (nextAttempt == 0 || recipient.NextAttemptAt < nextAttempt) {
+				nextAttempt = recipient.NextAttemptAt
+			}
+		}
+	}
+	n := d.notification
+	if d.lastError != "" {
+		n.Attempts++
+		n.LastError = d.lastError
+	}
+	n.NextAttemptAt = nextAttempt
+	if nextAttempt != 0 {
+		n.Delivered = model.NotificationNotDelivered
+		common.Info("Notification %d will be sent again at %d", n.ID, nextAttempt)
+	} else if failed == 0 {
+		n.Delivered = model.NotificationDeliverySuccess
+	} else if succeeded == 0 {
+		n.Delivered = model.NotificationDeliveryFailure
+	} else {
+		n.Delivered = model.NotificationDeliveryPartialFailure
+	}
+	n.UpdateNotificationStatus(ctx)
+}
@@ -0,0 +1,308 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+const (
+	ERROROIDCDISABLED      = "login with an external account is disabled"
+	ERROROIDC              = "error with the external account"
+	ERROROIDCSTATE         = "invalid or expired login, please try again"
+	ERROROIDCEMAILNOTFOUND = "no member with the email of this account"
+	ERROROIDCEMAIL         = "the email of this account is not verified"
+	ERROROIDCUNLINKED      = "this account was unlinked from the member, ask an admin"
+)
+
+const oidcStateTTL = 10 * time.Minute
+
+// The provider is discovered at the first login, and again if the issuer
+// changes.
+var oidcProvider struct {
+	sync.Mutex
+	issuer   string
+	provider *oidc.Provider
+}
+
+type oidcCallbackPayload struct {
+	Code     string `json:"code"`
+	State    string `json:"state"`
+	Verifier string `json:"verifier"`
+}
+
+// oidcLoginState is saved with the state of a login. The verifier is only
+// known by the browser that started the login, so that a code cannot be
+// finished by another one.
+type oidcLoginState struct {
+	Nonce        string `json:"nonce"`
+	VerifierHash string `json:"verifier_hash"`
+}
+
+type oidcClaims struct {
+	Email         string `json:"email"`
+	Nonce         string `json:"nonce"`
+	EmailVerified bool   `json:"-"` // From oidc.email_verified_claim
+}
+
+// emailVerified reads oidc.email_verified_claim, true or "true" if the
+// provider verified the email. Without a claim configured, every email is
+// trusted.
+func emailVerified(claims map[string]interface{}) bool {
+	name := common.GetConfigString("oidc.email_verified_claim")
+	if name == "" {
+		return true
+	}
+	switch verified := claims[name].(type) {
+	case bool:
+		return verified
+	case string:
+		return verified == "true"
+	}
+	return false
+}
+
+func getOIDCProvider(ctx context.Context) (*oidc.Provider, error) {
+	issuer := common.GetConfigString("oidc.issuer")
+	oidcProvider.Lock()
+	defer oidcProvider.Unlock()
+	if oidcProvider.provider == nil || oidcProvider.issuer != issuer {
+		provider, err := oidc.NewProvider(ctx, issuer)
+		if err != nil {
+			return nil, err
+		}
+		oidcProvider.issuer, oidcProvider.provider = issuer, provider
+	}
+	return oidcProvider.provider, nil
+}
+
+func oidcConfig(provider *oidc.Provider) *oauth2.Config {
+	redirectURL := common.GetConfigString("oidc.redirect_url")
+	if redirectURL == "" {
+		redirectURL = common.GetConfigString("domain") + "/login/oidc"
+	}
+	return &oauth2.Config{
+		ClientID:     common.GetConfigString("oidc.client_id"),
+		ClientSecret: common.GetConfigString("oidc.client_secret"),
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  redirectURL,
+		Scopes:       strings.Split(common.GetConfigString("oidc.scopes"), ","),
+	}
+}
+
+// StartOIDCLogin returns the URL of the provider where the member logs in,
+// and the PKCE verifier of the login, kept by the browser. The provider then
+// redirects them to oidc.redirect_url with a code and a state, sent to
+// FinishOIDCLogin with the verifier.
+func StartOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "StartOIDCLogin")
+	defer span.End()
+
+	if !common.GetConfigBool("oidc.enabled") {
+		RespondWithError(w, http.StatusForbidden, ERROROIDCDISABLED)
+		return
+	}
+	provider, err := getOIDCProvider(ctx)
+	if err != nil {
+		common.Warn("Error discovering the OpenID Connect provider: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERROROIDC)
+		return
+	}
+	state, verifier := common.GenerateToken(), oauth2.GenerateVerifier()
+	loginState := oidcLoginState{Nonce: common.GenerateToken(), VerifierHash: common.HashToken(verifier)}
+	value, _ := json.Marshal(loginState)
+	if err := tokenStore.Set(ctx, "oidc_state:"+state, string(value), oidcStateTTL); err != nil {
+		common.Warn("Error saving the state: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERROROIDC)
+		return
+	}
+	url := oidcConfig(provider).AuthCodeURL(state, oidc.Nonce(loginState.Nonce), oauth2.S256ChallengeOption(verifier))
+	RespondWithJSON(w, http.StatusOK, map[string]string{"url": url, "verifier": verifier})
+}
+
+// FinishOIDCLogin exchanges the code returned by the provider for the ID
+// token of the account, and logs in the member linked to it, with the same
+// response as Login. At the first login, the account is linked to the
+// member with its email, if the provider verified it.
+func FinishOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "FinishOIDCLogin")
+	defer span.End()
+
+	if !common.GetConfigBool("oidc.enabled") {
+		RespondWithError(w, http.StatusForbidden, ERROROIDCDISABLED)
+		return
+	}
+	var payload oidcCallbackPayload
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&payload); err != nil {
+		common.Debug("Invalid request payload: %s", err.Error())
+		RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+		return
+	}
+	defer r.Body.Close()
+	// The state can only be used once, by the browser that started the login
+	var loginState oidcLoginState
+	value, err := tokenStore.Get(ctx, "oidc_state:"+payload.State)
+	if err == nil {
+		var deleted int64
+		if deleted, err = deleteTokenInCache(ctx, "oidc_state:"+payload.State); err == nil && deleted == 0 {
+			err = errors.New("state already used")
+		}
+	}
+	if err == nil {
+		err = json.Unmarshal([]byte(value), &loginState)
+	}
+	if err == nil && (payload.Verifier == "" || common.HashToken(payload.Verifier) != loginState.VerifierHash) {
+		err = errors.New("wrong verifier")
+	}
+	if err != nil {
+		common.Info("Unknown OpenID Connect state: %s", err.Error())
+		RespondWithError(w, http.StatusBadRequest, ERROROIDCSTATE)
+		return
+	}
+	provider, err := getOIDCProvider(ctx)
+	if err != nil {
+		common.Warn("Error discovering the OpenID Connect provider: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERROROIDC)
+		return
+	}
+	token, err := oidcConfig(provider).Exchange(ctx, payload.Code, oauth2.VerifierOption(payload.Verifier))
+	if err != nil {
+		common.Info("Error exchanging the OpenID Connect code: %s", err.Error())
+		RespondWithError(w, http.StatusUnauthorized, ERROROIDC)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		common.Info("No ID token in the OpenID Connect response")
+		RespondWithError(w, http.StatusUnauthorized, ERROROIDC)
+		return
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: common.GetConfigString("oidc.client_id")}).Verify(ctx, rawIDToken)
+	if err != nil {
+		common.Info("Invalid ID token: %s", err.Error())
+		RespondWithError(w, http.StatusUnauthorized, ERROROIDC)
+		return
+	}
+	var claims oidcClaims
+	var allClaims map[string]interface{}
+	err = idToken.Claims(&claims)
+	if err == nil {
+		err = idToken.Claims(&allClaims)
+	}
+	if err != nil || claims.Nonce != loginState.Nonce {
+		common.Info("Invalid claims in the ID token: %v", err)
+		RespondWithError(w, http.StatusUnauthorized, ERROROIDC)
+		return
+	}
+	claims.EmailVerified = emailVerified(allClaims)
+
+	identity := model.OIDCIdentity{Issuer: idToken.Issuer, Subject: idToken.Subject}
+	if err := identity.Get(ctx); err != nil {
+		if err != sql.ErrNoRows {
+			common.Warn("Error getting the linked account: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERROROIDC)
+			return
+		}
+		var linked bool
+		if identity.MemberUUID, linked = linkOIDCIdentity(ctx, w, identity, claims); !linked {
+			return
+		}
+	}
+	member := model.Member{UUID: identity.MemberUUID}
+	err = member.Get(ctx)
+	if err != nil && err != sql.ErrNoRows {
+		common.Warn("Error getting member: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORGETMEMBER)
+		return
+	}
+	if err == sql.ErrNoRows {
+		// Like the password login, the credentials of whom are deleted
+		common.Info("Member %s of the account %s is deleted", identity.MemberUUID, identity.Subject)
+		RespondWithError(w, http.StatusUnauthorized, ERRORUNAUTHORIZED)
+		return
+	}
+	if !oidcCanLogin(w, member) {
+		return
+	}
+	common.Info("Member %s logged in with the account %s of %s", member.UUID, identity.Subject, identity.Issuer)
+	respondLoginTokens(ctx, w, r, member.UUID)
+}
+
+// linkOIDCIdentity links an account to the member with its email, and
+// returns the member. Responds with an error and returns false if there is
+// none, or if an admin unlinked the account.
+func linkOIDCIdentity(ctx context.Context, w http.ResponseWriter, identity model.OIDCIdentity, claims oidcClaims) (string, bool) {
+	unlinked, err := identity.Unlinked(ctx)
+	if err != nil {
+		common.Warn("Error getting the unlinked accounts: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERROROIDC)
+		return "", false
+	}
+	if unlinked {
+		common.Info("Account %s of %s was unlinked, not linked again", identity.Subject, identity.Issuer)
+		RespondWithError(w, http.StatusUnauthorized, ERROROIDCUNLINKED)
+		return "", false
+	}
+	if !claims.EmailVerified || claims.Email == "" {
+		common.Info("Email of the account %s not verified", identity.Subject)
+		RespondWithError(w, http.StatusUnauthorized, ERROROIDCEMAIL)
+		return "", false
+	}
+	member := model.Member{Email: claims.Email}
+	if err := member.GetByEmail(ctx); err != nil {
+		common.Info("No member for the account %s: %s", identity.Subject, err.Error())
+		RespondWithError(w, http.StatusUnauthorized, ERROROIDCEMAILNOTFOUND)
+		return "", false
+	}
+	if !oidcCanLogin(w, member) {
+		return "", false
+	}
+	identity.MemberUUID = member.UUID
+	if err := identity.Create(ctx); err != nil {
+		common.Warn("Error linking the account: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERROROIDC)
+		return "", false
+	}
+	common.Info("Account %s of %s linked to member %s", identity.Subject, identity.Issuer, member.UUID)
+	return member.UUID, true
+}
+
+// oidcCanLogin responds with an error and returns false if the member
+// cannot login, like the guests.
+func oidcCanLogin(w http.ResponseWriter, member model.Member) bool {
+	if member.Type != model.MEMBERSTYPEREGULAR && member.Type != model.MEMBERSTYPEADMIN {
+		RespondWithError(w, http.StatusForbidden, ERRORGUESTCANNOTLOGIN)
+		return false
+	}
+	return true
+}
+
+// UnlinkMemberOIDC lets an admin unlink the external accounts of a member,
+// e.g. if one was compromised. These accounts are not linked again with
+// the email of the member, only other accounts are.
+func UnlinkMemberOIDC(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "UnlinkMemberOIDC")
+	defer span.End()
+
+	member := model.Member{UUID: mux.Vars(r)["member_uuid"]}
+	unlinked, err := member.UnlinkOIDCIdentities(ctx)
+	if err != nil {
+		common.Warn("Error unlinking accounts: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERROROIDC)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, map[string]int64{"unlinked": unlinked})
+}
@@ -1,6 +1,8 @@
 package controller
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"net/http"
@@ -15,6 +17,7 @@ const (
 	ERRORPARTICIPATEEVENT = "Error setting participation to event"
 	ERRORPRESENCEEVENT    = "Error setting presence to event"
 	ERRORGETPARTICIPATION = "Error getting participation"
+	ERRORANSWERDEADLINE   = "The answers to this event are closed"
 )
 
 func ParticipateEvent(w http.ResponseWriter, r *http.Request) {
@@ -84,6 +87,14 @@ func ParticipateEvent(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	// After the deadline, only admins can still change an answer
+	isAdmin := common.StringInSlice(model.MEMBERSTYPEADMIN, tokenAuth.Permissions)
+	lateChange := event.AnswersClosed()
+	if lateChange && !isAdmin {
+		common.Debug("Answers to event %s closed at %d", event.UUID, event.AnswerDeadline)
+		RespondWithError(w, http.StatusForbidden, ERRORANSWERDEADLINE)
+		return
+	}
 	if err := member.Get(ctx); err != nil {
 		common.Warn("Error getting Member: %s", err.Error())
 		RespondWithError(w, http.StatusInternalServerError, ERRORPARTICIPATEEVENT)
@@ -113,6 +124,19 @@ func ParticipateEvent(w http.ResponseWriter, r *http.Request) {
 		RespondWithError(w, http.StatusInternalServerError, ERRORPARTICIPATEEVENT)
 		return
 	}
+	if lateChange {
+		if err := recordLateParticipationChange(ctx, event, p, tokenAuth.UserId); err != nil {
+			common.Warn("Error recording late participation change: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORPARTICIPATEEVENT)
+			return
+		}
+	}
+	// A place might have been freed
+	if err := promoteFromWaitingList(ctx, event); err != nil {
+		common.Warn("Error promoting members from the waiting list: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORPARTICIPATEEVENT)
+		return
+	}
 	// Reward members who confirm a participation themselves (or a parent doing
 	// it for a dependent) with the Amunt badge. Best-effort and idempotent.
 	if awardEligible {
@@ -123,7 +147,7 @@ func ParticipateEvent(w http.ResponseWriter, r *http.Request) {
 	inactive_delay_future := uint(time.Now().Unix()) + uint(common.GetConfigInt("inactive_delay_days"))*3600*24
 	if p.Answer == common.AnswerYes && member.Status == model.MEMBERSSTATUSPAUSED &&
 		event.StartDate >= inactive_delay_past && event.StartDate <= inactive_delay_future {
-		err = member.SetStatus(ctx, model.MEMBERSSTATUSACTIVATED)
+		err = member.SetStatus(ctx, model.MEMBERSSTATUSACTIVATED, model.STATUSCAUSEPARTICIPATION)
 		if err != nil {
 			common.Warn("Error activating member: %v", member)
 			RespondWithError(w, http.StatusInternalServerError, ERRORACTIVATINGMEMBER)
@@ -191,7 +215,7 @@ func PresenceEvent(w http.ResponseWriter, r *http.Request) {
 	inactive_delay_future := uint(time.Now().Unix()) + uint(common.GetConfigInt("inactive_delay_days"))*3600*24
 	if p.Presence == common.AnswerYes && member.Status == model.MEMBERSSTATUSPAUSED &&
 		event.StartDate >= inactive_delay_past && event.StartDate <= inactive_delay_future {
-		err := member.SetStatus(ctx, model.MEMBERSSTATUSACTIVATED)
+		err := member.SetStatus(ctx, model.MEMBERSSTATUSACTIVATED, model.STATUSCAUSEPARTICIPATION)
 		if err != nil {
 			common.Warn("Error activating member: %v", member)
 			RespondWithError(w, http.StatusInternalServerError, ERRORACTIVATINGMEMBER)
@@ -209,26 +233,62 @@ func GetEventParticipation(w http.ResponseWriter, r *http.Request) {
 	memberStatusList := memberStatusListFromQuery(r.FormValue("status"))
 	memberTypeList := memberTypeListFromQuery(r.FormValue("type"))
 	m := model.Member{}
-	members, err := m.GetAll(ctx, memberStatusList, memberTypeList)
+	members, err := m.GetAllWithParticipation(ctx, eventUUID, memberStatusList, memberTypeList)
 	if err != nil {
-		common.Warn("Error getting members: %s", err.Error())
+		common.Warn("Error getting participation: %s", err.Error())
 		RespondWithError(w, http.StatusInternalServerError, ERRORGETPARTICIPATION)
 		return
 	}
-	for index, member := range members {
-		p := model.Participation{EventUUID: eventUUID, MemberUUID: member.UUID}
-		if err := p.GetParticipation(r.Context()); err != nil {
-			switch err {
-			case sql.ErrNoRows:
-				continue
-			default:
-				common.Warn("Error getting participation: %s", err.Error())
-				RespondWithError(w, http.StatusInternalServerError, ERRORGETPARTICIPATION)
-				return
-			}
-		}
-		members[index].Participation = p.Answer
-		members[index].Presence = p.Presence
-	}
 	RespondWithJSON(w, http.StatusOK, members)
 }
+
+// promoteFromWaitingList gives the free places of an event to the members of
+// its waiting list and queues a notification to let them know.
+func promoteFromWaitingList(ctx context.Context, event model.Event) error {
+	promoted, err := model.PromoteFromWaitingList(ctx, event.UUID)
+	if err != nil {
+		return err
+	}
+	if len(promoted) == 0 {
+		return nil
+	}
+	common.Info("Members %v promoted from the waiting list of event %s", promoted, event.UUID)
+	if event.StartDate < uint(time.Now().Unix()) { // Do not send emails for events in the past
+		return nil
+	}
+	payloadBytes := new(bytes.Buffer)
+	json.NewEncoder(payloadBytes).Encode(model.WaitingListPromotedPayload{MemberUUIDs: promoted})
+	n := model.Notification{
+		NotificationType: model.TypeWaitingListPromoted,
+		ObjectUUID:       event.UUID,
+		SendDate:         int(time.Now().Unix()),
+		Payload:          payloadBytes.Bytes(),
+	}
+	return n.CreateNotification(ctx)
+}
+
+// recordLateParticipationChange keeps track of an answer changed by an admin
+// after the answer deadline and queues a notification for the admins. The
+// notification sends all the changes not sent yet, so several changes made
+// close together end up in the same email.
+func recordLateParticipationChange(ctx context.Context, event model.Event, p model.Participation, authorUUID string) error {
+	change := model.LateParticipationChange{
+		EventUUID:  event.UUID,
+		MemberUUID: p.MemberUUID,
+		AuthorUUID: authorUUID,
+		Answer:     p.Answer,
+	}
+	if err := change.CreateLateParticipationChange(ctx); err != nil {
+		return err
+	}
+	common.Info("Member %s changed the answer of %s to event %s after the deadline", authorUUID, p.MemberUUID, event.UUID)
+	if event.StartDate < uint(time.Now().Unix()) { // Do not send emails for events in the past
+		return nil
+	}
+	n := model.Notification{
+		NotificationType: model.TypeLateParticipationChanges,
+		ObjectUUID:       event.UUID,
+		SendDate:         int(time.Now().Unix()),
+	}
+	return n.CreateNotification(ctx)
+}
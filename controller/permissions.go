@@ -0,0 +1,197 @@
+package controller
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+const (
+	ERRORGETPERMISSIONSETS     = "error getting the permission sets"
+	ERRORSAVEPERMISSIONSET     = "error saving the permission set"
+	ERRORDELETEPERMISSIONSET   = "error deleting the permission set"
+	ERRORPERMISSIONSETNOTFOUND = "permission set not found"
+	ERRORPERMISSIONSETNAME     = "error with the name of the permission set"
+	ERRORINVALIDPERMISSIONS    = "error with the permissions provided"
+	ERRORSETPERMISSIONSETS     = "error assigning the permission sets"
+)
+
+var permissionSetNameRegexp = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+type permissionsList struct {
+	Permissions []string              `json:"permissions"` // Every permission that can be in a set
+	Sets        []model.PermissionSet `json:"sets"`
+}
+
+type memberPermissionSetsPayload struct {
+	Sets []string `json:"sets"`
+}
+
+// hasPermission returns true if the token is an admin token or carries the
+// permission.
+func hasPermission(tokenAuth *AccessTokenDetails, permission string) bool {
+	return common.StringInSlice(model.MEMBERSTYPEADMIN, tokenAuth.Permissions) ||
+		common.StringInSlice(permission, tokenAuth.Permissions)
+}
+
+// GetPermissions returns the permissions that can be given to members and
+// the permission sets.
+func GetPermissions(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "GetPermissions")
+	defer span.End()
+
+	sets, err := model.GetPermissionSets(ctx)
+	if err != nil {
+		common.Warn("Error getting permission sets: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORGETPERMISSIONSETS)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, permissionsList{Permissions: model.ValidPermissions, Sets: sets})
+}
+
+// SavePermissionSet creates a permission set, or replaces its permissions.
+// The members it is assigned to get the new permissions at their next
+// login or token refresh.
+func SavePermissionSet(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "SavePermissionSet")
+	defer span.End()
+
+	vars := mux.Vars(r)
+	set := model.PermissionSet{Name: vars["name"]}
+	var payload model.PermissionSet
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&payload); err != nil {
+		common.Debug("Invalid request payload: %s", err.Error())
+		RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+		return
+	}
+	defer r.Body.Close()
+	if !permissionSetNameRegexp.MatchString(set.Name) {
+		common.Debug("Invalid permission set name: %s", set.Name)
+		RespondWithError(w, http.StatusBadRequest, ERRORPERMISSIONSETNAME)
+		return
+	}
+	if err := model.ValidatePermissions(payload.Permissions); err != nil {
+		common.Debug("Invalid permissions: %v", payload.Permissions)
+		RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPERMISSIONS)
+		return
+	}
+	set.Permissions = payload.Permissions
+	if set.Permissions == nil {
+		set.Permissions = []string{}
+	}
+	if err := set.Save(ctx); err != nil {
+		common.Warn("Error saving permission set: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORSAVEPERMISSIONSET)
+		return
+	}
+	common.Info("Permission set %s saved with permissions %v", set.Name, set.Permissions)
+	RespondWithJSON(w, http.StatusOK, set)
+}
+
+// DeletePermissionSet deletes a permission set and removes it from the
+// members it was assigned to.
+func DeletePermissionSet(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "DeletePermissionSet")
+	defer span.End()
+
+	vars := mux.Vars(r)
+	set := model.PermissionSet{Name: vars["name"]}
+	if err := set.Delete(ctx); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			common.Debug("Permission set not found: %s", set.Name)
+			RespondWithError(w, http.StatusNotFound, ERRORPERMISSIONSETNOTFOUND)
+		default:
+			common.Warn("Error deleting permission set: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORDELETEPERMISSIONSET)
+		}
+		return
+	}
+	common.Info("Permission set %s deleted", set.Name)
+	RespondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// GetMemberPermissionSets returns the names of the permission sets assigned
+// to a member.
+func GetMemberPermissionSets(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "GetMemberPermissionSets")
+	defer span.End()
+
+	vars := mux.Vars(r)
+	m := model.Member{UUID: vars["member_uuid"]}
+	sets, err := m.GetPermissionSets(ctx)
+	if err != nil {
+		common.Warn("Error getting permission sets: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORGETPERMISSIONSETS)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, memberPermissionSetsPayload{Sets: sets})
+}
+
+// SetMemberPermissionSets replaces the permission sets assigned to an admin
+// or a regular member. The member gets the new permissions at their next
+// login or token refresh.
+func SetMemberPermissionSets(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "SetMemberPermissionSets")
+	defer span.End()
+
+	vars := mux.Vars(r)
+	m := model.Member{UUID: vars["member_uuid"]}
+
+	var payload memberPermissionSetsPayload
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&payload); err != nil {
+		common.Debug("Invalid request payload: %s", err.Error())
+		RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+		return
+	}
+	defer r.Body.Close()
+
+	if err := m.Get(ctx); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			common.Debug("Member not found: %s", err.Error())
+			RespondWithError(w, http.StatusNotFound, ERRORMEMBERNOTFOUND)
+		default:
+			common.Warn("Error getting member: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORGETMEMBER)
+		}
+		return
+	}
+	if m.Type != model.MEMBERSTYPEADMIN && m.Type != model.MEMBERSTYPEREGULAR {
+		common.Debug("Member %s of type %s cannot login", m.UUID, m.Type)
+		RespondWithError(w, http.StatusBadRequest, ERRORGUESTCANNOTLOGIN)
+		return
+	}
+	sets, err := model.GetPermissionSets(ctx)
+	if err != nil {
+		common.Warn("Error getting permission sets: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORGETPERMISSIONSETS)
+		return
+	}
+	names := []string{}
+	for _, set := range sets {
+		names = append(names, set.Name)
+	}
+	for _, name := range payload.Sets {
+		if !common.StringInSlice(name, names) {
+			common.Debug("Permission set not found: %s", name)
+			RespondWithError(w, http.StatusBadRequest, ERRORPERMISSIONSETNOTFOUND)
+			return
+		}
+	}
+	if err := m.SetPermissionSets(ctx, payload.Sets); err != nil {
+		common.Warn("Error assigning permission sets: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORSETPERMISSIONSETS)
+		return
+	}
+	common.Info("Permission sets of member %s set to %v", m.UUID, payload.Sets)
+	GetMemberPermissionSets(w, r)
+}
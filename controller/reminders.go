@@ -147,87 +147,54 @@ func resolveManualReminderRecipients(ctx context.Context, event model.Event, pay
 
 func membersWithNoAnswer(ctx context.Context, eventUUID string, statuses []string) ([]model.Member, error) {
 	m := model.Member{}
-	all, err := m.GetAll(ctx, statuses, []string{})
+	all, err := m.GetAllWithParticipation(ctx, eventUUID, statuses, []string{})
 	if err != nil {
 		return nil, err
 	}
 	filtered := []model.Member{}
-	p := model.Participation{EventUUID: eventUUID}
 	for _, member := range all {
-		p.MemberUUID = member.UUID
-		if err := p.GetParticipation(ctx); err != nil {
-			switch err {
-			case sql.ErrNoRows:
-				filtered = append(filtered, member)
-			default:
-				return nil, err
-			}
-			continue
-		}
-		if p.Answer == "" {
+		if member.Participation == "" {
 			filtered = append(filtered, member)
 		}
 	}
 	return filtered, nil
 }
 
-func sendReminderEmailsToMembers(ctx context.Context, event model.Event, members []model.Member) int {
-	failures := 0
-	p := model.Participation{EventUUID: event.UUID}
+func sendReminderEmailsToMembers(ctx context.Context, delivery *notificationDelivery, event model.Event, members []model.Member) {
 	for _, member := range members {
-		p.MemberUUID = member.UUID
-		err := p.GetParticipation(ctx)
-		if err != nil {
-			switch err {
-			case sql.ErrNoRows:
-				p.Answer = ""
-			default:
-				common.Error("%v\n", err)
-				failures++
-				continue
-			}
-		}
 		if member.Subscribed != 1 {
 			continue
 		}
-		token, err := ParticipateEventToken(ctx, member.UUID, common.GetConfigInt("jwt.participation_ttl_minutes"))
-		if err != nil {
-			common.Error("%v\n", err)
-			failures++
-			continue
-		}
-		dependents, err := member.GetDependents(ctx)
-		if err != nil {
-			common.Error("%v\n", err)
-			failures++
-			continue
-		}
-		emailPayload := mail.EmailReminderPayload{
-			Member:        member,
-			Event:         event,
-			Participation: p,
-			Token:         token,
-			Dependents:    dependents,
-		}
-		if err := mail.SendReminderEmail(ctx, emailPayload); err != nil {
-			common.Error("%v\n", err)
-			failures++
-		}
-	}
-	return failures
-}
-
-func setReminderDeliveryStatus(notification *model.Notification, failures, memberCount int) {
-	if failures == 0 {
-		notification.Delivered = model.NotificationDeliverySuccess
-	} else if failures == memberCount {
-		notification.Delivered = model.NotificationDeliveryFailure
-	} else {
-		notification.Delivered = model.NotificationDeliveryPartialFailure
+		delivery.send(ctx, member.UUID, func() error {
+			p := model.Participation{EventUUID: event.UUID, MemberUUID: member.UUID}
+			if err := p.GetParticipation(ctx); err != nil {
+				if err != sql.ErrNoRows {
+					return err
+				}
+				p.Answer = ""
+			}
+			token, err := ParticipateEventToken(ctx, member.UUID, common.GetConfigInt("jwt.participation_ttl_minutes"))
+			if err != nil {
+				return err
+			}
+			dependents, err := member.GetDependents(ctx)
+			if err != nil {
+				return err
+			}
+			emailPayload := mail.EmailReminderPayload{
+				Member:        member,
+				Event:         event,
+				Participation: p,
+				Token:         token,
+				Dependents:    dependents,
+			}
+			return mail.SendReminderEmail(ctx, emailPayload)
+		})
 	}
 }
 
-func deliverEventReminderNotification(ctx context.Context, notification *model.Notification, members []model.Member) {
+func deliverEventReminderNotification(ctx context.Context, delivery *notificationDelivery, members []model.Member) {
+	notification := delivery.notification
 	event := model.Event{UUID: notification.ObjectUUID}
 	if err := event.Get(ctx); err != nil {
 		common.Error("%v\n", err)
@@ -241,7 +208,6 @@ func deliverEventReminderNotification(ctx context.Context, notification *model.N
 		notification.UpdateNotificationStatus(ctx)
 		return
 	}
-	failures := sendReminderEmailsToMembers(ctx, event, members)
-	setReminderDeliveryStatus(notification, failures, len(members))
-	notification.UpdateNotificationStatus(ctx)
+	sendReminderEmailsToMembers(ctx, delivery, event, members)
+	delivery.finish(ctx)
 }
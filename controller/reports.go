@@ -0,0 +1,229 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+const (
+	ERRORGETREPORT = "error getting report"
+
+	REPORTFORMATJSON = "json"
+	REPORTFORMATCSV  = "csv"
+	REPORTFORMATXLSX = "xlsx"
+
+	// Default period of a report when start is not given
+	reportDefaultPeriod = 365 * 24 * 3600
+
+	retentionReportDefaultSeasons = 5
+	retentionReportMaxSeasons     = 50
+)
+
+// GetAttendanceReport returns the answer and presence of the members to the
+// events of a period, with their attendance rate.
+// Query parameters:
+//   - start, end: timestamps, events starting in [start, end). Defaults to the last year.
+//     The attendance rate only counts the events started before now.
+//   - eventType: comma-separated event types
+//   - type: comma-separated member types
+//   - format: json (default), csv or xlsx
+func GetAttendanceReport(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "GetAttendanceReport")
+	defer span.End()
+
+	end := uint(time.Now().Unix())
+	if r.FormValue("end") != "" {
+		value, err := strconv.ParseUint(r.FormValue("end"), 10, 64)
+		if err != nil {
+			common.Debug("Invalid end: %s", r.FormValue("end"))
+			RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+			return
+		}
+		end = uint(value)
+	}
+	start := end - reportDefaultPeriod
+	if r.FormValue("start") != "" {
+		value, err := strconv.ParseUint(r.FormValue("start"), 10, 64)
+		if err != nil {
+			common.Debug("Invalid start: %s", r.FormValue("start"))
+			RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+			return
+		}
+		start = uint(value)
+	}
+	if start > end {
+		common.Debug("Report starts after its end")
+		RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+		return
+	}
+	eventTypes := []string{}
+	for _, eventType := range strings.Split(r.FormValue("eventType"), ",") {
+		if eventType == "" {
+			continue
+		}
+		if !common.StringInSlice(eventType, model.ValidEventTypes) {
+			common.Debug("Invalid event type: %s", eventType)
+			RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+			return
+		}
+		eventTypes = append(eventTypes, eventType)
+	}
+	memberTypes := memberTypeListFromQuery(r.FormValue("type"))
+	format := r.FormValue("format")
+	if format == "" {
+		format = REPORTFORMATJSON
+	}
+	if !common.StringInSlice(format, []string{REPORTFORMATJSON, REPORTFORMATCSV, REPORTFORMATXLSX}) {
+		common.Debug("Invalid report format: %s", format)
+		RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+		return
+	}
+
+	report, err := model.GetAttendanceReport(ctx, start, end, eventTypes, memberTypes, time.Now().Unix())
+	if err != nil {
+		common.Warn("Error getting attendance report: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORGETREPORT)
+		return
+	}
+	if format == REPORTFORMATJSON {
+		RespondWithJSON(w, http.StatusOK, report)
+		return
+	}
+
+	location, err := common.LoadLocation()
+	if err != nil {
+		common.Warn("Error getting timezone data: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORGETTINGTIMEZONE)
+		return
+	}
+	rows := attendanceReportRows(report, location)
+	filename := fmt.Sprintf("attendance-%s-%s.%s",
+		time.Unix(int64(start), 0).In(location).Format("20060102"),
+		time.Unix(int64(end), 0).In(location).Format("20060102"), format)
+	content := new(bytes.Buffer)
+	contentType := "text/csv; charset=utf-8"
+	if format == REPORTFORMATCSV {
+		writer := csv.NewWriter(content)
+		for _, row := range rows {
+			record := make([]string, len(row))
+			for i, cell := range row {
+				record[i] = csvCell(fmt.Sprint(cell))
+			}
+			writer.Write(record)
+		}
+		writer.Flush()
+		err = writer.Error()
+	} else {
+		contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+		err = common.WriteXLSX(content, "attendance", rows)
+	}
+	if err != nil {
+		common.Warn("Error writing attendance report: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORGETREPORT)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	w.WriteHeader(http.StatusOK)
+	w.Write(content.Bytes())
+}
+
+// csvCell prefixes the cells a spreadsheet would read as a formula, e.g. a
+// name set by a member to =HYPERLINK(...), with a quote so they stay text.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsAny(value[:1], "=+-@") {
+		return "'" + value
+	}
+	return value
+}
+
+// attendanceReportRows lays out a report as a table: one row per member,
+// with an answer and a presence column per event.
+func attendanceReportRows(report model.AttendanceReport, location *time.Location) [][]interface{} {
+	header := []interface{}{"uuid", "firstName", "lastName", "type"}
+	for _, event := range report.Events {
+		title := time.Unix(int64(event.StartDate), 0).In(location).Format("2006-01-02 15:04") + " " + event.Name
+		header = append(header, title+" (answer)", title+" (presence)")
+	}
+	header = append(header, "attended", "attendanceRate")
+	rows := [][]interface{}{header}
+	for _, member := range report.Members {
+		row := []interface{}{member.UUID, member.FirstName, member.LastName, member.Type}
+		for _, p := range member.Participations {
+			row = append(row, p.Answer, p.Presence)
+		}
+		row = append(row, member.Attended, member.AttendanceRate)
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// GetRetentionReport returns, for each season, the members who joined, the
+// members active, the changes of status and how many of the members who
+// joined stayed active in the following seasons.
+// Query parameters:
+// - seasons: number of seasons until the current one, 5 by default
+// - type: comma-separated member types
+func GetRetentionReport(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "GetRetentionReport")
+	defer span.End()
+
+	count := retentionReportDefaultSeasons
+	if r.FormValue("seasons") != "" {
+		value, err := strconv.Atoi(r.FormValue("seasons"))
+		if err != nil || value < 1 || value > retentionReportMaxSeasons {
+			common.Debug("Invalid number of seasons: %s", r.FormValue("seasons"))
+			RespondWithError(w, http.StatusBadRequest, ERRORINVALIDPAYLOAD)
+			return
+		}
+		count = value
+	}
+	memberTypes := memberTypeListFromQuery(r.FormValue("type"))
+	location, err := common.LoadLocation()
+	if err != nil {
+		common.Warn("Error getting timezone data: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORGETTINGTIMEZONE)
+		return
+	}
+	now := time.Now()
+	report, err := model.GetRetentionReport(ctx, seasons(count, now.In(location)), memberTypes, now.Unix())
+	if err != nil {
+		common.Warn("Error getting retention report: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORGETREPORT)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, report)
+}
+
+// seasons returns the last count seasons, until the one of now, in order. A
+// season starts on the first day of the month season_start_month and is
+// named after its year, or its two years if it does not start in January.
+func seasons(count int, now time.Time) []model.Season {
+	startMonth := time.Month(common.GetConfigInt("season_start_month"))
+	if startMonth < time.January || startMonth > time.December {
+		startMonth = time.January
+	}
+	year := now.Year()
+	if now.Month() < startMonth {
+		year--
+	}
+	seasons := make([]model.Season, count)
+	for i := range seasons {
+		seasonYear := year - count + 1 + i
+		start := time.Date(seasonYear, startMonth, 1, 0, 0, 0, 0, now.Location())
+		name := strconv.Itoa(seasonYear)
+		if startMonth != time.January {
+			name += "-" + strconv.Itoa(seasonYear+1)
+		}
+		seasons[i] = model.Season{Name: name, Start: start.Unix(), End: start.AddDate(1, 0, 0).Unix()}
+	}
+	return seasons
+}
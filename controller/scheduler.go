@@ -33,6 +33,12 @@ func (s *Scheduler) Start() {
 	// Change status of member who have not participated in some time
 	s.cron.AddFunc("@every 10m", pauseAbsentMembers)
 
+	// Purge the personal data of members deleted for longer than the retention period
+	s.cron.AddFunc("@every 1h", purgeDeletedMembers)
+
+	// Delete the expired tokens of the SQLite token store
+	s.cron.AddFunc("@every 10m", deleteExpiredTokens)
+
 	s.cron.Start()
 }
 
@@ -46,6 +52,16 @@ func RunPauseAbsentMembersOnce() {
 	pauseAbsentMembers()
 }
 
+// RunPurgeDeletedMembersOnce runs the purge of deleted members once (used by tests and cron).
+func RunPurgeDeletedMembersOnce() {
+	purgeDeletedMembers()
+}
+
+// RunDeleteExpiredTokensOnce deletes the expired tokens once (used by tests and cron).
+func RunDeleteExpiredTokensOnce() {
+	deleteExpiredTokens()
+}
+
 func checkAndSendNotification() {
 
 	ctx, span := tracer.Start(context.Background(), "checkAndSendNotification")
@@ -59,6 +75,12 @@ func checkAndSendNotification() {
 	}
 	// Check all notifications that are ready
 	for _, notification := range notificationsToSend {
+		// Previous attempts, if the notification is retried
+		delivery, err := newNotificationDelivery(ctx, &notification)
+		if err != nil {
+			common.Error("%v\n", err)
+			continue
+		}
 		notification.Delivered = model.NotificationDeliveryInProgress
 		notification.UpdateNotificationStatus(ctx)
 		switch notificationType := notification.NotificationType; notificationType {
@@ -72,22 +94,17 @@ func checkAndSendNotification() {
 					notification.UpdateNotificationStatus(ctx)
 					continue
 				}
-				// Get a token to create credentials
-				resetCredentialsToken, err := ResetCredentialsToken(ctx, payload.Member.UUID, payload.Member.Email, common.GetConfigInt("jwt.registration_ttl_minutes"))
-				if err != nil {
-					notification.Delivered = model.NotificationDeliveryFailure
-					notification.UpdateNotificationStatus(ctx)
-					continue
-				}
-				payload.Token = resetCredentialsToken
-				if err := mail.SendRegistrationEmail(ctx, payload); err != nil {
-					notification.Delivered = model.NotificationDeliveryFailure
-					notification.UpdateNotificationStatus(ctx)
-					continue
-				}
+				delivery.send(ctx, payload.Member.UUID, func() error {
+					// Get a token to create credentials
+					resetCredentialsToken, err := ResetCredentialsToken(ctx, payload.Member.UUID, payload.Member.Email, common.GetConfigInt("jwt.registration_ttl_minutes"))
+					if err != nil {
+						return err
+					}
+					payload.Token = resetCredentialsToken
+					return mail.SendRegistrationEmail(ctx, payload)
+				})
 			}
-			notification.Delivered = model.NotificationDeliverySuccess
-			notification.UpdateNotificationStatus(ctx)
+			delivery.finish(ctx)
 		case model.TypeUpcomingEvent:
 			m := model.Member{}
 			members, err := m.GetAll(ctx, []string{model.MEMBERSSTATUSACTIVATED, model.MEMBERSSTATUSPAUSED}, []string{})
@@ -97,7 +114,7 @@ func checkAndSendNotification() {
 				notification.UpdateNotificationStatus(ctx)
 				continue
 			}
-			deliverEventReminderNotification(ctx, &notification, members)
+			deliverEventReminderNotification(ctx, delivery, members)
 		case model.TypeManualEventReminder:
 			var payload model.ManualReminderPayload
 			if err := json.Unmarshal(notification.Payload, &payload); err != nil {
@@ -114,7 +131,7 @@ func checkAndSendNotification() {
 				notification.UpdateNotificationStatus(ctx)
 				continue
 			}
-			deliverEventReminderNotification(ctx, &notification, members)
+			deliverEventReminderNotification(ctx, delivery, members)
 		case model.TypeSummaryEvent:
 			event := model.Event{UUID: notification.ObjectUUID}
 			err := event.Get(ctx)
@@ -133,7 +150,7 @@ func checkAndSendNotification() {
 				continue
 			}
 			m := model.Member{}
-			members, err := m.GetAll(ctx, []string{}, []string{})
+			members, err := m.GetAllWithParticipation(ctx, event.UUID, []string{}, []string{})
 			if err != nil {
 				// Cannot get the members, complete failure
 				common.Error("%v\n", err)
@@ -141,23 +158,6 @@ func checkAndSendNotification() {
 				notification.UpdateNotificationStatus(ctx)
 				continue
 			}
-			failures := 0
-			// Get participation for all members
-			for index, member := range members {
-				p := model.Participation{EventUUID: notification.ObjectUUID, MemberUUID: member.UUID}
-				if err := p.GetParticipation(ctx); err != nil {
-					switch err {
-					case sql.ErrNoRows:
-						members[index].Participation = ""
-					default:
-						// Cannot get participation for user
-						failures += 1
-						continue
-					}
-				}
-				members[index].Participation = p.Answer
-				members[index].Presence = p.Presence
-			}
 			// Sort by FirstName then by Participation
 			sort.Slice(members, func(i, j int) bool { return members[i].FirstName < members[j].FirstName })
 			sort.Slice(members, func(i, j int) bool { return members[i].Participation > members[j].Participation })
@@ -172,23 +172,11 @@ func checkAndSendNotification() {
 			// Send email to all admins
 			for _, member := range members {
 				if member.Type == model.MEMBERSTYPEADMIN && member.Subscribed == 1 { // Send the email
-					// get eventDate as a string
 					payload := mail.EmailSummaryPayload{Member: member, Event: event, Participants: participantsForEmail}
-					if err := mail.SendSummaryEmail(ctx, payload); err != nil {
-						common.Error("%v\n", err)
-						failures += 1
-						continue
-					}
+					delivery.send(ctx, member.UUID, func() error { return mail.SendSummaryEmail(ctx, payload) })
 				}
 			}
-			if failures == 0 {
-				notification.Delivered = model.NotificationDeliverySuccess
-			} else if failures == len(members) {
-				notification.Delivered = model.NotificationDeliveryFailure
-			} else {
-				notification.Delivered = model.NotificationDeliveryPartialFailure
-			}
-			notification.UpdateNotificationStatus(ctx)
+			delivery.finish(ctx)
 		case model.TypeForgotPassword:
 			m := model.Member{UUID: notification.ObjectUUID}
 			err := m.Get(ctx)
@@ -199,33 +187,53 @@ func checkAndSendNotification() {
 				continue
 			}
 			if common.GetConfigBool("smtp.enabled") {
-				// Get a token to create credentials
-				resetCredentialsToken, err := ResetCredentialsToken(ctx, m.UUID, m.Email, common.GetConfigInt("jwt.reset_ttl_minutes"))
-				if err != nil {
-					common.Debug("Error creating token for reset password: %s", err.Error())
-					notification.Delivered = model.NotificationDeliveryFailure
-					notification.UpdateNotificationStatus(ctx)
-					continue
-				}
-				credentials := model.Credentials{UUID: m.UUID}
-				err = credentials.GetCredentialsByUUID(ctx)
-				if err != nil && err != sql.ErrNoRows {
-					common.Debug("Error getting current credentials for reset password: %s", err.Error())
-					notification.Delivered = model.NotificationDeliveryFailure
-					notification.UpdateNotificationStatus(ctx)
-					continue
-				}
-				payload := mail.EmailForgotPasswordPayload{Member: m, Token: resetCredentialsToken, Credentials: credentials}
-				if err := mail.SendForgotPasswordEmail(ctx, payload); err != nil {
-					common.Debug("Error sending email for reset password: %s", err.Error())
-					notification.Delivered = model.NotificationDeliveryFailure
-					notification.UpdateNotificationStatus(ctx)
-					continue
-				}
+				delivery.send(ctx, m.UUID, func() error {
+					// Get a token to create credentials
+					resetCredentialsToken, err := ResetCredentialsToken(ctx, m.UUID, m.Email, common.GetConfigInt("jwt.reset_ttl_minutes"))
+					if err != nil {
+						common.Debug("Error creating token for reset password: %s", err.Error())
+						return err
+					}
+					credentials := model.Credentials{UUID: m.UUID}
+					err = credentials.GetCredentialsByUUID(ctx)
+					if err != nil && err != sql.ErrNoRows {
+						common.Debug("Error getting current credentials for reset password: %s", err.Error())
+						return err
+					}
+					payload := mail.EmailForgotPasswordPayload{Member: m, Token: resetCredentialsToken, Credentials: credentials}
+					return mail.SendForgotPasswordEmail(ctx, payload)
+				})
 			}
-			notification.Delivered = model.NotificationDeliverySuccess
-			notification.UpdateNotificationStatus(ctx)
+			delivery.finish(ctx)
+		case model.TypeMagicLink:
+			m := model.Member{UUID: notification.ObjectUUID}
+			if err := m.Get(ctx); err != nil {
+				common.Debug("Error getting member for magic link: %s", err.Error())
+				notification.Delivered = model.NotificationDeliveryFailure
+				notification.UpdateNotificationStatus(ctx)
+				continue
+			}
+			if common.GetConfigBool("smtp.enabled") {
+				delivery.send(ctx, m.UUID, func() error {
+					ttl := common.GetConfigInt("magic_link.ttl_minutes")
+					token, err := MagicLinkToken(ctx, m.UUID, ttl)
+					if err != nil {
+						common.Debug("Error creating token for magic link: %s", err.Error())
+						return err
+					}
+					payload := mail.EmailMagicLinkPayload{Member: m, Token: token, TTLMinutes: ttl}
+					return mail.SendMagicLinkEmail(ctx, payload)
+				})
+			}
+			delivery.finish(ctx)
 		case model.TypeEventDeleted:
+			var payload mail.EmailDeletedEventPayload
+			if err := json.Unmarshal(notification.Payload, &payload); err != nil {
+				common.Error("%v\n", err)
+				notification.Delivered = model.NotificationDeliveryFailure
+				notification.UpdateNotificationStatus(ctx)
+				continue
+			}
 			// Get All members
 			m := model.Member{}
 			members, err := m.GetAll(ctx, []string{model.MEMBERSSTATUSACTIVATED, model.MEMBERSSTATUSPAUSED}, []string{})
@@ -236,35 +244,23 @@ func checkAndSendNotification() {
 				notification.UpdateNotificationStatus(ctx)
 				continue
 			}
-			failures := 0
 			for _, member := range members {
 				// Send the email
 				if member.Subscribed == 1 {
-
-					var payload mail.EmailDeletedEventPayload
-					if err := json.Unmarshal(notification.Payload, &payload); err != nil {
-						common.Error("%v\n", err)
-						failures += 1
-						continue
-					}
-					payload.Member = member
-
-					if err := mail.SendDeletedEventEmail(ctx, payload); err != nil {
-						common.Error("%v\n", err)
-						failures += 1
-						continue
-					}
+					memberPayload := payload
+					memberPayload.Member = member
+					delivery.send(ctx, member.UUID, func() error { return mail.SendDeletedEventEmail(ctx, memberPayload) })
 				}
 			}
-			if failures == 0 {
-				notification.Delivered = model.NotificationDeliverySuccess
-			} else if failures == len(members) {
+			delivery.finish(ctx)
+		case model.TypeEventModified:
+			var payload mail.EmailModifiedPayload
+			if err := json.Unmarshal(notification.Payload, &payload); err != nil {
+				common.Error("%v\n", err)
 				notification.Delivered = model.NotificationDeliveryFailure
-			} else {
-				notification.Delivered = model.NotificationDeliveryPartialFailure
+				notification.UpdateNotificationStatus(ctx)
+				continue
 			}
-			notification.UpdateNotificationStatus(ctx)
-		case model.TypeEventModified:
 			// Get All members
 			m := model.Member{}
 			members, err := m.GetAll(ctx, []string{model.MEMBERSSTATUSACTIVATED, model.MEMBERSSTATUSPAUSED}, []string{})
@@ -275,33 +271,23 @@ func checkAndSendNotification() {
 				notification.UpdateNotificationStatus(ctx)
 				continue
 			}
-			failures := 0
 			for _, member := range members {
 				// Send the email
 				if member.Subscribed == 1 {
-					var payload mail.EmailModifiedPayload
-					if err := json.Unmarshal(notification.Payload, &payload); err != nil {
-						common.Error("%v\n", err)
-						failures += 1
-						continue
-					}
-					payload.Member = member
-					if err := mail.SendModifiedEventEmail(ctx, payload); err != nil {
-						common.Error("%v\n", err)
-						failures += 1
-						continue
-					}
+					memberPayload := payload
+					memberPayload.Member = member
+					delivery.send(ctx, member.UUID, func() error { return mail.SendModifiedEventEmail(ctx, memberPayload) })
 				}
 			}
-			if failures == 0 {
-				notification.Delivered = model.NotificationDeliverySuccess
-			} else if failures == len(members) {
+			delivery.finish(ctx)
+		case model.TypeEventCreated:
+			var payload mail.EmailCreateEventPayload
+			if err := json.Unmarshal(notification.Payload, &payload); err != nil {
+				common.Error("%v\n", err)
 				notification.Delivered = model.NotificationDeliveryFailure
-			} else {
-				notification.Delivered = model.NotificationDeliveryPartialFailure
+				notification.UpdateNotificationStatus(ctx)
+				continue
 			}
-			notification.UpdateNotificationStatus(ctx)
-		case model.TypeEventCreated:
 			// Get All members
 			m := model.Member{}
 			members, err := m.GetAll(ctx, []string{model.MEMBERSSTATUSACTIVATED, model.MEMBERSSTATUSPAUSED}, []string{})
@@ -312,32 +298,15 @@ func checkAndSendNotification() {
 				notification.UpdateNotificationStatus(ctx)
 				continue
 			}
-			failures := 0
 			for _, member := range members {
 				// Send the email
 				if member.Subscribed == 1 {
-					var payload mail.EmailCreateEventPayload
-					if err := json.Unmarshal(notification.Payload, &payload); err != nil {
-						common.Error("%v\n", err)
-						failures += 1
-						continue
-					}
-					payload.Member = member
-					if err := mail.SendCreateEventEmail(ctx, payload); err != nil {
-						common.Error("%v\n", err)
-						failures += 1
-						continue
-					}
+					memberPayload := payload
+					memberPayload.Member = member
+					delivery.send(ctx, member.UUID, func() error { return mail.SendCreateEventEmail(ctx, memberPayload) })
 				}
 			}
-			if failures == 0 {
-				notification.Delivered = model.NotificationDeliverySuccess
-			} else if failures == len(members) {
-				notification.Delivered = model.NotificationDeliveryFailure
-			} else {
-				notification.Delivered = model.NotificationDeliveryPartialFailure
-			}
-			notification.UpdateNotificationStatus(ctx)
+			delivery.finish(ctx)
 		case model.TypeBadgeAwarded:
 			var payload model.BadgeAwardedPayload
 			if err := json.Unmarshal(notification.Payload, &payload); err != nil {
@@ -346,41 +315,188 @@ func checkAndSendNotification() {
 				notification.UpdateNotificationStatus(ctx)
 				continue
 			}
-			failures := 0
-			attempted := 0
 			for _, memberUUID := range payload.MemberUUIDs {
-				member := model.Member{UUID: memberUUID}
-				if err := member.Get(ctx); err != nil {
-					common.Error("%v\n", err)
-					failures++
-					attempted++
+				member, err := getNotificationRecipient(ctx, memberUUID)
+				if err == nil && member.Subscribed != 1 {
 					continue
 				}
-				if member.Subscribed != 1 {
+				delivery.send(ctx, memberUUID, func() error {
+					if err != nil {
+						return err
+					}
+					emailPayload := mail.EmailBadgeAwardedPayload{
+						Member:    member,
+						BadgeCode: payload.BadgeCode,
+					}
+					return mail.SendBadgeAwardedEmail(ctx, emailPayload)
+				})
+			}
+			delivery.finish(ctx)
+		case model.TypeWaitingListPromoted:
+			var payload model.WaitingListPromotedPayload
+			if err := json.Unmarshal(notification.Payload, &payload); err != nil {
+				common.Error("%v\n", err)
+				notification.Delivered = model.NotificationDeliveryFailure
+				notification.UpdateNotificationStatus(ctx)
+				continue
+			}
+			event := model.Event{UUID: notification.ObjectUUID}
+			if err := event.Get(ctx); err != nil {
+				// Cannot get the event, complete failure
+				common.Error("%v\n", err)
+				notification.Delivered = model.NotificationDeliveryFailure
+				notification.UpdateNotificationStatus(ctx)
+				continue
+			}
+			if event.StartDate < uint(time.Now().Unix()) {
+				common.Info("Event %v has already started.\n", event.UUID)
+				notification.Delivered = model.NotificationTooLate
+				notification.UpdateNotificationStatus(ctx)
+				continue
+			}
+			for _, memberUUID := range payload.MemberUUIDs {
+				// Being promoted matters even to members not subscribed to
+				// the other emails, they asked to participate
+				delivery.send(ctx, memberUUID, func() error {
+					member, err := getNotificationRecipient(ctx, memberUUID)
+					if err != nil {
+						return err
+					}
+					emailPayload := mail.EmailWaitingListPromotedPayload{Member: member, Event: event}
+					return mail.SendWaitingListPromotedEmail(ctx, emailPayload)
+				})
+			}
+			delivery.finish(ctx)
+		case model.TypeLateParticipationChanges:
+			event := model.Event{UUID: notification.ObjectUUID}
+			if err := event.Get(ctx); err != nil {
+				// Cannot get the event, complete failure
+				common.Error("%v\n", err)
+				notification.Delivered = model.NotificationDeliveryFailure
+				notification.UpdateNotificationStatus(ctx)
+				continue
+			}
+			changes, err := model.GetLateParticipationChanges(ctx, event.UUID)
+			if err != nil {
+				common.Error("%v\n", err)
+				notification.Delivered = model.NotificationDeliveryFailure
+				notification.UpdateNotificationStatus(ctx)
+				continue
+			}
+			// Each admin receives the changes they did not receive yet, with
+			// this notification or another one
+			sent, err := model.GetLateParticipationChangesSent(ctx, event.UUID)
+			if err != nil {
+				common.Error("%v\n", err)
+				notification.Delivered = model.NotificationDeliveryFailure
+				notification.UpdateNotificationStatus(ctx)
+				continue
+			}
+			lateChanges, err := lateParticipationChangesForEmail(ctx, changes)
+			if err != nil {
+				common.Error("%v\n", err)
+				notification.Delivered = model.NotificationDeliveryFailure
+				notification.UpdateNotificationStatus(ctx)
+				continue
+			}
+			m := model.Member{}
+			admins, err := m.GetAll(ctx, []string{model.MEMBERSSTATUSACTIVATED, model.MEMBERSSTATUSPAUSED}, []string{model.MEMBERSTYPEADMIN})
+			if err != nil {
+				common.Error("%v\n", err)
+				notification.Delivered = model.NotificationDeliveryFailure
+				notification.UpdateNotificationStatus(ctx)
+				continue
+			}
+			for _, admin := range admins {
+				if admin.Subscribed != 1 {
 					continue
 				}
-				attempted++
-				emailPayload := mail.EmailBadgeAwardedPayload{
-					Member:    member,
-					BadgeCode: payload.BadgeCode,
+				first := 0
+				for first < len(changes) && changes[first].ID <= sent[admin.UUID] {
+					first++
 				}
-				if err := mail.SendBadgeAwardedEmail(ctx, emailPayload); err != nil {
-					common.Error("%v\n", err)
-					failures++
+				if first == len(changes) {
+					continue
 				}
+				emailPayload := mail.EmailLateParticipationChangesPayload{Member: admin, Event: event, Changes: lateChanges[first:]}
+				delivery.sendChanges(ctx, admin.UUID, changes[len(changes)-1].ID, func() error {
+					return mail.SendLateParticipationChangesEmail(ctx, emailPayload)
+				})
+			}
+			delivery.finish(ctx)
+		case model.TypeInactivityWarning:
+			var payload model.InactivityWarningPayload
+			if err := json.Unmarshal(notification.Payload, &payload); err != nil {
+				common.Error("%v\n", err)
+				notification.Delivered = model.NotificationDeliveryFailure
+				notification.UpdateNotificationStatus(ctx)
+				continue
+			}
+			member := model.Member{UUID: notification.ObjectUUID}
+			if err := member.Get(ctx); err != nil {
+				common.Error("%v\n", err)
+				notification.Delivered = model.NotificationDeliveryFailure
+				notification.UpdateNotificationStatus(ctx)
+				continue
 			}
-			if failures == 0 {
-				notification.Delivered = model.NotificationDeliverySuccess
-			} else if attempted > 0 && failures == attempted {
+			if member.Status != model.MEMBERSSTATUSACTIVATED {
+				common.Info("Member %v is not active anymore.\n", member.UUID)
+				notification.Delivered = model.NotificationTooLate
+				notification.UpdateNotificationStatus(ctx)
+				continue
+			}
+			// The pause matters even to members not subscribed to the other emails
+			emailPayload := mail.EmailInactivityWarningPayload{Member: member, PauseDate: payload.PauseDate}
+			delivery.send(ctx, member.UUID, func() error { return mail.SendInactivityWarningEmail(ctx, emailPayload) })
+			delivery.finish(ctx)
+		case model.TypeAccountLocked:
+			var payload model.AccountLockedPayload
+			if err := json.Unmarshal(notification.Payload, &payload); err != nil {
+				common.Error("%v\n", err)
 				notification.Delivered = model.NotificationDeliveryFailure
-			} else {
-				notification.Delivered = model.NotificationDeliveryPartialFailure
+				notification.UpdateNotificationStatus(ctx)
+				continue
 			}
-			notification.UpdateNotificationStatus(ctx)
+			member := model.Member{UUID: notification.ObjectUUID}
+			if err := member.Get(ctx); err != nil {
+				common.Error("%v\n", err)
+				notification.Delivered = model.NotificationDeliveryFailure
+				notification.UpdateNotificationStatus(ctx)
+				continue
+			}
+			m := model.Member{}
+			admins, err := m.GetAll(ctx, []string{model.MEMBERSSTATUSACTIVATED, model.MEMBERSSTATUSPAUSED}, []string{model.MEMBERSTYPEADMIN})
+			if err != nil {
+				common.Error("%v\n", err)
+				notification.Delivered = model.NotificationDeliveryFailure
+				notification.UpdateNotificationStatus(ctx)
+				continue
+			}
+			for _, admin := range admins {
+				// A possible attack matters even to admins not subscribed to the other emails
+				if admin.Email == "" {
+					continue
+				}
+				emailPayload := mail.EmailAccountLockedPayload{
+					Admin: admin, Member: member, IP: payload.IP, Attempts: payload.Attempts, LockedUntil: payload.LockedUntil}
+				delivery.send(ctx, admin.UUID, func() error { return mail.SendAccountLockedEmail(ctx, emailPayload) })
+			}
+			delivery.finish(ctx)
 		}
 	}
 }
 
+// getNotificationRecipient returns a member listed in the payload of a
+// notification. A member deleted since is a permanent failure.
+func getNotificationRecipient(ctx context.Context, memberUUID string) (model.Member, error) {
+	member := model.Member{UUID: memberUUID}
+	err := member.Get(ctx)
+	if err == sql.ErrNoRows {
+		return member, mail.Permanent(err)
+	}
+	return member, err
+}
+
 func generateEventsNotificationsReminder() {
 
 	ctx, span := tracer.Start(context.Background(), "generateEventsNotificationsReminder")
@@ -394,7 +510,12 @@ func generateEventsNotificationsReminder() {
 	}
 	n := model.Notification{NotificationType: model.TypeUpcomingEvent}
 	for _, event := range events {
-		if (event.StartDate - uint(time.Now().Unix())) < uint(common.GetConfigInt("reminder_time_before_event")) {
+		// Remind members before answers close rather than before the event
+		reference := event.StartDate
+		if event.AnswerDeadline != 0 && event.AnswerDeadline < reference {
+			reference = event.AnswerDeadline
+		}
+		if int64(reference)-time.Now().Unix() < int64(common.GetConfigInt("reminder_time_before_event")) {
 			n.ObjectUUID = event.UUID
 			n.SendDate = int(time.Now().Unix())
 			err = n.CreateNotification(ctx)
@@ -433,6 +554,9 @@ func generateEventsNotificationsSummary() {
 	}
 }
 
+// pauseAbsentMembers pauses the active members inactive for longer than the
+// delay of their type, and warns them a few days before. The decision is
+// logged for each member.
 func pauseAbsentMembers() {
 	ctx, span := tracer.Start(context.Background(), "pauseMembers")
 	defer span.End()
@@ -442,25 +566,93 @@ func pauseAbsentMembers() {
 	if err != nil {
 		common.Error("%v\n", err)
 	}
+	warningDays := common.GetConfigInt("inactivity.warning_days")
+	now := time.Now().Unix()
 	for _, member := range members {
-		// Get last participation
-		lastEvent, err := member.GetMemberLastParticipation(ctx)
+		inactivity, err := member.GetInactivity(ctx)
 		if err != nil {
 			common.Error("%v\n", err)
+			continue
 		}
 		// A manual reactivation by an admin resets the inactivity counter, so we
 		// keep the most recent of the last participated event and last_activity_date.
-		lastActivityDate, err := member.GetLastActivityDate(ctx)
-		if err != nil {
-			common.Error("%v\n", err)
+		referenceDate := inactivityReferenceDate(ctx, member, inactivity)
+		decision, pauseDate := inactivityDecision(now, referenceDate, inactivity, inactiveDelayDays(member.Type), warningDays)
+		common.Info("Inactivity of member %s (%s): last activity %d, pause date %d, decision: %s",
+			member.UUID, member.Type, referenceDate, pauseDate, decision)
+		switch decision {
+		case inactivityDecisionWarn:
+			// Guests and canalla have no email
+			if member.Email == "" {
+				continue
+			}
+			if err := warnInactiveMember(ctx, member, pauseDate); err != nil {
+				common.Error("%v\n", err)
+			}
+		case inactivityDecisionPause:
+			common.Debug("Setting member %v as %s", member, model.MEMBERSSTATUSPAUSED)
+			if err := member.SetStatus(ctx, model.MEMBERSSTATUSPAUSED, model.STATUSCAUSEAUTOPAUSE); err != nil {
+				common.Error("%v\n", err)
+				continue
+			}
+			paused := member
+			paused.Status = model.MEMBERSSTATUSPAUSED
+			auditMember(ctx, model.MEMBERAUDITACTORSYSTEM, model.MEMBERAUDITSTATUS, member, paused)
 		}
-		referenceDate := int64(lastEvent.StartDate)
-		if lastActivityDate > referenceDate {
-			referenceDate = lastActivityDate
+	}
+}
+
+func purgeDeletedMembers() {
+	ctx, span := tracer.Start(context.Background(), "purgeDeletedMembers")
+	defer span.End()
+
+	retentionDays := common.GetConfigInt("purge_retention_days")
+	if retentionDays <= 0 {
+		return
+	}
+	uuids, err := model.GetMembersToPurge(ctx, time.Now().Unix()-int64(retentionDays)*24*3600)
+	if err != nil {
+		common.Error("%v\n", err)
+		return
+	}
+	for _, uuid := range uuids {
+		member := model.Member{UUID: uuid}
+		if err := member.Purge(ctx); err != nil {
+			common.Error("Error purging member %s: %v\n", uuid, err)
+			continue
 		}
-		if time.Now().Unix()-referenceDate > int64(common.GetConfigInt("inactive_delay_days"))*24*3600 {
-			common.Debug("Setting member %v as %s", member, model.MEMBERSSTATUSPAUSED)
-			member.SetStatus(ctx, model.MEMBERSSTATUSPAUSED)
+		common.Info("Purged the personal data of member %s", uuid)
+		auditMember(ctx, model.MEMBERAUDITACTORSYSTEM, model.MEMBERAUDITPURGE,
+			model.Member{UUID: uuid, Status: model.MEMBERSSTATUSDELETED}, model.Member{UUID: uuid, Status: model.MEMBERSSTATUSPURGED})
+	}
+}
+
+// lateParticipationChangesForEmail adds the members and the authors to the
+// late changes of an event.
+func lateParticipationChangesForEmail(ctx context.Context, changes []model.LateParticipationChange) ([]mail.LateParticipationChange, error) {
+	members := map[string]model.Member{}
+	getMember := func(uuid string) (model.Member, error) {
+		if member, ok := members[uuid]; ok {
+			return member, nil
+		}
+		member := model.Member{UUID: uuid}
+		if err := member.Get(ctx); err != nil {
+			return member, err
+		}
+		members[uuid] = member
+		return member, nil
+	}
+	lateChanges := []mail.LateParticipationChange{}
+	for _, change := range changes {
+		member, err := getMember(change.MemberUUID)
+		if err != nil {
+			return nil, err
+		}
+		author, err := getMember(change.AuthorUUID)
+		if err != nil {
+			return nil, err
 		}
+		lateChanges = append(lateChanges, mail.LateParticipationChange{Member: member, Author: author, Answer: change.Answer, ChangedAt: change.ChangedAt})
 	}
+	return lateChanges, nil
 }
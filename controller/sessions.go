@@ -0,0 +1,282 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+const (
+	ERRORSESSIONS        = "error with the sessions"
+	ERRORSESSIONNOTFOUND = "session not found"
+)
+
+// A Session is a login of a member on a device. Its ID is the UUID of the
+// current refresh token, which changes when the tokens are refreshed.
+// The metadata is stored in Redis with the refresh token, and the sessions
+// of a member are listed in a set.
+type Session struct {
+	ID         string `json:"id"`
+	MemberUUID string `json:"memberUuid"`
+	CreatedAt  int64  `json:"createdAt"`  // Login
+	LastUsedAt int64  `json:"lastUsedAt"` // Last login or refresh
+	UserAgent  string `json:"userAgent"`
+	IP         string `json:"ip"`
+	Current    bool   `json:"current,omitempty"` // Session of the request
+}
+
+func sessionKey(id string) string {
+	return "session:" + id
+}
+
+func memberSessionsKey(memberUUID string) string {
+	return "sessions:" + memberUUID
+}
+
+// newSession returns the metadata of a login from the request.
+func newSession(r *http.Request) Session {
+	now := time.Now().Unix()
+	return Session{CreatedAt: now, LastUsedAt: now, UserAgent: r.UserAgent(), IP: clientIP(r)}
+}
+
+// saveSession stores the session of the tokens.
+func saveSession(ctx context.Context, memberUUID string, td *TokenDetails, session Session) error {
+	ctx, span := tracer.Start(ctx, "saveSession")
+	defer span.End()
+
+	session.ID = td.RefreshUuid
+	session.MemberUUID = memberUUID
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(time.Unix(td.RtExpires, 0))
+	if err := tokenStore.Set(ctx, sessionKey(session.ID), string(data), ttl); err != nil {
+		return err
+	}
+	// The set lives as long as the most recent session
+	return tokenStore.AddToSet(ctx, memberSessionsKey(memberUUID), session.ID, ttl)
+}
+
+// getSession returns a session, ErrTokenNotFound if it does not exist.
+func getSession(ctx context.Context, id string) (Session, error) {
+	var session Session
+	data, err := tokenStore.Get(ctx, sessionKey(id))
+	if err != nil {
+		return session, err
+	}
+	err = json.Unmarshal([]byte(data), &session)
+	return session, err
+}
+
+// getMemberSessions returns the sessions of a member, the most recent
+// first. Expired sessions are removed from the set.
+func getMemberSessions(ctx context.Context, memberUUID string) ([]Session, error) {
+	ctx, span := tracer.Start(ctx, "getMemberSessions")
+	defer span.End()
+
+	ids, err := tokenStore.SetMembers(ctx, memberSessionsKey(memberUUID))
+	if err != nil {
+		return nil, err
+	}
+	sessions := []Session{}
+	for _, id := range ids {
+		session, err := getSession(ctx, id)
+		if err == ErrTokenNotFound {
+			tokenStore.RemoveFromSet(ctx, memberSessionsKey(memberUUID), id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastUsedAt > sessions[j].LastUsedAt })
+	return sessions, nil
+}
+
+// revokeSession deletes a session of a member and its refresh token, so
+// its tokens cannot be used anymore. Returns false if the member has no
+// such session.
+func revokeSession(ctx context.Context, memberUUID, id string) (bool, error) {
+	ctx, span := tracer.Start(ctx, "revokeSession")
+	defer span.End()
+
+	removed, err := tokenStore.RemoveFromSet(ctx, memberSessionsKey(memberUUID), id)
+	if err != nil || !removed {
+		return false, err
+	}
+	_, err = tokenStore.Delete(ctx, id, sessionKey(id))
+	return true, err
+}
+
+// revokeMemberSessions revokes the sessions of a member but the session
+// except, if not empty. Returns the number of revoked sessions.
+func revokeMemberSessions(ctx context.Context, memberUUID, except string) (int, error) {
+	ctx, span := tracer.Start(ctx, "revokeMemberSessions")
+	defer span.End()
+
+	ids, err := tokenStore.SetMembers(ctx, memberSessionsKey(memberUUID))
+	if err != nil {
+		return 0, err
+	}
+	revoked := 0
+	for _, id := range ids {
+		if id == except {
+			continue
+		}
+		if _, err := tokenStore.Delete(ctx, id, sessionKey(id)); err != nil {
+			return revoked, err
+		}
+		if _, err := tokenStore.RemoveFromSet(ctx, memberSessionsKey(memberUUID), id); err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+// GetSessions returns the sessions of the member of the token.
+func GetSessions(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "GetSessions")
+	defer span.End()
+
+	tokenAuth, err := ExtractToken(ctx, r)
+	if err != nil {
+		common.Warn("Error reading token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAUTHENTICATION)
+		return
+	}
+	sessions, err := getMemberSessions(ctx, tokenAuth.UserId)
+	if err != nil {
+		common.Warn("Error getting sessions: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORSESSIONS)
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == tokenAuth.RefreshUuid
+	}
+	RespondWithJSON(w, http.StatusOK, sessions)
+}
+
+// RevokeSession logs out a session of the member of the token, e.g. on a
+// lost phone.
+func RevokeSession(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "RevokeSession")
+	defer span.End()
+
+	tokenAuth, err := ExtractToken(ctx, r)
+	if err != nil {
+		common.Warn("Error reading token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAUTHENTICATION)
+		return
+	}
+	respondRevokeSession(ctx, w, tokenAuth.UserId, mux.Vars(r)["session_id"])
+}
+
+// RevokeOtherSessions logs out every session of the member of the token,
+// except the session of the request.
+func RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "RevokeOtherSessions")
+	defer span.End()
+
+	tokenAuth, err := ExtractToken(ctx, r)
+	if err != nil {
+		common.Warn("Error reading token: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORAUTHENTICATION)
+		return
+	}
+	respondRevokeMemberSessions(ctx, w, tokenAuth.UserId, tokenAuth.RefreshUuid)
+}
+
+// GetMemberSessions returns the sessions of a member, for admins.
+func GetMemberSessions(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "GetMemberSessions")
+	defer span.End()
+
+	member, found := getSessionsMember(ctx, w, r)
+	if !found {
+		return
+	}
+	sessions, err := getMemberSessions(ctx, member.UUID)
+	if err != nil {
+		common.Warn("Error getting sessions: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORSESSIONS)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, sessions)
+}
+
+// RevokeMemberSession lets an admin log out a session of a member.
+func RevokeMemberSession(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "RevokeMemberSession")
+	defer span.End()
+
+	member, found := getSessionsMember(ctx, w, r)
+	if !found {
+		return
+	}
+	respondRevokeSession(ctx, w, member.UUID, mux.Vars(r)["session_id"])
+}
+
+// RevokeMemberSessions lets an admin log out every session of a member,
+// e.g. if their account was compromised.
+func RevokeMemberSessions(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "RevokeMemberSessions")
+	defer span.End()
+
+	member, found := getSessionsMember(ctx, w, r)
+	if !found {
+		return
+	}
+	respondRevokeMemberSessions(ctx, w, member.UUID, "")
+}
+
+func getSessionsMember(ctx context.Context, w http.ResponseWriter, r *http.Request) (model.Member, bool) {
+	member := model.Member{UUID: mux.Vars(r)["member_uuid"]}
+	if err := member.Get(ctx); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			RespondWithError(w, http.StatusNotFound, ERRORMEMBERNOTFOUND)
+		default:
+			common.Warn("Error getting member: %s", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, ERRORGETMEMBER)
+		}
+		return member, false
+	}
+	return member, true
+}
+
+func respondRevokeSession(ctx context.Context, w http.ResponseWriter, memberUUID, id string) {
+	revoked, err := revokeSession(ctx, memberUUID, id)
+	if err != nil {
+		common.Warn("Error revoking session: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORSESSIONS)
+		return
+	}
+	if !revoked {
+		RespondWithError(w, http.StatusNotFound, ERRORSESSIONNOTFOUND)
+		return
+	}
+	common.Info("Session %s of member %s revoked", id, memberUUID)
+	RespondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func respondRevokeMemberSessions(ctx context.Context, w http.ResponseWriter, memberUUID, except string) {
+	revoked, err := revokeMemberSessions(ctx, memberUUID, except)
+	if err != nil {
+		common.Warn("Error revoking sessions: %s", err.Error())
+		RespondWithError(w, http.StatusInternalServerError, ERRORSESSIONS)
+		return
+	}
+	common.Info("%d sessions of member %s revoked", revoked, memberUUID)
+	RespondWithJSON(w, http.StatusOK, map[string]int{"revoked": revoked})
+}
@@ -0,0 +1,199 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+const (
+	TokenStoreRedis  = "redis"
+	TokenStoreSQLite = "sqlite"
+)
+
+// ErrTokenNotFound is returned by the token store for keys that do not
+// exist or expired.
+var ErrTokenNotFound = errors.New("token not found")
+
+// A TokenStore keeps the short-lived state of the authentication: the
+// refresh tokens, the sessions, the counters of the login protection...
+// A ttl of 0 means the key does not expire.
+type TokenStore interface {
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+	// Get returns ErrTokenNotFound if the key does not exist
+	Get(ctx context.Context, key string) (string, error)
+	Exists(ctx context.Context, key string) (bool, error)
+	// Delete deletes keys and sets, and returns how many existed
+	Delete(ctx context.Context, keys ...string) (int64, error)
+	// Incr increments a counter, which expires after ttl if it is created
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+	// TTL returns how long the key remains, 0 if it does not exist or does
+	// not expire
+	TTL(ctx context.Context, key string) (time.Duration, error)
+	// AddToSet adds a member to a set, and sets the ttl of the whole set
+	AddToSet(ctx context.Context, key, member string, ttl time.Duration) error
+	SetMembers(ctx context.Context, key string) ([]string, error)
+	// RemoveFromSet returns whether the member was in the set
+	RemoveFromSet(ctx context.Context, key, member string) (bool, error)
+}
+
+var tokenStore TokenStore
+
+// InitializeTokenStore connects to the token store of the configuration.
+func InitializeTokenStore() {
+	switch store := common.GetConfigString("token_store"); store {
+	case TokenStoreRedis:
+		InitializeRedis()
+		tokenStore = redisTokenStore{client: RedisClient}
+	case TokenStoreSQLite:
+		tokenStore = sqliteTokenStore{}
+	default:
+		common.Fatal("Unknown token store: %s", store)
+	}
+}
+
+type redisTokenStore struct {
+	client *redis.Client
+}
+
+func (s redisTokenStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return s.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (s redisTokenStore) Get(ctx context.Context, key string) (string, error) {
+	value, err := s.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", ErrTokenNotFound
+	}
+	return value, err
+}
+
+func (s redisTokenStore) Exists(ctx context.Context, key string) (bool, error) {
+	exists, err := s.client.Exists(ctx, key).Result()
+	return exists > 0, err
+}
+
+func (s redisTokenStore) Delete(ctx context.Context, keys ...string) (int64, error) {
+	return s.client.Del(ctx, keys...).Result()
+}
+
+func (s redisTokenStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	value, err := s.client.Incr(ctx, key).Result()
+	if err == nil && value == 1 && ttl > 0 {
+		err = s.client.Expire(ctx, key, ttl).Err()
+	}
+	return value, err
+}
+
+func (s redisTokenStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := s.client.PTTL(ctx, key).Result()
+	// Negative for keys without expiry or missing
+	if err != nil || ttl < 0 {
+		return 0, err
+	}
+	return ttl, nil
+}
+
+func (s redisTokenStore) AddToSet(ctx context.Context, key, member string, ttl time.Duration) error {
+	if err := s.client.SAdd(ctx, key, member).Err(); err != nil {
+		return err
+	}
+	if ttl > 0 {
+		return s.client.Expire(ctx, key, ttl).Err()
+	}
+	return s.client.Persist(ctx, key).Err()
+}
+
+func (s redisTokenStore) SetMembers(ctx context.Context, key string) ([]string, error) {
+	return s.client.SMembers(ctx, key).Result()
+}
+
+func (s redisTokenStore) RemoveFromSet(ctx context.Context, key, member string) (bool, error) {
+	removed, err := s.client.SRem(ctx, key, member).Result()
+	return removed > 0, err
+}
+
+// sqliteTokenStore keeps the tokens in the database, for the deployments
+// without Redis. The expired keys are deleted by the scheduler.
+type sqliteTokenStore struct{}
+
+func expiresAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixMilli()
+}
+
+func (s sqliteTokenStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return model.SetStoredToken(ctx, key, value, expiresAt(ttl))
+}
+
+func (s sqliteTokenStore) Get(ctx context.Context, key string) (string, error) {
+	value, _, err := model.GetStoredToken(ctx, key)
+	if err == sql.ErrNoRows {
+		return "", ErrTokenNotFound
+	}
+	return value, err
+}
+
+func (s sqliteTokenStore) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.Get(ctx, key)
+	if err == ErrTokenNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s sqliteTokenStore) Delete(ctx context.Context, keys ...string) (int64, error) {
+	return model.DeleteStoredTokens(ctx, keys...)
+}
+
+func (s sqliteTokenStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	return model.IncrStoredToken(ctx, key, expiresAt(ttl))
+}
+
+func (s sqliteTokenStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	_, expires, err := model.GetStoredToken(ctx, key)
+	if err == sql.ErrNoRows || (err == nil && expires == 0) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return time.Until(time.UnixMilli(expires)), nil
+}
+
+func (s sqliteTokenStore) AddToSet(ctx context.Context, key, member string, ttl time.Duration) error {
+	return model.AddToStoredSet(ctx, key, member, expiresAt(ttl))
+}
+
+func (s sqliteTokenStore) SetMembers(ctx context.Context, key string) ([]string, error) {
+	return model.GetStoredSet(ctx, key)
+}
+
+func (s sqliteTokenStore) RemoveFromSet(ctx context.Context, key, member string) (bool, error) {
+	return model.RemoveFromStoredSet(ctx, key, member)
+}
+
+// deleteExpiredTokens deletes the expired keys of the SQLite token store.
+// Redis expires them itself.
+func deleteExpiredTokens() {
+	ctx, span := tracer.Start(context.Background(), "deleteExpiredTokens")
+	defer span.End()
+
+	if _, ok := tokenStore.(sqliteTokenStore); !ok {
+		return
+	}
+	deleted, err := model.DeleteExpiredStoredTokens(ctx)
+	if err != nil {
+		common.Error("Error deleting expired tokens: %v\n", err)
+		return
+	}
+	common.Debug("%d expired tokens deleted", deleted)
+}
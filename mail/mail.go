@@ -3,8 +3,10 @@ package mail
 import (
 	"bytes"
 	"context"
+	"errors"
 	"html/template"
 	"net/smtp"
+	"net/textproto"
 
 	"github.com/vilisseranen/castellers/common"
 	"go.opentelemetry.io/otel"
@@ -94,7 +96,7 @@ func sendMail(ctx context.Context, email emailInfo) error {
 	body, err := email.buildEmail()
 	if err != nil {
 		common.Error("Cannot build Email")
-		return err
+		return Permanent(err)
 	}
 
 	auth := smtp.PlainAuth("", common.GetConfigString("smtp.username"), common.GetConfigString("smtp.password"), common.GetConfigString("smtp.server"))
@@ -105,3 +107,29 @@ func sendMail(ctx context.Context, email emailInfo) error {
 	}
 	return nil
 }
+
+// permanentError is an error that sending the email again will not fix.
+type permanentError struct {
+	error
+}
+
+func (e permanentError) Unwrap() error {
+	return e.error
+}
+
+// Permanent marks an error as permanent, so the email is not sent again.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// IsPermanent returns whether sending the email again cannot succeed: it
+// cannot be built, or the server refused it (5xx replies). Network errors
+// and the temporary refusals of the server (4xx replies) can be retried.
+func IsPermanent(err error) bool {
+	var permanent permanentError
+	if errors.As(err, &permanent) {
+		return true
+	}
+	var reply *textproto.Error
+	return errors.As(err, &reply) && reply.Code >= 500
+}
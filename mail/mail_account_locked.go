@@ -0,0 +1,54 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+type EmailAccountLockedPayload struct {
+	Admin       model.Member
+	Member      model.Member
+	IP          string
+	Attempts    int64
+	LockedUntil int64
+}
+
+// SendAccountLockedEmail tells an admin that the login of a member was
+// locked after too many failed attempts.
+func SendAccountLockedEmail(ctx context.Context, payload EmailAccountLockedPayload) error {
+	ctx, span := tracer.Start(ctx, "mail.SendAccountLockedEmail")
+	defer span.End()
+
+	lang := payload.Admin.Language
+	profileLink := common.GetConfigString("domain") + "/memberEdit/" + payload.Admin.UUID
+	location, err := common.LoadLocation(payload.Admin.Timezone)
+	if err != nil {
+		common.Error("%v\n", err)
+		return err
+	}
+	lockedUntil := time.Unix(payload.LockedUntil, 0).In(location).Format("02-01-2006 15:04")
+
+	email := emailInfo{}
+	email.Header = emailHeader{Title: common.Translate("account_locked_subject", lang)}
+	email.Top = emailTop{
+		Title:    common.Translate("greetings", lang) + " " + payload.Admin.FirstName,
+		Subtitle: common.Translate("account_locked_intro", lang),
+		To:       payload.Admin.Email,
+	}
+	email.MainSections = []emailMain{{
+		Title: payload.Member.FirstName + " " + payload.Member.LastName,
+		Text:  fmt.Sprintf(common.Translate("account_locked_text", lang), payload.Attempts, payload.IP, lockedUntil),
+	}}
+	email.Bottom = emailBottom{ProfileLink: profileLink, MyProfile: common.Translate("email_my_profile", lang), Suggestions: common.Translate("email_suggestions", lang)}
+	email.ImageSource = common.GetConfigString("cdn") + "/static/img/"
+
+	if err = sendMail(ctx, email); err != nil {
+		common.Error("Error sending Email: " + err.Error())
+		return err
+	}
+	return nil
+}
@@ -33,7 +33,7 @@ func SendCreateEventEmail(ctx context.Context, payload EmailCreateEventPayload)
 	defer span.End()
 
 	profileLink := common.GetConfigString("domain") + "/memberEdit/" + payload.Member.UUID
-	location, err := time.LoadLocation("America/Montreal")
+	location, err := common.LoadLocation(payload.Member.Timezone, payload.Event.Timezone)
 	if err != nil {
 		common.Error("%v\n", err)
 		return err
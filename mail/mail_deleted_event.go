@@ -2,6 +2,7 @@ package mail
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/vilisseranen/castellers/common"
@@ -11,6 +12,8 @@ import (
 type EmailDeletedEventPayload struct {
 	Member       model.Member `json:"member"`
 	EventDeleted model.Event  `json:"eventDeleted"`
+	// Number of events of the series cancelled, 0 for a single event
+	Occurrences int `json:"occurrences"`
 }
 
 func SendDeletedEventEmail(ctx context.Context, payload EmailDeletedEventPayload) error {
@@ -18,13 +21,18 @@ func SendDeletedEventEmail(ctx context.Context, payload EmailDeletedEventPayload
 	defer span.End()
 
 	profileLink := common.GetConfigString("domain") + "/memberEdit/" + payload.Member.UUID
-	location, err := time.LoadLocation("America/Montreal")
+	location, err := common.LoadLocation(payload.Member.Timezone, payload.EventDeleted.Timezone)
 	if err != nil {
 		common.Error("%v\n", err)
 		return err
 	}
 	eventDate := time.Unix(int64(payload.EventDeleted.StartDate), 0).In(location).Format("02-01-2006")
 
+	text := common.Translate("deleted_event_text", payload.Member.Language)
+	if payload.Occurrences > 1 {
+		text = fmt.Sprintf(common.Translate("deleted_event_series_text", payload.Member.Language), payload.Occurrences)
+	}
+
 	// Build email
 	email := emailInfo{}
 	email.Header = emailHeader{Title: common.Translate("deleted_event_subject", payload.Member.Language)}
@@ -34,7 +42,7 @@ func SendDeletedEventEmail(ctx context.Context, payload EmailDeletedEventPayload
 		To:       payload.Member.Email}
 	email.MainSections = []emailMain{{
 		Title: payload.EventDeleted.Name + " " + common.Translate("on_the", payload.Member.Language) + " " + eventDate + ".",
-		Text:  common.Translate("deleted_event_text", payload.Member.Language)}}
+		Text:  text}}
 	email.Actions = []emailAction{{}}
 	email.Bottom = emailBottom{ProfileLink: profileLink, MyProfile: common.Translate("email_my_profile", payload.Member.Language), Suggestions: common.Translate("email_suggestions", payload.Member.Language)}
 	email.ImageSource = common.GetConfigString("cdn") + "/static/img/"
@@ -0,0 +1,59 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+type EmailInactivityWarningPayload struct {
+	Member    model.Member
+	PauseDate int64
+}
+
+// SendInactivityWarningEmail tells a member that they will be paused for
+// inactivity unless they participate to an event before the pause date.
+func SendInactivityWarningEmail(ctx context.Context, payload EmailInactivityWarningPayload) error {
+	ctx, span := tracer.Start(ctx, "mail.SendInactivityWarningEmail")
+	defer span.End()
+
+	lang := payload.Member.Language
+	profileLink := common.GetConfigString("domain") + "/memberEdit/" + payload.Member.UUID
+	location, err := common.LoadLocation(payload.Member.Timezone)
+	if err != nil {
+		common.Error("%v\n", err)
+		return err
+	}
+	pauseDate := time.Unix(payload.PauseDate, 0).In(location).Format("02-01-2006")
+
+	email := emailInfo{}
+	email.Header = emailHeader{Title: common.Translate("inactivity_warning_subject", lang)}
+	email.Top = emailTop{
+		Title:    common.Translate("greetings", lang) + " " + payload.Member.FirstName,
+		Subtitle: common.Translate("inactivity_warning_intro", lang),
+		To:       payload.Member.Email,
+	}
+	email.MainSections = []emailMain{{
+		Title: common.Translate("inactivity_warning_title", lang),
+		Text:  fmt.Sprintf(common.Translate("inactivity_warning_text", lang), pauseDate),
+	}}
+	email.Actions = []emailAction{{
+		Title: common.Translate("inactivity_warning_action_title", lang),
+		Text:  common.Translate("inactivity_warning_action_text", lang),
+		Buttons: []Button{{
+			Text: common.Translate("inactivity_warning_action_button", lang),
+			Link: common.GetConfigString("domain"),
+		}},
+	}}
+	email.Bottom = emailBottom{ProfileLink: profileLink, MyProfile: common.Translate("email_my_profile", lang), Suggestions: common.Translate("email_suggestions", lang)}
+	email.ImageSource = common.GetConfigString("cdn") + "/static/img/"
+
+	if err = sendMail(ctx, email); err != nil {
+		common.Error("Error sending Email: " + err.Error())
+		return err
+	}
+	return nil
+}
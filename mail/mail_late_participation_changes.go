@@ -0,0 +1,133 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"time"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+type LateParticipationChange struct {
+	Member    model.Member
+	Author    model.Member
+	Answer    string
+	ChangedAt int64
+}
+
+type EmailLateParticipationChangesPayload struct {
+	Member  model.Member
+	Event   model.Event
+	Changes []LateParticipationChange
+}
+
+// SendLateParticipationChangesEmail sends an admin the answers changed by
+// admins after the answer deadline of an event.
+func SendLateParticipationChangesEmail(ctx context.Context, payload EmailLateParticipationChangesPayload) error {
+	ctx, span := tracer.Start(ctx, "mail.SendLateParticipationChangesEmail")
+	defer span.End()
+
+	lang := payload.Member.Language
+	profileLink := common.GetConfigString("domain") + "/memberEdit/" + payload.Member.UUID
+	location, err := common.LoadLocation(payload.Member.Timezone, payload.Event.Timezone)
+	if err != nil {
+		common.Error("%v\n", err)
+		return err
+	}
+	eventDate := time.Unix(int64(payload.Event.StartDate), 0).In(location).Format("02-01-2006")
+
+	table := lateChangesTable{
+		Member:   common.Translate("late_changes_member", lang),
+		Answer:   common.Translate("summary_answer", lang),
+		Author:   common.Translate("late_changes_author", lang),
+		Date:     common.Translate("late_changes_date", lang),
+		Answered: map[string]string{},
+	}
+	for _, answer := range []string{common.AnswerYes, common.AnswerNo, common.AnswerMaybe} {
+		table.Answered[answer] = common.Translate("late_changes_answer_"+answer, lang)
+	}
+	for _, change := range payload.Changes {
+		table.Changes = append(table.Changes, lateChangesRow{
+			Member: change.Member.FirstName + " " + change.Member.LastName,
+			Answer: change.Answer,
+			Author: change.Author.FirstName + " " + change.Author.LastName,
+			Date:   time.Unix(change.ChangedAt, 0).In(location).Format("02-01-2006 15:04"),
+		})
+	}
+	changesTable, err := lateParticipationChangesTable(table)
+	if err != nil {
+		return err
+	}
+
+	email := emailInfo{}
+	email.Header = emailHeader{Title: common.Translate("late_changes_subject", lang)}
+	email.Top = emailTop{
+		Title:    common.Translate("greetings", lang) + " " + payload.Member.FirstName,
+		Subtitle: common.Translate("late_changes_intro", lang),
+		To:       payload.Member.Email,
+	}
+	email.MainSections = []emailMain{{
+		Title: payload.Event.Name + " " + common.Translate("on_the", lang) + " " + eventDate + ".",
+		Text:  changesTable,
+	}}
+	email.Bottom = emailBottom{ProfileLink: profileLink, MyProfile: common.Translate("email_my_profile", lang), Suggestions: common.Translate("email_suggestions", lang)}
+	email.ImageSource = common.GetConfigString("cdn") + "/static/img/"
+
+	if err = sendMail(ctx, email); err != nil {
+		common.Error("Error sending Email: " + err.Error())
+		return err
+	}
+	return nil
+}
+
+type lateChangesRow struct {
+	Member string
+	Answer string
+	Author string
+	Date   string
+}
+
+type lateChangesTable struct {
+	Member   string
+	Answer   string
+	Author   string
+	Date     string
+	Answered map[string]string
+	Changes  []lateChangesRow
+}
+
+func lateParticipationChangesTable(table lateChangesTable) (string, error) {
+	const templateChanges = `              <table class="pure-table pure-table-bordered" style="border: 1px solid #ccc; margin: 50px auto;">
+	<thead style="background: #3498db; color: white; font-weight:bold;">
+	  <tr>
+		<th>{{ .Member }}</th>
+		<th>{{ .Answer }}</th>
+		<th>{{ .Author }}</th>
+		<th>{{ .Date }}</th>
+	  </tr>
+	</thead>
+	<tbody>
+	  {{ range .Changes }}
+	  <tr>
+		<td>{{ .Member }}</td>
+		<td>{{ index $.Answered .Answer }}</td>
+		<td>{{ .Author }}</td>
+		<td>{{ .Date }}</td>
+	  </tr>
+	  {{ end }}
+	</tbody>
+  </table>`
+	t, err := template.New("lateChanges").Parse(templateChanges)
+	if err != nil {
+		common.Error("Error parsing template: " + err.Error())
+		return "", err
+	}
+	buffer := new(bytes.Buffer)
+	if err = t.Execute(buffer, table); err != nil {
+		common.Error("Error generating template: " + err.Error())
+		return "", err
+	}
+	return buffer.String(), nil
+}
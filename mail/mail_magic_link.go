@@ -0,0 +1,52 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+type EmailMagicLinkPayload struct {
+	Member     model.Member
+	Token      string
+	TTLMinutes int
+}
+
+// SendMagicLinkEmail sends a member a link to login without password.
+func SendMagicLinkEmail(ctx context.Context, payload EmailMagicLinkPayload) error {
+	ctx, span := tracer.Start(ctx, "mail.SendMagicLinkEmail")
+	defer span.End()
+
+	lang := payload.Member.Language
+	loginLink := common.GetConfigString("domain") + "/login?t=" + payload.Token + "&a=magic"
+	profileLink := common.GetConfigString("domain") + "/memberEdit/" + payload.Member.UUID
+	email := emailInfo{}
+	email.Header = emailHeader{Title: common.Translate("magic_link_subject", lang)}
+	email.Top = emailTop{
+		Title:    common.Translate("greetings", lang) + " " + payload.Member.FirstName,
+		Subtitle: common.Translate("magic_link_intro", lang),
+		To:       payload.Member.Email,
+	}
+	email.MainSections = []emailMain{{
+		Title: common.Translate("forgot_reset_not_requested_title", lang),
+		Text:  common.Translate("forgot_reset_not_requested_text", lang),
+	}}
+	email.Actions = []emailAction{{
+		Title: common.Translate("magic_link_title", lang),
+		Text:  fmt.Sprintf(common.Translate("magic_link_text", lang), payload.TTLMinutes),
+		Buttons: []Button{{
+			Text: common.Translate("magic_link_button", lang),
+			Link: loginLink,
+		}},
+	}}
+	email.Bottom = emailBottom{ProfileLink: profileLink, MyProfile: common.Translate("email_my_profile", lang), Suggestions: common.Translate("email_suggestions", lang)}
+	email.ImageSource = common.GetConfigString("cdn") + "/static/img/"
+
+	if err := sendMail(ctx, email); err != nil {
+		common.Error("Error sending Email: " + err.Error())
+		return err
+	}
+	return nil
+}
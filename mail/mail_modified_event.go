@@ -3,6 +3,7 @@ package mail
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"text/template"
 	"time"
 
@@ -14,6 +15,8 @@ type EmailModifiedPayload struct {
 	Member            model.Member `json:"member"`
 	EventBeforeUpdate model.Event  `json:"eventBeforeUpdate"`
 	EventAfterUpdate  model.Event  `json:"eventAfterUpdate"`
+	// Number of events of the series affected, 0 for a single event
+	Occurrences int `json:"occurrences"`
 }
 
 type change struct {
@@ -27,7 +30,7 @@ func SendModifiedEventEmail(ctx context.Context, payload EmailModifiedPayload) e
 	defer span.End()
 
 	profileLink := common.GetConfigString("domain") + "/memberEdit/" + payload.Member.UUID
-	location, err := time.LoadLocation("America/Montreal")
+	location, err := common.LoadLocation(payload.Member.Timezone, payload.EventAfterUpdate.Timezone)
 	if err != nil {
 		common.Error("%v\n", err)
 		return err
@@ -67,6 +70,18 @@ func SendModifiedEventEmail(ctx context.Context, payload EmailModifiedPayload) e
 			Before: payload.EventBeforeUpdate.LocationName, After: payload.EventAfterUpdate.LocationName}
 		changes = append(changes, change)
 	}
+	if payload.EventBeforeUpdate.Recurring.Until != payload.EventAfterUpdate.Recurring.Until {
+		change := change{
+			Type:   common.Translate("modified_event_until", payload.Member.Language),
+			Before: time.Unix(int64(payload.EventBeforeUpdate.Recurring.Until), 0).In(location).Format("02-01-2006"),
+			After:  time.Unix(int64(payload.EventAfterUpdate.Recurring.Until), 0).In(location).Format("02-01-2006"),
+		}
+		changes = append(changes, change)
+	}
+	subtitle := common.Translate("modified_event_text", payload.Member.Language)
+	if payload.Occurrences > 1 {
+		subtitle = fmt.Sprintf(common.Translate("modified_event_series_text", payload.Member.Language), payload.Occurrences)
+	}
 
 	email := emailInfo{}
 	email.Header = emailHeader{common.Translate("modified_event_subject", payload.Member.Language)}
@@ -81,7 +96,7 @@ func SendModifiedEventEmail(ctx context.Context, payload EmailModifiedPayload) e
 	}
 	email.MainSections = []emailMain{{
 		Title:    payload.EventAfterUpdate.Name + " " + common.Translate("on_the", payload.Member.Language) + " " + eventDate + ".",
-		Subtitle: common.Translate("modified_event_text", payload.Member.Language),
+		Subtitle: subtitle,
 		Text:     changesString,
 	}}
 	email.Actions = []emailAction{{
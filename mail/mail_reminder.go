@@ -34,7 +34,7 @@ func SendReminderEmail(ctx context.Context, payload EmailReminderPayload) error
 	if payload.Participation.Answer == common.AnswerYes || payload.Participation.Answer == common.AnswerNo {
 		answer = "true"
 	}
-	location, err := time.LoadLocation("America/Montreal")
+	location, err := common.LoadLocation(payload.Member.Timezone, payload.Event.Timezone)
 	if err != nil {
 		common.Error("%v\n", err)
 		return err
@@ -60,6 +60,13 @@ func SendReminderEmail(ctx context.Context, payload EmailReminderPayload) error
 		mainSection.Text = common.Translate("reminder_please_answer", payload.Member.Language)
 	}
 	email.MainSections = []emailMain{mainSection}
+	if payload.Event.AnswerDeadline != 0 {
+		deadline := time.Unix(int64(payload.Event.AnswerDeadline), 0).In(location).Format("02-01-2006 15:04")
+		email.MainSections = append(email.MainSections, emailMain{
+			Title: common.Translate("reminder_deadline_title", payload.Member.Language),
+			Text:  fmt.Sprintf(common.Translate("reminder_deadline_text", payload.Member.Language), deadline),
+		})
+	}
 	if payload.Event.UniformRequired == 1 {
 		email.MainSections = append(email.MainSections, emailMain{
 			Title: common.Translate("reminder_uniform_title", payload.Member.Language),
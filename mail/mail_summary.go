@@ -23,7 +23,7 @@ func SendSummaryEmail(ctx context.Context, payload EmailSummaryPayload) error {
 
 	common.Debug("Send summary Event Email")
 	profileLink := common.GetConfigString("domain") + "/memberEdit/" + payload.Member.UUID
-	var location, err = time.LoadLocation("America/Montreal")
+	var location, err = common.LoadLocation(payload.Member.Timezone, payload.Event.Timezone)
 	if err != nil {
 		common.Error("%v\n", err)
 		return err
@@ -0,0 +1,58 @@
+package mail
+
+import (
+	"context"
+	"time"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+type EmailWaitingListPromotedPayload struct {
+	Member model.Member
+	Event  model.Event
+}
+
+// SendWaitingListPromotedEmail tells a member on the waiting list of an event
+// that a place was freed for them.
+func SendWaitingListPromotedEmail(ctx context.Context, payload EmailWaitingListPromotedPayload) error {
+	ctx, span := tracer.Start(ctx, "mail.SendWaitingListPromotedEmail")
+	defer span.End()
+
+	lang := payload.Member.Language
+	profileLink := common.GetConfigString("domain") + "/memberEdit/" + payload.Member.UUID
+	location, err := common.LoadLocation(payload.Member.Timezone, payload.Event.Timezone)
+	if err != nil {
+		common.Error("%v\n", err)
+		return err
+	}
+	eventDate := time.Unix(int64(payload.Event.StartDate), 0).In(location).Format("02-01-2006")
+
+	email := emailInfo{}
+	email.Header = emailHeader{Title: common.Translate("waiting_list_promoted_subject", lang)}
+	email.Top = emailTop{
+		Title:    common.Translate("greetings", lang) + " " + payload.Member.FirstName,
+		Subtitle: common.Translate("waiting_list_promoted_intro", lang),
+		To:       payload.Member.Email,
+	}
+	email.MainSections = []emailMain{{
+		Title: payload.Event.Name + " " + common.Translate("on_the", lang) + " " + eventDate + ".",
+		Text:  common.Translate("waiting_list_promoted_text", lang),
+	}}
+	email.Actions = []emailAction{{
+		Title: common.Translate("modified_event_action_title", lang),
+		Text:  common.Translate("modified_event_action_text", lang),
+		Buttons: []Button{{
+			Text: common.Translate("modified_event_action_button", lang),
+			Link: common.GetConfigString("domain") + "/eventShow/" + payload.Event.UUID,
+		}},
+	}}
+	email.Bottom = emailBottom{ProfileLink: profileLink, MyProfile: common.Translate("email_my_profile", lang), Suggestions: common.Translate("email_suggestions", lang)}
+	email.ImageSource = common.GetConfigString("cdn") + "/static/img/"
+
+	if err = sendMail(ctx, email); err != nil {
+		common.Error("Error sending Email: " + err.Error())
+		return err
+	}
+	return nil
+}
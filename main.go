@@ -1,7 +1,12 @@
 package main
 
 import (
+	"log"
+	"os"
+	"strconv"
+
 	"github.com/vilisseranen/castellers/app"
+	"github.com/vilisseranen/castellers/controller"
 )
 
 func main() {
@@ -10,5 +15,18 @@ func main() {
 	a.Initialize()
 	defer a.Close()
 
+	// castellers reencrypt [batch size]: re-encrypt the members after a key rotation
+	if len(os.Args) > 1 && os.Args[1] == "reencrypt" {
+		batchSize := controller.ReencryptDefaultBatchSize
+		if len(os.Args) > 2 {
+			var err error
+			if batchSize, err = strconv.Atoi(os.Args[2]); err != nil || batchSize < 1 {
+				log.Fatalf("Invalid batch size: %s", os.Args[2])
+			}
+		}
+		a.Reencrypt(batchSize)
+		return
+	}
+
 	a.Run(":8080")
 }
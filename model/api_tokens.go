@@ -0,0 +1,114 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const API_TOKENS_TABLE = "api_tokens"
+
+// Minimum time between two updates of the last use of a token
+const apiTokenLastUsedPrecision = 60
+
+// APIToken is a long-lived token of a member, for scripts and integrations.
+// Only the hash of the token is stored.
+type APIToken struct {
+	ID          string   `json:"id"`
+	MemberUUID  string   `json:"memberUuid"`
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"` // Among the permissions of the member
+	CreatedAt   int64    `json:"createdAt"`
+	ExpiresAt   int64    `json:"expiresAt"`  // 0 if it does not expire
+	LastUsedAt  int64    `json:"lastUsedAt"` // 0 if never used
+}
+
+const apiTokenColumns = "id, member_uuid, name, permissions, created_at, expires_at, last_used_at"
+
+func scanAPIToken(scan func(dest ...interface{}) error) (APIToken, error) {
+	var t APIToken
+	var permissions string
+	err := scan(&t.ID, &t.MemberUUID, &t.Name, &permissions, &t.CreatedAt, &t.ExpiresAt, &t.LastUsedAt)
+	t.Permissions = splitPermissions(permissions)
+	return t, err
+}
+
+// Create stores the token by its hash.
+func (t *APIToken) Create(ctx context.Context, tokenHash string) error {
+	ctx, span := tracer.Start(ctx, "APIToken.Create")
+	defer span.End()
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (id, member_uuid, name, token_hash, permissions, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		API_TOKENS_TABLE))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	t.CreatedAt = time.Now().Unix()
+	_, err = stmt.ExecContext(ctx, t.ID, t.MemberUUID, t.Name, tokenHash, strings.Join(t.Permissions, ","), t.CreatedAt, t.ExpiresAt)
+	return err
+}
+
+// GetAPITokenByHash returns the token with the hash, sql.ErrNoRows if there
+// is none.
+func GetAPITokenByHash(ctx context.Context, tokenHash string) (APIToken, error) {
+	ctx, span := tracer.Start(ctx, "GetAPITokenByHash")
+	defer span.End()
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf("SELECT %s FROM %s WHERE token_hash = ?", apiTokenColumns, API_TOKENS_TABLE))
+	if err != nil {
+		return APIToken{}, err
+	}
+	defer stmt.Close()
+	return scanAPIToken(stmt.QueryRowContext(ctx, tokenHash).Scan)
+}
+
+// GetMemberAPITokens returns the tokens of a member, the most recent first.
+func GetMemberAPITokens(ctx context.Context, memberUUID string) ([]APIToken, error) {
+	ctx, span := tracer.Start(ctx, "GetMemberAPITokens")
+	defer span.End()
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT %s FROM %s WHERE member_uuid = ? ORDER BY created_at DESC, id", apiTokenColumns, API_TOKENS_TABLE), memberUUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []APIToken{}
+	for rows.Next() {
+		t, err := scanAPIToken(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// Delete revokes the token of the member, sql.ErrNoRows if they have no
+// such token.
+func (t *APIToken) Delete(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "APIToken.Delete")
+	defer span.End()
+	result, err := db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE id = ? AND member_uuid = ?", API_TOKENS_TABLE), t.ID, t.MemberUUID)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	return nil
+}
+
+// SetLastUsed records the use of the token, at most once a minute.
+func (t *APIToken) SetLastUsed(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "APIToken.SetLastUsed")
+	defer span.End()
+	now := time.Now().Unix()
+	_, err := db.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET last_used_at = ? WHERE id = ? AND last_used_at <= ?", API_TOKENS_TABLE),
+		now, t.ID, now-apiTokenLastUsedPrecision)
+	return err
+}
@@ -0,0 +1,58 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const CALENDAR_TOKENS_TABLE = "calendar_tokens"
+
+// SetCalendarToken stores the hash of the member's calendar feed token,
+// replacing (and therefore revoking) any previous one.
+func (m *Member) SetCalendarToken(ctx context.Context, tokenHash string) error {
+	ctx, span := tracer.Start(ctx, "Member.SetCalendarToken")
+	defer span.End()
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(
+		"INSERT OR REPLACE INTO %s (member_uuid, token_hash, created_at) VALUES (?, ?, ?)", CALENDAR_TOKENS_TABLE))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx, m.UUID, tokenHash, time.Now().Unix())
+	return err
+}
+
+// RevokeCalendarToken deletes the member's calendar feed token.
+// Returns the number of tokens deleted (0 or 1).
+func (m *Member) RevokeCalendarToken(ctx context.Context) (int64, error) {
+	ctx, span := tracer.Start(ctx, "Member.RevokeCalendarToken")
+	defer span.End()
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(
+		"DELETE FROM %s WHERE member_uuid = ?", CALENDAR_TOKENS_TABLE))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	result, err := stmt.ExecContext(ctx, m.UUID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetMemberUUIDByCalendarToken returns the UUID of the member owning a
+// calendar feed token. Returns sql.ErrNoRows if the token is unknown.
+func GetMemberUUIDByCalendarToken(ctx context.Context, tokenHash string) (string, error) {
+	ctx, span := tracer.Start(ctx, "GetMemberUUIDByCalendarToken")
+	defer span.End()
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(
+		"SELECT member_uuid FROM %s WHERE token_hash = ?", CALENDAR_TOKENS_TABLE))
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+	var memberUUID string
+	err = stmt.QueryRowContext(ctx, tokenHash).Scan(&memberUUID)
+	return memberUUID, err
+}
@@ -392,3 +392,40 @@ func (c *CastellModel) DettachFromEvent(ctx context.Context, e *Event) error {
 	_, err = stmt.ExecContext(ctx, c.UUID, e.UUID)
 	return err
 }
+
+// GetMemberCastellModels returns the castell models where a member has a
+// position, each with the positions of this member only.
+func GetMemberCastellModels(ctx context.Context, memberUUID string) ([]CastellModel, error) {
+	ctx, span := tracer.Start(ctx, "GetMemberCastellModels")
+	defer span.End()
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(
+		"SELECT model_uuid, model_name, model_type, position_in_castell_name, position_in_castell_column, position_in_castell_cordon, position_in_castell_part FROM %s WHERE member_uuid = ? AND model_deleted=0 ORDER BY model_uuid",
+		CASTELLMODELSVIEW))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.QueryContext(ctx, memberUUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	models := []CastellModel{}
+	for rows.Next() {
+		var c CastellModel
+		p := CastellPositionMembers{MemberUUID: memberUUID}
+		if err = rows.Scan(&c.UUID, &c.Name, &c.Type, &p.Position.Name, &p.Position.Column, &p.Position.Cordon, &p.Position.Part); err != nil {
+			return nil, err
+		}
+		if last := len(models) - 1; last >= 0 && models[last].UUID == c.UUID {
+			models[last].PositionMembers = append(models[last].PositionMembers, p)
+			continue
+		}
+		c.PositionMembers = []CastellPositionMembers{p}
+		models = append(models, c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return models, nil
+}
@@ -0,0 +1,231 @@
+package model
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vilisseranen/castellers/common"
+)
+
+// Encrypted columns of the members table
+var membersEncryptedColumns = []string{"firstName", "lastName", "height", "weight", "roles", "extra", "email", "contact"}
+
+// ReencryptMembers encrypts again with the current key the members whose
+// fields were encrypted with another one, and updates their blind index.
+// The audit log is re-encrypted too.
+// Members are processed in batches, each in its own transaction: if
+// interrupted, running it again skips the members already done.
+// Returns the number of members re-encrypted.
+func ReencryptMembers(ctx context.Context, batchSize int) (int, error) {
+	ctx, span := tracer.Start(ctx, "ReencryptMembers")
+	defer span.End()
+
+	reencrypted := 0
+	lastUUID := ""
+	for {
+		done, last, err := reencryptMembersBatch(ctx, lastUUID, batchSize)
+		if err != nil {
+			return reencrypted, err
+		}
+		if last == "" {
+			break
+		}
+		reencrypted += done
+		lastUUID = last
+		common.Info("Re-encrypted %d members, up to %s", reencrypted, lastUUID)
+	}
+	entries := 0
+	var lastID int64
+	for {
+		done, last, err := reencryptMemberAuditLogBatch(ctx, lastID, batchSize)
+		if err != nil {
+			return reencrypted, err
+		}
+		if last == 0 {
+			break
+		}
+		entries += done
+		lastID = last
+	}
+	common.Info("Re-encrypted %d entries of the audit log", entries)
+	secrets, err := reencryptTOTPSecrets(ctx)
+	if err != nil {
+		return reencrypted, err
+	}
+	common.Info("Re-encrypted %d second factor secrets", secrets)
+	return reencrypted, nil
+}
+
+// reencryptTOTPSecrets re-encrypts the secrets of the second factors, in
+// one transaction since there is at most one per member.
+func reencryptTOTPSecrets(ctx context.Context) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT uuid, secret FROM %s", MEMBERSTOTPTABLE))
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	secrets := map[string][]byte{}
+	for rows.Next() {
+		var uuid string
+		var secret []byte
+		if err := rows.Scan(&uuid, &secret); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return 0, err
+		}
+		if common.NeedsReencryption(secret) {
+			secrets[uuid] = secret
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	for uuid, secret := range secrets {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET secret = ? WHERE uuid = ?", MEMBERSTOTPTABLE),
+			common.Encrypt(common.Decrypt(secret)), uuid); err != nil {
+			tx.Rollback()
+			common.Error("Error re-encrypting the second factor of %s: %v", uuid, err)
+			return 0, err
+		}
+	}
+	return len(secrets), tx.Commit()
+}
+
+// reencryptMembersBatch re-encrypts the members of the batch after
+// afterUUID. Returns the number of members re-encrypted and the last UUID of
+// the batch, empty when there are no more members.
+func reencryptMembersBatch(ctx context.Context, afterUUID string, batchSize int) (int, string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(
+		"SELECT uuid, firstName, lastName, height, weight, roles, extra, email, contact, COALESCE(email_index, '') FROM %s WHERE uuid > ? ORDER BY uuid LIMIT ?",
+		MEMBERSTABLE), afterUUID, batchSize)
+	if err != nil {
+		tx.Rollback()
+		return 0, "", err
+	}
+	type encryptedMember struct {
+		uuid       string
+		values     []string
+		emailIndex string
+	}
+	members := []encryptedMember{}
+	for rows.Next() {
+		m := encryptedMember{values: make([]string, len(membersEncryptedColumns))}
+		if err := rows.Scan(&m.uuid, &m.values[0], &m.values[1], &m.values[2], &m.values[3], &m.values[4], &m.values[5], &m.values[6], &m.values[7], &m.emailIndex); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return 0, "", err
+		}
+		members = append(members, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return 0, "", err
+	}
+	if len(members) == 0 {
+		return 0, "", tx.Rollback()
+	}
+
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(
+		"UPDATE %s SET firstName = ?, lastName = ?, height = ?, weight = ?, roles = ?, extra = ?, email = ?, contact = ?, email_index = ? WHERE uuid = ?",
+		MEMBERSTABLE))
+	if err != nil {
+		tx.Rollback()
+		return 0, "", err
+	}
+	defer stmt.Close()
+	reencrypted := 0
+	for _, m := range members {
+		email := common.Decrypt([]byte(m.values[6]))
+		emailIndex := common.BlindIndex(email)
+		needed := m.emailIndex != emailIndex
+		for _, value := range m.values {
+			needed = needed || common.NeedsReencryption([]byte(value))
+		}
+		if !needed {
+			continue
+		}
+		args := []interface{}{}
+		for _, value := range m.values {
+			args = append(args, common.Encrypt(common.Decrypt([]byte(value))))
+		}
+		args = append(args, emailIndex, m.uuid)
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			tx.Rollback()
+			common.Error("Error re-encrypting member %s: %v", m.uuid, err)
+			return 0, "", err
+		}
+		reencrypted++
+	}
+	return reencrypted, members[len(members)-1].uuid, tx.Commit()
+}
+
+// reencryptMemberAuditLogBatch re-encrypts the audit log entries of the
+// batch after afterID. Returns the number of entries re-encrypted and the
+// last ID of the batch, 0 when there are no more entries.
+func reencryptMemberAuditLogBatch(ctx context.Context, afterID int64, batchSize int) (int, int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(
+		"SELECT id, encrypted_changes FROM %s WHERE id > ? ORDER BY id LIMIT ?",
+		MEMBER_AUDIT_LOG_TABLE), afterID, batchSize)
+	if err != nil {
+		tx.Rollback()
+		return 0, 0, err
+	}
+	type encryptedEntry struct {
+		id      int64
+		changes []byte
+	}
+	entries := []encryptedEntry{}
+	for rows.Next() {
+		var e encryptedEntry
+		if err := rows.Scan(&e.id, &e.changes); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return 0, 0, err
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return 0, 0, err
+	}
+	if len(entries) == 0 {
+		return 0, 0, tx.Rollback()
+	}
+
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(
+		"UPDATE %s SET encrypted_changes = ? WHERE id = ?", MEMBER_AUDIT_LOG_TABLE))
+	if err != nil {
+		tx.Rollback()
+		return 0, 0, err
+	}
+	defer stmt.Close()
+	reencrypted := 0
+	for _, e := range entries {
+		if len(e.changes) == 0 || !common.NeedsReencryption(e.changes) {
+			continue
+		}
+		if _, err := stmt.ExecContext(ctx, common.Encrypt(common.Decrypt(e.changes)), e.id); err != nil {
+			tx.Rollback()
+			common.Error("Error re-encrypting audit log entry %d: %v", e.id, err)
+			return 0, 0, err
+		}
+		reencrypted++
+	}
+	return reencrypted, entries[len(entries)-1].id, tx.Commit()
+}
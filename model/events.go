@@ -16,6 +16,8 @@ const EVENTS_TABLE = "events"
 type Recurring struct {
 	Interval string `json:"interval"`
 	Until    uint   `json:"until"`
+	RRule    string `json:"rrule"`
+	ExDates  []uint `json:"exdates"`
 }
 
 type LatLng struct {
@@ -36,28 +38,34 @@ type Event struct {
 	Location        LatLng    `json:"location"`
 	LocationName    string    `json:"locationName"`
 	UniformRequired int       `json:"uniformRequired"`
+	Timezone        string    `json:"timezone"`       // Empty for the organisation timezone
+	Capacity        uint      `json:"capacity"`       // Maximum number of participants, 0 for no limit
+	AnswerDeadline  uint      `json:"answerDeadline"` // Members cannot change their answer after, 0 for no deadline
+	Waitlisted      int       `json:"waitlisted"`
 	RecurringEvent  string
 }
 
 func (e *Event) Get(ctx context.Context) error {
 	ctx, span := tracer.Start(ctx, "Event.Get")
 	defer span.End()
-	stmt, err := db.PrepareContext(ctx, fmt.Sprintf("SELECT name, startDate, endDate, type, description, locationName, lat, lng, uniformRequired FROM %s WHERE uuid= ? AND deleted=0", EVENTS_TABLE))
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf("SELECT name, startDate, endDate, type, description, locationName, lat, lng, uniformRequired, timezone, capacity, answerDeadline, recurringEvent FROM %s WHERE uuid= ? AND deleted=0", EVENTS_TABLE))
 	if err != nil {
 		common.Fatal(err.Error())
 	}
 	defer stmt.Close()
-	var description, locationName sql.NullString // to manage possible NULL fields
-	err = stmt.QueryRowContext(ctx, e.UUID).Scan(&e.Name, &e.StartDate, &e.EndDate, &e.Type, &description, &locationName, &e.Location.Lat, &e.Location.Lng, &e.UniformRequired)
+	var description, locationName, timezone, recurringEvent sql.NullString // to manage possible NULL fields
+	err = stmt.QueryRowContext(ctx, e.UUID).Scan(&e.Name, &e.StartDate, &e.EndDate, &e.Type, &description, &locationName, &e.Location.Lat, &e.Location.Lng, &e.UniformRequired, &timezone, &e.Capacity, &e.AnswerDeadline, &recurringEvent)
 	e.Description = nullToEmptyString(description)
 	e.LocationName = nullToEmptyString(locationName)
+	e.Timezone = nullToEmptyString(timezone)
+	e.RecurringEvent = nullToEmptyString(recurringEvent)
 	return err
 }
 
 func (e *Event) GetAttendance(ctx context.Context) error {
 	ctx, span := tracer.Start(ctx, "Event.GetAttendance")
 	defer span.End()
-	stmt, err := db.PrepareContext(ctx, fmt.Sprintf("SELECT COUNT(answer) FROM %s WHERE event_uuid= ? AND (presence = 'yes' OR (presence != 'no' AND answer = 'yes'))", PARTICIPATION_TABLE))
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf("SELECT COUNT(answer) FROM %s WHERE event_uuid= ? AND (presence = 'yes' OR (presence != 'no' AND answer = 'yes' AND waitlisted_at IS NULL))", PARTICIPATION_TABLE))
 	if err != nil {
 		common.Fatal(err.Error())
 	}
@@ -73,9 +81,9 @@ func (e *Event) GetAll(ctx context.Context, page, limit int, pastEvents bool) ([
 	offset := page * limit
 	queryString := ""
 	if pastEvents {
-		queryString = fmt.Sprintf("SELECT uuid, name, startDate, endDate, type, uniformRequired FROM %s WHERE endDate < ? AND deleted=0 ORDER BY startDate DESC LIMIT ? OFFSET ?", EVENTS_TABLE)
+		queryString = fmt.Sprintf("SELECT uuid, name, startDate, endDate, type, description, locationName, lat, lng, uniformRequired, timezone, capacity, answerDeadline FROM %s WHERE endDate < ? AND deleted=0 ORDER BY startDate DESC LIMIT ? OFFSET ?", EVENTS_TABLE)
 	} else {
-		queryString = fmt.Sprintf("SELECT uuid, name, startDate, endDate, type, uniformRequired FROM %s WHERE endDate >= ? AND deleted=0 ORDER BY startDate LIMIT ? OFFSET ?", EVENTS_TABLE)
+		queryString = fmt.Sprintf("SELECT uuid, name, startDate, endDate, type, description, locationName, lat, lng, uniformRequired, timezone, capacity, answerDeadline FROM %s WHERE endDate >= ? AND deleted=0 ORDER BY startDate LIMIT ? OFFSET ?", EVENTS_TABLE)
 	}
 	rows, err := db.QueryContext(ctx, queryString, now, limit, offset)
 	if err != nil {
@@ -87,9 +95,13 @@ func (e *Event) GetAll(ctx context.Context, page, limit int, pastEvents bool) ([
 
 	for rows.Next() {
 		var e Event
-		if err = rows.Scan(&e.UUID, &e.Name, &e.StartDate, &e.EndDate, &e.Type, &e.UniformRequired); err != nil {
+		var description, locationName, timezone sql.NullString // to manage possible NULL fields
+		if err = rows.Scan(&e.UUID, &e.Name, &e.StartDate, &e.EndDate, &e.Type, &description, &locationName, &e.Location.Lat, &e.Location.Lng, &e.UniformRequired, &timezone, &e.Capacity, &e.AnswerDeadline); err != nil {
 			return nil, err
 		}
+		e.Description = nullToEmptyString(description)
+		e.LocationName = nullToEmptyString(locationName)
+		e.Timezone = nullToEmptyString(timezone)
 		Events = append(Events, e)
 	}
 	if err = rows.Err(); err != nil {
@@ -101,7 +113,7 @@ func (e *Event) GetAll(ctx context.Context, page, limit int, pastEvents bool) ([
 func (e *Event) UpdateEvent(ctx context.Context) error {
 	ctx, span := tracer.Start(ctx, "Event.UpdateEvent")
 	defer span.End()
-	stmt, err := db.PrepareContext(ctx, fmt.Sprintf("Update %s SET name = ?, startDate = ?, endDate = ?, type = ?, description = ?, locationName = ?, lat = ?, lng = ?, uniformRequired = ? WHERE uuid= ?", EVENTS_TABLE))
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf("Update %s SET name = ?, startDate = ?, endDate = ?, type = ?, description = ?, locationName = ?, lat = ?, lng = ?, uniformRequired = ?, timezone = ?, capacity = ?, answerDeadline = ? WHERE uuid= ?", EVENTS_TABLE))
 	if err != nil {
 		common.Fatal(err.Error())
 	}
@@ -117,6 +129,9 @@ func (e *Event) UpdateEvent(ctx context.Context) error {
 		e.Location.Lat,
 		e.Location.Lng,
 		e.UniformRequired,
+		stringOrNull(e.Timezone),
+		e.Capacity,
+		e.AnswerDeadline,
 		e.UUID)
 	return err
 }
@@ -133,18 +148,62 @@ func (e *Event) DeleteEvent(ctx context.Context) error {
 	return err
 }
 
-func (e *Event) CreateEvent(ctx context.Context) error {
-	ctx, span := tracer.Start(ctx, "Event.CreateEvent")
-	defer span.End()
-	stmt, err := db.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %s (uuid, name, startDate, endDate, recurringEvent, description, type, locationName, lat, lng, uniformRequired) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", EVENTS_TABLE))
+// updateEvents updates several events in the transaction.
+func updateEvents(ctx context.Context, tx *sql.Tx, events []Event) error {
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("UPDATE %s SET name = ?, startDate = ?, endDate = ?, type = ?, description = ?, locationName = ?, lat = ?, lng = ?, uniformRequired = ?, timezone = ?, capacity = ?, answerDeadline = ? WHERE uuid= ?", EVENTS_TABLE))
 	if err != nil {
-		common.Error(err.Error())
-		common.Error("%v\n", e)
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.ExecContext(
+	for _, e := range events {
+		if _, err := stmt.ExecContext(
+			ctx,
+			e.Name,
+			e.StartDate,
+			e.EndDate,
+			e.Type,
+			stringOrNull(e.Description),
+			stringOrNull(e.LocationName),
+			e.Location.Lat,
+			e.Location.Lng,
+			e.UniformRequired,
+			stringOrNull(e.Timezone),
+			e.Capacity,
+			e.AnswerDeadline,
+			e.UUID); err != nil {
+			common.Error("Error updating event %s: %v", e.UUID, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteEvents flags several events as deleted in the transaction.
+func deleteEvents(ctx context.Context, tx *sql.Tx, events []Event) error {
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("UPDATE %s SET deleted=1 WHERE uuid= ?", EVENTS_TABLE))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, e := range events {
+		if _, err := stmt.ExecContext(ctx, e.UUID); err != nil {
+			common.Error("Error deleting event %s: %v", e.UUID, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Event) CreateEvent(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "Event.CreateEvent")
+	defer span.End()
+	return e.create(ctx, db)
+}
+
+func (e *Event) create(ctx context.Context, q dbExecutor) error {
+	_, err := q.ExecContext(
 		ctx,
+		fmt.Sprintf("INSERT INTO %s (uuid, name, startDate, endDate, recurringEvent, description, type, locationName, lat, lng, uniformRequired, timezone, capacity, answerDeadline) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", EVENTS_TABLE),
 		e.UUID,
 		e.Name,
 		e.StartDate,
@@ -155,12 +214,13 @@ func (e *Event) CreateEvent(ctx context.Context) error {
 		stringOrNull(e.LocationName),
 		e.Location.Lat,
 		e.Location.Lng,
-		e.UniformRequired)
+		e.UniformRequired,
+		stringOrNull(e.Timezone),
+		e.Capacity,
+		e.AnswerDeadline)
 	if err != nil {
-		stmt.Close()
 		common.Error(err.Error())
 		common.Error("%v\n", e)
-		return err
 	}
 	return err
 }
@@ -169,7 +229,7 @@ func (e *Event) GetUpcomingEventsWithoutNotification(ctx context.Context, eventT
 	ctx, span := tracer.Start(ctx, "Event.GetUpcomingEventsWithoutNotification")
 	defer span.End()
 	rows, err := db.QueryContext(ctx, fmt.Sprintf(
-		"SELECT uuid, startDate FROM %s WHERE startDate > ? AND uuid NOT IN (SELECT objectUUID FROM notifications WHERE notificationType = ?) AND deleted=0 ORDER BY startDate",
+		"SELECT uuid, startDate, answerDeadline FROM %s WHERE startDate > ? AND uuid NOT IN (SELECT objectUUID FROM notifications WHERE notificationType = ?) AND deleted=0 ORDER BY startDate",
 		EVENTS_TABLE), time.Now().Unix(), eventType)
 	if err != nil {
 		common.Fatal(err.Error())
@@ -180,7 +240,7 @@ func (e *Event) GetUpcomingEventsWithoutNotification(ctx context.Context, eventT
 
 	for rows.Next() {
 		var e Event
-		if err = rows.Scan(&e.UUID, &e.StartDate); err != nil {
+		if err = rows.Scan(&e.UUID, &e.StartDate, &e.AnswerDeadline); err != nil {
 			return nil, err
 		}
 		Events = append(Events, e)
@@ -190,3 +250,8 @@ func (e *Event) GetUpcomingEventsWithoutNotification(ctx context.Context, eventT
 	}
 	return Events, nil
 }
+
+// AnswersClosed is true when the answer deadline of the event has passed
+func (e *Event) AnswersClosed() bool {
+	return e.AnswerDeadline != 0 && uint(time.Now().Unix()) > e.AnswerDeadline
+}
@@ -0,0 +1,54 @@
+package model
+
+import (
+	"context"
+	"fmt"
+)
+
+// Inactivity is what the inactivity scan knows about a member, besides
+// their participations.
+type Inactivity struct {
+	Exempt           bool  `json:"exempt"`           // Never paused by the inactivity scan
+	LastActivityDate int64 `json:"lastActivityDate"` // Manual reactivation, 0 if never
+	WarnedAt         int64 `json:"warnedAt"`         // Last inactivity warning, 0 if never
+}
+
+// GetInactivity returns the inactivity data of the member.
+func (m *Member) GetInactivity(ctx context.Context) (Inactivity, error) {
+	ctx, span := tracer.Start(ctx, "Member.GetInactivity")
+	defer span.End()
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(
+		"SELECT inactivity_exempt, last_activity_date, inactivity_warned_at FROM %s WHERE uuid = ?", MEMBERSTABLE))
+	if err != nil {
+		return Inactivity{}, err
+	}
+	defer stmt.Close()
+	var inactivity Inactivity
+	err = stmt.QueryRowContext(ctx, m.UUID).Scan(&inactivity.Exempt, &inactivity.LastActivityDate, &inactivity.WarnedAt)
+	return inactivity, err
+}
+
+// SetInactivityExempt exempts the member from the inactivity scan, or not.
+func (m *Member) SetInactivityExempt(ctx context.Context, exempt bool) error {
+	ctx, span := tracer.Start(ctx, "Member.SetInactivityExempt")
+	defer span.End()
+	return m.setInactivityColumn(ctx, "inactivity_exempt", exempt)
+}
+
+// SetInactivityWarnedAt stamps the date (Unix seconds) of the last
+// inactivity warning.
+func (m *Member) SetInactivityWarnedAt(ctx context.Context, date int64) error {
+	ctx, span := tracer.Start(ctx, "Member.SetInactivityWarnedAt")
+	defer span.End()
+	return m.setInactivityColumn(ctx, "inactivity_warned_at", date)
+}
+
+func (m *Member) setInactivityColumn(ctx context.Context, column string, value interface{}) error {
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf("UPDATE %s SET %s = ? WHERE uuid = ?", MEMBERSTABLE, column))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx, value, m.UUID)
+	return err
+}
@@ -0,0 +1,86 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const LATE_PARTICIPATION_CHANGES_TABLE = "late_participation_changes"
+
+// A LateParticipationChange is an answer changed by an admin after the
+// answer deadline of an event.
+type LateParticipationChange struct {
+	ID         int64  `json:"id"`
+	EventUUID  string `json:"eventUuid"`
+	MemberUUID string `json:"memberUuid"`
+	AuthorUUID string `json:"authorUuid"`
+	Answer     string `json:"answer"`
+	ChangedAt  int64  `json:"changedAt"`
+}
+
+func (c *LateParticipationChange) CreateLateParticipationChange(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "LateParticipationChange.CreateLateParticipationChange")
+	defer span.End()
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (event_uuid, member_uuid, author_uuid, answer, changed_at) VALUES (?, ?, ?, ?, ?)", LATE_PARTICIPATION_CHANGES_TABLE))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	c.ChangedAt = time.Now().Unix()
+	result, err := stmt.ExecContext(ctx, c.EventUUID, c.MemberUUID, c.AuthorUUID, c.Answer, c.ChangedAt)
+	if err != nil {
+		return err
+	}
+	c.ID, err = result.LastInsertId()
+	return err
+}
+
+// GetLateParticipationChanges returns the late changes of an event, oldest
+// first.
+func GetLateParticipationChanges(ctx context.Context, eventUUID string) ([]LateParticipationChange, error) {
+	ctx, span := tracer.Start(ctx, "GetLateParticipationChanges")
+	defer span.End()
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT id, event_uuid, member_uuid, author_uuid, answer, changed_at FROM %s WHERE event_uuid = ? ORDER BY id",
+		LATE_PARTICIPATION_CHANGES_TABLE), eventUUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := []LateParticipationChange{}
+	for rows.Next() {
+		var c LateParticipationChange
+		if err := rows.Scan(&c.ID, &c.EventUUID, &c.MemberUUID, &c.AuthorUUID, &c.Answer, &c.ChangedAt); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// GetLateParticipationChangesSent returns, by admin, the last late change of
+// an event that was sent to them, by any notification.
+func GetLateParticipationChangesSent(ctx context.Context, eventUUID string) (map[string]int64, error) {
+	ctx, span := tracer.Start(ctx, "GetLateParticipationChangesSent")
+	defer span.End()
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT r.member_uuid, MAX(r.last_change_id) FROM %s r JOIN %s n ON n.id = r.notification_id "+
+			"WHERE n.notificationType = ? AND n.objectUUID = ? AND r.delivered = ? GROUP BY r.member_uuid",
+		NOTIFICATION_RECIPIENTS_TABLE, notificationsTable), TypeLateParticipationChanges, eventUUID, NotificationDeliverySuccess)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sent := map[string]int64{}
+	for rows.Next() {
+		var memberUUID string
+		var lastID int64
+		if err := rows.Scan(&memberUUID, &lastID); err != nil {
+			return nil, err
+		}
+		sent[memberUUID] = lastID
+	}
+	return sent, rows.Err()
+}
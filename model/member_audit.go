@@ -0,0 +1,170 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vilisseranen/castellers/common"
+)
+
+const MEMBER_AUDIT_LOG_TABLE = "member_audit_log"
+
+const (
+	MEMBERAUDITCREATE = "create"
+	MEMBERAUDITUPDATE = "update"
+	MEMBERAUDITSTATUS = "status"
+	MEMBERAUDITDELETE = "delete"
+	MEMBERAUDITPURGE  = "purge"
+
+	// Actor of the changes made by the scheduler
+	MEMBERAUDITACTORSYSTEM = "system"
+)
+
+// MemberAuditChange is the change of a field of a member.
+type MemberAuditChange struct {
+	Field     string `json:"field"`
+	Before    string `json:"before"`
+	After     string `json:"after"`
+	Encrypted bool   `json:"encrypted,omitempty"`
+}
+
+// MemberAuditEntry is a change made to a member, by an admin, the member
+// themselves or the scheduler. Entries are only ever added.
+type MemberAuditEntry struct {
+	ID         int64               `json:"id"`
+	CreatedAt  int64               `json:"createdAt"`
+	ActorUUID  string              `json:"actorUuid"`
+	MemberUUID string              `json:"memberUuid"`
+	Action     string              `json:"action"`
+	Changes    []MemberAuditChange `json:"changes"`
+}
+
+// MemberDiff returns the fields that differ between two versions of a
+// member, in clear: encrypted fields are marked and encrypted when stored.
+func MemberDiff(before, after Member) []MemberAuditChange {
+	fields := []MemberAuditChange{
+		{"firstName", before.FirstName, after.FirstName, true},
+		{"lastName", before.LastName, after.LastName, true},
+		{"height", before.Height, after.Height, true},
+		{"weight", before.Weight, after.Weight, true},
+		{"roles", sortedRoles(before.Roles), sortedRoles(after.Roles), true},
+		{"extra", before.Extra, after.Extra, true},
+		{"email", before.Email, after.Email, true},
+		{"contact", before.Contact, after.Contact, true},
+		{"type", before.Type, after.Type, false},
+		{"status", before.Status, after.Status, false},
+		{"language", before.Language, after.Language, false},
+		{"timezone", before.Timezone, after.Timezone, false},
+		{"subscribed", strconv.Itoa(before.Subscribed), strconv.Itoa(after.Subscribed), false},
+	}
+	changes := []MemberAuditChange{}
+	for _, field := range fields {
+		if field.Before != field.After {
+			changes = append(changes, field)
+		}
+	}
+	return changes
+}
+
+// sortedRoles joins roles in order, since the validation sorts them
+func sortedRoles(roles []string) string {
+	sorted := append([]string{}, roles...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// Create adds the entry to the audit log. The changes of encrypted fields
+// are stored encrypted.
+func (e *MemberAuditEntry) Create(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "MemberAuditEntry.Create")
+	defer span.End()
+	return e.create(ctx, db)
+}
+
+func (e *MemberAuditEntry) create(ctx context.Context, q dbExecutor) error {
+	plain := []MemberAuditChange{}
+	encrypted := []MemberAuditChange{}
+	for _, change := range e.Changes {
+		if change.Encrypted {
+			encrypted = append(encrypted, change)
+		} else {
+			plain = append(plain, change)
+		}
+	}
+	plainJSON, err := json.Marshal(plain)
+	if err != nil {
+		return err
+	}
+	var encryptedChanges []byte
+	if len(encrypted) > 0 {
+		encryptedJSON, err := json.Marshal(encrypted)
+		if err != nil {
+			return err
+		}
+		encryptedChanges = common.Encrypt(string(encryptedJSON))
+	}
+	e.CreatedAt = time.Now().Unix()
+	result, err := q.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (created_at, actor_uuid, member_uuid, action, changes, encrypted_changes) VALUES (?, ?, ?, ?, ?, ?)",
+		MEMBER_AUDIT_LOG_TABLE), e.CreatedAt, e.ActorUUID, e.MemberUUID, e.Action, string(plainJSON), encryptedChanges)
+	if err != nil {
+		return err
+	}
+	e.ID, err = result.LastInsertId()
+	return err
+}
+
+// GetMemberAuditLog returns the audit log, most recent first, of a member or
+// of every member if memberUUID is empty. Only the entries before the ID
+// beforeID are returned if it is not 0, at most limit entries.
+func GetMemberAuditLog(ctx context.Context, memberUUID string, beforeID int64, limit int) ([]MemberAuditEntry, error) {
+	ctx, span := tracer.Start(ctx, "GetMemberAuditLog")
+	defer span.End()
+
+	filters := []string{"1 = 1"}
+	queryValues := []interface{}{}
+	if memberUUID != "" {
+		filters = append(filters, "member_uuid = ?")
+		queryValues = append(queryValues, memberUUID)
+	}
+	if beforeID > 0 {
+		filters = append(filters, "id < ?")
+		queryValues = append(queryValues, beforeID)
+	}
+	queryValues = append(queryValues, limit)
+	query := fmt.Sprintf(
+		"SELECT id, created_at, actor_uuid, member_uuid, action, changes, encrypted_changes FROM %s WHERE %s ORDER BY id DESC LIMIT ?",
+		MEMBER_AUDIT_LOG_TABLE, strings.Join(filters, " AND "))
+	common.Debug("SQL query: %s; params(values=%v)", query, queryValues)
+	rows, err := db.QueryContext(ctx, query, queryValues...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []MemberAuditEntry{}
+	for rows.Next() {
+		var e MemberAuditEntry
+		var changes string
+		var encryptedChanges []byte
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.ActorUUID, &e.MemberUUID, &e.Action, &changes, &encryptedChanges); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(changes), &e.Changes); err != nil {
+			return nil, err
+		}
+		if len(encryptedChanges) > 0 {
+			var decrypted []MemberAuditChange
+			if err := json.Unmarshal([]byte(common.Decrypt(encryptedChanges)), &decrypted); err != nil {
+				return nil, err
+			}
+			e.Changes = append(decrypted, e.Changes...)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
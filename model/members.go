@@ -2,6 +2,7 @@ package model
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"strings"
@@ -43,8 +44,10 @@ type Member struct {
 	Status        string   `json:"status"`
 	Subscribed    int      `json:"subscribed"`
 	Language      string   `json:"language"`
+	Timezone      string   `json:"timezone"` // Empty for the organisation timezone
 	Participation string   `json:"participation"`
 	Presence      string   `json:"presence"`
+	Waitlisted    int      `json:"waitlisted"`
 }
 
 type Credentials struct {
@@ -61,11 +64,25 @@ func (m *Member) CreateMember(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	if err = insertMember(ctx, tx, m); err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		common.Error("%v\n", err)
+		tx.Rollback()
+	}
+	return err
+}
+
+// insertMember creates the member in the transaction, with the status
+// created.
+func insertMember(ctx context.Context, tx *sql.Tx, m *Member) error {
 	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(
-		"INSERT INTO %s (uuid, firstName, lastName, height, weight, roles, extra, type, email, contact, language) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		"INSERT INTO %s (uuid, firstName, lastName, height, weight, roles, extra, type, email, email_index, contact, language, timezone) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 		MEMBERSTABLE))
 	if err != nil {
-		tx.Rollback()
 		common.Error("Error: %v on member: %v", err.Error(), m)
 		return err
 	}
@@ -81,19 +98,15 @@ func (m *Member) CreateMember(ctx context.Context) error {
 		common.Encrypt(m.Extra),
 		m.Type,
 		common.Encrypt(m.Email),
+		common.BlindIndex(m.Email),
 		common.Encrypt(m.Contact),
-		stringOrNull(m.Language))
+		stringOrNull(m.Language),
+		stringOrNull(m.Timezone))
 	if err != nil {
-		tx.Rollback()
 		common.Error("Error: %v on member: %v", err.Error(), m)
 		return err
 	}
-	err = tx.Commit()
-	if err != nil {
-		common.Error("%v\n", err)
-		tx.Rollback()
-	}
-	return err
+	return recordStatusChange(ctx, tx, m.UUID, "", MEMBERSSTATUSCREATED, STATUSCAUSECREATION)
 }
 
 func (m *Member) EditMember(ctx context.Context) error {
@@ -104,7 +117,7 @@ func (m *Member) EditMember(ctx context.Context) error {
 		return err
 	}
 	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(
-		"UPDATE %s SET firstName=?, lastName=?, height=?, weight=?, roles=?, extra=?, type=?, email=?, contact=?, language=?, subscribed=? WHERE uuid=?",
+		"UPDATE %s SET firstName=?, lastName=?, height=?, weight=?, roles=?, extra=?, type=?, email=?, email_index=?, contact=?, language=?, timezone=?, subscribed=? WHERE uuid=?",
 		MEMBERSTABLE))
 	if err != nil {
 		tx.Rollback()
@@ -121,8 +134,10 @@ func (m *Member) EditMember(ctx context.Context) error {
 		common.Encrypt(m.Extra),
 		m.Type,
 		common.Encrypt(m.Email),
+		common.BlindIndex(m.Email),
 		common.Encrypt(m.Contact),
 		m.Language,
+		stringOrNull(m.Timezone),
 		m.Subscribed,
 		stringOrNull(m.UUID))
 	if err != nil {
@@ -138,19 +153,22 @@ func (m *Member) EditMember(ctx context.Context) error {
 	return err
 }
 
+// Get reads a member, sql.ErrNoRows if they are deleted or purged.
 func (m *Member) Get(ctx context.Context) error {
 	ctx, span := tracer.Start(ctx, "Member.Get")
 	defer span.End()
 	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(
-		"SELECT firstName, lastName, height, weight, roles, extra, type, email, contact, status, subscribed, language FROM %s WHERE uuid= ? AND status != ?",
+		"SELECT firstName, lastName, height, weight, roles, extra, type, email, contact, status, subscribed, language, timezone FROM %s WHERE uuid= ? AND status NOT IN (?, ?)",
 		MEMBERSTABLE))
 	if err != nil {
 		common.Fatal(err.Error())
 	}
 	defer stmt.Close()
 	var rolesAsString string
-	err = stmt.QueryRowContext(ctx, m.UUID, MEMBERSSTATUSDELETED).Scan(&m.FirstName, &m.LastName, &m.Height, &m.Weight, &rolesAsString, &m.Extra, &m.Type, &m.Email, &m.Contact, &m.Status, &m.Subscribed, &m.Language)
+	var timezone sql.NullString // to manage possible NULL fields
+	err = stmt.QueryRowContext(ctx, m.UUID, MEMBERSSTATUSDELETED, MEMBERSSTATUSPURGED).Scan(&m.FirstName, &m.LastName, &m.Height, &m.Weight, &rolesAsString, &m.Extra, &m.Type, &m.Email, &m.Contact, &m.Status, &m.Subscribed, &m.Language, &timezone)
 	if err == nil {
+		m.Timezone = nullToEmptyString(timezone)
 		m.FirstName = common.Decrypt([]byte(m.FirstName))
 		m.LastName = common.Decrypt([]byte(m.LastName))
 		m.Height = common.Decrypt([]byte(m.Height))
@@ -167,9 +185,81 @@ func (m *Member) Get(ctx context.Context) error {
 func (m *Member) GetAll(ctx context.Context, memberStatusList, memberTypeList []string) ([]Member, error) {
 	ctx, span := tracer.Start(ctx, "Member.GetAll")
 	defer span.End()
-	queryString := []string{fmt.Sprintf(
-		"SELECT uuid, firstName, lastName, height, weight, roles, extra, type, email, contact, status, subscribed, language FROM %s",
-		MEMBERSTABLE)}
+	filter, queryValues := membersFilter(memberStatusList, memberTypeList)
+	query := fmt.Sprintf(
+		"SELECT uuid, firstName, lastName, height, weight, roles, extra, type, email, contact, status, subscribed, language, timezone FROM %s WHERE %s",
+		MEMBERSTABLE, filter)
+	common.Debug("SQL query: %s; params(values=%v)", query, queryValues)
+	rows, err := db.QueryContext(ctx, query, queryValues...)
+	if err != nil {
+		common.Fatal(err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []Member{}
+
+	for rows.Next() {
+		var m Member
+		var rolesAsString string
+		var timezone sql.NullString // to manage possible NULL fields
+		if err = rows.Scan(&m.UUID, &m.FirstName, &m.LastName, &m.Height, &m.Weight, &rolesAsString, &m.Extra, &m.Type, &m.Email, &m.Contact, &m.Status, &m.Subscribed, &m.Language, &timezone); err != nil {
+			return nil, err
+		}
+		m.Timezone = nullToEmptyString(timezone)
+		m.decrypt(rolesAsString)
+		members = append(members, m)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// GetAllWithParticipation returns the members like GetAll, with their answer,
+// presence and waiting list status for an event, in a single query.
+func (m *Member) GetAllWithParticipation(ctx context.Context, eventUUID string, memberStatusList, memberTypeList []string) ([]Member, error) {
+	ctx, span := tracer.Start(ctx, "Member.GetAllWithParticipation")
+	defer span.End()
+	filter, filterValues := membersFilter(memberStatusList, memberTypeList)
+	query := fmt.Sprintf(
+		`SELECT m.uuid, m.firstName, m.lastName, m.height, m.weight, m.roles, m.extra, m.type, m.email, m.contact, m.status, m.subscribed, m.language, m.timezone,
+		 COALESCE(p.answer, ''), COALESCE(p.presence, ''), p.waitlisted_at IS NOT NULL
+		 FROM %s AS m LEFT JOIN %s AS p ON p.member_uuid = m.uuid AND p.event_uuid = ?
+		 WHERE %s`,
+		MEMBERSTABLE, PARTICIPATION_TABLE, filter)
+	queryValues := append([]interface{}{eventUUID}, filterValues...)
+	common.Debug("SQL query: %s; params(values=%v)", query, queryValues)
+	rows, err := db.QueryContext(ctx, query, queryValues...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []Member{}
+
+	for rows.Next() {
+		var m Member
+		var rolesAsString string
+		var timezone sql.NullString // to manage possible NULL fields
+		if err = rows.Scan(&m.UUID, &m.FirstName, &m.LastName, &m.Height, &m.Weight, &rolesAsString, &m.Extra, &m.Type, &m.Email, &m.Contact, &m.Status, &m.Subscribed, &m.Language, &timezone,
+			&m.Participation, &m.Presence, &m.Waitlisted); err != nil {
+			return nil, err
+		}
+		m.Timezone = nullToEmptyString(timezone)
+		m.decrypt(rolesAsString)
+		members = append(members, m)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// membersFilter returns the WHERE clause (without WHERE) and its values
+// selecting the members with one of the statuses and one of the types.
+// Empty lists match everything but deleted members.
+func membersFilter(memberStatusList, memberTypeList []string) (string, []interface{}) {
 	filters := []string{}
 	statusFilters := []string{}
 	typeFilters := []string{}
@@ -200,55 +290,26 @@ func (m *Member) GetAll(ctx context.Context, memberStatusList, memberTypeList []
 	filters = append(filters, "status NOT IN (?, ?)")
 	queryValues = append(queryValues, MEMBERSSTATUSDELETED, MEMBERSSTATUSPURGED)
 
-	filter := strings.Join(filters, " AND ")
-	queryString = compact(append(queryString, filter))
-	query := strings.Join(queryString, " WHERE ")
-	common.Debug("SQL query: %s; params(values=%v)", query, queryValues)
-	rows, err := db.QueryContext(ctx, query, queryValues...)
-	if err != nil {
-		common.Fatal(err.Error())
-		return nil, err
-	}
-	defer rows.Close()
-
-	members := []Member{}
+	return strings.Join(filters, " AND "), queryValues
+}
 
-	for rows.Next() {
-		var m Member
-		var rolesAsString string
-		if err = rows.Scan(&m.UUID, &m.FirstName, &m.LastName, &m.Height, &m.Weight, &rolesAsString, &m.Extra, &m.Type, &m.Email, &m.Contact, &m.Status, &m.Subscribed, &m.Language); err != nil {
-			return nil, err
-		}
-		m.FirstName = common.Decrypt([]byte(m.FirstName))
-		m.LastName = common.Decrypt([]byte(m.LastName))
-		m.Height = common.Decrypt([]byte(m.Height))
-		m.Weight = common.Decrypt([]byte(m.Weight))
-		m.Roles = strings.Split(common.Decrypt([]byte(rolesAsString)), ",")
-		m.Extra = common.Decrypt([]byte(m.Extra))
-		m.Email = common.Decrypt([]byte(m.Email))
-		m.Contact = common.Decrypt([]byte(m.Contact))
-		m.sanitizeEmptyRoles()
-		members = append(members, m)
-	}
-	if err = rows.Err(); err != nil {
-		return nil, err
-	}
-	return members, nil
+// decrypt decrypts the encrypted fields of a member read from the database
+func (m *Member) decrypt(rolesAsString string) {
+	m.FirstName = common.Decrypt([]byte(m.FirstName))
+	m.LastName = common.Decrypt([]byte(m.LastName))
+	m.Height = common.Decrypt([]byte(m.Height))
+	m.Weight = common.Decrypt([]byte(m.Weight))
+	m.Roles = strings.Split(common.Decrypt([]byte(rolesAsString)), ",")
+	m.Extra = common.Decrypt([]byte(m.Extra))
+	m.Email = common.Decrypt([]byte(m.Email))
+	m.Contact = common.Decrypt([]byte(m.Contact))
+	m.sanitizeEmptyRoles()
 }
 
 func (m *Member) DeleteMember(ctx context.Context) error {
 	ctx, span := tracer.Start(ctx, "Member.DeleteMember")
 	defer span.End()
-	stmt, err := db.PrepareContext(ctx, fmt.Sprintf("UPDATE %s SET status=? WHERE uuid=?",
-		MEMBERSTABLE))
-	if err != nil {
-		common.Fatal(err.Error())
-		return err
-	}
-	defer stmt.Close()
-
-	_, err = stmt.ExecContext(ctx, MEMBERSSTATUSDELETED, m.UUID)
-	return err
+	return updateStatus(ctx, m.UUID, MEMBERSSTATUSDELETED, STATUSCAUSEDELETION, ", deleted_at = ?", time.Now().Unix())
 }
 
 func (m *Member) sanitizeEmptyRoles() {
@@ -257,17 +318,12 @@ func (m *Member) sanitizeEmptyRoles() {
 	}
 }
 
-func (m *Member) SetStatus(ctx context.Context, status string) error {
+// SetStatus sets the status of the member, and records the change with its
+// cause (STATUSCAUSE...) in the status history.
+func (m *Member) SetStatus(ctx context.Context, status, cause string) error {
 	ctx, span := tracer.Start(ctx, "Member.SetStatus")
 	defer span.End()
-	stmt, err := db.PrepareContext(ctx, fmt.Sprintf("UPDATE %s SET status = ? WHERE uuid= ?", MEMBERSTABLE))
-	if err != nil {
-		common.Fatal(err.Error())
-		return err
-	}
-	defer stmt.Close()
-	_, err = stmt.ExecContext(ctx, status, m.UUID)
-	return err
+	return updateStatus(ctx, m.UUID, status, cause, "")
 }
 
 // SetStatusManual sets the status following an explicit admin action.
@@ -277,23 +333,10 @@ func (m *Member) SetStatus(ctx context.Context, status string) error {
 func (m *Member) SetStatusManual(ctx context.Context, status string) error {
 	ctx, span := tracer.Start(ctx, "Member.SetStatusManual")
 	defer span.End()
-	var query string
-	args := []interface{}{}
 	if status == MEMBERSSTATUSACTIVATED {
-		query = fmt.Sprintf("UPDATE %s SET status = ?, last_activity_date = ? WHERE uuid = ?", MEMBERSTABLE)
-		args = append(args, status, time.Now().Unix(), m.UUID)
-	} else {
-		query = fmt.Sprintf("UPDATE %s SET status = ? WHERE uuid = ?", MEMBERSTABLE)
-		args = append(args, status, m.UUID)
-	}
-	stmt, err := db.PrepareContext(ctx, query)
-	if err != nil {
-		common.Fatal(err.Error())
-		return err
+		return updateStatus(ctx, m.UUID, status, STATUSCAUSEMANUAL, ", last_activity_date = ?", time.Now().Unix())
 	}
-	defer stmt.Close()
-	_, err = stmt.ExecContext(ctx, args...)
-	return err
+	return updateStatus(ctx, m.UUID, status, STATUSCAUSEMANUAL, "")
 }
 
 // GetLastActivityDate returns the last_activity_date stamp (Unix seconds, 0 if never set).
@@ -315,7 +358,7 @@ func (c *Credentials) ResetCredentials(ctx context.Context, username string, pas
 	ctx, span := tracer.Start(ctx, "Credentials.ResetCredentials")
 	defer span.End()
 	member := Member{UUID: c.UUID}
-	err := member.SetStatus(ctx, MEMBERSSTATUSACTIVATED)
+	err := member.SetStatus(ctx, MEMBERSSTATUSACTIVATED, STATUSCAUSECREDENTIALS)
 	if err != nil {
 		common.Fatal(err.Error())
 	}
@@ -369,28 +412,82 @@ func (c *Credentials) GetCredentialsByUUID(ctx context.Context) error {
 	return err
 }
 
+// GetByEmail finds a member, except deleted ones, by the blind index of
+// their email, ignoring the case.
 func (m *Member) GetByEmail(ctx context.Context) error {
 	ctx, span := tracer.Start(ctx, "Member.GetByEmail")
 	defer span.End()
-	found := false
-	members, err := m.GetAll(ctx, []string{}, []string{})
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(
+		"SELECT uuid, firstName, lastName, height, weight, roles, extra, type, email, contact, status, subscribed, language, timezone FROM %s WHERE email_index = ? AND status NOT IN (?, ?) LIMIT 1",
+		MEMBERSTABLE))
 	if err != nil {
 		return err
 	}
-	for _, member := range members {
-		if strings.EqualFold(member.Email, m.Email) {
-			common.Debug("Found a member with email %s", m.Email)
-			*m = member
-			found = true
-		}
-	}
-	if !found {
+	defer stmt.Close()
+	var member Member
+	var rolesAsString string
+	var timezone sql.NullString // to manage possible NULL fields
+	err = stmt.QueryRowContext(ctx, common.BlindIndex(m.Email), MEMBERSSTATUSDELETED, MEMBERSSTATUSPURGED).Scan(
+		&member.UUID, &member.FirstName, &member.LastName, &member.Height, &member.Weight, &rolesAsString, &member.Extra, &member.Type, &member.Email, &member.Contact, &member.Status, &member.Subscribed, &member.Language, &timezone)
+	if err == sql.ErrNoRows {
 		common.Debug("Email %s not found.", m.Email)
 		return errors.New(MEMBERSEMAILNOTFOUNDMESSAGE)
 	}
+	if err != nil {
+		return err
+	}
+	member.Timezone = nullToEmptyString(timezone)
+	member.decrypt(rolesAsString)
+	common.Debug("Found a member with email %s", m.Email)
+	*m = member
 	return nil
 }
 
+// BackfillEmailIndex computes the blind index of the members that do not
+// have one yet, like the ones created before it existed.
+func BackfillEmailIndex(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "BackfillEmailIndex")
+	defer span.End()
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT uuid, email FROM %s WHERE email_index IS NULL", MEMBERSTABLE))
+	if err != nil {
+		return err
+	}
+	indexes := map[string]string{}
+	for rows.Next() {
+		var uuid, email string
+		if err := rows.Scan(&uuid, &email); err != nil {
+			rows.Close()
+			return err
+		}
+		indexes[uuid] = common.BlindIndex(common.Decrypt([]byte(email)))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(indexes) == 0 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("UPDATE %s SET email_index = ? WHERE uuid = ?", MEMBERSTABLE))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for uuid, index := range indexes {
+		if _, err := stmt.ExecContext(ctx, index, uuid); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	common.Info("Email index computed for %d members", len(indexes))
+	return tx.Commit()
+}
+
 func (m *Member) GetDependents(ctx context.Context) ([]Member, error) {
 	ctx, span := tracer.Start(ctx, "Member.GetDependent")
 	defer span.End()
@@ -432,14 +529,13 @@ func (m *Member) AddDependent(ctx context.Context, dependent *Member) error {
 		return err
 	}
 
-	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(
+	return addDependent(ctx, db, m.UUID, dependent.UUID)
+}
+
+func addDependent(ctx context.Context, q dbExecutor, responsibleUUID, dependentUUID string) error {
+	_, err := q.ExecContext(ctx, fmt.Sprintf(
 		"INSERT INTO %s(responsible_uuid, dependent_uuid) VALUES(?, ?) ON CONFLICT DO NOTHING", MEMBERSDEPENDANTSTABLE,
-	))
-	if err != nil {
-		common.Fatal(err.Error())
-	}
-	defer stmt.Close()
-	_, err = stmt.ExecContext(ctx, m.UUID, dependent.UUID)
+	), responsibleUUID, dependentUUID)
 	return err
 }
 
@@ -461,13 +557,3 @@ func (m *Member) RemoveDependent(ctx context.Context, dependent *Member) error {
 	_, err = stmt.ExecContext(ctx, m.UUID, dependent.UUID)
 	return err
 }
-
-func compact(s []string) []string {
-	var r []string
-	for _, str := range s {
-		if str != "" {
-			r = append(r, str)
-		}
-	}
-	return r
-}
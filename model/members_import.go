@@ -0,0 +1,60 @@
+package model
+
+import (
+	"context"
+)
+
+// MemberImport is a member created by an import, with what is written
+// with it.
+type MemberImport struct {
+	Member          Member // With its UUID and its status, created or activated
+	Audit           MemberAuditEntry
+	Notification    *Notification // The registration email, nil if none
+	ResponsibleUUID string        // Empty without responsible
+}
+
+// ImportMembers creates the members in a single transaction, so that none
+// is created if one fails.
+func ImportMembers(ctx context.Context, imports []MemberImport) error {
+	ctx, span := tracer.Start(ctx, "ImportMembers")
+	defer span.End()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for i := range imports {
+		m := &imports[i].Member
+		if err := insertMember(ctx, tx, m); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if m.Status != MEMBERSSTATUSCREATED {
+			if err := updateStatusInTx(ctx, tx, m.UUID, m.Status, STATUSCAUSECREATION, ""); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err := imports[i].Audit.create(ctx, tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if imports[i].Notification != nil {
+			if err := imports[i].Notification.create(ctx, tx); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	// The responsibles can be members of the import
+	for _, imported := range imports {
+		if imported.ResponsibleUUID == "" {
+			continue
+		}
+		if err := addDependent(ctx, tx, imported.ResponsibleUUID, imported.Member.UUID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
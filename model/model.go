@@ -1,6 +1,7 @@
 package model
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
@@ -25,6 +26,12 @@ const initQuery = `CREATE TABLE IF NOT EXISTS schema_version
 var db *sql.DB
 var tracer = otel.Tracer("castellers")
 
+// dbExecutor is the database or a transaction, for the writes that are
+// also part of larger transactions.
+type dbExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
 func InitializeDB(dbname string) {
 	var err error
 	driverName, err := otelsql.Register("sqlite3", otelsql.WithAttributes(
@@ -116,6 +123,11 @@ func InitializeDB(dbname string) {
 		common.Fatal(err.Error())
 	}
 
+	// The blind indexes cannot be computed in SQL
+	if err := BackfillEmailIndex(context.Background()); err != nil {
+		common.Fatal(err.Error())
+	}
+
 }
 
 func stringOrNull(s string) sql.NullString {
@@ -3,6 +3,7 @@ package model
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -10,6 +11,7 @@ import (
 )
 
 const notificationsTable = "notifications"
+const NOTIFICATION_RECIPIENTS_TABLE = "notification_recipients"
 
 const TypeMemberRegistration = "memberRegistration"
 const TypeUpcomingEvent = "upcomingEvent"
@@ -20,6 +22,11 @@ const TypeEventModified = "eventModified"
 const TypeEventCreated = "eventCreated"
 const TypeManualEventReminder = "manualEventReminder"
 const TypeBadgeAwarded = "badgeAwarded"
+const TypeWaitingListPromoted = "waitingListPromoted"
+const TypeLateParticipationChanges = "lateParticipationChanges"
+const TypeInactivityWarning = "inactivityWarning"
+const TypeAccountLocked = "accountLocked"
+const TypeMagicLink = "magicLink"
 
 // BadgeAwardedPayload is stored on badgeAwarded notifications.
 type BadgeAwardedPayload struct {
@@ -27,6 +34,26 @@ type BadgeAwardedPayload struct {
 	MemberUUIDs []string `json:"memberUuids"`
 }
 
+// WaitingListPromotedPayload is stored on waitingListPromoted notifications,
+// the event is the object of the notification.
+type WaitingListPromotedPayload struct {
+	MemberUUIDs []string `json:"memberUuids"`
+}
+
+// InactivityWarningPayload is stored on inactivityWarning notifications,
+// the member is the object of the notification.
+type InactivityWarningPayload struct {
+	PauseDate int64 `json:"pauseDate"`
+}
+
+// AccountLockedPayload is stored on accountLocked notifications, the member
+// whose login is locked is the object of the notification.
+type AccountLockedPayload struct {
+	IP          string `json:"ip"` // Of the last failed attempt
+	Attempts    int64  `json:"attempts"`
+	LockedUntil int64  `json:"lockedUntil"`
+}
+
 const ManualReminderAudienceDefault = "default"
 const ManualReminderAudienceNoAnswerActive = "no_answer_active"
 const ManualReminderAudienceNoAnswerActivePaused = "no_answer_active_paused"
@@ -52,22 +79,32 @@ type Notification struct {
 	SendDate         int
 	Delivered        int
 	Payload          []byte
+	Attempts         int    // Failed attempts to send it
+	NextAttemptAt    int64  // When to try again, after a failure
+	LastError        string // Of the last failed attempt
+}
+
+// NotificationRecipient is the delivery of a notification to a member.
+type NotificationRecipient struct {
+	NotificationID int
+	MemberUUID     string
+	Delivered      int // NotificationNotDelivered while it can be retried
+	Attempts       int
+	NextAttemptAt  int64
+	LastError      string
+	LastChangeID   int64 // Last late participation change in the email
 }
 
 func (n *Notification) CreateNotification(ctx context.Context) error {
 	ctx, span := tracer.Start(ctx, "Notification.CreateNotification")
 	defer span.End()
+	return n.create(ctx, db)
+}
 
-	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(
+func (n *Notification) create(ctx context.Context, q dbExecutor) error {
+	result, err := q.ExecContext(ctx, fmt.Sprintf(
 		"INSERT INTO %s (notificationType, objectUUID, sendDate, payload) VALUES (?, ?, ?, ?)",
-		notificationsTable))
-	defer stmt.Close()
-	if err != nil {
-		common.Error(err.Error())
-		common.Error("%v\n", n)
-		return err
-	}
-	result, err := stmt.ExecContext(ctx,
+		notificationsTable),
 		stringOrNull(n.NotificationType),
 		stringOrNull(n.ObjectUUID),
 		n.SendDate,
@@ -92,8 +129,8 @@ func (n *Notification) GetNotificationsReady(ctx context.Context) ([]Notificatio
 
 	now := time.Now().Unix()
 	rows, err := db.QueryContext(ctx, fmt.Sprintf(
-		"SELECT id, notificationType, objectUUID, sendDate, payload FROM %s WHERE sendDate <= ? AND delivered=0",
-		notificationsTable), now)
+		"SELECT id, notificationType, objectUUID, sendDate, payload, attempts, next_attempt_at, last_error FROM %s WHERE sendDate <= ? AND delivered=0 AND next_attempt_at <= ?",
+		notificationsTable), now, now)
 	defer rows.Close()
 	if err != nil {
 		common.Fatal(err.Error())
@@ -102,7 +139,7 @@ func (n *Notification) GetNotificationsReady(ctx context.Context) ([]Notificatio
 	for rows.Next() {
 		var n Notification
 		var objectUUID sql.NullString // to manage possible NULL fields
-		if err = rows.Scan(&n.ID, &n.NotificationType, &objectUUID, &n.SendDate, &n.Payload); err != nil {
+		if err = rows.Scan(&n.ID, &n.NotificationType, &objectUUID, &n.SendDate, &n.Payload, &n.Attempts, &n.NextAttemptAt, &n.LastError); err != nil {
 			return nil, err
 		}
 		n.ObjectUUID = nullToEmptyString(objectUUID)
@@ -119,7 +156,7 @@ func (n *Notification) UpdateNotificationStatus(ctx context.Context) error {
 	defer span.End()
 
 	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(
-		"UPDATE %s SET delivered = ? WHERE id = ?",
+		"UPDATE %s SET delivered = ?, attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ?",
 		notificationsTable))
 	defer stmt.Close()
 	if err != nil {
@@ -129,6 +166,9 @@ func (n *Notification) UpdateNotificationStatus(ctx context.Context) error {
 	}
 	_, err = stmt.ExecContext(ctx,
 		n.Delivered,
+		n.Attempts,
+		n.NextAttemptAt,
+		n.LastError,
 		n.ID)
 	if err != nil {
 		common.Error(err.Error())
@@ -137,3 +177,85 @@ func (n *Notification) UpdateNotificationStatus(ctx context.Context) error {
 	}
 	return err
 }
+
+// GetRecipients returns the deliveries of the notification to its
+// recipients, by member.
+func (n *Notification) GetRecipients(ctx context.Context) (map[string]NotificationRecipient, error) {
+	ctx, span := tracer.Start(ctx, "Notification.GetRecipients")
+	defer span.End()
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT notification_id, member_uuid, delivered, attempts, next_attempt_at, last_error, last_change_id FROM %s WHERE notification_id = ?",
+		NOTIFICATION_RECIPIENTS_TABLE), n.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	recipients := map[string]NotificationRecipient{}
+	for rows.Next() {
+		var r NotificationRecipient
+		if err = rows.Scan(&r.NotificationID, &r.MemberUUID, &r.Delivered, &r.Attempts, &r.NextAttemptAt, &r.LastError, &r.LastChangeID); err != nil {
+			return nil, err
+		}
+		recipients[r.MemberUUID] = r
+	}
+	return recipients, rows.Err()
+}
+
+// Save records the delivery to the recipient.
+func (r *NotificationRecipient) Save(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "NotificationRecipient.Save")
+	defer span.End()
+
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (notification_id, member_uuid, delivered, attempts, next_attempt_at, last_error, last_change_id) VALUES (?, ?, ?, ?, ?, ?, ?) "+
+			"ON CONFLICT(notification_id, member_uuid) DO UPDATE SET delivered = excluded.delivered, attempts = excluded.attempts, "+
+			"next_attempt_at = excluded.next_attempt_at, last_error = excluded.last_error, last_change_id = excluded.last_change_id",
+		NOTIFICATION_RECIPIENTS_TABLE), r.NotificationID, r.MemberUUID, r.Delivered, r.Attempts, r.NextAttemptAt, r.LastError, r.LastChangeID)
+	return err
+}
+
+// GetMemberNotifications returns the notifications about a member: the ones
+// they are the object of (registration, forgotten password) and the ones
+// listing them in the memberUuids of their payload (badges, waiting list,
+// reminders to chosen members). Broadcasts to every member are left out.
+func GetMemberNotifications(ctx context.Context, memberUUID string) ([]Notification, error) {
+	ctx, span := tracer.Start(ctx, "GetMemberNotifications")
+	defer span.End()
+
+	// The LIKE only narrows the search, the payload is checked below
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(
+		"SELECT id, notificationType, objectUUID, sendDate, delivered, payload FROM %s WHERE objectUUID = ? OR payload LIKE ? ORDER BY sendDate, id",
+		notificationsTable))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.QueryContext(ctx, memberUUID, "%\""+memberUUID+"\"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		var objectUUID sql.NullString
+		if err = rows.Scan(&n.ID, &n.NotificationType, &objectUUID, &n.SendDate, &n.Delivered, &n.Payload); err != nil {
+			return nil, err
+		}
+		n.ObjectUUID = nullToEmptyString(objectUUID)
+		if n.ObjectUUID != memberUUID {
+			var payload struct {
+				MemberUUIDs []string `json:"memberUuids"`
+			}
+			if err := json.Unmarshal(n.Payload, &payload); err != nil || !common.StringInSlice(memberUUID, payload.MemberUUIDs) {
+				continue
+			}
+		}
+		notifications = append(notifications, n)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return notifications, nil
+}
@@ -0,0 +1,88 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	MEMBER_OIDC_IDENTITIES_TABLE = "member_oidc_identities"
+	MEMBER_OIDC_UNLINKED_TABLE   = "member_oidc_unlinked"
+)
+
+// OIDCIdentity is an account of an OpenID Connect provider linked to a
+// member.
+type OIDCIdentity struct {
+	Issuer     string
+	Subject    string
+	MemberUUID string
+	CreatedAt  int64
+}
+
+// Get returns the member linked to the subject of the issuer,
+// sql.ErrNoRows if there is none.
+func (i *OIDCIdentity) Get(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "OIDCIdentity.Get")
+	defer span.End()
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(
+		"SELECT member_uuid, created_at FROM %s WHERE issuer = ? AND subject = ?", MEMBER_OIDC_IDENTITIES_TABLE))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	return stmt.QueryRowContext(ctx, i.Issuer, i.Subject).Scan(&i.MemberUUID, &i.CreatedAt)
+}
+
+// Create links the subject of the issuer to the member.
+func (i *OIDCIdentity) Create(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "OIDCIdentity.Create")
+	defer span.End()
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (issuer, subject, member_uuid, created_at) VALUES (?, ?, ?, ?)", MEMBER_OIDC_IDENTITIES_TABLE))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	i.CreatedAt = time.Now().Unix()
+	_, err = stmt.ExecContext(ctx, i.Issuer, i.Subject, i.MemberUUID, i.CreatedAt)
+	return err
+}
+
+// Unlinked returns true if an admin unlinked the subject of the issuer.
+func (i *OIDCIdentity) Unlinked(ctx context.Context) (bool, error) {
+	ctx, span := tracer.Start(ctx, "OIDCIdentity.Unlinked")
+	defer span.End()
+	var count int
+	err := db.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT COUNT(*) FROM %s WHERE issuer = ? AND subject = ?", MEMBER_OIDC_UNLINKED_TABLE), i.Issuer, i.Subject).Scan(&count)
+	return count > 0, err
+}
+
+// UnlinkOIDCIdentities unlinks the accounts of the member, remembered so
+// that they are not linked again, and returns how many were linked.
+func (m *Member) UnlinkOIDCIdentities(ctx context.Context) (int64, error) {
+	ctx, span := tracer.Start(ctx, "Member.UnlinkOIDCIdentities")
+	defer span.End()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+		"INSERT OR REPLACE INTO %s (issuer, subject, member_uuid, unlinked_at) SELECT issuer, subject, member_uuid, ? FROM %s WHERE member_uuid = ?",
+		MEMBER_OIDC_UNLINKED_TABLE, MEMBER_OIDC_IDENTITIES_TABLE), time.Now().Unix(), m.UUID); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	result, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE member_uuid = ?", MEMBER_OIDC_IDENTITIES_TABLE), m.UUID)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	unlinked, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return unlinked, tx.Commit()
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"time"
 
 	"github.com/vilisseranen/castellers/common"
 )
@@ -15,60 +16,147 @@ type Participation struct {
 	MemberUUID string `json:"memberUuid"`
 	Answer     string `json:"answer"`
 	Presence   string `json:"presence"`
+	Waitlisted int    `json:"waitlisted"` // 1 if the answer is yes but the event is full
 }
 
 // A member will say if he or she participates BEFORE the event:
 // We always insert in the table
+// When the event has a capacity and is full, a yes answer is put on the
+// waiting list. A member already confirmed or waiting keeps their place.
 func (p *Participation) Participate(ctx context.Context) error {
 	ctx, span := tracer.Start(ctx, "Participation.Participate")
 	defer span.End()
 
-	// Check if a participation already exists
-	stmt, err := db.PrepareContext(ctx, fmt.Sprintf("SELECT count(*) FROM %s WHERE member_uuid= ? AND event_uuid= ?", PARTICIPATION_TABLE))
-	defer stmt.Close()
+	// The participation is created first, so the transaction takes the write
+	// lock before counting the places, and two answers cannot get the last
+	// one. A new participation has no answer yet, like no participation.
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	c := 0
-	err = stmt.QueryRowContext(ctx, p.MemberUUID, p.EventUUID).Scan(&c)
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT OR IGNORE INTO %s (event_uuid, member_uuid, answer, presence) VALUES (?, ?, NULL, '')", PARTICIPATION_TABLE),
+		p.EventUUID, p.MemberUUID)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
-	if c == 0 {
-		stmt, err := db.Prepare(fmt.Sprintf("INSERT INTO %s (event_uuid, member_uuid, answer, presence) VALUES (?, ?, ?, ?)", PARTICIPATION_TABLE))
-		defer stmt.Close()
+	var answer sql.NullString
+	var waitlistedAt sql.NullInt64
+	err = tx.QueryRowContext(ctx, fmt.Sprintf("SELECT answer, waitlisted_at FROM %s WHERE member_uuid= ? AND event_uuid= ?", PARTICIPATION_TABLE),
+		p.MemberUUID, p.EventUUID).Scan(&answer, &waitlistedAt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	var newWaitlistedAt sql.NullInt64
+	confirmed := answer.String == common.AnswerYes && !waitlistedAt.Valid
+	if p.Answer == common.AnswerYes && !confirmed {
+		var capacity, participants uint
+		err = tx.QueryRowContext(ctx, fmt.Sprintf(
+			"SELECT e.capacity, (SELECT COUNT(*) FROM %s WHERE event_uuid = e.uuid AND answer = ? AND waitlisted_at IS NULL) FROM %s AS e WHERE e.uuid = ?",
+			PARTICIPATION_TABLE, EVENTS_TABLE), common.AnswerYes, p.EventUUID).Scan(&capacity, &participants)
 		if err != nil {
+			tx.Rollback()
 			return err
 		}
-		_, err = stmt.Exec(p.EventUUID, p.MemberUUID, stringOrNull(p.Answer), "")
-		if err != nil {
-			return err
+		if capacity > 0 && participants >= capacity {
+			newWaitlistedAt = waitlistedAt
+			if !newWaitlistedAt.Valid {
+				newWaitlistedAt = sql.NullInt64{Int64: time.Now().Unix(), Valid: true}
+			}
 		}
-	} else if c == 1 {
-		stmt, err := db.Prepare(fmt.Sprintf("UPDATE %s SET answer = ? WHERE event_uuid= ? AND member_uuid= ?", PARTICIPATION_TABLE))
-		defer stmt.Close()
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET answer = ?, waitlisted_at = ? WHERE event_uuid= ? AND member_uuid= ?", PARTICIPATION_TABLE),
+		stringOrNull(p.Answer), newWaitlistedAt, p.EventUUID, p.MemberUUID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	p.Waitlisted = 0
+	if newWaitlistedAt.Valid {
+		p.Waitlisted = 1
+	}
+	return tx.Commit()
+}
+
+// PromoteFromWaitingList confirms the members of the waiting list of an event,
+// first come first served, as long as there are free places. Returns the
+// members promoted.
+func PromoteFromWaitingList(ctx context.Context, eventUUID string) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "PromoteFromWaitingList")
+	defer span.End()
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT member_uuid FROM %s WHERE event_uuid = ? AND answer = ? AND waitlisted_at IS NOT NULL ORDER BY waitlisted_at, rowid", PARTICIPATION_TABLE),
+		eventUUID, common.AnswerYes)
+	if err != nil {
+		return nil, err
+	}
+	waiting := []string{}
+	for rows.Next() {
+		var memberUUID string
+		if err := rows.Scan(&memberUUID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		waiting = append(waiting, memberUUID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	promoted := []string{}
+	if len(waiting) == 0 {
+		return promoted, nil
+	}
+	// Each member is promoted only if they are still waiting and there is
+	// still a free place, without capacity everybody gets one. The first
+	// statement is a write, so the transaction takes the write lock before
+	// counting the places, and two promotions cannot give the same place.
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf(
+		`UPDATE %s SET waitlisted_at = NULL
+		 WHERE event_uuid = ? AND member_uuid = ? AND answer = ? AND waitlisted_at IS NOT NULL
+		 AND ((SELECT capacity FROM %s WHERE uuid = ?) = 0 OR
+		 (SELECT COUNT(*) FROM %s WHERE event_uuid = ? AND answer = ? AND waitlisted_at IS NULL) < (SELECT capacity FROM %s WHERE uuid = ?))`,
+		PARTICIPATION_TABLE, EVENTS_TABLE, PARTICIPATION_TABLE, EVENTS_TABLE)
+	for _, memberUUID := range waiting {
+		result, err := tx.ExecContext(ctx, query, eventUUID, memberUUID, common.AnswerYes, eventUUID, eventUUID, common.AnswerYes, eventUUID)
 		if err != nil {
-			return err
+			tx.Rollback()
+			common.Error("Error promoting %s from the waiting list of %s: %v", memberUUID, eventUUID, err)
+			return nil, err
 		}
-		_, err = stmt.Exec(stringOrNull(p.Answer), p.EventUUID, p.MemberUUID)
+		updated, err := result.RowsAffected()
 		if err != nil {
-			return err
+			tx.Rollback()
+			return nil, err
 		}
+		if updated == 0 {
+			// Full, or the member left the waiting list meanwhile
+			continue
+		}
+		promoted = append(promoted, memberUUID)
 	}
-	return err
+	return promoted, tx.Commit()
 }
 
 func (p *Participation) GetParticipation(ctx context.Context) error {
 	ctx, span := tracer.Start(ctx, "Participation.GetParticipation")
 	defer span.End()
 	// Check if a participation already exists
-	stmt, err := db.PrepareContext(ctx, fmt.Sprintf("SELECT answer, presence FROM %s WHERE member_uuid= ? AND event_uuid= ?", PARTICIPATION_TABLE))
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf("SELECT answer, presence, waitlisted_at IS NOT NULL FROM %s WHERE member_uuid= ? AND event_uuid= ?", PARTICIPATION_TABLE))
 	defer stmt.Close()
 	if err != nil {
 		return err
 	}
 	var answer, presence sql.NullString // to manage possible NULL fields
-	err = stmt.QueryRowContext(ctx, p.MemberUUID, p.EventUUID).Scan(&answer, &presence)
+	err = stmt.QueryRowContext(ctx, p.MemberUUID, p.EventUUID).Scan(&answer, &presence, &p.Waitlisted)
 	p.Answer = nullToEmptyString(answer)
 	p.Presence = nullToEmptyString(presence)
 	return err
@@ -158,3 +246,74 @@ func (m *Member) GetMemberLastParticipation(ctx context.Context) (Event, error)
 	}
 	return e, nil
 }
+
+// MemberParticipation is the answer and presence of a member to an event.
+type MemberParticipation struct {
+	EventUUID  string `json:"eventUuid"`
+	EventName  string `json:"eventName"`
+	EventType  string `json:"eventType"`
+	StartDate  uint   `json:"startDate"`
+	EndDate    uint   `json:"endDate"`
+	Answer     string `json:"answer"`
+	Presence   string `json:"presence"`
+	Waitlisted int    `json:"waitlisted"`
+}
+
+// GetMemberParticipations returns every answer and presence of a member,
+// including to deleted events, ordered by event start.
+func (m *Member) GetMemberParticipations(ctx context.Context) ([]MemberParticipation, error) {
+	ctx, span := tracer.Start(ctx, "Participation.GetMemberParticipations")
+	defer span.End()
+
+	query := fmt.Sprintf(
+		`SELECT e.uuid, e.name, e.type, e.startDate, e.endDate, COALESCE(p.answer, ''), COALESCE(p.presence, ''), p.waitlisted_at IS NOT NULL
+		 FROM %s AS p JOIN %s AS e ON e.uuid = p.event_uuid
+		 WHERE p.member_uuid = ?
+		 ORDER BY e.startDate, e.uuid`, PARTICIPATION_TABLE, EVENTS_TABLE)
+	common.Debug("SQL query: " + query)
+	rows, err := db.QueryContext(ctx, query, m.UUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	participations := []MemberParticipation{}
+	for rows.Next() {
+		var p MemberParticipation
+		if err := rows.Scan(&p.EventUUID, &p.EventName, &p.EventType, &p.StartDate, &p.EndDate, &p.Answer, &p.Presence, &p.Waitlisted); err != nil {
+			return nil, err
+		}
+		participations = append(participations, p)
+	}
+	return participations, rows.Err()
+}
+
+// GetAnswers returns the answers of a member to events, by event, in a
+// single query. The events without answer are left out.
+func (m *Member) GetAnswers(ctx context.Context, eventUUIDs []string) (map[string]string, error) {
+	ctx, span := tracer.Start(ctx, "Participation.GetAnswers")
+	defer span.End()
+
+	answers := map[string]string{}
+	if len(eventUUIDs) == 0 {
+		return answers, nil
+	}
+	query := fmt.Sprintf("SELECT event_uuid, COALESCE(answer, '') FROM %s WHERE member_uuid = ? AND event_uuid IN (%s)",
+		PARTICIPATION_TABLE, placeholders(len(eventUUIDs)))
+	queryValues := []interface{}{m.UUID}
+	for _, eventUUID := range eventUUIDs {
+		queryValues = append(queryValues, eventUUID)
+	}
+	rows, err := db.QueryContext(ctx, query, queryValues...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var eventUUID, answer string
+		if err := rows.Scan(&eventUUID, &answer); err != nil {
+			return nil, err
+		}
+		answers[eventUUID] = answer
+	}
+	return answers, rows.Err()
+}
@@ -0,0 +1,176 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/vilisseranen/castellers/common"
+)
+
+const (
+	PERMISSION_SETS_TABLE        = "permission_sets"
+	MEMBER_PERMISSION_SETS_TABLE = "member_permission_sets"
+
+	PERMISSIONCASTELLSWRITE        = "castells:write"         // Create and edit castell models, attach them to events
+	PERMISSIONREMINDERSSEND        = "reminders:send"         // Send event reminders
+	PERMISSIONMEMBERSREADSENSITIVE = "members:read-sensitive" // See the full profile of the members
+	PERMISSIONDEPENDENTSWRITE      = "dependents:write"       // Link responsibles and dependents
+)
+
+// PermissionSet is a named set of permissions, given to the members it is
+// assigned to when they log in.
+type PermissionSet struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+// GetPermissionSets returns all the permission sets, by name.
+func GetPermissionSets(ctx context.Context) ([]PermissionSet, error) {
+	ctx, span := tracer.Start(ctx, "GetPermissionSets")
+	defer span.End()
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT name, permissions FROM %s ORDER BY name", PERMISSION_SETS_TABLE))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sets := []PermissionSet{}
+	for rows.Next() {
+		var set PermissionSet
+		var permissions string
+		if err := rows.Scan(&set.Name, &permissions); err != nil {
+			return nil, err
+		}
+		set.Permissions = splitPermissions(permissions)
+		sets = append(sets, set)
+	}
+	return sets, rows.Err()
+}
+
+// Save creates the permission set, or replaces its permissions.
+func (p *PermissionSet) Save(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "PermissionSet.Save")
+	defer span.End()
+	sort.Strings(p.Permissions)
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (name, permissions) VALUES (?, ?) ON CONFLICT(name) DO UPDATE SET permissions = excluded.permissions",
+		PERMISSION_SETS_TABLE))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx, p.Name, strings.Join(p.Permissions, ","))
+	return err
+}
+
+// Delete removes the permission set and its assignments to members.
+func (p *PermissionSet) Delete(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "PermissionSet.Delete")
+	defer span.End()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE permission_set = ?", MEMBER_PERMISSION_SETS_TABLE), p.Name); err != nil {
+		tx.Rollback()
+		return err
+	}
+	result, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE name = ?", PERMISSION_SETS_TABLE), p.Name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		tx.Rollback()
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetPermissionSets returns the names of the permission sets assigned to
+// the member.
+func (m *Member) GetPermissionSets(ctx context.Context) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "Member.GetPermissionSets")
+	defer span.End()
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT permission_set FROM %s WHERE member_uuid = ? ORDER BY permission_set", MEMBER_PERMISSION_SETS_TABLE), m.UUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// SetPermissionSets replaces the permission sets assigned to the member.
+// The sets must exist.
+func (m *Member) SetPermissionSets(ctx context.Context, names []string) error {
+	ctx, span := tracer.Start(ctx, "Member.SetPermissionSets")
+	defer span.End()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE member_uuid = ?", MEMBER_PERMISSION_SETS_TABLE), m.UUID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, name := range names {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+			"INSERT OR IGNORE INTO %s (member_uuid, permission_set) SELECT ?, name FROM %s WHERE name = ?",
+			MEMBER_PERMISSION_SETS_TABLE, PERMISSION_SETS_TABLE), m.UUID, name); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetPermissions returns the permissions of all the sets assigned to the
+// member, sorted and without duplicates.
+func (m *Member) GetPermissions(ctx context.Context) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "Member.GetPermissions")
+	defer span.End()
+	query := fmt.Sprintf(
+		"SELECT s.permissions FROM %s AS s JOIN %s AS ms ON ms.permission_set = s.name WHERE ms.member_uuid = ?",
+		PERMISSION_SETS_TABLE, MEMBER_PERMISSION_SETS_TABLE)
+	common.Debug("SQL query: %s; params(values=%v)", query, m.UUID)
+	rows, err := db.QueryContext(ctx, query, m.UUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	permissions := []string{}
+	for rows.Next() {
+		var setPermissions string
+		if err := rows.Scan(&setPermissions); err != nil {
+			return nil, err
+		}
+		for _, permission := range splitPermissions(setPermissions) {
+			if !common.StringInSlice(permission, permissions) {
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	sort.Strings(permissions)
+	return permissions, rows.Err()
+}
+
+func splitPermissions(permissions string) []string {
+	if permissions == "" {
+		return []string{}
+	}
+	return strings.Split(permissions, ",")
+}
@@ -0,0 +1,94 @@
+package model
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vilisseranen/castellers/common"
+)
+
+// GetMembersToPurge returns the UUIDs of the members deleted before
+// deletedBefore (Unix seconds).
+func GetMembersToPurge(ctx context.Context, deletedBefore int64) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "GetMembersToPurge")
+	defer span.End()
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(
+		"SELECT uuid FROM %s WHERE status = ? AND deleted_at < ? ORDER BY deleted_at", MEMBERSTABLE))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.QueryContext(ctx, MEMBERSSTATUSDELETED, deletedBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	uuids := []string{}
+	for rows.Next() {
+		var uuid string
+		if err := rows.Scan(&uuid); err != nil {
+			return nil, err
+		}
+		uuids = append(uuids, uuid)
+	}
+	return uuids, rows.Err()
+}
+
+// Purge scrubs the personal data of a deleted member and sets their status
+// to purged. Their credentials, second factor, linked accounts, API
+// tokens, calendar token, permission sets and links with responsibles or
+// dependents are removed, as well as the payloads of their registration
+// emails and the changes of their personal data in the audit log. The row
+// itself is kept, so participation, presence, badges and castell positions
+// remain available, anonymised, for statistics.
+// Does nothing if the member is not deleted.
+func (m *Member) Purge(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "Member.Purge")
+	defer span.End()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	empty := common.Encrypt("")
+	result, err := tx.ExecContext(ctx, fmt.Sprintf(
+		"UPDATE %s SET firstName = ?, lastName = ?, height = ?, weight = ?, roles = ?, extra = ?, email = ?, contact = ?, email_index = NULL, timezone = NULL, subscribed = 0, status = ? WHERE uuid = ? AND status = ?",
+		MEMBERSTABLE), empty, empty, empty, empty, empty, empty, empty, empty, MEMBERSSTATUSPURGED, m.UUID, MEMBERSSTATUSDELETED)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if purged, err := result.RowsAffected(); err != nil || purged == 0 {
+		tx.Rollback()
+		return err
+	}
+	if err := recordStatusChange(ctx, tx, m.UUID, MEMBERSSTATUSDELETED, MEMBERSSTATUSPURGED, STATUSCAUSEPURGE); err != nil {
+		tx.Rollback()
+		return err
+	}
+	queries := []struct {
+		query  string
+		values []interface{}
+	}{
+		{fmt.Sprintf("DELETE FROM %s WHERE uuid = ?", MEMBERSCREDENTIALSTABLE), []interface{}{m.UUID}},
+		{fmt.Sprintf("DELETE FROM %s WHERE responsible_uuid = ? OR dependent_uuid = ?", MEMBERSDEPENDANTSTABLE), []interface{}{m.UUID, m.UUID}},
+		{fmt.Sprintf("DELETE FROM %s WHERE member_uuid = ?", CALENDAR_TOKENS_TABLE), []interface{}{m.UUID}},
+		{fmt.Sprintf("DELETE FROM %s WHERE member_uuid = ?", MEMBER_PERMISSION_SETS_TABLE), []interface{}{m.UUID}},
+		{fmt.Sprintf("DELETE FROM %s WHERE uuid = ?", MEMBERSTOTPTABLE), []interface{}{m.UUID}},
+		{fmt.Sprintf("DELETE FROM %s WHERE member_uuid = ?", MEMBERSRECOVERYCODESTABLE), []interface{}{m.UUID}},
+		{fmt.Sprintf("DELETE FROM %s WHERE member_uuid = ?", MEMBER_OIDC_IDENTITIES_TABLE), []interface{}{m.UUID}},
+		{fmt.Sprintf("DELETE FROM %s WHERE member_uuid = ?", MEMBER_OIDC_UNLINKED_TABLE), []interface{}{m.UUID}},
+		{fmt.Sprintf("DELETE FROM %s WHERE member_uuid = ?", API_TOKENS_TABLE), []interface{}{m.UUID}},
+		{fmt.Sprintf("UPDATE %s SET payload = NULL WHERE notificationType = ? AND objectUUID = ?", notificationsTable), []interface{}{TypeMemberRegistration, m.UUID}},
+		{fmt.Sprintf("UPDATE %s SET encrypted_changes = NULL WHERE member_uuid = ?", MEMBER_AUDIT_LOG_TABLE), []interface{}{m.UUID}},
+		// The SMTP errors of the member can contain their address
+		{fmt.Sprintf("UPDATE %s SET last_error = '' WHERE member_uuid = ?", NOTIFICATION_RECIPIENTS_TABLE), []interface{}{m.UUID}},
+	}
+	for _, q := range queries {
+		if _, err := tx.ExecContext(ctx, q.query, q.values...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
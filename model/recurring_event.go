@@ -2,7 +2,10 @@ package model
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/vilisseranen/castellers/common"
 )
@@ -14,29 +17,36 @@ type RecurringEvent struct {
 	Name        string
 	Description string
 	Interval    string
+	Until       uint
+	RRule       string
+	ExDates     []uint
 }
 
 func (r *RecurringEvent) Get(ctx context.Context) error {
 	ctx, span := tracer.Start(ctx, "RecurringEvent.Get")
 	defer span.End()
-	stmt, err := db.PrepareContext(ctx, fmt.Sprintf("SELECT name, description, interval FROM %s WHERE uuid= ?", RECURRING_EVENTS_TABLE))
-	defer stmt.Close()
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf("SELECT name, description, interval, until, rrule, exdates FROM %s WHERE uuid= ?", RECURRING_EVENTS_TABLE))
 	if err != nil {
 		common.Fatal(err.Error())
 	}
-	err = stmt.QueryRowContext(ctx, r.UUID).Scan(&r.Name, &r.Description, &r.Interval)
+	defer stmt.Close()
+	var description, rrule, exdates sql.NullString // to manage possible NULL fields
+	err = stmt.QueryRowContext(ctx, r.UUID).Scan(&r.Name, &description, &r.Interval, &r.Until, &rrule, &exdates)
+	r.Description = nullToEmptyString(description)
+	r.RRule = nullToEmptyString(rrule)
+	r.ExDates = parseExDates(nullToEmptyString(exdates))
 	return err
 }
 
 func (r *RecurringEvent) CreateRecurringEvent(ctx context.Context) error {
 	ctx, span := tracer.Start(ctx, "RecurringEvent.CreateRecurringEvent")
 	defer span.End()
-	stmt, err := db.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %s (uuid, name, description, interval) VALUES (?, ?, ?, ?)", RECURRING_EVENTS_TABLE))
-	defer stmt.Close()
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %s (uuid, name, description, interval, until, rrule, exdates) VALUES (?, ?, ?, ?, ?, ?, ?)", RECURRING_EVENTS_TABLE))
 	if err != nil {
 		return err
 	}
-	_, err = stmt.ExecContext(ctx, r.UUID, r.Name, r.Description, r.Interval)
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx, r.UUID, r.Name, r.Description, r.Interval, r.Until, stringOrNull(r.RRule), stringOrNull(formatExDates(r.ExDates)))
 	if err != nil {
 		stmt.Close()
 		common.Error(err.Error())
@@ -45,3 +55,96 @@ func (r *RecurringEvent) CreateRecurringEvent(ctx context.Context) error {
 	}
 	return err
 }
+
+func (r *RecurringEvent) UpdateRecurringEvent(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "RecurringEvent.UpdateRecurringEvent")
+	defer span.End()
+	return r.update(ctx, db)
+}
+
+func (r *RecurringEvent) update(ctx context.Context, q dbExecutor) error {
+	_, err := q.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET name = ?, description = ?, until = ?, exdates = ? WHERE uuid = ?", RECURRING_EVENTS_TABLE),
+		r.Name, r.Description, r.Until, stringOrNull(formatExDates(r.ExDates)), r.UUID)
+	return err
+}
+
+// UpdateSeries changes the occurrences of the series and the series itself,
+// all or nothing: the updated occurrences are saved, the removed ones are
+// deleted and the added ones are created.
+func (r *RecurringEvent) UpdateSeries(ctx context.Context, updated, removed, added []Event) error {
+	ctx, span := tracer.Start(ctx, "RecurringEvent.UpdateSeries")
+	defer span.End()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := updateEvents(ctx, tx, updated); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := deleteEvents(ctx, tx, removed); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, e := range added {
+		if err := e.create(ctx, tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := r.update(ctx, tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Exception dates are stored as a comma-separated list of timestamps
+func formatExDates(exdates []uint) string {
+	dates := make([]string, 0, len(exdates))
+	for _, date := range exdates {
+		dates = append(dates, strconv.FormatUint(uint64(date), 10))
+	}
+	return strings.Join(dates, ",")
+}
+
+func parseExDates(exdates string) []uint {
+	dates := []uint{}
+	for _, value := range strings.Split(exdates, ",") {
+		if date, err := strconv.ParseUint(value, 10, 64); err == nil {
+			dates = append(dates, uint(date))
+		}
+	}
+	return dates
+}
+
+// GetEvents returns the occurrences of the series starting at or after
+// fromDate, ordered by start date. Deleted occurrences are ignored.
+func (r *RecurringEvent) GetEvents(ctx context.Context, fromDate uint) ([]Event, error) {
+	ctx, span := tracer.Start(ctx, "RecurringEvent.GetEvents")
+	defer span.End()
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT uuid, name, startDate, endDate, type, description, locationName, lat, lng, uniformRequired, timezone, capacity, answerDeadline FROM %s WHERE recurringEvent = ? AND startDate >= ? AND deleted=0 ORDER BY startDate",
+		EVENTS_TABLE), r.UUID, fromDate)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		e := Event{RecurringEvent: r.UUID}
+		var description, locationName, timezone sql.NullString // to manage possible NULL fields
+		if err = rows.Scan(&e.UUID, &e.Name, &e.StartDate, &e.EndDate, &e.Type, &description, &locationName, &e.Location.Lat, &e.Location.Lng, &e.UniformRequired, &timezone, &e.Capacity, &e.AnswerDeadline); err != nil {
+			return nil, err
+		}
+		e.Description = nullToEmptyString(description)
+		e.LocationName = nullToEmptyString(locationName)
+		e.Timezone = nullToEmptyString(timezone)
+		events = append(events, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,234 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/vilisseranen/castellers/common"
+)
+
+type AttendanceReport struct {
+	Start   uint                     `json:"start"`
+	End     uint                     `json:"end"`
+	Events  []Event                  `json:"events"`
+	Members []AttendanceReportMember `json:"members"`
+}
+
+type AttendanceReportMember struct {
+	UUID           string          `json:"uuid"`
+	FirstName      string          `json:"firstName"`
+	LastName       string          `json:"lastName"`
+	Type           string          `json:"type"`
+	Participations []Participation `json:"participations"` // In the same order as the events of the report
+	Attended       int             `json:"attended"`
+	AttendanceRate float64         `json:"attendanceRate"`
+}
+
+// Attended is true if the member was present, or answered yes and their
+// presence was not taken, like in Event.GetAttendance.
+func (p Participation) Attended() bool {
+	return p.Presence == common.AnswerYes ||
+		(p.Presence != common.AnswerNo && p.Answer == common.AnswerYes && p.Waitlisted == 0)
+}
+
+// GetAttendanceReport returns the answer and the presence of every member to
+// every event starting between start (included) and end (excluded), with
+// their attendance rate to the events started before now. Empty filters
+// match all event or member types. Deleted members are left out.
+func GetAttendanceReport(ctx context.Context, start, end uint, eventTypes, memberTypes []string, now int64) (AttendanceReport, error) {
+	ctx, span := tracer.Start(ctx, "GetAttendanceReport")
+	defer span.End()
+
+	report := AttendanceReport{Start: start, End: end, Events: []Event{}, Members: []AttendanceReportMember{}}
+	filters := []string{"e.startDate >= ?", "e.startDate < ?", "e.deleted = 0", "m.status NOT IN (?, ?)"}
+	queryValues := []interface{}{start, end, MEMBERSSTATUSDELETED, MEMBERSSTATUSPURGED}
+	if len(eventTypes) > 0 {
+		filters = append(filters, fmt.Sprintf("e.type IN (%s)", placeholders(len(eventTypes))))
+		for _, eventType := range eventTypes {
+			queryValues = append(queryValues, eventType)
+		}
+	}
+	if len(memberTypes) > 0 {
+		filters = append(filters, fmt.Sprintf("m.type IN (%s)", placeholders(len(memberTypes))))
+		for _, memberType := range memberTypes {
+			queryValues = append(queryValues, memberType)
+		}
+	}
+	query := fmt.Sprintf(
+		`SELECT m.uuid, m.firstName, m.lastName, m.type, e.uuid, e.name, e.startDate, e.endDate, e.type,
+		 COALESCE(p.answer, ''), COALESCE(p.presence, ''), p.waitlisted_at IS NOT NULL
+		 FROM %s AS m CROSS JOIN %s AS e
+		 LEFT JOIN %s AS p ON p.member_uuid = m.uuid AND p.event_uuid = e.uuid
+		 WHERE %s
+		 ORDER BY m.uuid, e.startDate, e.uuid`,
+		MEMBERSTABLE, EVENTS_TABLE, PARTICIPATION_TABLE, strings.Join(filters, " AND "))
+	common.Debug("SQL query: %s; params(values=%v)", query, queryValues)
+	rows, err := db.QueryContext(ctx, query, queryValues...)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+
+	// Every member has one row per event, in the same order
+	eventSeen := map[string]bool{}
+	pastEvents := 0
+	for rows.Next() {
+		var member AttendanceReportMember
+		var e Event
+		var p Participation
+		if err := rows.Scan(&member.UUID, &member.FirstName, &member.LastName, &member.Type,
+			&e.UUID, &e.Name, &e.StartDate, &e.EndDate, &e.Type, &p.Answer, &p.Presence, &p.Waitlisted); err != nil {
+			return report, err
+		}
+		if !eventSeen[e.UUID] {
+			eventSeen[e.UUID] = true
+			report.Events = append(report.Events, e)
+			if int64(e.StartDate) < now {
+				pastEvents++
+			}
+		}
+		last := len(report.Members) - 1
+		if last < 0 || report.Members[last].UUID != member.UUID {
+			member.FirstName = common.Decrypt([]byte(member.FirstName))
+			member.LastName = common.Decrypt([]byte(member.LastName))
+			member.Participations = []Participation{}
+			report.Members = append(report.Members, member)
+			last++
+		}
+		p.EventUUID = e.UUID
+		p.MemberUUID = member.UUID
+		report.Members[last].Participations = append(report.Members[last].Participations, p)
+		// The answers to the future events are not an attendance yet
+		if int64(e.StartDate) < now && p.Attended() {
+			report.Members[last].Attended++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+	for index, member := range report.Members {
+		if pastEvents > 0 {
+			report.Members[index].AttendanceRate = float64(member.Attended) / float64(pastEvents)
+		}
+	}
+	sort.SliceStable(report.Members, func(i, j int) bool {
+		if report.Members[i].LastName != report.Members[j].LastName {
+			return report.Members[i].LastName < report.Members[j].LastName
+		}
+		return report.Members[i].FirstName < report.Members[j].FirstName
+	})
+	return report, nil
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// A Season is a period of a year of activity, starting at Start (included)
+// and ending at End (excluded).
+type Season struct {
+	Name  string `json:"name"`
+	Start int64  `json:"start"`
+	End   int64  `json:"end"`
+}
+
+type RetentionReport struct {
+	Seasons []SeasonRetention `json:"seasons"`
+}
+
+// SeasonRetention describes the members of a season, and the cohort of the
+// members who joined during this season.
+type SeasonRetention struct {
+	Season
+	Joined            int            `json:"joined"`            // Members whose first status is in the season
+	Active            int            `json:"active"`            // Members active during some time of the season
+	Transitions       map[string]int `json:"transitions"`       // Changes of status during the season, by cause
+	Retention         []int          `json:"retention"`         // Members of the cohort active in this season and in each following one
+	AverageActiveDays float64        `json:"averageActiveDays"` // Average time spent active by the cohort until now
+}
+
+// GetRetentionReport returns the cohort and retention statistics of the
+// seasons, which must be in order, computed from the status history of the
+// members of the given types (all types if empty).
+func GetRetentionReport(ctx context.Context, seasons []Season, memberTypes []string, now int64) (RetentionReport, error) {
+	ctx, span := tracer.Start(ctx, "GetRetentionReport")
+	defer span.End()
+
+	history, err := GetAllStatusHistory(ctx, memberTypes)
+	if err != nil {
+		return RetentionReport{}, err
+	}
+	return retentionFromHistory(history, seasons, now), nil
+}
+
+// retentionFromHistory computes the report from the status history, ordered
+// by member and date.
+func retentionFromHistory(history []StatusChange, seasons []Season, now int64) RetentionReport {
+	report := RetentionReport{Seasons: make([]SeasonRetention, len(seasons))}
+	activeDays := make([]float64, len(seasons))
+	for i, season := range seasons {
+		report.Seasons[i] = SeasonRetention{Season: season, Transitions: map[string]int{}, Retention: make([]int, len(seasons)-i)}
+	}
+	seasonOf := func(date int64) int {
+		for i, season := range seasons {
+			if date >= season.Start && date < season.End {
+				return i
+			}
+		}
+		return -1
+	}
+	for start := 0; start < len(history); {
+		end := start
+		for end < len(history) && history[end].MemberUUID == history[start].MemberUUID {
+			end++
+		}
+		changes := history[start:end]
+		start = end
+
+		// Seasons where the member was active, and for how long
+		active := make([]bool, len(seasons))
+		var activeSeconds int64
+		for i, change := range changes {
+			if season := seasonOf(change.ChangedAt); season >= 0 {
+				report.Seasons[season].Transitions[change.Cause]++
+			}
+			if change.To != MEMBERSSTATUSACTIVATED || change.ChangedAt >= now {
+				continue
+			}
+			until := now
+			if i+1 < len(changes) && changes[i+1].ChangedAt < now {
+				until = changes[i+1].ChangedAt
+			}
+			activeSeconds += until - change.ChangedAt
+			for s, season := range seasons {
+				if change.ChangedAt < season.End && until > season.Start {
+					active[s] = true
+				}
+			}
+		}
+		for s := range seasons {
+			if active[s] {
+				report.Seasons[s].Active++
+			}
+		}
+		cohort := seasonOf(changes[0].ChangedAt)
+		if cohort < 0 {
+			continue
+		}
+		report.Seasons[cohort].Joined++
+		activeDays[cohort] += float64(activeSeconds) / (24 * 3600)
+		for s := cohort; s < len(seasons); s++ {
+			if active[s] {
+				report.Seasons[cohort].Retention[s-cohort]++
+			}
+		}
+	}
+	for i := range report.Seasons {
+		if report.Seasons[i].Joined > 0 {
+			report.Seasons[i].AverageActiveDays = activeDays[i] / float64(report.Seasons[i].Joined)
+		}
+	}
+	return report
+}
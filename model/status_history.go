@@ -0,0 +1,118 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/vilisseranen/castellers/common"
+)
+
+const MEMBER_STATUS_HISTORY_TABLE = "member_status_history"
+
+// Causes of a change of status
+const (
+	STATUSCAUSECREATION      = "creation"      // Member created
+	STATUSCAUSECREDENTIALS   = "credentials"   // Password set by the member
+	STATUSCAUSEMANUAL        = "manual"        // Admin pause or reactivation
+	STATUSCAUSEAUTOPAUSE     = "auto_pause"    // Inactivity scan of the scheduler
+	STATUSCAUSEPARTICIPATION = "participation" // Paused member answering yes or present
+	STATUSCAUSETYPECHANGE    = "type_change"   // Guest becoming a member
+	STATUSCAUSEDELETION      = "deletion"
+	STATUSCAUSEPURGE         = "purge"
+	STATUSCAUSEINITIAL       = "initial" // Status of the members before the history
+)
+
+// StatusChange is a change of status of a member.
+type StatusChange struct {
+	MemberUUID string `json:"memberUuid"`
+	From       string `json:"from"` // Empty for the first status
+	To         string `json:"to"`
+	Cause      string `json:"cause"`
+	ChangedAt  int64  `json:"changedAt"`
+}
+
+func recordStatusChange(ctx context.Context, tx *sql.Tx, memberUUID, from, to, cause string) error {
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (member_uuid, status_from, status_to, cause, changed_at) VALUES (?, ?, ?, ?, ?)",
+		MEMBER_STATUS_HISTORY_TABLE), memberUUID, from, to, cause, time.Now().Unix())
+	return err
+}
+
+// updateStatus sets the status of a member and records the change in the
+// history if the status is different. set adds columns to update, with
+// their values in args.
+func updateStatus(ctx context.Context, memberUUID, status, cause, set string, args ...interface{}) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := updateStatusInTx(ctx, tx, memberUUID, status, cause, set, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// updateStatusInTx is updateStatus in a transaction. Nothing is done if the
+// member does not exist. The change is recorded before the update, reading
+// the previous status in the same statement: the transaction takes the write
+// lock at once, so that concurrent changes wait for each other instead of
+// failing or recording a status that was already changed.
+func updateStatusInTx(ctx context.Context, tx *sql.Tx, memberUUID, status, cause, set string, args ...interface{}) error {
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (member_uuid, status_from, status_to, cause, changed_at) SELECT uuid, status, ?, ?, ? FROM %s WHERE uuid = ? AND status != ?",
+		MEMBER_STATUS_HISTORY_TABLE, MEMBERSTABLE), status, cause, time.Now().Unix(), memberUUID, status)
+	if err != nil {
+		return err
+	}
+	args = append([]interface{}{status}, args...)
+	args = append(args, memberUUID)
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET status = ?%s WHERE uuid = ?", MEMBERSTABLE, set), args...)
+	return err
+}
+
+// GetStatusHistory returns the changes of status of a member, oldest first.
+func (m *Member) GetStatusHistory(ctx context.Context) ([]StatusChange, error) {
+	ctx, span := tracer.Start(ctx, "Member.GetStatusHistory")
+	defer span.End()
+	return getStatusHistory(ctx, "member_uuid = ?", m.UUID)
+}
+
+// GetAllStatusHistory returns the changes of status of the members of the
+// given types (all types if empty), ordered by member and date.
+func GetAllStatusHistory(ctx context.Context, memberTypes []string) ([]StatusChange, error) {
+	ctx, span := tracer.Start(ctx, "GetAllStatusHistory")
+	defer span.End()
+	filter := "1 = 1"
+	queryValues := []interface{}{}
+	if len(memberTypes) > 0 {
+		filter = fmt.Sprintf("member_uuid IN (SELECT uuid FROM %s WHERE type IN (%s))", MEMBERSTABLE, placeholders(len(memberTypes)))
+		for _, memberType := range memberTypes {
+			queryValues = append(queryValues, memberType)
+		}
+	}
+	return getStatusHistory(ctx, filter, queryValues...)
+}
+
+func getStatusHistory(ctx context.Context, filter string, queryValues ...interface{}) ([]StatusChange, error) {
+	query := fmt.Sprintf(
+		"SELECT member_uuid, status_from, status_to, cause, changed_at FROM %s WHERE %s ORDER BY member_uuid, changed_at, id",
+		MEMBER_STATUS_HISTORY_TABLE, filter)
+	common.Debug("SQL query: %s; params(values=%v)", query, queryValues)
+	rows, err := db.QueryContext(ctx, query, queryValues...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := []StatusChange{}
+	for rows.Next() {
+		var c StatusChange
+		if err := rows.Scan(&c.MemberUUID, &c.From, &c.To, &c.Cause, &c.ChangedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, c)
+	}
+	return history, rows.Err()
+}
@@ -0,0 +1,184 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const TOKEN_STORE_TABLE = "token_store"
+const TOKEN_STORE_SETS_TABLE = "token_store_sets"
+
+// The keys of the token store expire in milliseconds, 0 if they do not
+// expire. The expired keys are ignored until they are deleted by
+// DeleteExpiredStoredTokens.
+
+const storedTokenValid = "(expires_at = 0 OR expires_at > ?)"
+
+// SetStoredToken sets the value of a key.
+func SetStoredToken(ctx context.Context, key, value string, expiresAt int64) error {
+	ctx, span := tracer.Start(ctx, "SetStoredToken")
+	defer span.End()
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (key, value, expires_at) VALUES (?, ?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at",
+		TOKEN_STORE_TABLE), key, value, expiresAt)
+	return err
+}
+
+// GetStoredToken returns the value of a key and when it expires,
+// sql.ErrNoRows if it does not exist or expired.
+func GetStoredToken(ctx context.Context, key string) (string, int64, error) {
+	ctx, span := tracer.Start(ctx, "GetStoredToken")
+	defer span.End()
+	var value string
+	var expiresAt int64
+	err := db.QueryRowContext(ctx, fmt.Sprintf("SELECT value, expires_at FROM %s WHERE key = ? AND %s", TOKEN_STORE_TABLE, storedTokenValid),
+		key, time.Now().UnixMilli()).Scan(&value, &expiresAt)
+	return value, expiresAt, err
+}
+
+// DeleteStoredTokens deletes keys and sets, and returns how many of them
+// existed.
+func DeleteStoredTokens(ctx context.Context, keys ...string) (int64, error) {
+	ctx, span := tracer.Start(ctx, "DeleteStoredTokens")
+	defer span.End()
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	args := make([]interface{}, 0, len(keys)+1)
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	args = append(args, time.Now().UnixMilli())
+	// The expired keys are deleted first, so the transaction takes the write
+	// lock before counting the keys, and another one cannot delete them too
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	var deleted int64
+	for _, table := range []string{TOKEN_STORE_TABLE, TOKEN_STORE_SETS_TABLE} {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE key IN (%s) AND NOT %s", table, placeholders(len(keys)), storedTokenValid),
+			args...); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		var existing int64
+		if err := tx.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(DISTINCT key) FROM %s WHERE key IN (%s)", table, placeholders(len(keys))),
+			args[:len(keys)]...).Scan(&existing); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE key IN (%s)", table, placeholders(len(keys))), args[:len(keys)]...); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		deleted += existing
+	}
+	return deleted, tx.Commit()
+}
+
+// IncrStoredToken increments the counter of a key, which expires at
+// expiresAt if it is created, and returns its new value.
+func IncrStoredToken(ctx context.Context, key string, expiresAt int64) (int64, error) {
+	ctx, span := tracer.Start(ctx, "IncrStoredToken")
+	defer span.End()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE key = ? AND NOT %s", TOKEN_STORE_TABLE, storedTokenValid),
+		key, time.Now().UnixMilli()); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	var value int64
+	if err := tx.QueryRowContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (key, value, expires_at) VALUES (?, '1', ?) ON CONFLICT(key) DO UPDATE SET value = CAST(value AS INTEGER) + 1 RETURNING CAST(value AS INTEGER)",
+		TOKEN_STORE_TABLE), key, expiresAt).Scan(&value); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return value, tx.Commit()
+}
+
+// AddToStoredSet adds a member to a set, and sets when the whole set
+// expires.
+func AddToStoredSet(ctx context.Context, key, member string, expiresAt int64) error {
+	ctx, span := tracer.Start(ctx, "AddToStoredSet")
+	defer span.End()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE key = ? AND NOT %s", TOKEN_STORE_SETS_TABLE, storedTokenValid),
+		key, time.Now().UnixMilli()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT OR IGNORE INTO %s (key, member) VALUES (?, ?)", TOKEN_STORE_SETS_TABLE), key, member); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET expires_at = ? WHERE key = ?", TOKEN_STORE_SETS_TABLE), expiresAt, key); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetStoredSet returns the members of a set, none if it expired.
+func GetStoredSet(ctx context.Context, key string) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "GetStoredSet")
+	defer span.End()
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT member FROM %s WHERE key = ? AND %s", TOKEN_STORE_SETS_TABLE, storedTokenValid),
+		key, time.Now().UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	members := []string{}
+	for rows.Next() {
+		var member string
+		if err := rows.Scan(&member); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// RemoveFromStoredSet removes a member from a set, and returns whether it
+// was in the set.
+func RemoveFromStoredSet(ctx context.Context, key, member string) (bool, error) {
+	ctx, span := tracer.Start(ctx, "RemoveFromStoredSet")
+	defer span.End()
+	result, err := db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE key = ? AND member = ? AND %s", TOKEN_STORE_SETS_TABLE, storedTokenValid),
+		key, member, time.Now().UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	removed, err := result.RowsAffected()
+	return removed > 0, err
+}
+
+// DeleteExpiredStoredTokens deletes the expired keys and sets, and returns
+// how many rows were deleted.
+func DeleteExpiredStoredTokens(ctx context.Context) (int64, error) {
+	ctx, span := tracer.Start(ctx, "DeleteExpiredStoredTokens")
+	defer span.End()
+	now := time.Now().UnixMilli()
+	var deleted int64
+	for _, table := range []string{TOKEN_STORE_TABLE, TOKEN_STORE_SETS_TABLE} {
+		result, err := db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE expires_at > 0 AND expires_at <= ?", table), now)
+		if err != nil {
+			return deleted, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
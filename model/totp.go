@@ -0,0 +1,167 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/vilisseranen/castellers/common"
+)
+
+const (
+	MEMBERSTOTPTABLE          = "members_totp"
+	MEMBERSRECOVERYCODESTABLE = "members_recovery_codes"
+)
+
+// TOTP is the second factor of a member. It is pending until the member
+// confirms the enrollment with a first code.
+type TOTP struct {
+	MemberUUID string
+	Secret     string // Encrypted
+	Enabled    bool
+	LastStep   int64 // Last time step used to login
+}
+
+// Get returns the second factor of the member, sql.ErrNoRows if there is
+// none.
+func (t *TOTP) Get(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "TOTP.Get")
+	defer span.End()
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf("SELECT secret, enabled, last_step FROM %s WHERE uuid = ?", MEMBERSTOTPTABLE))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	var secret []byte
+	if err := stmt.QueryRowContext(ctx, t.MemberUUID).Scan(&secret, &t.Enabled, &t.LastStep); err != nil {
+		return err
+	}
+	t.Secret = common.Decrypt(secret)
+	return nil
+}
+
+// CreatePending replaces the second factor of the member with a new secret,
+// disabled until Enable.
+func (t *TOTP) CreatePending(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "TOTP.CreatePending")
+	defer span.End()
+	stmt, err := db.PrepareContext(ctx, fmt.Sprintf(
+		"INSERT OR REPLACE INTO %s (uuid, secret, enabled, last_step) VALUES (?, ?, 0, 0)", MEMBERSTOTPTABLE))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx, t.MemberUUID, common.Encrypt(t.Secret))
+	return err
+}
+
+// Enable confirms the enrollment with the time step of the first code, and
+// sets the recovery codes, by their hashes.
+func (t *TOTP) Enable(ctx context.Context, step int64, codeHashes []string) error {
+	ctx, span := tracer.Start(ctx, "TOTP.Enable")
+	defer span.End()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET enabled = 1, last_step = ? WHERE uuid = ?", MEMBERSTOTPTABLE), step, t.MemberUUID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := replaceRecoveryCodes(ctx, tx, t.MemberUUID, codeHashes); err != nil {
+		tx.Rollback()
+		return err
+	}
+	t.Enabled = true
+	t.LastStep = step
+	return tx.Commit()
+}
+
+// UseStep records that the code of the time step was used. Returns false if
+// a code of this step or of a later one was already used.
+func (t *TOTP) UseStep(ctx context.Context, step int64) (bool, error) {
+	ctx, span := tracer.Start(ctx, "TOTP.UseStep")
+	defer span.End()
+	result, err := db.ExecContext(ctx, fmt.Sprintf(
+		"UPDATE %s SET last_step = ? WHERE uuid = ? AND enabled = 1 AND last_step < ?", MEMBERSTOTPTABLE), step, t.MemberUUID, step)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated == 1, err
+}
+
+// Delete removes the second factor and the recovery codes of the member.
+func (t *TOTP) Delete(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "TOTP.Delete")
+	defer span.End()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE uuid = ?", MEMBERSTOTPTABLE), t.MemberUUID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := replaceRecoveryCodes(ctx, tx, t.MemberUUID, []string{}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetRecoveryCodes replaces the recovery codes of the member, by their
+// hashes.
+func SetRecoveryCodes(ctx context.Context, memberUUID string, codeHashes []string) error {
+	ctx, span := tracer.Start(ctx, "SetRecoveryCodes")
+	defer span.End()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(ctx, tx, memberUUID, codeHashes); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, memberUUID string, codeHashes []string) error {
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE member_uuid = ?", MEMBERSRECOVERYCODESTABLE), memberUUID); err != nil {
+		return err
+	}
+	for _, codeHash := range codeHashes {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+			"INSERT INTO %s (member_uuid, code_hash) VALUES (?, ?)", MEMBERSRECOVERYCODESTABLE), memberUUID, codeHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseRecoveryCode marks the recovery code of the member, by its hash, as
+// used. Returns false if the code does not exist or was already used.
+func UseRecoveryCode(ctx context.Context, memberUUID, codeHash string) (bool, error) {
+	ctx, span := tracer.Start(ctx, "UseRecoveryCode")
+	defer span.End()
+	result, err := db.ExecContext(ctx, fmt.Sprintf(
+		"UPDATE %s SET used_at = ? WHERE member_uuid = ? AND code_hash = ? AND used_at = 0", MEMBERSRECOVERYCODESTABLE),
+		time.Now().Unix(), memberUUID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated == 1, err
+}
+
+// CountRecoveryCodes returns the number of recovery codes of the member not
+// used yet.
+func CountRecoveryCodes(ctx context.Context, memberUUID string) (int, error) {
+	ctx, span := tracer.Start(ctx, "CountRecoveryCodes")
+	defer span.End()
+	var count int
+	err := db.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT COUNT(*) FROM %s WHERE member_uuid = ? AND used_at = 0", MEMBERSRECOVERYCODESTABLE), memberUUID).Scan(&count)
+	return count, err
+}
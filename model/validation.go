@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"regexp"
 	"sort"
+	"time"
+
+	"github.com/vilisseranen/castellers/common"
 )
 
 var ValidRoleList = []string{
@@ -44,6 +47,13 @@ var ValidMemberTypes = []string{
 	MEMBERSTYPECANALLA,
 }
 
+var ValidPermissions = []string{
+	PERMISSIONCASTELLSWRITE,
+	PERMISSIONREMINDERSSEND,
+	PERMISSIONMEMBERSREADSENSITIVE,
+	PERMISSIONDEPENDENTSWRITE,
+}
+
 func ValidateRoles(roles []string) error {
 	sort.Strings(roles)
 	sort.Strings(ValidRoleList)
@@ -80,6 +90,18 @@ func ValidateLanguage(language string) error {
 	return nil
 }
 
+// ValidateTimezone accepts an IANA timezone name, or an empty string for the
+// organisation timezone.
+func ValidateTimezone(timezone string) error {
+	if timezone == "" {
+		return nil
+	}
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return errors.New("Invalid timezone")
+	}
+	return nil
+}
+
 func ValidateType(memberType string) error {
 	sort.Strings(ValidMemberTypes)
 	index := sort.SearchStrings(ValidMemberTypes, memberType)
@@ -88,3 +110,12 @@ func ValidateType(memberType string) error {
 	}
 	return nil
 }
+
+func ValidatePermissions(permissions []string) error {
+	for _, permission := range permissions {
+		if !common.StringInSlice(permission, ValidPermissions) {
+			return errors.New("Invalid permission")
+		}
+	}
+	return nil
+}
@@ -18,12 +18,12 @@ func AttachV1API(r *mux.Router) {
 	s.HandleFunc("/castells/types", controller.GetCastellTypeList).Methods("GET")
 	s.HandleFunc("/castells/types/{type:[0-9]+d[0-9]+}", controller.GetCastellType).Methods("GET")
 	s.HandleFunc("/castells/models", checkTokenType(controller.GetCastellModels, model.MEMBERSTYPEREGULAR)).Methods("GET")
-	s.HandleFunc("/castells/models", checkTokenType(controller.CreateCastellModel, model.MEMBERSTYPEADMIN)).Methods("POST")
+	s.HandleFunc("/castells/models", checkTokenType(controller.CreateCastellModel, model.MEMBERSTYPEADMIN, model.PERMISSIONCASTELLSWRITE)).Methods("POST")
 	s.HandleFunc("/castells/models/{uuid:[0-9a-f]+}", checkTokenType(controller.GetCastellModel, model.MEMBERSTYPEREGULAR)).Methods("GET")
-	s.HandleFunc("/castells/models/{uuid:[0-9a-f]+}", checkTokenType(controller.DeleteCastellModel, model.MEMBERSTYPEADMIN)).Methods("DELETE")
-	s.HandleFunc("/castells/models/{uuid:[0-9a-f]+}", checkTokenType(controller.EditCastellModel, model.MEMBERSTYPEADMIN)).Methods("PUT")
-	s.HandleFunc("/castells/models/{model_uuid:[0-9a-f]+}/events/{event_uuid:[0-9a-f]+}", checkTokenType(controller.AttachCastellModelToEvent, model.MEMBERSTYPEADMIN)).Methods("POST")
-	s.HandleFunc("/castells/models/{model_uuid:[0-9a-f]+}/events/{event_uuid:[0-9a-f]+}", checkTokenType(controller.DettachCastellModelFromEvent, model.MEMBERSTYPEADMIN)).Methods("DELETE")
+	s.HandleFunc("/castells/models/{uuid:[0-9a-f]+}", checkTokenType(controller.DeleteCastellModel, model.MEMBERSTYPEADMIN, model.PERMISSIONCASTELLSWRITE)).Methods("DELETE")
+	s.HandleFunc("/castells/models/{uuid:[0-9a-f]+}", checkTokenType(controller.EditCastellModel, model.MEMBERSTYPEADMIN, model.PERMISSIONCASTELLSWRITE)).Methods("PUT")
+	s.HandleFunc("/castells/models/{model_uuid:[0-9a-f]+}/events/{event_uuid:[0-9a-f]+}", checkTokenType(controller.AttachCastellModelToEvent, model.MEMBERSTYPEADMIN, model.PERMISSIONCASTELLSWRITE)).Methods("POST")
+	s.HandleFunc("/castells/models/{model_uuid:[0-9a-f]+}/events/{event_uuid:[0-9a-f]+}", checkTokenType(controller.DettachCastellModelFromEvent, model.MEMBERSTYPEADMIN, model.PERMISSIONCASTELLSWRITE)).Methods("DELETE")
 
 	// Initialize, login, tokens, version
 	s.HandleFunc("/initialize", controller.Initialize).Methods("POST")
@@ -32,9 +32,38 @@ func AttachV1API(r *mux.Router) {
 	s.HandleFunc("/logout", controller.Logout).Methods("POST")
 	s.HandleFunc("/refresh", controller.RefreshToken).Methods("POST")
 	s.HandleFunc("/forgot_password", controller.ForgotPassword).Methods("POST")
+	s.HandleFunc("/magic_link", controller.RequestMagicLink).Methods("POST")
+	s.HandleFunc("/login/magic_link", checkTokenType(controller.LoginMagicLink, controller.MagicLinkPermission)).Methods("POST")
+	s.HandleFunc("/login/oidc", controller.StartOIDCLogin).Methods("GET")
+	s.HandleFunc("/login/oidc", controller.FinishOIDCLogin).Methods("POST")
 	s.HandleFunc("/version", controller.Version).Methods("GET")
 	s.HandleFunc("/reset_credentials", checkTokenType(controller.ResetCredentials, controller.ResetCredentialsPermission)).Methods("POST")
-	s.HandleFunc("/change_password", checkTokenType(controller.ResetCredentials, model.MEMBERSTYPEREGULAR)).Methods("POST")
+	s.HandleFunc("/change_password", checkSessionTokenType(controller.ResetCredentials, model.MEMBERSTYPEREGULAR)).Methods("POST")
+
+	// Second factor
+	s.HandleFunc("/login/mfa", checkSessionTokenType(controller.LoginMFA, controller.MFAPermission)).Methods("POST")
+	s.HandleFunc("/mfa", checkSessionTokenType(controller.GetMFA, model.MEMBERSTYPEREGULAR)).Methods("GET")
+	s.HandleFunc("/mfa", checkSessionTokenType(controller.DisableMFA, model.MEMBERSTYPEREGULAR)).Methods("DELETE")
+	s.HandleFunc("/mfa/enroll", checkSessionTokenType(controller.EnrollMFA, model.MEMBERSTYPEREGULAR, controller.MFAEnrollPermission)).Methods("POST")
+	s.HandleFunc("/mfa/enroll/confirm", checkSessionTokenType(controller.ConfirmMFA, model.MEMBERSTYPEREGULAR, controller.MFAEnrollPermission)).Methods("POST")
+	s.HandleFunc("/mfa/recovery_codes", checkSessionTokenType(controller.RegenerateRecoveryCodes, model.MEMBERSTYPEREGULAR)).Methods("POST")
+	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}/mfa", checkSessionTokenType(controller.ResetMemberMFA, model.MEMBERSTYPEADMIN)).Methods("DELETE")
+	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}/oidc", checkSessionTokenType(controller.UnlinkMemberOIDC, model.MEMBERSTYPEADMIN)).Methods("DELETE")
+
+	// Sessions
+	s.HandleFunc("/sessions", checkSessionTokenType(controller.GetSessions, model.MEMBERSTYPEREGULAR)).Methods("GET")
+	s.HandleFunc("/sessions", checkSessionTokenType(controller.RevokeOtherSessions, model.MEMBERSTYPEREGULAR)).Methods("DELETE")
+	s.HandleFunc("/sessions/{session_id:[0-9a-f]+}", checkSessionTokenType(controller.RevokeSession, model.MEMBERSTYPEREGULAR)).Methods("DELETE")
+	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}/sessions", checkSessionTokenType(controller.GetMemberSessions, model.MEMBERSTYPEADMIN)).Methods("GET")
+	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}/sessions", checkSessionTokenType(controller.RevokeMemberSessions, model.MEMBERSTYPEADMIN)).Methods("DELETE")
+	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}/sessions/{session_id:[0-9a-f]+}", checkSessionTokenType(controller.RevokeMemberSession, model.MEMBERSTYPEADMIN)).Methods("DELETE")
+
+	// Personal API tokens
+	s.HandleFunc("/api_tokens", checkSessionTokenType(controller.GetAPITokens, model.MEMBERSTYPEREGULAR)).Methods("GET")
+	s.HandleFunc("/api_tokens", checkSessionTokenType(controller.CreateAPIToken, model.MEMBERSTYPEREGULAR)).Methods("POST")
+	s.HandleFunc("/api_tokens/{token_id:[0-9a-f]+}", checkSessionTokenType(controller.RevokeAPIToken, model.MEMBERSTYPEREGULAR)).Methods("DELETE")
+	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}/api_tokens", checkSessionTokenType(controller.GetMemberAPITokens, model.MEMBERSTYPEADMIN)).Methods("GET")
+	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}/api_tokens/{token_id:[0-9a-f]+}", checkSessionTokenType(controller.RevokeMemberAPIToken, model.MEMBERSTYPEADMIN)).Methods("DELETE")
 
 	// Events
 	s.HandleFunc("/events", controller.GetEvents).Methods("GET")
@@ -42,23 +71,39 @@ func AttachV1API(r *mux.Router) {
 	s.HandleFunc("/events", checkTokenType(controller.CreateEvent, model.MEMBERSTYPEADMIN)).Methods("POST")
 	s.HandleFunc("/events/{uuid:[0-9a-f]+}", checkTokenType(controller.UpdateEvent, model.MEMBERSTYPEADMIN)).Methods("PUT")
 	s.HandleFunc("/events/{uuid:[0-9a-f]+}", checkTokenType(controller.DeleteEvent, model.MEMBERSTYPEADMIN)).Methods("DELETE")
+	s.HandleFunc("/events/{uuid:[0-9a-f]+}/series", checkTokenType(controller.UpdateEventSeries, model.MEMBERSTYPEADMIN)).Methods("PUT")
+	s.HandleFunc("/events/{uuid:[0-9a-f]+}/series", checkTokenType(controller.DeleteEventSeries, model.MEMBERSTYPEADMIN)).Methods("DELETE")
 	s.HandleFunc("/events/{event_uuid:[0-9a-f]+}/members", checkTokenType(controller.GetEventParticipation, model.MEMBERSTYPEADMIN)).Methods("GET")
 	s.HandleFunc("/events/{event_uuid:[0-9a-f]+}/members/{member_uuid:[0-9a-f]+}", checkTokenType(controller.PresenceEvent, model.MEMBERSTYPEADMIN)).Methods("POST")
-	s.HandleFunc("/events/{event_uuid:[0-9a-f]+}/reminders", checkTokenType(controller.SendEventReminders, model.MEMBERSTYPEADMIN)).Methods("POST")
+	s.HandleFunc("/events/{event_uuid:[0-9a-f]+}/reminders", checkTokenType(controller.SendEventReminders, model.MEMBERSTYPEADMIN, model.PERMISSIONREMINDERSSEND)).Methods("POST")
 
 	// Members
 	s.HandleFunc("/members", checkTokenType(controller.GetMembers, model.MEMBERSTYPEREGULAR)).Methods("GET")
 	s.HandleFunc("/members", checkTokenType(controller.CreateMember, model.MEMBERSTYPEADMIN)).Methods("POST")
 	s.HandleFunc("/members/roles", controller.GetRoles).Methods("GET")
+	s.HandleFunc("/members/reencrypt", checkTokenType(controller.ReencryptMembers, model.MEMBERSTYPEADMIN)).Methods("POST")
+	s.HandleFunc("/members/import", checkTokenType(controller.ImportMembers, model.MEMBERSTYPEADMIN)).Methods("POST")
+	s.HandleFunc("/members/audit", checkTokenType(controller.GetMemberAuditLog, model.MEMBERSTYPEADMIN)).Methods("GET")
 	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}", checkTokenType(controller.GetMember, model.MEMBERSTYPEREGULAR)).Methods("GET")
 	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}", checkTokenType(controller.EditMember, model.MEMBERSTYPEREGULAR)).Methods("PUT")
 	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}", checkTokenType(controller.DeleteMember, model.MEMBERSTYPEADMIN)).Methods("DELETE")
 	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}/status", checkTokenType(controller.SetMemberStatus, model.MEMBERSTYPEADMIN)).Methods("PUT")
+	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}/status/history", checkTokenType(controller.GetMemberStatusHistory, model.MEMBERSTYPEADMIN)).Methods("GET")
+	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}/inactivity", checkTokenType(controller.GetMemberInactivity, model.MEMBERSTYPEADMIN)).Methods("GET")
+	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}/inactivity", checkTokenType(controller.SetMemberInactivity, model.MEMBERSTYPEADMIN)).Methods("PUT")
+	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}/permissions", checkTokenType(controller.GetMemberPermissionSets, model.MEMBERSTYPEADMIN)).Methods("GET")
+	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}/permissions", checkTokenType(controller.SetMemberPermissionSets, model.MEMBERSTYPEADMIN)).Methods("PUT")
 	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}/registration", checkTokenType(controller.SendRegistrationEmail, model.MEMBERSTYPEADMIN)).Methods("GET")
 	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}/events/{event_uuid:[0-9a-f]+}", checkTokenType(controller.ParticipateEvent, model.MEMBERSTYPEREGULAR, controller.ParticipateEventPermission)).Methods("POST")
-	s.HandleFunc("/members/{responsible_uuid:[0-9a-f]+}/dependents/{dependent_uuid:[0-9a-f]+}", checkTokenType(controller.AddRemoveDependent, model.MEMBERSTYPEADMIN)).Methods("POST")
-	s.HandleFunc("/members/{responsible_uuid:[0-9a-f]+}/dependents/{dependent_uuid:[0-9a-f]+}", checkTokenType(controller.AddRemoveDependent, model.MEMBERSTYPEADMIN)).Methods("DELETE")
+	s.HandleFunc("/members/{responsible_uuid:[0-9a-f]+}/dependents/{dependent_uuid:[0-9a-f]+}", checkTokenType(controller.AddRemoveDependent, model.MEMBERSTYPEADMIN, model.PERMISSIONDEPENDENTSWRITE)).Methods("POST")
+	s.HandleFunc("/members/{responsible_uuid:[0-9a-f]+}/dependents/{dependent_uuid:[0-9a-f]+}", checkTokenType(controller.AddRemoveDependent, model.MEMBERSTYPEADMIN, model.PERMISSIONDEPENDENTSWRITE)).Methods("DELETE")
 	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}/badges", checkTokenType(controller.GetMemberBadges, model.MEMBERSTYPEREGULAR)).Methods("GET")
+	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}/export", checkTokenType(controller.ExportMemberData, model.MEMBERSTYPEREGULAR)).Methods("GET")
+	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}/calendar", checkTokenType(controller.CreateCalendarToken, model.MEMBERSTYPEREGULAR)).Methods("POST")
+	s.HandleFunc("/members/{member_uuid:[0-9a-f]+}/calendar", checkTokenType(controller.RevokeCalendarToken, model.MEMBERSTYPEREGULAR)).Methods("DELETE")
+
+	// Calendar feeds, authenticated by the calendar token in the URL
+	s.HandleFunc("/calendar/{token:[0-9a-f]+}.ics", controller.GetCalendarFeed).Methods("GET")
 
 	// Badges
 	s.HandleFunc("/badges", checkTokenType(controller.GetBadges, model.MEMBERSTYPEREGULAR)).Methods("GET")
@@ -66,6 +111,15 @@ func AttachV1API(r *mux.Router) {
 	s.HandleFunc("/badges/{badge_uuid:[0-9a-f]+}/members", checkTokenType(controller.AssignBadge, model.MEMBERSTYPEADMIN)).Methods("POST")
 	s.HandleFunc("/badges/{badge_uuid:[0-9a-f]+}/members", checkTokenType(controller.RemoveBadge, model.MEMBERSTYPEADMIN)).Methods("DELETE")
 
+	// Permissions
+	s.HandleFunc("/permissions", checkTokenType(controller.GetPermissions, model.MEMBERSTYPEADMIN)).Methods("GET")
+	s.HandleFunc("/permissions/sets/{name}", checkTokenType(controller.SavePermissionSet, model.MEMBERSTYPEADMIN)).Methods("PUT")
+	s.HandleFunc("/permissions/sets/{name}", checkTokenType(controller.DeletePermissionSet, model.MEMBERSTYPEADMIN)).Methods("DELETE")
+
+	// Reports
+	s.HandleFunc("/reports/attendance", checkTokenType(controller.GetAttendanceReport, model.MEMBERSTYPEADMIN)).Methods("GET")
+	s.HandleFunc("/reports/retention", checkTokenType(controller.GetRetentionReport, model.MEMBERSTYPEADMIN)).Methods("GET")
+
 	// Deprecated
 	s.HandleFunc("/members/events/{event_uuid:[0-9a-f]+}", checkTokenType(controller.ParticipateEvent, model.MEMBERSTYPEREGULAR, controller.ParticipateEventPermission)).Methods("POST")
 }
@@ -10,6 +10,16 @@ import (
 type handler func(w http.ResponseWriter, r *http.Request)
 
 func checkTokenType(h handler, requestedType ...string) handler {
+	return checkToken(h, true, requestedType...)
+}
+
+// checkSessionTokenType is checkTokenType for the resources managing the
+// credentials of the members, which personal API tokens cannot access.
+func checkSessionTokenType(h handler, requestedType ...string) handler {
+	return checkToken(h, false, requestedType...)
+}
+
+func checkToken(h handler, allowAPIToken bool, requestedType ...string) handler {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx, span := tracer.Start(r.Context(), "checkTokenType")
 		defer span.End()
@@ -25,6 +35,11 @@ func checkTokenType(h handler, requestedType ...string) handler {
 			common.Debug("Token invalid: %s", err.Error())
 			return
 		}
+		if tokenAuth.APIToken && !allowAPIToken {
+			common.Warn("API token not allowed to access this resource")
+			controller.RespondWithError(w, http.StatusUnauthorized, controller.ERRORUNAUTHORIZED)
+			return
+		}
 		if !common.StringInBothSlices(requestedType, tokenAuth.Permissions) {
 			common.Warn("Token not allowed to access this resource")
 			controller.RespondWithError(w, http.StatusUnauthorized, controller.ERRORUNAUTHORIZED)
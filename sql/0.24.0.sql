@@ -0,0 +1,10 @@
+-- Long-lived tokens used to subscribe to a member's iCalendar feed.
+-- Only the SHA-256 hash of the token is stored.
+CREATE TABLE IF NOT EXISTS calendar_tokens
+(
+	member_uuid TEXT PRIMARY KEY,
+	token_hash TEXT NOT NULL,
+	created_at INTEGER NOT NULL DEFAULT 0,
+	CONSTRAINT token_hash_unique UNIQUE (token_hash),
+	FOREIGN KEY(member_uuid) REFERENCES members(uuid)
+);
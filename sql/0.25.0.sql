@@ -0,0 +1,3 @@
+-- Remember the end of each series so it can be extended or shortened.
+ALTER TABLE recurring_events ADD COLUMN until INTEGER NOT NULL DEFAULT 0;
+UPDATE recurring_events SET until = COALESCE((SELECT MAX(startDate) FROM events WHERE events.recurringEvent = recurring_events.uuid), 0);
@@ -0,0 +1,8 @@
+-- Recurrence of the series as an RFC 5545 RRULE, and dates to skip (EXDATE)
+ALTER TABLE recurring_events ADD COLUMN rrule TEXT;
+ALTER TABLE recurring_events ADD COLUMN exdates TEXT;
+UPDATE recurring_events SET rrule = CASE substr(interval, -1)
+	WHEN 'w' THEN 'FREQ=WEEKLY;INTERVAL=' || substr(interval, 1, length(interval) - 1)
+	WHEN 'd' THEN 'FREQ=DAILY;INTERVAL=' || substr(interval, 1, length(interval) - 1)
+	END
+WHERE rrule IS NULL;
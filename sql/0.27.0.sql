@@ -0,0 +1,3 @@
+-- Timezone overrides, NULL for the organisation timezone
+ALTER TABLE events ADD COLUMN timezone TEXT;
+ALTER TABLE members ADD COLUMN timezone TEXT;
@@ -0,0 +1,4 @@
+-- Maximum number of participants of an event, 0 for no limit
+ALTER TABLE events ADD COLUMN capacity INTEGER NOT NULL DEFAULT 0;
+-- When a yes answer was put on the waiting list, NULL if confirmed
+ALTER TABLE participation ADD COLUMN waitlisted_at INTEGER;
@@ -0,0 +1,15 @@
+-- Timestamp after which members cannot change their answer, 0 for no deadline
+ALTER TABLE events ADD COLUMN answerDeadline INTEGER NOT NULL DEFAULT 0;
+-- Answers changed by an admin after the deadline, to let the other admins know
+CREATE TABLE IF NOT EXISTS late_participation_changes
+(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	event_uuid TEXT NOT NULL,
+	member_uuid TEXT NOT NULL,
+	author_uuid TEXT NOT NULL,
+	answer TEXT NOT NULL,
+	changed_at INTEGER NOT NULL DEFAULT 0,
+	notified INTEGER NOT NULL DEFAULT 0,
+	FOREIGN KEY(event_uuid) REFERENCES events(uuid),
+	FOREIGN KEY(member_uuid) REFERENCES members(uuid)
+);
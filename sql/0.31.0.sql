@@ -0,0 +1,4 @@
+-- Keyed hash of the normalised email, to find a member by email without
+-- decrypting every row. Computed by the API at startup for existing rows.
+ALTER TABLE members ADD COLUMN email_index TEXT;
+CREATE INDEX IF NOT EXISTS members_email_index ON members(email_index);
@@ -0,0 +1,5 @@
+-- When the member was deleted, to purge their personal data after the
+-- retention period. The members deleted before this version start their
+-- retention period now.
+ALTER TABLE members ADD COLUMN deleted_at INTEGER NOT NULL DEFAULT 0;
+UPDATE members SET deleted_at = CAST(strftime('%s', 'now') AS INTEGER) WHERE status = 'deleted';
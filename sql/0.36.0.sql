@@ -0,0 +1,15 @@
+-- Append-only history of the changes made to members. changes is the JSON
+-- diff of the plain fields, encrypted_changes the encrypted JSON diff of the
+-- encrypted fields, removed when the member is purged.
+CREATE TABLE IF NOT EXISTS member_audit_log
+(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	created_at INTEGER NOT NULL,
+	actor_uuid TEXT NOT NULL,
+	member_uuid TEXT NOT NULL,
+	action TEXT NOT NULL,
+	changes TEXT NOT NULL,
+	encrypted_changes BLOB,
+	FOREIGN KEY(member_uuid) REFERENCES members(uuid)
+);
+CREATE INDEX IF NOT EXISTS member_audit_log_member ON member_audit_log(member_uuid, id);
@@ -0,0 +1,25 @@
+-- Every change of status of the members, with its cause
+CREATE TABLE IF NOT EXISTS member_status_history
+(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	member_uuid TEXT NOT NULL,
+	status_from TEXT NOT NULL,
+	status_to TEXT NOT NULL,
+	cause TEXT NOT NULL,
+	changed_at INTEGER NOT NULL,
+	FOREIGN KEY(member_uuid) REFERENCES members(uuid)
+);
+CREATE INDEX IF NOT EXISTS member_status_history_member ON member_status_history(member_uuid, changed_at);
+
+-- The history of the existing members is unknown: they are considered
+-- active since their first participation, and in their current status
+-- since now.
+INSERT INTO member_status_history (member_uuid, status_from, status_to, cause, changed_at)
+	SELECT p.member_uuid, '', 'active', 'initial', MIN(MIN(e.startDate), CAST(strftime('%s', 'now') AS INTEGER))
+	FROM participation AS p JOIN events AS e ON e.uuid = p.event_uuid
+	JOIN members AS m ON m.uuid = p.member_uuid
+	GROUP BY p.member_uuid;
+INSERT INTO member_status_history (member_uuid, status_from, status_to, cause, changed_at)
+	SELECT m.uuid, COALESCE(h.status_to, ''), m.status, 'initial', CAST(strftime('%s', 'now') AS INTEGER)
+	FROM members AS m LEFT JOIN member_status_history AS h ON h.member_uuid = m.uuid
+	WHERE h.status_to IS NULL OR h.status_to != m.status;
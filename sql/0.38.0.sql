@@ -0,0 +1,4 @@
+-- Members never paused by the inactivity scan, and when the last inactivity
+-- warning was sent to the member
+ALTER TABLE members ADD COLUMN inactivity_exempt INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE members ADD COLUMN inactivity_warned_at INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,19 @@
+-- Named sets of permissions (comma-separated), assignable to members on top
+-- of the permissions of their type
+CREATE TABLE IF NOT EXISTS permission_sets
+(
+	name TEXT PRIMARY KEY,
+	permissions TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS member_permission_sets
+(
+	member_uuid TEXT NOT NULL,
+	permission_set TEXT NOT NULL,
+	PRIMARY KEY(member_uuid, permission_set),
+	FOREIGN KEY(member_uuid) REFERENCES members(uuid),
+	FOREIGN KEY(permission_set) REFERENCES permission_sets(name)
+);
+INSERT OR IGNORE INTO permission_sets (name, permissions) VALUES
+	('technical', 'castells:write'),
+	('canalla', 'dependents:write,members:read-sensitive'),
+	('communications', 'reminders:send');
@@ -0,0 +1,21 @@
+-- Second factor of the members: the TOTP secret (encrypted), enabled once
+-- the enrollment is confirmed, and the last time step used, so a code cannot
+-- be used twice
+CREATE TABLE IF NOT EXISTS members_totp
+(
+	uuid TEXT PRIMARY KEY,
+	secret BLOB NOT NULL,
+	enabled INTEGER NOT NULL DEFAULT 0,
+	last_step INTEGER NOT NULL DEFAULT 0,
+	FOREIGN KEY(uuid) REFERENCES members(uuid)
+);
+-- Single-use recovery codes, by their SHA-256
+CREATE TABLE IF NOT EXISTS members_recovery_codes
+(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	member_uuid TEXT NOT NULL,
+	code_hash TEXT NOT NULL,
+	used_at INTEGER NOT NULL DEFAULT 0,
+	FOREIGN KEY(member_uuid) REFERENCES members(uuid)
+);
+CREATE INDEX IF NOT EXISTS members_recovery_codes_member ON members_recovery_codes(member_uuid, code_hash);
@@ -0,0 +1,12 @@
+-- Accounts of an OpenID Connect provider linked to members, by the subject
+-- of the provider
+CREATE TABLE IF NOT EXISTS member_oidc_identities
+(
+	issuer TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	member_uuid TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	PRIMARY KEY(issuer, subject),
+	FOREIGN KEY(member_uuid) REFERENCES members(uuid)
+);
+CREATE INDEX IF NOT EXISTS member_oidc_identities_member ON member_oidc_identities(member_uuid);
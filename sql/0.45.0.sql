@@ -0,0 +1,15 @@
+-- Personal API tokens of the members, by their SHA-256, with the
+-- permissions they are limited to (comma-separated)
+CREATE TABLE IF NOT EXISTS api_tokens
+(
+	id TEXT PRIMARY KEY,
+	member_uuid TEXT NOT NULL,
+	name TEXT NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	permissions TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL DEFAULT 0,
+	last_used_at INTEGER NOT NULL DEFAULT 0,
+	FOREIGN KEY(member_uuid) REFERENCES members(uuid)
+);
+CREATE INDEX IF NOT EXISTS api_tokens_member ON api_tokens(member_uuid);
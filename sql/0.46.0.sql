@@ -0,0 +1,18 @@
+-- Tokens, sessions and counters of the authentication, when they are kept
+-- in the database instead of Redis (token_store = sqlite).
+-- expires_at is in milliseconds, 0 if the key does not expire.
+CREATE TABLE IF NOT EXISTS token_store
+(
+	key TEXT PRIMARY KEY,
+	value TEXT NOT NULL,
+	expires_at INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS token_store_expires_at ON token_store(expires_at);
+CREATE TABLE IF NOT EXISTS token_store_sets
+(
+	key TEXT NOT NULL,
+	member TEXT NOT NULL,
+	expires_at INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (key, member)
+);
+CREATE INDEX IF NOT EXISTS token_store_sets_expires_at ON token_store_sets(expires_at);
@@ -0,0 +1,18 @@
+-- Failed attempts to send a notification, and when to try again. A
+-- notification waiting for a retry is not delivered (0).
+ALTER TABLE notifications ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE notifications ADD COLUMN next_attempt_at INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE notifications ADD COLUMN last_error TEXT NOT NULL DEFAULT '';
+-- Delivery of a notification to each of its recipients, so a retry only
+-- sends it to the members who did not receive it
+CREATE TABLE IF NOT EXISTS notification_recipients
+(
+	notification_id INTEGER NOT NULL,
+	member_uuid TEXT NOT NULL,
+	delivered INTEGER NOT NULL DEFAULT 0,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY(notification_id, member_uuid),
+	FOREIGN KEY(notification_id) REFERENCES notifications(id)
+);
@@ -0,0 +1,5 @@
+-- The late changes are tracked for each admin by
+-- notification_recipients.last_change_id: the changes sent to all the admins
+-- before are not needed anymore
+DELETE FROM late_participation_changes WHERE notified = 1;
+ALTER TABLE late_participation_changes DROP COLUMN notified;
@@ -0,0 +1,11 @@
+-- Accounts unlinked by an admin, which are not linked again automatically
+-- with their email
+CREATE TABLE IF NOT EXISTS member_oidc_unlinked
+(
+	issuer TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	member_uuid TEXT NOT NULL,
+	unlinked_at INTEGER NOT NULL,
+	PRIMARY KEY(issuer, subject)
+);
+CREATE INDEX IF NOT EXISTS member_oidc_unlinked_member ON member_oidc_unlinked(member_uuid);
@@ -0,0 +1,3 @@
+-- Last late participation change of an event sent to the admin, so that
+-- each admin only receives the changes they did not receive yet
+ALTER TABLE notification_recipients ADD COLUMN last_change_id INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,180 @@
+package tests
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// createAPIToken creates an API token with the access token of a session.
+func (test *TestHelper) createAPIToken(accessToken string, permissions []string, expiresAt int64) (int, map[string]interface{}) {
+	payload, _ := json.Marshal(map[string]interface{}{"name": "script", "permissions": permissions, "expiresAt": expiresAt})
+	req, _ := http.NewRequest("POST", "/api/v1/api_tokens", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	var token map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &token)
+	return response.Code, token
+}
+
+func (test *TestHelper) execSQL(query string, args ...interface{}) {
+	db, err := sql.Open("sqlite3", testDbName)
+	if err != nil {
+		tFatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Exec(query, args...); err != nil {
+		tFatal(err)
+	}
+}
+
+func (test *TestHelper) getWithToken(token, url string) int {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	return h.executeRequest(req).Code
+}
+
+func TestAPITokenUse(t *testing.T) {
+	h.clearTables()
+	h.addAMember()
+	accessToken := h.login("member", "member")
+
+	code, token := h.createAPIToken(accessToken, []string{"member"}, 0)
+	if err := h.checkResponseCode(http.StatusCreated, code); err != nil {
+		t.Fatal(err)
+	}
+	secret := token["token"].(string)
+	if len(secret) != 68 || secret[:4] != "cst_" {
+		t.Fatalf("Expected a token starting with cst_. Got %s", secret)
+	}
+	if n := h.countRows("SELECT COUNT(*) FROM api_tokens WHERE token_hash = ?", secret); n != 0 {
+		t.Errorf("Expected the token to be stored hashed")
+	}
+
+	if err := h.checkResponseCode(http.StatusOK, h.getWithToken(secret, "/api/v1/members/deadbeef")); err != nil {
+		t.Fatal(err)
+	}
+	if n := h.countRows("SELECT COUNT(*) FROM api_tokens WHERE id = ? AND last_used_at > 0", token["id"]); n != 1 {
+		t.Errorf("Expected the last use of the token to be recorded")
+	}
+
+	// The token is listed without its secret
+	code, tokens := h.getSessions(accessToken, "/api/v1/api_tokens")
+	if err := h.checkResponseCode(http.StatusOK, code); err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0]["token"] != nil || tokens[0]["lastUsedAt"] == 0.0 {
+		t.Errorf("Expected the token without its secret. Got %v", tokens)
+	}
+
+	// API tokens cannot manage the credentials of the member
+	for _, url := range []string{"/api/v1/api_tokens", "/api/v1/sessions", "/api/v1/mfa"} {
+		if err := h.checkResponseCode(http.StatusUnauthorized, h.getWithToken(secret, url)); err != nil {
+			t.Errorf("%s: %s", url, err)
+		}
+	}
+	if code, _ := h.createAPIToken(secret, []string{"member"}, 0); code != http.StatusUnauthorized {
+		t.Errorf("Expected an API token not to create API tokens. Got %d", code)
+	}
+
+	if err := h.checkResponseCode(http.StatusOK, h.deleteWithToken(accessToken, "/api/v1/api_tokens/"+token["id"].(string))); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.checkResponseCode(http.StatusUnauthorized, h.getWithToken(secret, "/api/v1/members/deadbeef")); err != nil {
+		t.Error(err)
+	}
+	if err := h.checkResponseCode(http.StatusNotFound, h.deleteWithToken(accessToken, "/api/v1/api_tokens/"+token["id"].(string))); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAPITokenPermissions(t *testing.T) {
+	h.clearTables()
+	h.addAMember()
+	h.addAnAdmin()
+	memberToken := h.login("member", "member")
+	adminToken := h.login("admin", "admin")
+
+	if code, _ := h.createAPIToken(memberToken, []string{"admin"}, 0); code != http.StatusBadRequest {
+		t.Errorf("Expected a member not to create an admin token. Got %d", code)
+	}
+	if code, _ := h.createAPIToken(memberToken, []string{}, 0); code != http.StatusBadRequest {
+		t.Errorf("Expected a token without permissions to be refused. Got %d", code)
+	}
+	if code, _ := h.createAPIToken(memberToken, []string{"member"}, time.Now().Add(-time.Hour).Unix()); code != http.StatusBadRequest {
+		t.Errorf("Expected a token expired at creation to be refused. Got %d", code)
+	}
+
+	// A token with only the member permission cannot access admin resources
+	_, memberScoped := h.createAPIToken(adminToken, []string{"member"}, 0)
+	if err := h.checkResponseCode(http.StatusUnauthorized, h.getWithToken(memberScoped["token"].(string), "/api/v1/permissions")); err != nil {
+		t.Error(err)
+	}
+	_, adminScoped := h.createAPIToken(adminToken, []string{"member", "admin"}, 0)
+	adminSecret := adminScoped["token"].(string)
+	if err := h.checkResponseCode(http.StatusOK, h.getWithToken(adminSecret, "/api/v1/permissions")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The token loses the permissions the member loses
+	h.execSQL("UPDATE members SET type = 'member' WHERE uuid = 'deadfeed'")
+	if err := h.checkResponseCode(http.StatusUnauthorized, h.getWithToken(adminSecret, "/api/v1/permissions")); err != nil {
+		t.Error(err)
+	}
+	if err := h.checkResponseCode(http.StatusOK, h.getWithToken(adminSecret, "/api/v1/members/deadfeed")); err != nil {
+		t.Error(err)
+	}
+
+	// The tokens of a deleted member cannot be used
+	_, token := h.createAPIToken(memberToken, []string{"member"}, 0)
+	h.execSQL("UPDATE members SET type = 'admin' WHERE uuid = 'deadfeed'")
+	h.deleteMember(adminToken, "deadbeef")
+	if err := h.checkResponseCode(http.StatusUnauthorized, h.getWithToken(token["token"].(string), "/api/v1/members/deadbeef")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAPITokenExpiration(t *testing.T) {
+	h.clearTables()
+	h.addAMember()
+	accessToken := h.login("member", "member")
+
+	_, token := h.createAPIToken(accessToken, []string{"member"}, time.Now().Add(time.Hour).Unix())
+	secret := token["token"].(string)
+	if err := h.checkResponseCode(http.StatusOK, h.getWithToken(secret, "/api/v1/members/deadbeef")); err != nil {
+		t.Fatal(err)
+	}
+	h.execSQL("UPDATE api_tokens SET expires_at = ? WHERE id = ?", time.Now().Add(-time.Minute).Unix(), token["id"])
+	if err := h.checkResponseCode(http.StatusUnauthorized, h.getWithToken(secret, "/api/v1/members/deadbeef")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAdminRevokeMemberAPIToken(t *testing.T) {
+	h.clearTables()
+	h.addAMember()
+	h.addAnAdmin()
+	memberToken := h.login("member", "member")
+	adminToken := h.login("admin", "admin")
+
+	_, token := h.createAPIToken(memberToken, []string{"member"}, 0)
+	code, tokens := h.getSessions(adminToken, "/api/v1/members/deadbeef/api_tokens")
+	if err := h.checkResponseCode(http.StatusOK, code); err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0]["id"] != token["id"] {
+		t.Fatalf("Expected the token of the member. Got %v", tokens)
+	}
+	if err := h.checkResponseCode(http.StatusUnauthorized, h.deleteWithToken(memberToken, "/api/v1/members/deadbeef/api_tokens/"+token["id"].(string))); err != nil {
+		t.Error(err)
+	}
+	if err := h.checkResponseCode(http.StatusOK, h.deleteWithToken(adminToken, "/api/v1/members/deadbeef/api_tokens/"+token["id"].(string))); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.checkResponseCode(http.StatusUnauthorized, h.getWithToken(token["token"].(string), "/api/v1/members/deadbeef")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,95 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/vilisseranen/castellers/model"
+)
+
+func TestCalendarFeed(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAMember()
+	h.setMemberStatus("deadbeef", model.MEMBERSSTATUSACTIVATED)
+	start := futureEventStart()
+	h.addEvent("deadbeef", "diada", start, start+3600)
+	h.addEvent("deadfeed", "assaig", start+86400, start+90000)
+	h.addParticipation("deadbeef", "deadbeef", "yes")
+	h.addParticipation("deadbeef", "deadfeed", "no")
+
+	req, _ := http.NewRequest("POST", "/api/v1/members/deadbeef/calendar", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusCreated, response.Code); err != nil {
+		t.Error(err)
+	}
+	var body map[string]string
+	json.Unmarshal(response.Body.Bytes(), &body)
+	if body["token"] == "" {
+		t.Fatalf("Expected a calendar token. Got '%v'", body)
+	}
+	if !strings.HasSuffix(body["url"], "/api/v1/calendar/"+body["token"]+".ics") {
+		t.Errorf("Expected the url to point to the feed. Got '%s'", body["url"])
+	}
+
+	// The feed does not need an Authorization header
+	req, _ = http.NewRequest("GET", "/api/v1/calendar/"+body["token"]+".ics", nil)
+	response = h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Error(err)
+	}
+	if contentType := response.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/calendar") {
+		t.Errorf("Expected a text/calendar content type. Got '%s'", contentType)
+	}
+	feed := response.Body.String()
+	if !strings.HasPrefix(feed, "BEGIN:VCALENDAR\r\n") || !strings.HasSuffix(feed, "END:VCALENDAR\r\n") {
+		t.Errorf("Expected a VCALENDAR. Got '%s'", feed)
+	}
+	if strings.Count(feed, "BEGIN:VEVENT") != 2 {
+		t.Errorf("Expected 2 events in the feed. Got '%s'", feed)
+	}
+	if !strings.Contains(feed, "SUMMARY:diada") || !strings.Contains(feed, "UID:deadbeef@castellers") {
+		t.Errorf("Expected the diada in the feed. Got '%s'", feed)
+	}
+	// The assaig the member will not attend does not block their agenda
+	if strings.Count(feed, "TRANSP:OPAQUE") != 1 || strings.Count(feed, "TRANSP:TRANSPARENT") != 1 {
+		t.Errorf("Expected the answers of the member in the feed. Got '%s'", feed)
+	}
+
+	// The feed of a member who is not activated is not found
+	h.setMemberStatus("deadbeef", model.MEMBERSSTATUSPAUSED)
+	req, _ = http.NewRequest("GET", "/api/v1/calendar/"+body["token"]+".ics", nil)
+	response = h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusNotFound, response.Code); err != nil {
+		t.Error(err)
+	}
+	h.setMemberStatus("deadbeef", model.MEMBERSSTATUSACTIVATED)
+
+	// Revoking the token makes the feed unavailable
+	req, _ = http.NewRequest("DELETE", "/api/v1/members/deadbeef/calendar", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response = h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Error(err)
+	}
+	req, _ = http.NewRequest("GET", "/api/v1/calendar/"+body["token"]+".ics", nil)
+	response = h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusNotFound, response.Code); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCalendarTokenOtherMember(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAMember()
+	h.addMember("aabbccdd", "Ada", "Lovelace", "", "", "", "baix", "member", "ada@test.ca", "")
+
+	req, _ := http.NewRequest("POST", "/api/v1/members/aabbccdd/calendar", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusUnauthorized, response.Code); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,8 +1,11 @@
 package tests
 
 import (
+	"bytes"
 	"fmt"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/vilisseranen/castellers/common"
 )
@@ -31,6 +34,74 @@ func TestEncryption2(t *testing.T) {
 	}
 }
 
+// rotateEncryptionKey makes newKey the current key with ID 2, the test key
+// becoming key 1. It returns a function restoring the test key.
+func rotateEncryptionKey(newKey string) func() {
+	oldKey := os.Getenv("APP_KEY")
+	os.Setenv("APP_KEY", newKey)
+	os.Setenv("APP_KEY_ID", "2")
+	os.Setenv("APP_OLD_KEYS", "1:"+oldKey)
+	return func() {
+		os.Setenv("APP_KEY", oldKey)
+		os.Unsetenv("APP_KEY_ID")
+		os.Unsetenv("APP_OLD_KEYS")
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	encryptedText := common.Encrypt("This is a text")
+	if !bytes.HasPrefix(encryptedText, []byte("$k1$")) {
+		t.Errorf("Expected the ciphertext to start with the key ID. Got '%s'", encryptedText[:4])
+	}
+	// Written before key IDs existed
+	legacyText := bytes.TrimPrefix(common.Encrypt("This is a legacy text"), []byte("$k1$"))
+
+	restore := rotateEncryptionKey("aNewKeyAfterTheOldOneLeakedddddd")
+	defer restore()
+	if decryptedText := common.Decrypt(encryptedText); decryptedText != "This is a text" {
+		t.Errorf("Expected to decrypt with the old key. Got '%s'", decryptedText)
+	}
+	if decryptedText := common.Decrypt(legacyText); decryptedText != "This is a legacy text" {
+		t.Errorf("Expected to decrypt a ciphertext without key ID. Got '%s'", decryptedText)
+	}
+	if !common.NeedsReencryption(encryptedText) || !common.NeedsReencryption(legacyText) {
+		t.Error("Expected ciphertexts of the old key to need a re-encryption")
+	}
+	newText := common.Encrypt("This is a new text")
+	if !bytes.HasPrefix(newText, []byte("$k2$")) || common.NeedsReencryption(newText) {
+		t.Errorf("Expected the new key to be used. Got '%s'", newText[:4])
+	}
+	if decryptedText := common.Decrypt(newText); decryptedText != "This is a new text" {
+		t.Errorf("Expected to decrypt with the new key. Got '%s'", decryptedText)
+	}
+}
+
+func TestValidateEncryptionKeys(t *testing.T) {
+	if err := common.ValidateEncryptionKeys(); err != nil {
+		t.Errorf("Expected the test keys to be valid. Got %v", err)
+	}
+	restore := rotateEncryptionKey("aNewKeyAfterTheOldOneLeakedddddd")
+	defer restore()
+	if err := common.ValidateEncryptionKeys(); err != nil {
+		t.Errorf("Expected the rotated keys to be valid. Got %v", err)
+	}
+
+	os.Setenv("APP_OLD_KEYS", "1")
+	if err := common.ValidateEncryptionKeys(); err == nil {
+		t.Error("Expected a malformed old key to be refused")
+	}
+	// The email index would change without the key 1
+	os.Unsetenv("APP_OLD_KEYS")
+	if err := common.ValidateEncryptionKeys(); err == nil {
+		t.Error("Expected the index key to be required without the key 1")
+	}
+	os.Setenv("APP_INDEX_KEY", "anIndexKey")
+	defer os.Unsetenv("APP_INDEX_KEY")
+	if err := common.ValidateEncryptionKeys(); err != nil {
+		t.Errorf("Expected the index key to replace the key 1. Got %v", err)
+	}
+}
+
 func TestHashing(t *testing.T) {
 	password := "my super password"
 	hashedPassword, _ := common.GenerateFromPassword(password)
@@ -42,3 +113,113 @@ func TestHashing(t *testing.T) {
 		t.Error("Password was not decrypted properly.")
 	}
 }
+
+func expandRRule(t *testing.T, rule string, start, until time.Time, exdates ...time.Time) []time.Time {
+	r, err := common.ParseRRule(rule, start.Location())
+	if err != nil {
+		t.Fatalf("Error parsing '%s': %v", rule, err)
+	}
+	occurrences, err := r.Expand(start, until, exdates)
+	if err != nil {
+		t.Fatalf("Error expanding '%s': %v", rule, err)
+	}
+	return occurrences
+}
+
+func TestRRuleMonthlyByDay(t *testing.T) {
+	location, _ := time.LoadLocation("America/Montreal")
+	start := time.Date(2026, time.January, 10, 10, 0, 0, 0, location) // 2nd Saturday
+	occurrences := expandRRule(t, "FREQ=MONTHLY;BYDAY=2SA,4SA;COUNT=5", start, time.Time{})
+	expected := []int{10, 24, 14, 28, 14}
+	if len(occurrences) != len(expected) {
+		t.Fatalf("Expected %d occurrences. Got '%v'", len(expected), occurrences)
+	}
+	for i, occurrence := range occurrences {
+		if occurrence.Day() != expected[i] || occurrence.Weekday() != time.Saturday {
+			t.Errorf("Expected occurrence %d on Saturday %d. Got '%v'", i, expected[i], occurrence)
+		}
+	}
+}
+
+func TestRRuleWeeklyByDayKeepsTimeAcrossDST(t *testing.T) {
+	location, _ := time.LoadLocation("America/Montreal")
+	start := time.Date(2026, time.October, 27, 19, 30, 0, 0, location) // Tuesday, before winter time
+	until := time.Date(2026, time.November, 12, 23, 0, 0, 0, location)
+	occurrences := expandRRule(t, "RRULE:FREQ=WEEKLY;BYDAY=TU,TH", start, until)
+	if len(occurrences) != 6 {
+		t.Fatalf("Expected 6 occurrences. Got '%v'", occurrences)
+	}
+	for _, occurrence := range occurrences {
+		if occurrence.Hour() != 19 || occurrence.Minute() != 30 {
+			t.Errorf("Expected occurrences at 19:30. Got '%v'", occurrence)
+		}
+		if occurrence.Weekday() != time.Tuesday && occurrence.Weekday() != time.Thursday {
+			t.Errorf("Expected occurrences on Tuesday or Thursday. Got '%v'", occurrence)
+		}
+	}
+}
+
+func TestRRuleExDates(t *testing.T) {
+	location, _ := time.LoadLocation("America/Montreal")
+	start := time.Date(2026, time.December, 1, 19, 0, 0, 0, location)
+	holiday := time.Date(2026, time.December, 29, 0, 0, 0, 0, location)
+	occurrences := expandRRule(t, "FREQ=WEEKLY;COUNT=6", start, time.Time{}, holiday)
+	// COUNT includes the skipped date, as in RFC 5545
+	if len(occurrences) != 5 {
+		t.Fatalf("Expected 5 occurrences. Got '%v'", occurrences)
+	}
+	for _, occurrence := range occurrences {
+		if occurrence.Month() == time.December && occurrence.Day() == 29 {
+			t.Errorf("Expected the holiday to be skipped. Got '%v'", occurrences)
+		}
+	}
+}
+
+func TestRRuleByMonthDay(t *testing.T) {
+	location, _ := time.LoadLocation("America/Montreal")
+	start := time.Date(2026, time.January, 1, 20, 0, 0, 0, location)
+	until := time.Date(2026, time.April, 30, 23, 0, 0, 0, location)
+	occurrences := expandRRule(t, "FREQ=MONTHLY;BYMONTHDAY=1,-1", start, until)
+	expected := []string{"01-01", "31-01", "01-02", "28-02", "01-03", "31-03", "01-04", "30-04"}
+	if len(occurrences) != len(expected) {
+		t.Fatalf("Expected %d occurrences. Got '%v'", len(expected), occurrences)
+	}
+	for i, occurrence := range occurrences {
+		if occurrence.Format("02-01") != expected[i] {
+			t.Errorf("Expected occurrence %d on %s. Got '%v'", i, expected[i], occurrence)
+		}
+	}
+}
+
+func TestRRuleYearlyWithoutByMonth(t *testing.T) {
+	location, _ := time.LoadLocation("America/Montreal")
+	start := time.Date(2026, time.January, 15, 20, 0, 0, 0, location)
+	// Every month, not only the month of the start
+	occurrences := expandRRule(t, "FREQ=YEARLY;BYMONTHDAY=15;COUNT=13", start, time.Time{})
+	if len(occurrences) != 13 {
+		t.Fatalf("Expected 13 occurrences. Got '%v'", occurrences)
+	}
+	for i, occurrence := range occurrences {
+		if occurrence.Day() != 15 || occurrence.Month() != time.Month(i%12+1) || occurrence.Year() != 2026+i/12 {
+			t.Errorf("Expected occurrence %d on the 15th of month %d. Got '%v'", i, i%12+1, occurrence)
+		}
+	}
+	until := time.Date(2026, time.March, 1, 0, 0, 0, 0, location)
+	occurrences = expandRRule(t, "FREQ=YEARLY;BYDAY=MO", start, until)
+	if len(occurrences) != 6 || occurrences[0].Format("02-01") != "19-01" || occurrences[5].Format("02-01") != "23-02" {
+		t.Errorf("Expected every Monday from January 19 to February 23. Got '%v'", occurrences)
+	}
+	// Without BY* parts, the day of the start once a year
+	occurrences = expandRRule(t, "FREQ=YEARLY;COUNT=2", start, time.Time{})
+	if len(occurrences) != 2 || occurrences[1].Format("02-01-2006") != "15-01-2027" {
+		t.Errorf("Expected January 15 of 2026 and 2027. Got '%v'", occurrences)
+	}
+}
+
+func TestRRuleInvalid(t *testing.T) {
+	for _, rule := range []string{"", "BYDAY=MO", "FREQ=HOURLY", "FREQ=WEEKLY;BYDAY=2MO", "FREQ=DAILY;COUNT=2;UNTIL=20261231", "FREQ=MONTHLY;BYMONTHDAY=32", "FREQ=WEEKLY;BYMONTHDAY=1"} {
+		if _, err := common.ParseRRule(rule, time.UTC); err == nil {
+			t.Errorf("Expected '%s' to be rejected", rule)
+		}
+	}
+}
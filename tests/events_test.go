@@ -2,6 +2,7 @@ package tests
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -516,3 +517,335 @@ func TestCreateAndUpdateEventUniformRequired(t *testing.T) {
 		t.Errorf("Expected uniformRequired to be 0 after update. Got '%v'", event.UniformRequired)
 	}
 }
+
+func (test *TestHelper) addDailySeries(accessToken string, occurrences int) []model.Event {
+	startDate := futureEventStart()
+	until := startDate + 3600*24*(occurrences-1)
+	payload := []byte(fmt.Sprintf(`{"name":"assaig","startDate":%d, "endDate":%d, "recurring": {"interval": "1d", "until": %d}, "type":"practice"}`, startDate, startDate+3600, until))
+	req, _ := http.NewRequest("POST", "/api/v1/events", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusCreated, response.Code); err != nil {
+		tFatal(err)
+	}
+	return h.getUpcomingEvents()
+}
+
+func (test *TestHelper) getUpcomingEvents() []model.Event {
+	req, _ := http.NewRequest("GET", "/api/v1/events?limit=100&page=0", nil)
+	response := h.executeRequest(req)
+	events := make([]model.Event, 0)
+	json.Unmarshal(response.Body.Bytes(), &events)
+	return events
+}
+
+func (test *TestHelper) countNotifications(notificationType string) int {
+	db, err := sql.Open("sqlite3", testDbName)
+	if err != nil {
+		tFatal(err)
+	}
+	defer db.Close()
+	var count int
+	tFatal(db.QueryRow("SELECT COUNT(*) FROM notifications WHERE notificationType = ?", notificationType).Scan(&count))
+	return count
+}
+
+func TestUpdateEventSeries(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+	events := h.addDailySeries(accessToken, 4)
+	if len(events) != 4 {
+		t.Fatalf("Expected 4 events in the series. Got %d", len(events))
+	}
+
+	// Rename and move the second occurrence one hour later, the following ones must follow
+	second := events[1]
+	payload := []byte(fmt.Sprintf(`{"name":"assaig general","startDate":%d, "endDate":%d, "type":"practice", "locationName":"Brébeuf", "uniformRequired":1}`,
+		second.StartDate+3600, second.EndDate+7200))
+	req, _ := http.NewRequest("PUT", "/api/v1/events/"+second.UUID+"/series", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Fatal(err)
+	}
+
+	updated := h.getUpcomingEvents()
+	if len(updated) != 4 {
+		t.Fatalf("Expected 4 events in the series. Got %d", len(updated))
+	}
+	if updated[0].Name != "assaig" || updated[0].StartDate != events[0].StartDate {
+		t.Errorf("Expected the first occurrence to be unchanged. Got '%v'", updated[0])
+	}
+	for i := 1; i < 4; i++ {
+		if updated[i].Name != "assaig general" || updated[i].LocationName != "Brébeuf" || updated[i].UniformRequired != 1 {
+			t.Errorf("Expected occurrence %d to be updated. Got '%v'", i, updated[i])
+		}
+		if updated[i].StartDate != events[i].StartDate+3600 {
+			t.Errorf("Expected occurrence %d to start at %d. Got %d", i, events[i].StartDate+3600, updated[i].StartDate)
+		}
+		if updated[i].EndDate-updated[i].StartDate != 7200 {
+			t.Errorf("Expected occurrence %d to last 7200 seconds. Got %d", i, updated[i].EndDate-updated[i].StartDate)
+		}
+	}
+	if count := h.countNotifications(model.TypeEventModified); count != 1 {
+		t.Errorf("Expected exactly 1 eventModified notification. Got %d", count)
+	}
+}
+
+func TestUpdateEventSeriesUntil(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+	events := h.addDailySeries(accessToken, 4)
+
+	// Shorten the series to the first 2 occurrences
+	payload := []byte(fmt.Sprintf(`{"name":"assaig","startDate":%d, "endDate":%d, "type":"practice", "recurring": {"until": %d}}`,
+		events[0].StartDate, events[0].EndDate, events[1].StartDate))
+	req, _ := http.NewRequest("PUT", "/api/v1/events/"+events[0].UUID+"/series", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	if updated := h.getUpcomingEvents(); len(updated) != 2 {
+		t.Errorf("Expected 2 events after shortening the series. Got %d", len(updated))
+	}
+
+	// Extend it to 6 occurrences
+	payload = []byte(fmt.Sprintf(`{"name":"assaig","startDate":%d, "endDate":%d, "type":"practice", "recurring": {"until": %d}}`,
+		events[0].StartDate, events[0].EndDate, events[0].StartDate+3600*24*5+3600))
+	req, _ = http.NewRequest("PUT", "/api/v1/events/"+events[0].UUID+"/series", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response = h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	updated := h.getUpcomingEvents()
+	if len(updated) != 6 {
+		t.Fatalf("Expected 6 events after extending the series. Got %d", len(updated))
+	}
+	for i := 2; i < 6; i++ {
+		if updated[i].Name != "assaig" || updated[i].EndDate-updated[i].StartDate != 3600 {
+			t.Errorf("Expected occurrence %d to copy the series. Got '%v'", i, updated[i])
+		}
+	}
+	if count := h.countNotifications(model.TypeEventModified); count != 2 {
+		t.Errorf("Expected one eventModified notification per update. Got %d", count)
+	}
+}
+
+func TestDeleteEventSeries(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+	events := h.addDailySeries(accessToken, 4)
+
+	req, _ := http.NewRequest("DELETE", "/api/v1/events/"+events[2].UUID+"/series", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	remaining := h.getUpcomingEvents()
+	if len(remaining) != 2 || remaining[0].UUID != events[0].UUID || remaining[1].UUID != events[1].UUID {
+		t.Errorf("Expected only the first 2 occurrences to remain. Got '%v'", remaining)
+	}
+	if count := h.countNotifications(model.TypeEventDeleted); count != 1 {
+		t.Errorf("Expected exactly 1 eventDeleted notification. Got %d", count)
+	}
+}
+
+func TestUpdateEventSeriesFailureChangesNothing(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+	events := h.addDailySeries(accessToken, 4)
+	h.execSQL("CREATE TRIGGER fail_series BEFORE UPDATE ON recurring_events BEGIN SELECT RAISE(ABORT, 'failure'); END")
+	defer h.execSQL("DROP TRIGGER fail_series")
+
+	// The series fails once its occurrences are changed
+	payload := []byte(fmt.Sprintf(`{"name":"assaig general","startDate":%d, "endDate":%d, "type":"practice", "recurring": {"until": %d}}`,
+		events[1].StartDate+3600, events[1].EndDate+3600, events[1].StartDate+3600*24*4+3600))
+	req, _ := http.NewRequest("PUT", "/api/v1/events/"+events[1].UUID+"/series", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	if err := h.checkResponseCode(http.StatusInternalServerError, h.executeRequest(req).Code); err != nil {
+		t.Fatal(err)
+	}
+	req, _ = http.NewRequest("DELETE", "/api/v1/events/"+events[2].UUID+"/series", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	if err := h.checkResponseCode(http.StatusInternalServerError, h.executeRequest(req).Code); err != nil {
+		t.Fatal(err)
+	}
+
+	unchanged := h.getUpcomingEvents()
+	if len(unchanged) != len(events) {
+		t.Fatalf("Expected the %d occurrences to be kept. Got '%v'", len(events), unchanged)
+	}
+	for i, event := range unchanged {
+		if event.UUID != events[i].UUID || event.Name != "assaig" || event.StartDate != events[i].StartDate {
+			t.Errorf("Expected occurrence %d to be unchanged. Got '%v'", i, event)
+		}
+	}
+	if count := h.countNotifications(model.TypeEventModified) + h.countNotifications(model.TypeEventDeleted); count != 0 {
+		t.Errorf("Expected no notification. Got %d", count)
+	}
+}
+
+func TestUpdateEventSeriesNotRecurring(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+	start := futureEventStart()
+	h.addEvent("deadbeef", "diada", start, start+3600)
+
+	req, _ := http.NewRequest("DELETE", "/api/v1/events/deadbeef/series", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusBadRequest, response.Code); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreateEventWithRRule(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+
+	location, _ := time.LoadLocation("America/Montreal")
+	now := time.Now().In(location)
+	// Next Tuesday at 19:30
+	start := time.Date(now.Year(), now.Month(), now.Day()+(int(time.Tuesday)-int(now.Weekday())+7)%7+7, 19, 30, 0, 0, location)
+	holiday := start.AddDate(0, 0, 9) // Thursday of the following week
+	payload := []byte(fmt.Sprintf(`{"name":"assaig","startDate":%d, "endDate":%d, "recurring": {"rrule": "FREQ=WEEKLY;BYDAY=TU,TH;COUNT=6", "exdates": [%d]}, "type":"practice"}`,
+		start.Unix(), start.Unix()+7200, holiday.Unix()))
+	req, _ := http.NewRequest("POST", "/api/v1/events", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusCreated, response.Code); err != nil {
+		t.Fatal(err)
+	}
+
+	events := h.getUpcomingEvents()
+	if len(events) != 5 {
+		t.Fatalf("Expected 5 events. Got %d", len(events))
+	}
+	for _, event := range events {
+		eventStart := time.Unix(int64(event.StartDate), 0).In(location)
+		if eventStart.Weekday() != time.Tuesday && eventStart.Weekday() != time.Thursday {
+			t.Errorf("Expected events on Tuesday or Thursday. Got '%v'", eventStart)
+		}
+		if eventStart.Hour() != 19 || eventStart.Minute() != 30 {
+			t.Errorf("Expected events at 19:30. Got '%v'", eventStart)
+		}
+		if eventStart.Format("20060102") == holiday.Format("20060102") {
+			t.Errorf("Expected the holiday to be skipped. Got '%v'", eventStart)
+		}
+	}
+
+	// Extending the series follows the rule
+	payload = []byte(fmt.Sprintf(`{"name":"assaig","startDate":%d, "endDate":%d, "type":"practice", "recurring": {"until": %d}}`,
+		events[0].StartDate, events[0].EndDate, start.AddDate(0, 0, 28).Unix()))
+	req, _ = http.NewRequest("PUT", "/api/v1/events/"+events[0].UUID+"/series", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response = h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	// 5 weeks of Tuesday and Thursday up to the Tuesday, minus the holiday
+	if events = h.getUpcomingEvents(); len(events) != 8 {
+		t.Errorf("Expected 8 events after extending the series. Got %d", len(events))
+	}
+}
+
+func TestCreateEventInvalidRRule(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+
+	start := futureEventStart()
+	// A rule without end
+	payload := []byte(fmt.Sprintf(`{"name":"assaig","startDate":%d, "endDate":%d, "recurring": {"rrule": "FREQ=WEEKLY"}, "type":"practice"}`, start, start+3600))
+	req, _ := http.NewRequest("POST", "/api/v1/events", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusBadRequest, response.Code); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreateWeeklyEventWithTimezone(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+
+	// Europe and America do not switch to winter time on the same day
+	location, _ := time.LoadLocation("Europe/Madrid")
+	now := time.Now().In(location)
+	start := time.Date(now.Year(), now.Month(), now.Day()+1, 20, 0, 0, 0, location)
+	until := start.AddDate(0, 0, 7*30)
+	payload := []byte(fmt.Sprintf(`{"name":"assaig","startDate":%d, "endDate":%d, "recurring": {"interval": "1w", "until": %d}, "type":"practice", "timezone": "Europe/Madrid"}`,
+		start.Unix(), start.Unix()+7200, until.Unix()))
+	req, _ := http.NewRequest("POST", "/api/v1/events", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusCreated, response.Code); err != nil {
+		t.Fatal(err)
+	}
+
+	events := h.getUpcomingEvents()
+	if len(events) != 31 {
+		t.Fatalf("Expected 31 events. Got %d", len(events))
+	}
+	for _, event := range events {
+		if event.Timezone != "Europe/Madrid" {
+			t.Errorf("Expected the timezone of the event to be Europe/Madrid. Got '%s'", event.Timezone)
+		}
+		if eventStart := time.Unix(int64(event.StartDate), 0).In(location); eventStart.Hour() != 20 {
+			t.Errorf("Expected events at 20:00 in Madrid. Got '%v'", eventStart)
+		}
+	}
+}
+
+func TestCreateEventInvalidTimezone(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+
+	start := futureEventStart()
+	payload := []byte(fmt.Sprintf(`{"name":"diada","startDate":%d, "endDate":%d, "type":"presentation", "timezone": "Montreal"}`, start, start+3600))
+	req, _ := http.NewRequest("POST", "/api/v1/events", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusBadRequest, response.Code); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreateWeeklyEventWithAnswerDeadline(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+
+	start := futureEventStart()
+	payload := []byte(fmt.Sprintf(`{"name":"diada","startDate":%d, "endDate":%d, "type":"presentation", "answerDeadline": %d, "recurring": {"rrule": "FREQ=WEEKLY;COUNT=3"}}`, start, start+3600, start-86400))
+	req, _ := http.NewRequest("POST", "/api/v1/events", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusCreated, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	events := h.getUpcomingEvents()
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events. Got %d", len(events))
+	}
+	for _, event := range events {
+		if event.StartDate-event.AnswerDeadline != 86400 {
+			t.Errorf("Expected answers to close a day before the event. Got start %d and deadline %d", event.StartDate, event.AnswerDeadline)
+		}
+	}
+}
+
+func TestCreateEventAnswerDeadlineAfterStart(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+
+	start := futureEventStart()
+	payload := []byte(fmt.Sprintf(`{"name":"diada","startDate":%d, "endDate":%d, "type":"presentation", "answerDeadline": %d}`, start, start+3600, start+60))
+	req, _ := http.NewRequest("POST", "/api/v1/events", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusBadRequest, response.Code); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,110 @@
+package tests
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/vilisseranen/castellers/model"
+)
+
+// exportMemberData downloads the data export of a member and returns the
+// files of the archive by name.
+func (test *TestHelper) exportMemberData(t *testing.T, accessToken, memberUUID string, expectedCode int) map[string][]byte {
+	req, _ := http.NewRequest("GET", "/api/v1/members/"+memberUUID+"/export", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(expectedCode, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	if expectedCode != http.StatusOK {
+		return files
+	}
+	archive, err := zip.NewReader(bytes.NewReader(response.Body.Bytes()), int64(response.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range archive.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content := new(bytes.Buffer)
+		content.ReadFrom(r)
+		r.Close()
+		files[f.Name] = content.Bytes()
+	}
+	return files
+}
+
+func TestExportMemberData(t *testing.T) {
+	h.clearTables()
+	h.addAnAdmin()
+	accessToken := h.addAMember()
+	h.addEvent("deadbee1", "assaig", 1528048800, 1528059600)
+	h.addParticipation("deadbeef", "deadbee1", "yes")
+	n := model.Notification{NotificationType: model.TypeWaitingListPromoted, ObjectUUID: "deadbee1", SendDate: 1528000000,
+		Payload: []byte(`{"memberUuids":["deadbeef"]}`)}
+	n.CreateNotification(context.Background())
+	n = model.Notification{NotificationType: model.TypeWaitingListPromoted, ObjectUUID: "deadbee1", SendDate: 1528000000,
+		Payload: []byte(`{"memberUuids":["deadfeed"]}`)}
+	n.CreateNotification(context.Background())
+
+	files := h.exportMemberData(t, accessToken, "deadbeef", http.StatusOK)
+
+	for _, name := range []string{"profile.json", "credentials.json", "participations.json", "badges.json", "castells.json", "notifications.json"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("Expected %s in the archive", name)
+		}
+	}
+	var profile model.Member
+	json.Unmarshal(files["profile.json"], &profile)
+	if profile.FirstName != "Ramon" || profile.Email != "ramon@gerard.ca" {
+		t.Errorf("Expected the decrypted profile. Got '%v'", profile)
+	}
+	var credentials map[string]interface{}
+	json.Unmarshal(files["credentials.json"], &credentials)
+	if credentials["username"] != "member" || len(credentials) != 1 {
+		t.Errorf("Expected only the username in the credentials. Got '%v'", credentials)
+	}
+	var participations []model.MemberParticipation
+	json.Unmarshal(files["participations.json"], &participations)
+	if len(participations) != 1 || participations[0].EventName != "assaig" || participations[0].Answer != "yes" {
+		t.Errorf("Expected the participation to assaig. Got '%v'", participations)
+	}
+	var notifications []map[string]interface{}
+	json.Unmarshal(files["notifications.json"], &notifications)
+	if len(notifications) != 1 || notifications[0]["type"] != model.TypeWaitingListPromoted {
+		t.Errorf("Expected only the notification about the member. Got '%v'", notifications)
+	}
+}
+
+func TestExportMemberDataOfAnotherMember(t *testing.T) {
+	h.clearTables()
+	h.addAnAdmin()
+	accessToken := h.addAMember()
+
+	h.exportMemberData(t, accessToken, "deadfeed", http.StatusUnauthorized)
+}
+
+func TestExportMemberDataOfDependent(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAMember()
+	h.addMember("123", "Jordi", "Gerard", "120", "30", "", "", model.MEMBERSTYPECANALLA, "", "")
+	responsible := model.Member{UUID: "deadbeef"}
+	if err := responsible.AddDependent(context.Background(), &model.Member{UUID: "123"}); err != nil {
+		t.Fatal(err)
+	}
+
+	files := h.exportMemberData(t, accessToken, "123", http.StatusOK)
+
+	var profile model.Member
+	json.Unmarshal(files["profile.json"], &profile)
+	if profile.FirstName != "Jordi" {
+		t.Errorf("Expected the profile of the dependent. Got '%v'", profile)
+	}
+}
@@ -24,12 +24,15 @@ type TestHelper struct {
 	app app.App
 }
 
+var mockRedis *miniredis.Miniredis
+
 func TestMain(m *testing.M) {
-	redis, err := miniredis.Run()
+	var err error
+	mockRedis, err = miniredis.Run()
 	if err != nil {
 		log.Fatalf("Cannot create mock redis: %v", err)
 	}
-	defer redis.Close()
+	defer mockRedis.Close()
 	os.Chdir("..")
 	h.app = app.App{}
 	os.Setenv("APP_DB_NAME", "test_database.db")
@@ -40,7 +43,7 @@ func TestMain(m *testing.M) {
 	os.Setenv("APP_KEY", "fsjKJWJIJIJndndokspfkshtgrfghggcf4q32324")
 	os.Setenv("APP_KEY_SALT", "dtgftgft7hftgth")
 	os.Setenv("APP_PASSWORD_PEPPER", "gkjsneisuefsi")
-	os.Setenv("APP_REDIS_DSN", redis.Addr())
+	os.Setenv("APP_REDIS_DSN", mockRedis.Addr())
 	os.Setenv("APP_ACCESS_SECRET", "sefsefsefsefhftgdfs")
 	os.Setenv("APP_REFRESH_SECRET", "zsgrxdrgzdrgsfefsef")
 
@@ -133,7 +136,7 @@ func (test *TestHelper) addMember(uuid, firstName, lastName, height, weight, ext
 		tx.Rollback()
 		common.Fatal(err.Error())
 	}
-	stmt, err := tx.Prepare("INSERT INTO members(uuid, firstName, lastName, height, weight, roles, extra, type, email, contact) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	stmt, err := tx.Prepare("INSERT INTO members(uuid, firstName, lastName, height, weight, roles, extra, type, email, email_index, contact) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		tx.Rollback()
 		common.Fatal(err.Error())
@@ -149,6 +152,7 @@ func (test *TestHelper) addMember(uuid, firstName, lastName, height, weight, ext
 		common.Encrypt(extra),
 		memberType,
 		common.Encrypt(email),
+		common.BlindIndex(email),
 		common.Encrypt(contact))
 	if err != nil {
 		tx.Rollback()
@@ -215,12 +219,28 @@ func (test *TestHelper) removeExistingTables() {
 	db.Exec("DROP TABLE IF EXISTS member_badges")
 	db.Exec("DROP TABLE IF EXISTS badges")
 	db.Exec("DROP TABLE IF EXISTS badge_series")
+	db.Exec("DROP TABLE IF EXISTS calendar_tokens")
+	db.Exec("DROP TABLE IF EXISTS late_participation_changes")
+	db.Exec("DROP TABLE IF EXISTS member_audit_log")
+	db.Exec("DROP TABLE IF EXISTS member_status_history")
+	db.Exec("DROP TABLE IF EXISTS member_permission_sets")
+	db.Exec("DROP TABLE IF EXISTS permission_sets")
+	db.Exec("DROP TABLE IF EXISTS members_totp")
+	db.Exec("DROP TABLE IF EXISTS members_recovery_codes")
+	db.Exec("DROP TABLE IF EXISTS member_oidc_identities")
+	db.Exec("DROP TABLE IF EXISTS member_oidc_unlinked")
+	db.Exec("DROP TABLE IF EXISTS api_tokens")
+	db.Exec("DROP TABLE IF EXISTS token_store")
+	db.Exec("DROP TABLE IF EXISTS token_store_sets")
+	db.Exec("DROP TABLE IF EXISTS notification_recipients")
 	db.Exec("DROP VIEW IF EXISTS castell_types_view")
 	db.Exec("DROP VIEW IF EXISTS castell_models_view")
 	db.Exec("DROP VIEW IF EXISTS members_depepdents")
 }
 
 func (test *TestHelper) clearTables() {
+	// Tokens and login attempts
+	mockRedis.FlushAll()
 	db, err := sql.Open("sqlite3", testDbName)
 	if err != nil {
 		common.Fatal(err.Error())
@@ -234,4 +254,17 @@ func (test *TestHelper) clearTables() {
 	db.Exec("DELETE FROM members_dependent")
 	db.Exec("DELETE FROM notifications")
 	db.Exec("DELETE FROM member_badges")
+	db.Exec("DELETE FROM calendar_tokens")
+	db.Exec("DELETE FROM late_participation_changes")
+	db.Exec("DELETE FROM member_audit_log")
+	db.Exec("DELETE FROM member_status_history")
+	db.Exec("DELETE FROM member_permission_sets")
+	db.Exec("DELETE FROM members_totp")
+	db.Exec("DELETE FROM members_recovery_codes")
+	db.Exec("DELETE FROM member_oidc_identities")
+	db.Exec("DELETE FROM member_oidc_unlinked")
+	db.Exec("DELETE FROM api_tokens")
+	db.Exec("DELETE FROM token_store")
+	db.Exec("DELETE FROM token_store_sets")
+	db.Exec("DELETE FROM notification_recipients")
 }
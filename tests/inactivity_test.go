@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/vilisseranen/castellers/controller"
+	"github.com/vilisseranen/castellers/model"
+)
+
+func (test *TestHelper) setInactivityExempt(accessToken, uuid string, exempt bool) *http.Response {
+	payload, _ := json.Marshal(map[string]bool{"exempt": exempt})
+	req, _ := http.NewRequest("PUT", "/api/v1/members/"+uuid+"/inactivity", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	return h.executeRequest(req).Result()
+}
+
+func (test *TestHelper) setMemberInactivityWarnedAt(uuid string, date int64) {
+	db, err := sql.Open("sqlite3", testDbName)
+	if err != nil {
+		tFatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Exec("UPDATE members SET inactivity_warned_at = ? WHERE uuid = ?", date, uuid); err != nil {
+		tFatal(err)
+	}
+}
+
+func TestInactivityExemptMemberNotPaused(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+	h.addAMember()
+	h.setMemberStatus("deadbeef", model.MEMBERSSTATUSACTIVATED)
+	h.setMemberLastActivityDate("deadbeef", 0)
+
+	if response := h.setInactivityExempt(accessToken, "deadbeef", true); response.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected response code %d. Got %d", http.StatusAccepted, response.StatusCode)
+	}
+	controller.RunPauseAbsentMembersOnce()
+	if status := h.getMemberStatus("deadbeef"); status != model.MEMBERSSTATUSACTIVATED {
+		t.Errorf("Expected exempt member to stay 'active'. Got '%s'", status)
+	}
+
+	req, _ := http.NewRequest("GET", "/api/v1/members/deadbeef/inactivity", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["exempt"] != true || m["pauseDate"] != 0.0 {
+		t.Errorf("Expected the member to be exempt and never paused. Got '%v'", m)
+	}
+
+	// Without the exemption, the member is paused
+	h.setInactivityExempt(accessToken, "deadbeef", false)
+	controller.RunPauseAbsentMembersOnce()
+	if status := h.getMemberStatus("deadbeef"); status != model.MEMBERSSTATUSPAUSED {
+		t.Errorf("Expected member to be 'paused'. Got '%s'", status)
+	}
+}
+
+func TestInactivityDelayPerType(t *testing.T) {
+	h.clearTables()
+	h.addAnAdmin()
+	h.addAMember()
+	h.addMember("aabbccdd", "Pau", "Petit", "", "", "", "enxaneta", "canalla", "", "")
+	h.setMemberStatus("deadfeed", model.MEMBERSSTATUSACTIVATED)
+	h.setMemberStatus("deadbeef", model.MEMBERSSTATUSACTIVATED)
+	h.setMemberStatus("aabbccdd", model.MEMBERSSTATUSACTIVATED)
+	h.setMemberLastActivityDate("deadfeed", 0)
+	h.setMemberLastActivityDate("deadbeef", time.Now().Unix()-30*24*3600)
+	h.setMemberLastActivityDate("aabbccdd", time.Now().Unix()-30*24*3600)
+	os.Setenv("APP_INACTIVITY_DELAY_DAYS_ADMIN", "0")
+	os.Setenv("APP_INACTIVITY_DELAY_DAYS_CANALLA", "90")
+	defer os.Unsetenv("APP_INACTIVITY_DELAY_DAYS_ADMIN")
+	defer os.Unsetenv("APP_INACTIVITY_DELAY_DAYS_CANALLA")
+
+	controller.RunPauseAbsentMembersOnce()
+
+	expected := map[string]string{
+		"deadfeed": model.MEMBERSSTATUSACTIVATED, // Admins are never paused
+		"deadbeef": model.MEMBERSSTATUSPAUSED,    // Default delay of 21 days
+		"aabbccdd": model.MEMBERSSTATUSACTIVATED, // Canalla are paused after 90 days
+	}
+	for uuid, status := range expected {
+		if got := h.getMemberStatus(uuid); got != status {
+			t.Errorf("Expected member %s to be '%s'. Got '%s'", uuid, status, got)
+		}
+	}
+}
+
+func TestInactivityWarning(t *testing.T) {
+	h.clearTables()
+	h.addAMember()
+	h.setMemberStatus("deadbeef", model.MEMBERSSTATUSACTIVATED)
+	// Paused in 3 days with the default delay of 21 days
+	h.setMemberLastActivityDate("deadbeef", time.Now().Unix()-18*24*3600)
+
+	controller.RunPauseAbsentMembersOnce()
+	controller.RunPauseAbsentMembersOnce()
+
+	if status := h.getMemberStatus("deadbeef"); status != model.MEMBERSSTATUSACTIVATED {
+		t.Errorf("Expected member to stay 'active'. Got '%s'", status)
+	}
+	if count := h.countNotifications(model.TypeInactivityWarning); count != 1 {
+		t.Errorf("Expected 1 inactivity warning. Got %d", count)
+	}
+
+	// A warning sent before the last activity is for a previous period
+	h.setMemberInactivityWarnedAt("deadbeef", time.Now().Unix()-30*24*3600)
+	controller.RunPauseAbsentMembersOnce()
+	if count := h.countNotifications(model.TypeInactivityWarning); count != 2 {
+		t.Errorf("Expected a new inactivity warning. Got %d", count)
+	}
+}
+
+func TestSetMemberInactivityNonAdmin(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAMember()
+
+	if response := h.setInactivityExempt(accessToken, "deadbeef", true); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected response code %d. Got %d", http.StatusUnauthorized, response.StatusCode)
+	}
+}
@@ -0,0 +1,193 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (test *TestHelper) loginFrom(remoteAddr, username, password string) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(map[string]string{"username": username, "password": password})
+	req, _ := http.NewRequest("POST", "/api/v1/login", bytes.NewBuffer(payload))
+	req.RemoteAddr = remoteAddr
+	return h.executeRequest(req)
+}
+
+func (test *TestHelper) forgotPassword(remoteAddr, email string) int {
+	payload, _ := json.Marshal(map[string]string{"email": email})
+	req, _ := http.NewRequest("POST", "/api/v1/forgot_password", bytes.NewBuffer(payload))
+	req.RemoteAddr = remoteAddr
+	return h.executeRequest(req).Code
+}
+
+const testIP = "192.0.2.1:1234"
+
+func TestLoginProgressiveDelay(t *testing.T) {
+	h.clearTables()
+	h.addAMember()
+
+	for i := 0; i < 4; i++ {
+		if code := h.loginFrom(testIP, "member", "wrong").Code; code != http.StatusUnauthorized {
+			t.Fatalf("Expected attempt %d to be refused with %d. Got %d", i+1, http.StatusUnauthorized, code)
+		}
+	}
+	// The 4th failure delays the next attempt, even with the right password
+	response := h.loginFrom(testIP, "member", "member")
+	if err := h.checkResponseCode(http.StatusTooManyRequests, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	if retryAfter := response.Header().Get("Retry-After"); retryAfter != "1" {
+		t.Errorf("Expected to retry after 1 second. Got %s", retryAfter)
+	}
+	mockRedis.FastForward(2 * time.Second)
+	if err := h.checkResponseCode(http.StatusOK, h.loginFrom(testIP, "member", "member").Code); err != nil {
+		t.Fatal(err)
+	}
+	// The success resets the failures of the username
+	if err := h.checkResponseCode(http.StatusUnauthorized, h.loginFrom(testIP, "member", "wrong").Code); err != nil {
+		t.Error(err)
+	}
+	if err := h.checkResponseCode(http.StatusOK, h.loginFrom(testIP, "member", "member").Code); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	h.clearTables()
+	h.addAnAdmin()
+	h.addAMember()
+	os.Setenv("APP_LOGIN_PROTECTION_DELAY_SECONDS", "0")
+	defer os.Unsetenv("APP_LOGIN_PROTECTION_DELAY_SECONDS")
+	notifications := h.countNotifications("accountLocked")
+
+	for i := 0; i < 10; i++ {
+		h.loginFrom(testIP, "member", "wrong")
+	}
+	if err := h.checkResponseCode(http.StatusTooManyRequests, h.loginFrom(testIP, "member", "member").Code); err != nil {
+		t.Error(err)
+	}
+	if count := h.countNotifications("accountLocked"); count != notifications+1 {
+		t.Errorf("Expected the admins to be notified. Got %d notifications", count-notifications)
+	}
+	// Other members can still login from the same IP
+	if err := h.checkResponseCode(http.StatusOK, h.loginFrom(testIP, "admin", "admin").Code); err != nil {
+		t.Error(err)
+	}
+	mockRedis.FastForward(31 * time.Minute)
+	if err := h.checkResponseCode(http.StatusOK, h.loginFrom(testIP, "member", "member").Code); err != nil {
+		t.Error(err)
+	}
+
+	// Unknown usernames are locked too, without notification
+	for i := 0; i < 10; i++ {
+		h.loginFrom(testIP, "nobody", "wrong")
+	}
+	if err := h.checkResponseCode(http.StatusTooManyRequests, h.loginFrom(testIP, "nobody", "wrong").Code); err != nil {
+		t.Error(err)
+	}
+	if count := h.countNotifications("accountLocked"); count != notifications+1 {
+		t.Errorf("Expected no notification for an unknown username. Got %d notifications", count-notifications)
+	}
+}
+
+func TestLoginLockoutIP(t *testing.T) {
+	h.clearTables()
+	h.addAnAdmin()
+	os.Setenv("APP_LOGIN_PROTECTION_DELAY_SECONDS", "0")
+	defer os.Unsetenv("APP_LOGIN_PROTECTION_DELAY_SECONDS")
+	os.Setenv("APP_LOGIN_PROTECTION_MAX_ATTEMPTS_IP", "5")
+	defer os.Unsetenv("APP_LOGIN_PROTECTION_MAX_ATTEMPTS_IP")
+
+	for _, username := range []string{"a", "b", "c", "d", "e"} {
+		h.loginFrom(testIP, username, "wrong")
+	}
+	if err := h.checkResponseCode(http.StatusTooManyRequests, h.loginFrom(testIP, "admin", "admin").Code); err != nil {
+		t.Error(err)
+	}
+	if err := h.checkResponseCode(http.StatusOK, h.loginFrom("198.51.100.7:4321", "admin", "admin").Code); err != nil {
+		t.Error(err)
+	}
+
+	// Behind a proxy, the IP is read from the configured header
+	os.Setenv("APP_LOGIN_PROTECTION_IP_HEADER", "X-Forwarded-For")
+	defer os.Unsetenv("APP_LOGIN_PROTECTION_IP_HEADER")
+	if err := h.checkResponseCode(http.StatusTooManyRequests, h.loginBehindProxy("admin", "admin", "192.0.2.1").Code); err != nil {
+		t.Error(err)
+	}
+}
+
+// loginBehindProxy logs in through a proxy, which forwards the
+// X-Forwarded-For entries.
+func (test *TestHelper) loginBehindProxy(username, password string, forwardedFor ...string) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(map[string]string{"username": username, "password": password})
+	req, _ := http.NewRequest("POST", "/api/v1/login", bytes.NewBuffer(payload))
+	req.RemoteAddr = "10.0.0.1:4321"
+	req.Header.Set("X-Forwarded-For", strings.Join(forwardedFor, ", "))
+	return h.executeRequest(req)
+}
+
+func TestLoginLockoutIPSpoofedHeader(t *testing.T) {
+	h.clearTables()
+	h.addAnAdmin()
+	os.Setenv("APP_LOGIN_PROTECTION_DELAY_SECONDS", "0")
+	defer os.Unsetenv("APP_LOGIN_PROTECTION_DELAY_SECONDS")
+	os.Setenv("APP_LOGIN_PROTECTION_MAX_ATTEMPTS_IP", "5")
+	defer os.Unsetenv("APP_LOGIN_PROTECTION_MAX_ATTEMPTS_IP")
+	os.Setenv("APP_LOGIN_PROTECTION_IP_HEADER", "X-Forwarded-For")
+	defer os.Unsetenv("APP_LOGIN_PROTECTION_IP_HEADER")
+
+	for _, username := range []string{"a", "b", "c", "d", "e"} {
+		h.loginFrom(testIP, username, "wrong")
+	}
+	// The client sets the first hop, the proxy appends its address
+	if err := h.checkResponseCode(http.StatusTooManyRequests, h.loginBehindProxy("admin", "admin", "198.51.100.7", "192.0.2.1").Code); err != nil {
+		t.Error(err)
+	}
+	// Nor can the client lock out the IP it puts in the header
+	for _, username := range []string{"a", "b", "c", "d", "e"} {
+		h.loginBehindProxy(username, "wrong", "198.51.100.7", "203.0.113.9")
+	}
+	if err := h.checkResponseCode(http.StatusOK, h.loginBehindProxy("admin", "admin", "198.51.100.7").Code); err != nil {
+		t.Error(err)
+	}
+
+	// Behind 2 proxies, the IP is the second entry from the right
+	os.Setenv("APP_LOGIN_PROTECTION_TRUSTED_PROXIES", "2")
+	defer os.Unsetenv("APP_LOGIN_PROTECTION_TRUSTED_PROXIES")
+	if err := h.checkResponseCode(http.StatusTooManyRequests, h.loginBehindProxy("admin", "admin", "198.51.100.7", "192.0.2.1", "10.0.0.2").Code); err != nil {
+		t.Error(err)
+	}
+	// Without enough entries, the address of the connection is used
+	if err := h.checkResponseCode(http.StatusOK, h.loginBehindProxy("admin", "admin", "192.0.2.1").Code); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestForgotPasswordRateLimit(t *testing.T) {
+	h.clearTables()
+	h.addAMember()
+
+	for i := 0; i < 3; i++ {
+		if err := h.checkResponseCode(http.StatusAccepted, h.forgotPassword(testIP, "ramon@gerard.ca")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.checkResponseCode(http.StatusTooManyRequests, h.forgotPassword(testIP, "RAMON@gerard.ca")); err != nil {
+		t.Error(err)
+	}
+	// The limit of the IP is separate
+	for i := 0; i < 6; i++ {
+		h.forgotPassword(testIP, "nobody@castellers.ca")
+	}
+	if err := h.checkResponseCode(http.StatusTooManyRequests, h.forgotPassword(testIP, "other@castellers.ca")); err != nil {
+		t.Error(err)
+	}
+	if err := h.checkResponseCode(http.StatusAccepted, h.forgotPassword("198.51.100.7:4321", "other@castellers.ca")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/vilisseranen/castellers/controller"
+	"github.com/vilisseranen/castellers/model"
+)
+
+func (test *TestHelper) requestMagicLink(email string) int {
+	payload, _ := json.Marshal(map[string]string{"email": email})
+	req, _ := http.NewRequest("POST", "/api/v1/magic_link", bytes.NewBuffer(payload))
+	return h.executeRequest(req).Code
+}
+
+func (test *TestHelper) loginMagicLink(token string) (int, map[string]interface{}) {
+	req, _ := http.NewRequest("POST", "/api/v1/login/magic_link", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	response := h.executeRequest(req)
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	return response.Code, m
+}
+
+func TestMagicLinkDisabled(t *testing.T) {
+	h.clearTables()
+	h.addAMember()
+
+	if code := h.requestMagicLink("ramon@gerard.ca"); code != http.StatusForbidden {
+		t.Errorf("Expected response code %d. Got %d", http.StatusForbidden, code)
+	}
+	token, _ := controller.MagicLinkToken(context.Background(), "deadbeef", 15)
+	if code, _ := h.loginMagicLink(token); code != http.StatusForbidden {
+		t.Errorf("Expected response code %d. Got %d", http.StatusForbidden, code)
+	}
+}
+
+func TestMagicLinkRequest(t *testing.T) {
+	h.clearTables()
+	h.addAMember()
+	h.addMember("deadc0de", "Pere", "Convidat", "", "", "", "", "guest", "pere@convidat.ca", "")
+	os.Setenv("APP_MAGIC_LINK_ENABLED", "true")
+	defer os.Unsetenv("APP_MAGIC_LINK_ENABLED")
+	notifications := h.countNotifications(model.TypeMagicLink)
+
+	if code := h.requestMagicLink("ramon@gerard.ca"); code != http.StatusAccepted {
+		t.Errorf("Expected response code %d. Got %d", http.StatusAccepted, code)
+	}
+	if count := h.countNotifications(model.TypeMagicLink); count != notifications+1 {
+		t.Errorf("Expected a magic link email to be queued. Got %d", count-notifications)
+	}
+	// Unknown emails and guests get the same response, without email
+	for _, email := range []string{"nobody@castellers.ca", "pere@convidat.ca"} {
+		if code := h.requestMagicLink(email); code != http.StatusAccepted {
+			t.Errorf("Expected response code %d. Got %d", http.StatusAccepted, code)
+		}
+	}
+	if count := h.countNotifications(model.TypeMagicLink); count != notifications+1 {
+		t.Errorf("Expected no email for unknown emails and guests. Got %d", count-notifications)
+	}
+}
+
+func TestMagicLinkLogin(t *testing.T) {
+	h.clearTables()
+	h.addAMember()
+	os.Setenv("APP_MAGIC_LINK_ENABLED", "true")
+	defer os.Unsetenv("APP_MAGIC_LINK_ENABLED")
+
+	token, err := controller.MagicLinkToken(context.Background(), "deadbeef", 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := h.getSessions(token, "/api/v1/sessions"); code != http.StatusUnauthorized {
+		t.Errorf("Expected the magic link token to only login. Got %d", code)
+	}
+	code, tokens := h.loginMagicLink(token)
+	if err := h.checkResponseCode(http.StatusOK, code); err != nil {
+		t.Fatal(err)
+	}
+	accessToken, _ := tokens["access_token"].(string)
+	if _, found := tokens["refresh_token"]; !found || accessToken == "" {
+		t.Fatalf("Expected an access and refresh token. Got %v", tokens)
+	}
+	if code, _ := h.getSessions(accessToken, "/api/v1/sessions"); code != http.StatusOK {
+		t.Errorf("Expected the access token to be valid. Got %d", code)
+	}
+	// The link can only be used once
+	if code, _ := h.loginMagicLink(token); code != http.StatusUnauthorized {
+		t.Errorf("Expected a used link to be refused. Got %d", code)
+	}
+
+	// The second factor is still required
+	h.enrollMFA(accessToken)
+	token, _ = controller.MagicLinkToken(context.Background(), "deadbeef", 15)
+	code, step := h.loginMagicLink(token)
+	if code != http.StatusOK || step["mfa"] != "code_required" {
+		t.Errorf("Expected a code to be required. Got %d, %v", code, step)
+	}
+}
@@ -0,0 +1,187 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vilisseranen/castellers/controller"
+	"github.com/vilisseranen/castellers/model"
+)
+
+func (test *TestHelper) getMemberAuditLog(t *testing.T, accessToken, query string) []model.MemberAuditEntry {
+	req, _ := http.NewRequest("GET", "/api/v1/members/audit"+query, nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	var entries []model.MemberAuditEntry
+	json.Unmarshal(response.Body.Bytes(), &entries)
+	return entries
+}
+
+func findAuditChange(entry model.MemberAuditEntry, field string) *model.MemberAuditChange {
+	for _, change := range entry.Changes {
+		if change.Field == field {
+			return &change
+		}
+	}
+	return nil
+}
+
+func TestMemberAuditLog(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+	h.addAMember()
+
+	// Edit the member
+	req, _ := http.NewRequest("GET", "/api/v1/members/deadbeef", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	var m map[string]interface{}
+	json.Unmarshal(h.executeRequest(req).Body.Bytes(), &m)
+	m["roles"] = []string{"baix"}
+	m["type"] = model.MEMBERSTYPEADMIN
+	payload, _ := json.Marshal(m)
+	req, _ = http.NewRequest("PUT", "/api/v1/members/deadbeef", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	if err := h.checkResponseCode(http.StatusAccepted, h.executeRequest(req).Code); err != nil {
+		t.Fatal(err)
+	}
+	// Pause and delete it
+	req, _ = http.NewRequest("PUT", "/api/v1/members/deadbeef/status", bytes.NewBufferString(`{"status":"paused"}`))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	if err := h.checkResponseCode(http.StatusAccepted, h.executeRequest(req).Code); err != nil {
+		t.Fatal(err)
+	}
+	h.deleteMember(accessToken, "deadbeef")
+
+	entries := h.getMemberAuditLog(t, accessToken, "?member=deadbeef")
+
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries. Got '%v'", entries)
+	}
+	actions := []string{model.MEMBERAUDITDELETE, model.MEMBERAUDITSTATUS, model.MEMBERAUDITUPDATE}
+	for i, entry := range entries {
+		if entry.Action != actions[i] || entry.ActorUUID != "deadfeed" || entry.MemberUUID != "deadbeef" {
+			t.Errorf("Expected %s of deadbeef by deadfeed. Got '%v'", actions[i], entry)
+		}
+	}
+	update := entries[2]
+	if change := findAuditChange(update, "roles"); change == nil || change.Before != "baix,segon,terç" || change.After != "baix" || !change.Encrypted {
+		t.Errorf("Expected the change of roles. Got '%v'", update.Changes)
+	}
+	if change := findAuditChange(update, "type"); change == nil || change.Before != model.MEMBERSTYPEREGULAR || change.After != model.MEMBERSTYPEADMIN {
+		t.Errorf("Expected the change of type. Got '%v'", update.Changes)
+	}
+	if len(update.Changes) != 2 {
+		t.Errorf("Expected only the changed fields. Got '%v'", update.Changes)
+	}
+	if change := findAuditChange(entries[0], "status"); change == nil || change.Before != model.MEMBERSSTATUSPAUSED || change.After != model.MEMBERSSTATUSDELETED {
+		t.Errorf("Expected the change of status. Got '%v'", entries[0].Changes)
+	}
+
+	// Encrypted fields are not stored in clear
+	db, err := sql.Open("sqlite3", testDbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var changes string
+	var encryptedChanges []byte
+	if err := db.QueryRow("SELECT changes, encrypted_changes FROM member_audit_log WHERE id = ?", update.ID).Scan(&changes, &encryptedChanges); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(changes, "baix") || bytes.Contains(encryptedChanges, []byte("baix")) {
+		t.Errorf("Expected the roles to be encrypted. Got '%s' and '%s'", changes, encryptedChanges)
+	}
+
+	// The whole organisation, with pagination
+	if entries := h.getMemberAuditLog(t, accessToken, ""); len(entries) != 3 {
+		t.Errorf("Expected 3 entries for the organisation. Got '%v'", entries)
+	}
+	page := h.getMemberAuditLog(t, accessToken, "?limit=2")
+	if len(page) != 2 {
+		t.Fatalf("Expected 2 entries. Got '%v'", page)
+	}
+	if next := h.getMemberAuditLog(t, accessToken, "?limit=2&before="+strconv.FormatInt(page[1].ID, 10)); len(next) != 1 || next[0].ID != entries[2].ID {
+		t.Errorf("Expected the last entry on the next page. Got '%v'", next)
+	}
+}
+
+func TestMemberAuditLogScheduler(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+	h.addAMember()
+	h.setMemberStatus("deadbeef", model.MEMBERSSTATUSACTIVATED)
+	h.setMemberLastActivityDate("deadbeef", 0)
+
+	controller.RunPauseAbsentMembersOnce()
+	edit := model.MemberAuditEntry{ActorUUID: "deadfeed", MemberUUID: "deadbeef", Action: model.MEMBERAUDITUPDATE,
+		Changes: []model.MemberAuditChange{{Field: "height", Before: "", After: "180", Encrypted: true}}}
+	if err := edit.Create(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	h.deleteMember(accessToken, "deadbeef")
+	h.setMemberDeletedAt("deadbeef", time.Now().Add(-400*24*time.Hour).Unix())
+	controller.RunPurgeDeletedMembersOnce()
+
+	entries := h.getMemberAuditLog(t, accessToken, "?member=deadbeef")
+	if len(entries) != 4 {
+		t.Fatalf("Expected 4 entries. Got '%v'", entries)
+	}
+	if entries[0].Action != model.MEMBERAUDITPURGE || entries[0].ActorUUID != model.MEMBERAUDITACTORSYSTEM {
+		t.Errorf("Expected the purge by the system. Got '%v'", entries[0])
+	}
+	// The purge removes the personal data from the log
+	if len(entries[2].Changes) != 0 {
+		t.Errorf("Expected the changes of personal data to be removed. Got '%v'", entries[2].Changes)
+	}
+	if entries[3].Action != model.MEMBERAUDITSTATUS || entries[3].ActorUUID != model.MEMBERAUDITACTORSYSTEM {
+		t.Errorf("Expected the pause by the system. Got '%v'", entries[3])
+	}
+	if change := findAuditChange(entries[3], "status"); change == nil || change.After != model.MEMBERSSTATUSPAUSED {
+		t.Errorf("Expected the change of status. Got '%v'", entries[3].Changes)
+	}
+}
+
+func TestMemberAuditLogNotAdmin(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAMember()
+
+	req, _ := http.NewRequest("GET", "/api/v1/members/audit", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	if err := h.checkResponseCode(http.StatusUnauthorized, h.executeRequest(req).Code); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReencryptMemberAuditLog(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+	edit := model.MemberAuditEntry{ActorUUID: "deadfeed", MemberUUID: "deadfeed", Action: model.MEMBERAUDITUPDATE,
+		Changes: []model.MemberAuditChange{{Field: "height", Before: "", After: "180", Encrypted: true}}}
+	if err := edit.Create(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	restore := rotateEncryptionKey("aNewKeyAfterTheOldOneLeakedddddd")
+	defer restore()
+	if _, err := model.ReencryptMembers(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old key is not needed anymore
+	os.Unsetenv("APP_OLD_KEYS")
+	entries := h.getMemberAuditLog(t, accessToken, "?member=deadfeed")
+	if len(entries) != 1 || len(entries[0].Changes) != 1 || entries[0].Changes[0].After != "180" {
+		t.Errorf("Expected to decrypt the audit log with the new key. Got '%v'", entries)
+	}
+}
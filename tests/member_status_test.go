@@ -2,11 +2,13 @@ package tests
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"net/http"
 	"testing"
 	"time"
 
+	"github.com/vilisseranen/castellers/common"
 	"github.com/vilisseranen/castellers/controller"
 	"github.com/vilisseranen/castellers/model"
 )
@@ -122,3 +124,132 @@ func TestInactiveMemberStillPaused(t *testing.T) {
 		t.Errorf("Expected inactive member to be 'paused'. Got '%s'", status)
 	}
 }
+
+func (test *TestHelper) setMemberDeletedAt(uuid string, date int64) {
+	db, err := sql.Open("sqlite3", testDbName)
+	if err != nil {
+		tFatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Exec("UPDATE members SET deleted_at = ? WHERE uuid = ?", date, uuid); err != nil {
+		tFatal(err)
+	}
+}
+
+func (test *TestHelper) countRows(query string, args ...interface{}) int {
+	db, err := sql.Open("sqlite3", testDbName)
+	if err != nil {
+		tFatal(err)
+	}
+	defer db.Close()
+	var count int
+	if err = db.QueryRow(query, args...).Scan(&count); err != nil {
+		tFatal(err)
+	}
+	return count
+}
+
+func (test *TestHelper) deleteMember(accessToken, uuid string) {
+	req, _ := http.NewRequest("DELETE", "/api/v1/members/"+uuid, nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		tFatal(err)
+	}
+}
+
+func TestPurgeDeletedMember(t *testing.T) {
+	h.clearTables()
+	access_token := h.addAnAdmin()
+	h.addAMember()
+	h.addMember("123", "Jordi", "Gerard", "120", "30", "", "", model.MEMBERSTYPECANALLA, "", "")
+	h.addEvent("deadbeef", "Diada", 1000000000, 1000003600)
+	h.addParticipation("deadbeef", "deadbeef", common.AnswerYes)
+	m := model.Member{UUID: "deadbeef"}
+	if err := m.AddDependent(context.Background(), &model.Member{UUID: "123"}); err != nil {
+		t.Fatal(err)
+	}
+	h.execSQL("INSERT INTO notifications (id, notificationType, sendDate, last_error) VALUES (1, ?, 0, ?)",
+		model.TypeBadgeAwarded, "452 4.2.2 Mailbox full")
+	h.execSQL("INSERT INTO notification_recipients (notification_id, member_uuid, delivered, attempts, last_error) VALUES (1, ?, ?, 1, ?)",
+		"deadbeef", model.NotificationDeliveryFailure, "550 5.1.1 <ramon@gerard.ca>: No such user")
+	h.execSQL("INSERT INTO notification_recipients (notification_id, member_uuid, delivered, attempts, last_error) VALUES (1, ?, ?, 1, ?)",
+		"deadfeed", model.NotificationDeliveryFailure, "452 4.2.2 Mailbox full")
+	h.deleteMember(access_token, "deadbeef")
+	h.setMemberDeletedAt("deadbeef", time.Now().Add(-400*24*time.Hour).Unix())
+
+	controller.RunPurgeDeletedMembersOnce()
+
+	if status := h.getMemberStatus("deadbeef"); status != model.MEMBERSSTATUSPURGED {
+		t.Errorf("Expected deleted member to be '%s'. Got '%s'", model.MEMBERSSTATUSPURGED, status)
+	}
+	db, err := sql.Open("sqlite3", testDbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var firstName, lastName, height, weight, email, contact []byte
+	var emailIndex sql.NullString
+	if err := db.QueryRow("SELECT firstName, lastName, height, weight, email, contact, email_index FROM members WHERE uuid = ?", "deadbeef").Scan(
+		&firstName, &lastName, &height, &weight, &email, &contact, &emailIndex); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range [][]byte{firstName, lastName, height, weight, email, contact} {
+		if value := common.Decrypt(field); value != "" {
+			t.Errorf("Expected personal data to be scrubbed. Got '%s'", value)
+		}
+	}
+	if emailIndex.Valid {
+		t.Errorf("Expected email index to be removed. Got '%s'", emailIndex.String)
+	}
+	if count := h.countRows("SELECT COUNT(*) FROM members_credentials WHERE uuid = ?", "deadbeef"); count != 0 {
+		t.Errorf("Expected credentials to be removed. Got %d", count)
+	}
+	if count := h.countRows("SELECT COUNT(*) FROM members_dependent WHERE responsible_uuid = ? OR dependent_uuid = ?", "deadbeef", "deadbeef"); count != 0 {
+		t.Errorf("Expected dependents links to be removed. Got %d", count)
+	}
+	if count := h.countRows("SELECT COUNT(*) FROM notification_recipients WHERE last_error LIKE '%ramon%'"); count != 0 {
+		t.Errorf("Expected SMTP errors to be cleared. Got %d", count)
+	}
+	if count := h.countRows("SELECT COUNT(*) FROM notification_recipients WHERE member_uuid = 'deadfeed' AND last_error != ''") +
+		h.countRows("SELECT COUNT(*) FROM notifications WHERE last_error != ''"); count != 2 {
+		t.Errorf("Expected the SMTP errors of the other members to be kept. Got %d", count)
+	}
+	if count := h.countRows("SELECT COUNT(*) FROM participation WHERE member_uuid = ?", "deadbeef"); count != 1 {
+		t.Errorf("Expected participation to be kept. Got %d", count)
+	}
+	if status := h.getMemberStatus("deadfeed"); status == model.MEMBERSSTATUSPURGED {
+		t.Errorf("Expected other members to be left alone. Got '%s'", status)
+	}
+
+	// A purged member is not found, and cannot be activated again
+	req, _ := http.NewRequest("GET", "/api/v1/members/deadbeef", nil)
+	req.Header.Add("Authorization", "Bearer "+access_token)
+	if err := h.checkResponseCode(http.StatusNotFound, h.executeRequest(req).Code); err != nil {
+		t.Error(err)
+	}
+	req, _ = http.NewRequest("PUT", "/api/v1/members/deadbeef/status", bytes.NewBufferString(`{"status":"active"}`))
+	req.Header.Add("Authorization", "Bearer "+access_token)
+	if err := h.checkResponseCode(http.StatusNotFound, h.executeRequest(req).Code); err != nil {
+		t.Error(err)
+	}
+	if status := h.getMemberStatus("deadbeef"); status != model.MEMBERSSTATUSPURGED {
+		t.Errorf("Expected purged member to stay '%s'. Got '%s'", model.MEMBERSSTATUSPURGED, status)
+	}
+}
+
+func TestPurgeDeletedMemberWithinRetention(t *testing.T) {
+	h.clearTables()
+	access_token := h.addAnAdmin()
+	h.addAMember()
+	h.deleteMember(access_token, "deadbeef")
+
+	controller.RunPurgeDeletedMembersOnce()
+
+	if status := h.getMemberStatus("deadbeef"); status != model.MEMBERSSTATUSDELETED {
+		t.Errorf("Expected recently deleted member to stay '%s'. Got '%s'", model.MEMBERSSTATUSDELETED, status)
+	}
+	if count := h.countRows("SELECT COUNT(*) FROM members_credentials WHERE uuid = ?", "deadbeef"); count != 1 {
+		t.Errorf("Expected credentials to be kept. Got %d", count)
+	}
+}
@@ -0,0 +1,151 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/vilisseranen/castellers/model"
+)
+
+const memberImportCSV = `firstName,lastName,email,type,roles,language,height,weight,responsible
+Jordi,Puig,jordi@puig.cat,member,"baix, segon",cat,180,80,
+Anna,Puig,,canalla,,cat,110,20,jordi@puig.cat
+Pau,Gerard,,canalla,,fr,,,ramon@gerard.ca
+`
+
+func (test *TestHelper) importMembers(t *testing.T, accessToken, query, content string, expectedCode int) map[string]interface{} {
+	req, _ := http.NewRequest("POST", "/api/v1/members/import"+query, bytes.NewBufferString(content))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(expectedCode, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	var result map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &result)
+	return result
+}
+
+func (test *TestHelper) countMembers() int {
+	return h.countRows("SELECT COUNT(*) FROM members")
+}
+
+func TestImportMembersDryRun(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+	h.addAMember()
+
+	result := h.importMembers(t, accessToken, "?dryRun=true", memberImportCSV, http.StatusOK)
+
+	if result["valid"] != true || len(result["rows"].([]interface{})) != 3 {
+		t.Errorf("Expected 3 valid rows. Got '%v'", result)
+	}
+	if count := h.countMembers(); count != 2 {
+		t.Errorf("Expected no member created by a dry run. Got %d members", count)
+	}
+}
+
+func TestImportMembers(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+	h.addAMember()
+
+	h.importMembers(t, accessToken, "?sendRegistration=true", memberImportCSV, http.StatusCreated)
+
+	if count := h.countMembers(); count != 5 {
+		t.Errorf("Expected 3 members created. Got %d members", count)
+	}
+	jordi := model.Member{Email: "jordi@puig.cat"}
+	if err := jordi.GetByEmail(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if jordi.FirstName != "Jordi" || len(jordi.Roles) != 2 {
+		t.Errorf("Expected Jordi with 2 roles. Got '%v'", jordi)
+	}
+	dependents, err := jordi.GetDependents(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dependents) != 1 || dependents[0].FirstName != "Anna" {
+		t.Errorf("Expected Anna as dependent of Jordi. Got '%v'", dependents)
+	}
+	ramon := model.Member{UUID: "deadbeef"}
+	if dependents, _ := ramon.GetDependents(context.Background()); len(dependents) != 1 || dependents[0].FirstName != "Pau" {
+		t.Errorf("Expected Pau as dependent of Ramon. Got '%v'", dependents)
+	}
+	// Only members receive the registration email, canallas are activated
+	if count := h.countNotifications(model.TypeMemberRegistration); count != 1 {
+		t.Errorf("Expected 1 registration email. Got %d", count)
+	}
+}
+
+func TestImportMembersWithoutRegistration(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+	h.addAMember()
+
+	h.importMembers(t, accessToken, "", memberImportCSV, http.StatusCreated)
+
+	if count := h.countNotifications(model.TypeMemberRegistration); count != 0 {
+		t.Errorf("Expected no registration email. Got %d", count)
+	}
+}
+
+func TestImportMembersFailureCreatesNothing(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+	h.addAMember()
+	// The last write of the import fails
+	h.execSQL("CREATE TRIGGER fail_import BEFORE INSERT ON members_dependent BEGIN SELECT RAISE(ABORT, 'failure'); END")
+	defer h.execSQL("DROP TRIGGER fail_import")
+
+	h.importMembers(t, accessToken, "?sendRegistration=true", memberImportCSV, http.StatusInternalServerError)
+
+	if count := h.countMembers(); count != 2 {
+		t.Errorf("Expected no member created. Got %d members", count)
+	}
+	if count := h.countNotifications(model.TypeMemberRegistration); count != 0 {
+		t.Errorf("Expected no registration email. Got %d", count)
+	}
+	if count := h.countRows("SELECT COUNT(*) FROM member_status_history WHERE member_uuid NOT IN ('deadbeef', 'deadfeed')"); count != 0 {
+		t.Errorf("Expected no status history. Got %d", count)
+	}
+}
+
+func TestImportMembersInvalidRows(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+	h.addAMember()
+	content := `firstName,lastName,email,type,roles,language,responsible
+Jordi,Puig,jordi@puig.cat,member,baix,cat,
+Marta,Puig,jordi@puig.cat,member,,cat,
+Laia,Puig,ramon@gerard.ca,member,,cat,
+Pere,Puig,pere@puig.cat,member,acrobata,cat,
+Anna,Puig,,canalla,,cat,nobody@puig.cat
+,Puig,,canalla,,cat,
+`
+
+	result := h.importMembers(t, accessToken, "", content, http.StatusBadRequest)
+
+	rows := result["rows"].([]interface{})
+	expected := []string{"", "this email is used by another row", "this email is already used by another member.",
+		"error with the roles provided", "responsible not found", "missing fields in request payload"}
+	for i, row := range rows {
+		errors := row.(map[string]interface{})["errors"].([]interface{})
+		if expected[i] == "" && len(errors) != 0 || expected[i] != "" && (len(errors) != 1 || errors[0] != expected[i]) {
+			t.Errorf("Expected error '%s' on row %d. Got '%v'", expected[i], i+2, errors)
+		}
+	}
+	if count := h.countMembers(); count != 2 {
+		t.Errorf("Expected no member created. Got %d members", count)
+	}
+}
+
+func TestImportMembersUnknownColumn(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+
+	h.importMembers(t, accessToken, "", "firstName,lastName,nickname\n", http.StatusBadRequest)
+}
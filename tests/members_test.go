@@ -3,8 +3,10 @@ package tests
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"net/http"
+	"os"
 	"sort"
 	"testing"
 
@@ -130,6 +132,45 @@ func TestCreateMemberInvalidType(t *testing.T) {
 	}
 }
 
+func TestCreateMemberTimezone(t *testing.T) {
+	h.clearTables()
+	access_token := h.addAnAdmin()
+
+	payload := []byte(`{
+		"firstName":"Clément",
+		"lastName": "Contini",
+		"type": "member",
+		"language": "cat",
+		"timezone": "Europe/Madrid",
+		"email": "vilisseranen@gmail.com"}`)
+
+	req, _ := http.NewRequest("POST", "/api/v1/members", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+access_token)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusCreated, response.Code); err != nil {
+		t.Error(err)
+	}
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["timezone"] != "Europe/Madrid" {
+		t.Errorf("Expected timezone to be 'Europe/Madrid'. Got '%v'", m["timezone"])
+	}
+
+	payload = []byte(`{
+		"firstName":"Ada",
+		"lastName": "Lovelace",
+		"type": "member",
+		"language": "fr",
+		"timezone": "Mars/Olympus_Mons",
+		"email": "ada@test.ca"}`)
+	req, _ = http.NewRequest("POST", "/api/v1/members", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+access_token)
+	response = h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusBadRequest, response.Code); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestCreateMemberNoExtra(t *testing.T) {
 	h.clearTables()
 	access_token := h.addAnAdmin()
@@ -396,6 +437,94 @@ func TestGetMemberByEmailFail(t *testing.T) {
 	}
 }
 
+func TestGetMemberByEmailIgnoresCase(t *testing.T) {
+	h.clearTables()
+	h.addAMember()
+
+	member := model.Member{Email: " Ramon@Gerard.CA"}
+	if err := member.GetByEmail(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if member.UUID != "deadbeef" || member.Email != "ramon@gerard.ca" {
+		t.Errorf("Expected to find member deadbeef with its decrypted email. Got '%v'", member)
+	}
+}
+
+func TestBackfillEmailIndex(t *testing.T) {
+	h.clearTables()
+	h.addAMember()
+	db, err := sql.Open("sqlite3", testDbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// A member created before the index existed
+	if _, err := db.Exec("UPDATE members SET email_index = NULL WHERE uuid = ?", "deadbeef"); err != nil {
+		t.Fatal(err)
+	}
+	member := model.Member{Email: "ramon@gerard.ca"}
+	if err := member.GetByEmail(context.Background()); err == nil {
+		t.Fatal("Expected a member without index not to be found")
+	}
+
+	if err := model.BackfillEmailIndex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := member.GetByEmail(context.Background()); err != nil || member.UUID != "deadbeef" {
+		t.Errorf("Expected to find member deadbeef after the backfill. Got '%v' (%v)", member, err)
+	}
+}
+
+func TestReencryptMembers(t *testing.T) {
+	h.clearTables()
+	h.addAMember()
+	accessToken := h.addAnAdmin()
+
+	oldKey := os.Getenv("APP_KEY")
+	restore := rotateEncryptionKey("aNewKeyAfterTheOldOneLeakedddddd")
+	defer restore()
+
+	// The email index does not change with the key, members can still log
+	// in before the re-encryption
+	member := model.Member{Email: "ramon@gerard.ca"}
+	if err := member.GetByEmail(context.Background()); err != nil || member.UUID != "deadbeef" {
+		t.Errorf("Expected to find the member by email after the rotation. Got '%v' (%v)", member, err)
+	}
+
+	req, _ := http.NewRequest("POST", "/api/v1/members/reencrypt?batch=1", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]int
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["reencrypted"] != 2 {
+		t.Errorf("Expected 2 members re-encrypted. Got '%v'", m)
+	}
+
+	// Nothing left to do
+	response = h.executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["reencrypted"] != 0 {
+		t.Errorf("Expected no member re-encrypted. Got '%v'", m)
+	}
+
+	// The old key is not needed anymore to decrypt, only for the email
+	// index, as the index key
+	os.Unsetenv("APP_OLD_KEYS")
+	os.Setenv("APP_INDEX_KEY", oldKey)
+	defer os.Unsetenv("APP_INDEX_KEY")
+	member = model.Member{UUID: "deadbeef"}
+	if err := member.Get(context.Background()); err != nil || member.FirstName != "Ramon" {
+		t.Errorf("Expected to decrypt the member with the new key. Got '%v' (%v)", member, err)
+	}
+	member = model.Member{Email: "ramon@gerard.ca"}
+	if err := member.GetByEmail(context.Background()); err != nil || member.UUID != "deadbeef" {
+		t.Errorf("Expected the email index to be kept with the index key. Got '%v' (%v)", member, err)
+	}
+}
+
 func TestGetRoles(t *testing.T) {
 	h.clearTables()
 
@@ -0,0 +1,292 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+// totpCode returns the code of the secret, offset steps from now.
+func totpCode(secret string, offset int64) string {
+	code, err := common.TOTPCode(secret, time.Now().Unix()/common.TOTPPeriod+offset)
+	if err != nil {
+		tFatal(err)
+	}
+	return code
+}
+
+func (test *TestHelper) mfaRequest(method, url, accessToken string, payload interface{}) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(payload)
+	req, _ := http.NewRequest(method, url, bytes.NewBuffer(body))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	return h.executeRequest(req)
+}
+
+// loginStep sends the password and returns the response.
+func (test *TestHelper) loginStep(username, password string) map[string]interface{} {
+	payload, _ := json.Marshal(map[string]string{"username": username, "password": password})
+	req, _ := http.NewRequest("POST", "/api/v1/login", bytes.NewBuffer(payload))
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		tFatal(err)
+	}
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	return m
+}
+
+// enrollMFA enrolls a second factor with the token, and returns the secret
+// and the response of the confirmation. The current step is used.
+func (test *TestHelper) enrollMFA(accessToken string) (string, map[string]interface{}) {
+	response := h.mfaRequest("POST", "/api/v1/mfa/enroll", accessToken, nil)
+	if err := h.checkResponseCode(http.StatusCreated, response.Code); err != nil {
+		tFatal(err)
+	}
+	var enrollment map[string]string
+	json.Unmarshal(response.Body.Bytes(), &enrollment)
+	response = h.mfaRequest("POST", "/api/v1/mfa/enroll/confirm", accessToken, map[string]string{"code": totpCode(enrollment["secret"], 0)})
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		tFatal(err)
+	}
+	var confirmation map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &confirmation)
+	return enrollment["secret"], confirmation
+}
+
+func TestMFAEnrollAndLogin(t *testing.T) {
+	h.clearTables()
+	memberToken := h.addAMember()
+
+	secret, confirmation := h.enrollMFA(memberToken)
+	if codes := confirmation["recovery_codes"].([]interface{}); len(codes) != 10 {
+		t.Errorf("Expected 10 recovery codes. Got %d", len(codes))
+	}
+	if _, found := confirmation["access_token"]; found {
+		t.Errorf("Expected no tokens when enrolling from a session")
+	}
+	response := h.mfaRequest("POST", "/api/v1/mfa/enroll", memberToken, nil)
+	if err := h.checkResponseCode(http.StatusConflict, response.Code); err != nil {
+		t.Error(err)
+	}
+
+	// The password only gives a token for the second step
+	step := h.loginStep("member", "member")
+	if step["mfa"] != "code_required" {
+		t.Fatalf("Expected a code to be required. Got %v", step)
+	}
+	if _, found := step["access_token"]; found {
+		t.Errorf("Expected no access token before the second step")
+	}
+	mfaToken := step["mfa_token"].(string)
+	response = h.mfaRequest("GET", "/api/v1/mfa", mfaToken, nil)
+	if err := h.checkResponseCode(http.StatusUnauthorized, response.Code); err != nil {
+		t.Error(err)
+	}
+
+	response = h.mfaRequest("POST", "/api/v1/login/mfa", mfaToken, map[string]string{"code": "000000"})
+	if err := h.checkResponseCode(http.StatusUnauthorized, response.Code); err != nil {
+		t.Error(err)
+	}
+	// The code of the enrollment was used, the next one is accepted
+	code := totpCode(secret, 1)
+	response = h.mfaRequest("POST", "/api/v1/login/mfa", mfaToken, map[string]string{"code": code})
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Error(err)
+	}
+	var tokens map[string]string
+	json.Unmarshal(response.Body.Bytes(), &tokens)
+	if tokens["access_token"] == "" || tokens["refresh_token"] == "" {
+		t.Fatalf("Expected an access and refresh token. Got %v", tokens)
+	}
+
+	// A code cannot be used twice
+	mfaToken = h.loginStep("member", "member")["mfa_token"].(string)
+	response = h.mfaRequest("POST", "/api/v1/login/mfa", mfaToken, map[string]string{"code": code})
+	if err := h.checkResponseCode(http.StatusUnauthorized, response.Code); err != nil {
+		t.Error(err)
+	}
+
+	response = h.mfaRequest("GET", "/api/v1/mfa", tokens["access_token"], nil)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Error(err)
+	}
+	var status map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &status)
+	if status["enabled"] != true || status["required"] != false || status["recoveryCodes"] != 10.0 {
+		t.Errorf("Unexpected status of the second factor: %v", status)
+	}
+}
+
+func TestMFARecoveryCode(t *testing.T) {
+	h.clearTables()
+	memberToken := h.addAMember()
+	_, confirmation := h.enrollMFA(memberToken)
+	recoveryCode := confirmation["recovery_codes"].([]interface{})[0].(string)
+
+	mfaToken := h.loginStep("member", "member")["mfa_token"].(string)
+	response := h.mfaRequest("POST", "/api/v1/login/mfa", mfaToken, map[string]string{"recovery_code": recoveryCode})
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Error(err)
+	}
+
+	mfaToken = h.loginStep("member", "member")["mfa_token"].(string)
+	response = h.mfaRequest("POST", "/api/v1/login/mfa", mfaToken, map[string]string{"recovery_code": recoveryCode})
+	if err := h.checkResponseCode(http.StatusUnauthorized, response.Code); err != nil {
+		t.Error(err)
+	}
+
+	if count := h.countRows("SELECT COUNT(*) FROM members_recovery_codes WHERE member_uuid = ? AND used_at = 0", "deadbeef"); count != 9 {
+		t.Errorf("Expected 9 recovery codes left. Got %d", count)
+	}
+}
+
+func TestMFATooManyAttempts(t *testing.T) {
+	h.clearTables()
+	os.Setenv("APP_LOGIN_PROTECTION_DELAY_SECONDS", "0")
+	defer os.Unsetenv("APP_LOGIN_PROTECTION_DELAY_SECONDS")
+	memberToken := h.addAMember()
+	secret, _ := h.enrollMFA(memberToken)
+
+	mfaToken := h.loginStep("member", "member")["mfa_token"].(string)
+	for i := 0; i < 5; i++ {
+		response := h.mfaRequest("POST", "/api/v1/login/mfa", mfaToken, map[string]string{"code": "000000"})
+		if err := h.checkResponseCode(http.StatusUnauthorized, response.Code); err != nil {
+			t.Error(err)
+		}
+	}
+	// Even a valid code is refused, the password must be sent again
+	response := h.mfaRequest("POST", "/api/v1/login/mfa", mfaToken, map[string]string{"code": totpCode(secret, 1)})
+	if err := h.checkResponseCode(http.StatusUnauthorized, response.Code); err != nil {
+		t.Error(err)
+	}
+	mfaToken = h.loginStep("member", "member")["mfa_token"].(string)
+	response = h.mfaRequest("POST", "/api/v1/login/mfa", mfaToken, map[string]string{"code": totpCode(secret, 1)})
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMFAWrongCodesLockout(t *testing.T) {
+	h.clearTables()
+	os.Setenv("APP_LOGIN_PROTECTION_DELAY_SECONDS", "0")
+	defer os.Unsetenv("APP_LOGIN_PROTECTION_DELAY_SECONDS")
+	memberToken := h.addAMember()
+	secret, _ := h.enrollMFA(memberToken)
+
+	// Logging in again gives new attempts for the code, but the wrong codes
+	// are failed logins of the username, not reset by the password
+	for cycle := 0; cycle < 2; cycle++ {
+		mfaToken := h.loginStep("member", "member")["mfa_token"].(string)
+		for i := 0; i < 5; i++ {
+			response := h.mfaRequest("POST", "/api/v1/login/mfa", mfaToken, map[string]string{"code": "000000"})
+			if err := h.checkResponseCode(http.StatusUnauthorized, response.Code); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	response := h.loginFrom(testIP, "member", "member")
+	if err := h.checkResponseCode(http.StatusTooManyRequests, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	if n := h.countNotifications(model.TypeAccountLocked); n != 1 {
+		t.Errorf("Expected the lockout to be notified. Got %d", n)
+	}
+
+	// Only a valid code resets the failed logins
+	mockRedis.FlushAll()
+	mfaToken := h.loginStep("member", "member")["mfa_token"].(string)
+	h.mfaRequest("POST", "/api/v1/login/mfa", mfaToken, map[string]string{"code": "000000"})
+	if !mockRedis.Exists("login_protection:failures:user:member") {
+		t.Errorf("Expected the wrong code to be counted. Got %v", mockRedis.Keys())
+	}
+	response = h.mfaRequest("POST", "/api/v1/login/mfa", mfaToken, map[string]string{"code": totpCode(secret, 1)})
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Error(err)
+	}
+	if mockRedis.Exists("login_protection:failures:user:member") {
+		t.Errorf("Expected the failed logins to be reset")
+	}
+}
+
+func TestMFARequiredForAdmins(t *testing.T) {
+	h.clearTables()
+	h.addAnAdmin()
+	os.Setenv("APP_MFA_REQUIRED_FOR_ADMINS", "true")
+	defer os.Unsetenv("APP_MFA_REQUIRED_FOR_ADMINS")
+
+	step := h.loginStep("admin", "admin")
+	if step["mfa"] != "enrollment_required" {
+		t.Fatalf("Expected the enrollment to be required. Got %v", step)
+	}
+	enrollToken := step["mfa_token"].(string)
+	response := h.mfaRequest("GET", "/api/v1/members", enrollToken, nil)
+	if err := h.checkResponseCode(http.StatusUnauthorized, response.Code); err != nil {
+		t.Error(err)
+	}
+
+	secret, confirmation := h.enrollMFA(enrollToken)
+	adminToken, _ := confirmation["access_token"].(string)
+	if adminToken == "" {
+		t.Fatalf("Expected the tokens after the enrollment. Got %v", confirmation)
+	}
+	response = h.mfaRequest("GET", "/api/v1/members", adminToken, nil)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Error(err)
+	}
+
+	// The second factor cannot be removed
+	response = h.mfaRequest("DELETE", "/api/v1/mfa", adminToken, map[string]string{"code": totpCode(secret, 1)})
+	if err := h.checkResponseCode(http.StatusBadRequest, response.Code); err != nil {
+		t.Error(err)
+	}
+	if step := h.loginStep("admin", "admin"); step["mfa"] != "code_required" {
+		t.Errorf("Expected a code to be required. Got %v", step)
+	}
+}
+
+func TestMFADisableAndReset(t *testing.T) {
+	h.clearTables()
+	adminToken := h.addAnAdmin()
+	memberToken := h.addAMember()
+	secret, _ := h.enrollMFA(memberToken)
+
+	response := h.mfaRequest("DELETE", "/api/v1/mfa", memberToken, map[string]string{"code": "000000"})
+	if err := h.checkResponseCode(http.StatusUnauthorized, response.Code); err != nil {
+		t.Error(err)
+	}
+	response = h.mfaRequest("DELETE", "/api/v1/mfa", memberToken, map[string]string{"code": totpCode(secret, 1)})
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Error(err)
+	}
+	if _, found := h.loginStep("member", "member")["access_token"]; !found {
+		t.Errorf("Expected the tokens without a second factor")
+	}
+
+	// An admin can remove the second factor of a member who lost it
+	h.enrollMFA(memberToken)
+	response = h.mfaRequest("DELETE", "/api/v1/members/deadbeef/mfa", memberToken, nil)
+	if err := h.checkResponseCode(http.StatusUnauthorized, response.Code); err != nil {
+		t.Error(err)
+	}
+	response = h.mfaRequest("DELETE", "/api/v1/members/deadbeef/mfa", adminToken, nil)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Error(err)
+	}
+	if count := h.countRows("SELECT COUNT(*) FROM members_recovery_codes WHERE member_uuid = ?", "deadbeef"); count != 0 {
+		t.Errorf("Expected the recovery codes to be removed. Got %d", count)
+	}
+	if _, found := h.loginStep("member", "member")["access_token"]; !found {
+		t.Errorf("Expected the tokens without a second factor")
+	}
+	response = h.mfaRequest("DELETE", "/api/v1/members/deadc0de/mfa", adminToken, nil)
+	if err := h.checkResponseCode(http.StatusNotFound, response.Code); err != nil {
+		t.Error(err)
+	}
+}
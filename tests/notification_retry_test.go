@@ -0,0 +1,272 @@
+package tests
+
+import (
+	"database/sql"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vilisseranen/castellers/controller"
+	"github.com/vilisseranen/castellers/model"
+)
+
+// fakeSMTP accepts the emails, but the recipients listed in replies, which
+// are refused with the reply.
+type fakeSMTP struct {
+	listener net.Listener
+	mu       sync.Mutex
+	replies  map[string]string
+	received map[string]int
+}
+
+// startFakeSMTP starts the server and sends the emails to it until the
+// returned function is called.
+func startFakeSMTP() (*fakeSMTP, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tFatal(err)
+	}
+	s := &fakeSMTP{listener: listener, replies: map[string]string{}, received: map[string]int{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	os.Setenv("APP_SMTP_SERVER", "127.0.0.1")
+	os.Setenv("APP_SMTP_PORT", strconv.Itoa(listener.Addr().(*net.TCPAddr).Port))
+	return s, func() {
+		listener.Close()
+		os.Unsetenv("APP_SMTP_SERVER")
+		os.Unsetenv("APP_SMTP_PORT")
+	}
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP")
+	recipient := ""
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch command {
+		case "EHLO":
+			text.PrintfLine("250-localhost")
+			text.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			text.PrintfLine("235 Authenticated")
+		case "RCPT":
+			recipient = strings.TrimSuffix(strings.TrimPrefix(line[len("RCPT TO:"):], "<"), ">")
+			s.mu.Lock()
+			reply, refused := s.replies[recipient]
+			s.mu.Unlock()
+			if refused {
+				text.PrintfLine(reply)
+			} else {
+				text.PrintfLine("250 OK")
+			}
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			if _, err := text.ReadDotBytes(); err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.received[recipient]++
+			s.mu.Unlock()
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("250 OK")
+		}
+	}
+}
+
+func (s *fakeSMTP) setReply(recipient, reply string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reply == "" {
+		delete(s.replies, recipient)
+	} else {
+		s.replies[recipient] = reply
+	}
+}
+
+func (s *fakeSMTP) receivedBy(recipient string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.received[recipient]
+}
+
+// addBadgeNotification queues a badgeAwarded notification to Ada and Bob.
+func (test *TestHelper) addBadgeNotification() {
+	h.addMember("aabbccdd", "Ada", "Lovelace", "", "", "", "baix", "member", "ada@test.ca", "")
+	h.addMember("bbccddee", "Bob", "Builder", "", "", "", "baix", "member", "bob@test.ca", "")
+	h.setMemberSubscribed("aabbccdd", 1)
+	h.setMemberSubscribed("bbccddee", 1)
+	h.execSQL("INSERT INTO notifications (notificationType, sendDate, payload) VALUES (?, ?, ?)",
+		model.TypeBadgeAwarded, time.Now().Unix()-1, []byte(`{"badgeCode":"camisa","memberUuids":["aabbccdd","bbccddee"]}`))
+}
+
+func (test *TestHelper) getLatestNotification() model.Notification {
+	db, err := sql.Open("sqlite3", testDbName)
+	if err != nil {
+		tFatal(err)
+	}
+	defer db.Close()
+	var n model.Notification
+	if err = db.QueryRow("SELECT id, delivered, attempts, next_attempt_at, last_error FROM notifications ORDER BY id DESC LIMIT 1").Scan(
+		&n.ID, &n.Delivered, &n.Attempts, &n.NextAttemptAt, &n.LastError); err != nil {
+		tFatal(err)
+	}
+	return n
+}
+
+// retryNow makes the notifications waiting for a retry ready.
+func (test *TestHelper) retryNow() {
+	h.execSQL("UPDATE notifications SET next_attempt_at = 0")
+	h.execSQL("UPDATE notification_recipients SET next_attempt_at = 0")
+}
+
+func TestNotificationRetryTransientFailure(t *testing.T) {
+	h.clearTables()
+	server, stop := startFakeSMTP()
+	defer stop()
+	h.addBadgeNotification()
+	server.setReply("bob@test.ca", "451 4.3.0 Try again later")
+
+	controller.RunNotificationDeliveryOnce()
+	n := h.getLatestNotification()
+	if n.Delivered != model.NotificationNotDelivered || n.Attempts != 1 || !strings.Contains(n.LastError, "451") {
+		t.Fatalf("Expected the notification to wait for a retry. Got %+v", n)
+	}
+	if wait := n.NextAttemptAt - time.Now().Unix(); wait < 58 || wait > 60 {
+		t.Errorf("Expected a retry in 60 seconds. Got %d", wait)
+	}
+	if server.receivedBy("ada@test.ca") != 1 || server.receivedBy("bob@test.ca") != 0 {
+		t.Fatalf("Expected only Ada to receive the email. Got %v", server.received)
+	}
+
+	// Not before the next attempt
+	controller.RunNotificationDeliveryOnce()
+	if n := h.getLatestNotification(); n.Attempts != 1 {
+		t.Errorf("Expected no new attempt. Got %d", n.Attempts)
+	}
+
+	server.setReply("bob@test.ca", "")
+	h.retryNow()
+	controller.RunNotificationDeliveryOnce()
+	if n := h.getLatestNotification(); n.Delivered != model.NotificationDeliverySuccess || n.NextAttemptAt != 0 {
+		t.Errorf("Expected the notification to be delivered. Got %+v", n)
+	}
+	if server.receivedBy("ada@test.ca") != 1 || server.receivedBy("bob@test.ca") != 1 {
+		t.Errorf("Expected only Bob to receive the retry. Got %v", server.received)
+	}
+}
+
+func TestNotificationRetryPermanentFailure(t *testing.T) {
+	h.clearTables()
+	server, stop := startFakeSMTP()
+	defer stop()
+	h.addBadgeNotification()
+	server.setReply("bob@test.ca", "550 5.1.1 No such user")
+
+	controller.RunNotificationDeliveryOnce()
+	if n := h.getLatestNotification(); n.Delivered != model.NotificationDeliveryPartialFailure || n.NextAttemptAt != 0 {
+		t.Errorf("Expected a partial failure without retry. Got %+v", n)
+	}
+	if n := h.countRows("SELECT COUNT(*) FROM notification_recipients WHERE member_uuid = 'bbccddee' AND delivered = ? AND attempts = 1",
+		model.NotificationDeliveryFailure); n != 1 {
+		t.Errorf("Expected the delivery to Bob to fail")
+	}
+}
+
+func TestNotificationRetryLimit(t *testing.T) {
+	h.clearTables()
+	os.Setenv("APP_NOTIFICATION_RETRY_MAX_ATTEMPTS", "3")
+	defer os.Unsetenv("APP_NOTIFICATION_RETRY_MAX_ATTEMPTS")
+	server, stop := startFakeSMTP()
+	defer stop()
+	h.addBadgeNotification()
+	server.setReply("ada@test.ca", "421 4.7.0 Too many connections")
+	server.setReply("bob@test.ca", "421 4.7.0 Too many connections")
+
+	// The delay doubles after each attempt
+	for attempt, delay := range []int64{60, 120} {
+		controller.RunNotificationDeliveryOnce()
+		n := h.getLatestNotification()
+		if n.Delivered != model.NotificationNotDelivered || n.Attempts != attempt+1 {
+			t.Fatalf("Expected attempt %d to wait for a retry. Got %+v", attempt+1, n)
+		}
+		if wait := n.NextAttemptAt - time.Now().Unix(); wait < delay-2 || wait > delay {
+			t.Errorf("Expected a retry in %d seconds. Got %d", delay, wait)
+		}
+		h.retryNow()
+	}
+	controller.RunNotificationDeliveryOnce()
+	if n := h.getLatestNotification(); n.Delivered != model.NotificationDeliveryFailure || n.Attempts != 3 {
+		t.Errorf("Expected the notification to fail after 3 attempts. Got %+v", n)
+	}
+}
+
+// addLateParticipationChange records a late change of the event and queues
+// its notification to the admins.
+func (test *TestHelper) addLateParticipationChange(eventUUID, memberUUID string) {
+	h.execSQL("INSERT INTO late_participation_changes (event_uuid, member_uuid, author_uuid, answer, changed_at) VALUES (?, ?, ?, ?, ?)",
+		eventUUID, memberUUID, memberUUID, "yes", time.Now().Unix())
+	h.execSQL("INSERT INTO notifications (notificationType, objectUUID, sendDate) VALUES (?, ?, ?)",
+		model.TypeLateParticipationChanges, eventUUID, time.Now().Unix()-1)
+}
+
+func TestNotificationRetryLateParticipationChanges(t *testing.T) {
+	h.clearTables()
+	server, stop := startFakeSMTP()
+	defer stop()
+	start := futureEventStart()
+	h.addEvent("deadbeef", "diada", start, start+3600)
+	h.addMember("aabbccdd", "Ada", "Lovelace", "", "", "", "baix", model.MEMBERSTYPEADMIN, "ada@test.ca", "")
+	h.addMember("bbccddee", "Bob", "Builder", "", "", "", "baix", model.MEMBERSTYPEADMIN, "bob@test.ca", "")
+	h.setMemberSubscribed("aabbccdd", 1)
+	h.setMemberSubscribed("bbccddee", 1)
+	h.setMemberStatus("aabbccdd", model.MEMBERSSTATUSACTIVATED)
+	h.setMemberStatus("bbccddee", model.MEMBERSSTATUSACTIVATED)
+	server.setReply("bob@test.ca", "451 4.3.0 Try again later")
+
+	h.addLateParticipationChange("deadbeef", "aabbccdd")
+	controller.RunNotificationDeliveryOnce()
+	if server.receivedBy("ada@test.ca") != 1 || server.receivedBy("bob@test.ca") != 0 {
+		t.Fatalf("Expected only Ada to receive the first change. Got %v", server.received)
+	}
+
+	// Ada only receives the new change, Bob receives both changes once
+	server.setReply("bob@test.ca", "")
+	h.addLateParticipationChange("deadbeef", "bbccddee")
+	h.retryNow()
+	controller.RunNotificationDeliveryOnce()
+	controller.RunNotificationDeliveryOnce()
+	if server.receivedBy("ada@test.ca") != 2 || server.receivedBy("bob@test.ca") != 1 {
+		t.Errorf("Expected Ada and Bob to receive the changes once. Got %v", server.received)
+	}
+	for _, admin := range []string{"aabbccdd", "bbccddee"} {
+		if n := h.countRows("SELECT COUNT(*) FROM notification_recipients WHERE member_uuid = ? AND delivered = ? AND last_change_id = "+
+			"(SELECT MAX(id) FROM late_participation_changes)", admin, model.NotificationDeliverySuccess); n != 1 {
+			t.Errorf("Expected %s to have received the last change", admin)
+		}
+	}
+	if n := h.countRows("SELECT COUNT(*) FROM notifications WHERE delivered != ?", model.NotificationDeliverySuccess); n != 0 {
+		t.Errorf("Expected the notifications to be delivered. Got %d waiting", n)
+	}
+}
@@ -0,0 +1,321 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const oidcClientID = "castellers"
+
+// mockIdP is an OpenID Connect provider, returning an ID token with the
+// claims of each code, if the PKCE verifier matches the challenge of the
+// login of the code.
+type mockIdP struct {
+	server     *httptest.Server
+	key        *rsa.PrivateKey
+	codes      map[string]jwt.MapClaims
+	challenges map[string]string
+}
+
+// oidcLoginStart is returned by GET /api/v1/login/oidc.
+type oidcLoginStart struct {
+	state, nonce, challenge, verifier string
+}
+
+func newMockIdP() *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		tFatal(err)
+	}
+	idp := &mockIdP{key: key, codes: map[string]jwt.MapClaims{}, challenges: map[string]string{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                idp.server.URL,
+			"authorization_endpoint":                idp.server.URL + "/authorize",
+			"token_endpoint":                        idp.server.URL + "/token",
+			"jwks_uri":                              idp.server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "test", "use": "sig", "alg": "RS256",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		clientID, _, ok := r.BasicAuth()
+		if !ok {
+			clientID = r.FormValue("client_id")
+		}
+		claims, found := idp.codes[r.FormValue("code")]
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if clientID != oidcClientID || !found || base64.RawURLEncoding.EncodeToString(verifier[:]) != idp.challenges[r.FormValue("code")] {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		delete(idp.codes, r.FormValue("code"))
+		delete(idp.challenges, r.FormValue("code"))
+		claims["iss"] = idp.server.URL
+		claims["aud"] = oidcClientID
+		claims["iat"] = time.Now().Unix()
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "test"
+		idToken, _ := token.SignedString(key)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access", "token_type": "Bearer", "expires_in": 3600, "id_token": idToken})
+	})
+	idp.server = httptest.NewServer(mux)
+	return idp
+}
+
+// configure enables the login with the provider, until the returned
+// function is called.
+func (idp *mockIdP) configure() func() {
+	env := map[string]string{
+		"APP_OIDC_ENABLED":       "true",
+		"APP_OIDC_ISSUER":        idp.server.URL,
+		"APP_OIDC_CLIENT_ID":     oidcClientID,
+		"APP_OIDC_CLIENT_SECRET": "secret",
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+		idp.server.Close()
+	}
+}
+
+// authorize returns a code for the login, like the provider after the member
+// logged in.
+func (idp *mockIdP) authorize(code string, login oidcLoginStart, claims jwt.MapClaims) {
+	idp.codes[code] = claims
+	idp.challenges[code] = login.challenge
+}
+
+func (test *TestHelper) startOIDCLogin() oidcLoginStart {
+	req, _ := http.NewRequest("GET", "/api/v1/login/oidc", nil)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		tFatal(err)
+	}
+	var m map[string]string
+	json.Unmarshal(response.Body.Bytes(), &m)
+	authURL, err := url.Parse(m["url"])
+	if err != nil {
+		tFatal(err)
+	}
+	if authURL.Query().Get("code_challenge_method") != "S256" {
+		tFatal(errors.New("Expected a PKCE challenge in " + m["url"]))
+	}
+	return oidcLoginStart{
+		state:     authURL.Query().Get("state"),
+		nonce:     authURL.Query().Get("nonce"),
+		challenge: authURL.Query().Get("code_challenge"),
+		verifier:  m["verifier"],
+	}
+}
+
+func (test *TestHelper) finishOIDCLogin(code, state, verifier string) (int, map[string]interface{}) {
+	payload, _ := json.Marshal(map[string]string{"code": code, "state": state, "verifier": verifier})
+	req, _ := http.NewRequest("POST", "/api/v1/login/oidc", bytes.NewBuffer(payload))
+	response := h.executeRequest(req)
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	return response.Code, m
+}
+
+// oidcLogin logs in with an account of the provider.
+func (test *TestHelper) oidcLogin(idp *mockIdP, subject, email string, verified bool) (int, map[string]interface{}) {
+	login := h.startOIDCLogin()
+	idp.authorize(subject, login, jwt.MapClaims{"sub": subject, "email": email, "email_verified": verified, "nonce": login.nonce})
+	return h.finishOIDCLogin(subject, login.state, login.verifier)
+}
+
+func TestOIDCDisabled(t *testing.T) {
+	h.clearTables()
+	req, _ := http.NewRequest("GET", "/api/v1/login/oidc", nil)
+	if code := h.executeRequest(req).Code; code != http.StatusForbidden {
+		t.Errorf("Expected response code %d. Got %d", http.StatusForbidden, code)
+	}
+}
+
+func TestOIDCLoginLinksMemberByEmail(t *testing.T) {
+	h.clearTables()
+	h.addAMember()
+	idp := newMockIdP()
+	defer idp.configure()()
+
+	code, tokens := h.oidcLogin(idp, "google-1", "ramon@gerard.ca", true)
+	if err := h.checkResponseCode(http.StatusOK, code); err != nil {
+		t.Fatal(err)
+	}
+	accessToken, _ := tokens["access_token"].(string)
+	if _, found := tokens["refresh_token"]; !found || accessToken == "" {
+		t.Fatalf("Expected an access and refresh token. Got %v", tokens)
+	}
+	if code, _ := h.getSessions(accessToken, "/api/v1/sessions"); code != http.StatusOK {
+		t.Errorf("Expected the access token to be valid. Got %d", code)
+	}
+	if count := h.countRows("SELECT COUNT(*) FROM member_oidc_identities WHERE subject = ? AND member_uuid = ?", "google-1", "deadbeef"); count != 1 {
+		t.Errorf("Expected the account to be linked. Got %d", count)
+	}
+	// Once linked, the subject identifies the member, whatever the email
+	if code, _ := h.oidcLogin(idp, "google-1", "other@gmail.com", false); code != http.StatusOK {
+		t.Errorf("Expected the linked account to login. Got %d", code)
+	}
+}
+
+func TestOIDCLoginRefused(t *testing.T) {
+	h.clearTables()
+	h.addAMember()
+	h.addMember("deadc0de", "Pere", "Convidat", "", "", "", "", "guest", "pere@convidat.ca", "")
+	idp := newMockIdP()
+	defer idp.configure()()
+
+	if code, _ := h.oidcLogin(idp, "google-1", "ramon@gerard.ca", false); code != http.StatusUnauthorized {
+		t.Errorf("Expected an unverified email to be refused. Got %d", code)
+	}
+	if code, _ := h.oidcLogin(idp, "google-2", "nobody@gmail.com", true); code != http.StatusUnauthorized {
+		t.Errorf("Expected an unknown email to be refused. Got %d", code)
+	}
+	if code, _ := h.oidcLogin(idp, "google-3", "pere@convidat.ca", true); code != http.StatusForbidden {
+		t.Errorf("Expected a guest to be refused. Got %d", code)
+	}
+
+	// The nonce must be the one of the login
+	login := h.startOIDCLogin()
+	idp.authorize("code", login, jwt.MapClaims{"sub": "google-1", "email": "ramon@gerard.ca", "email_verified": true, "nonce": "other"})
+	if code, _ := h.finishOIDCLogin("code", login.state, login.verifier); code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong nonce to be refused. Got %d", code)
+	}
+	// The state can only be used once
+	if code, _ := h.finishOIDCLogin("code", login.state, login.verifier); code != http.StatusBadRequest {
+		t.Errorf("Expected a used state to be refused. Got %d", code)
+	}
+	if code, _ := h.finishOIDCLogin("code", "unknown", login.verifier); code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown state to be refused. Got %d", code)
+	}
+	login = h.startOIDCLogin()
+	if code, _ := h.finishOIDCLogin("unknown", login.state, login.verifier); code != http.StatusUnauthorized {
+		t.Errorf("Expected an invalid code to be refused. Got %d", code)
+	}
+	if count := h.countRows("SELECT COUNT(*) FROM member_oidc_identities"); count != 0 {
+		t.Errorf("Expected no linked account. Got %d", count)
+	}
+}
+
+func TestOIDCUnlink(t *testing.T) {
+	h.clearTables()
+	adminToken := h.addAnAdmin()
+	memberToken := h.addAMember()
+	idp := newMockIdP()
+	defer idp.configure()()
+	h.oidcLogin(idp, "google-1", "ramon@gerard.ca", true)
+
+	if code := h.deleteWithToken(memberToken, "/api/v1/members/deadbeef/oidc"); code != http.StatusUnauthorized {
+		t.Errorf("Expected a member to be refused. Got %d", code)
+	}
+	if code := h.deleteWithToken(adminToken, "/api/v1/members/deadbeef/oidc"); code != http.StatusOK {
+		t.Errorf("Expected response code %d. Got %d", http.StatusOK, code)
+	}
+	if count := h.countRows("SELECT COUNT(*) FROM member_oidc_identities"); count != 0 {
+		t.Errorf("Expected the account to be unlinked. Got %d", count)
+	}
+	// A compromised account is not linked again with the email
+	if code, _ := h.oidcLogin(idp, "google-1", "ramon@gerard.ca", true); code != http.StatusUnauthorized {
+		t.Errorf("Expected the unlinked account to be refused. Got %d", code)
+	}
+	if code, _ := h.oidcLogin(idp, "google-2", "ramon@gerard.ca", true); code != http.StatusOK {
+		t.Errorf("Expected another account to be linked. Got %d", code)
+	}
+}
+
+func TestOIDCLoginDeletedMember(t *testing.T) {
+	h.clearTables()
+	adminToken := h.addAnAdmin()
+	h.addAMember()
+	idp := newMockIdP()
+	defer idp.configure()()
+	if code, _ := h.oidcLogin(idp, "google-1", "ramon@gerard.ca", true); code != http.StatusOK {
+		t.Fatalf("Expected the account to be linked. Got %d", code)
+	}
+
+	h.deleteMember(adminToken, "deadbeef")
+	if code, _ := h.oidcLogin(idp, "google-1", "ramon@gerard.ca", true); code != http.StatusUnauthorized {
+		t.Errorf("Expected a deleted member to be refused. Got %d", code)
+	}
+}
+
+func TestOIDCEmailVerifiedClaim(t *testing.T) {
+	h.clearTables()
+	h.addAMember()
+	idp := newMockIdP()
+	defer idp.configure()()
+	// Like Microsoft Entra ID, without email_verified
+	os.Setenv("APP_OIDC_EMAIL_VERIFIED_CLAIM", "xms_edov")
+	defer os.Unsetenv("APP_OIDC_EMAIL_VERIFIED_CLAIM")
+
+	if code, _ := h.oidcLogin(idp, "entra-1", "ramon@gerard.ca", true); code != http.StatusUnauthorized {
+		t.Errorf("Expected email_verified to be ignored. Got %d", code)
+	}
+	login := h.startOIDCLogin()
+	idp.authorize("entra-1", login, jwt.MapClaims{"sub": "entra-1", "email": "ramon@gerard.ca", "xms_edov": true, "nonce": login.nonce})
+	if code, _ := h.finishOIDCLogin("entra-1", login.state, login.verifier); code != http.StatusOK {
+		t.Errorf("Expected the configured claim to verify the email. Got %d", code)
+	}
+}
+
+func TestOIDCLoginBoundToBrowser(t *testing.T) {
+	h.clearTables()
+	h.addAMember()
+	idp := newMockIdP()
+	defer idp.configure()()
+
+	// The link of an attacker, with the code of their account, opened in
+	// the browser of the member
+	attacker := h.startOIDCLogin()
+	idp.authorize("attacker", attacker, jwt.MapClaims{"sub": "google-1", "email": "ramon@gerard.ca", "email_verified": true, "nonce": attacker.nonce})
+	if code, _ := h.finishOIDCLogin("attacker", attacker.state, ""); code != http.StatusBadRequest {
+		t.Errorf("Expected a login without verifier to be refused. Got %d", code)
+	}
+	attacker = h.startOIDCLogin()
+	member := h.startOIDCLogin()
+	idp.authorize("attacker", attacker, jwt.MapClaims{"sub": "google-1", "email": "ramon@gerard.ca", "email_verified": true, "nonce": attacker.nonce})
+	if code, _ := h.finishOIDCLogin("attacker", attacker.state, member.verifier); code != http.StatusBadRequest {
+		t.Errorf("Expected the verifier of another login to be refused. Got %d", code)
+	}
+
+	// The provider checks the PKCE challenge of the code
+	first, second := h.startOIDCLogin(), h.startOIDCLogin()
+	idp.authorize("code", first, jwt.MapClaims{"sub": "google-1", "email": "ramon@gerard.ca", "email_verified": true, "nonce": second.nonce})
+	if code, _ := h.finishOIDCLogin("code", second.state, second.verifier); code != http.StatusUnauthorized {
+		t.Errorf("Expected the code of another login to be refused. Got %d", code)
+	}
+	if count := h.countRows("SELECT COUNT(*) FROM member_oidc_identities"); count != 0 {
+		t.Errorf("Expected no linked account. Got %d", count)
+	}
+}
@@ -2,10 +2,16 @@ package tests
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/vilisseranen/castellers/controller"
 	"github.com/vilisseranen/castellers/model"
 )
 
@@ -176,3 +182,300 @@ func TestPresenceWrongMember(t *testing.T) {
 	}
 
 }
+
+func (test *TestHelper) setEventCapacity(uuid string, capacity int) {
+	db, err := sql.Open("sqlite3", testDbName)
+	if err != nil {
+		tFatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec("UPDATE events SET capacity = ? WHERE uuid = ?", capacity, uuid)
+	tFatal(err)
+}
+
+func (test *TestHelper) answer(accessToken, memberUUID, eventUUID, answer string) map[string]interface{} {
+	payload := []byte(`{"answer":"` + answer + `"}`)
+	req, _ := http.NewRequest("POST", "/api/v1/members/"+memberUUID+"/events/"+eventUUID, bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusCreated, response.Code); err != nil {
+		tFatal(err)
+	}
+	var p map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &p)
+	return p
+}
+
+func TestParticipateEventWaitingList(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+	h.addMember("aabbccdd", "Ada", "Lovelace", "", "", "", "baix", "member", "ada@test.ca", "")
+	h.addMember("aabbccee", "Grace", "Hopper", "", "", "", "baix", "member", "grace@test.ca", "")
+	start := futureEventStart()
+	h.addEvent("deadbeef", "taller", start, start+3600)
+	h.setEventCapacity("deadbeef", 1)
+
+	if p := h.answer(accessToken, "deadfeed", "deadbeef", "yes"); p["waitlisted"] != 0.0 {
+		t.Errorf("Expected the first answer to be confirmed. Got '%v'", p)
+	}
+	if p := h.answer(accessToken, "aabbccdd", "deadbeef", "yes"); p["waitlisted"] != 1.0 {
+		t.Errorf("Expected the second answer to be on the waiting list. Got '%v'", p)
+	}
+	if p := h.answer(accessToken, "aabbccee", "deadbeef", "yes"); p["waitlisted"] != 1.0 {
+		t.Errorf("Expected the third answer to be on the waiting list. Got '%v'", p)
+	}
+
+	// A place is freed: the first on the waiting list gets it
+	h.answer(accessToken, "deadfeed", "deadbeef", "no")
+
+	req, _ := http.NewRequest("GET", "/api/v1/events/deadbeef/members", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	var members []model.Member
+	json.Unmarshal(response.Body.Bytes(), &members)
+	for _, member := range members {
+		switch member.UUID {
+		case "aabbccdd":
+			if member.Participation != "yes" || member.Waitlisted != 0 {
+				t.Errorf("Expected Ada to be promoted. Got '%v'", member)
+			}
+		case "aabbccee":
+			if member.Participation != "yes" || member.Waitlisted != 1 {
+				t.Errorf("Expected Grace to stay on the waiting list. Got '%v'", member)
+			}
+		}
+	}
+
+	nType, err := h.getLatestNotificationType()
+	if err != nil || nType != model.TypeWaitingListPromoted {
+		t.Errorf("Expected a %s notification. Got '%s' (%v)", model.TypeWaitingListPromoted, nType, err)
+	}
+}
+
+func TestUpdateEventCapacityPromotes(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+	h.addMember("aabbccdd", "Ada", "Lovelace", "", "", "", "baix", "member", "ada@test.ca", "")
+	start := futureEventStart()
+	h.addEvent("deadbeef", "taller", start, start+3600)
+	h.setEventCapacity("deadbeef", 1)
+	h.answer(accessToken, "deadfeed", "deadbeef", "yes")
+	h.answer(accessToken, "aabbccdd", "deadbeef", "yes")
+
+	payload := []byte(fmt.Sprintf(`{"name":"taller","startDate":%d,"endDate":%d,"type":"presentation","capacity":2}`, start, start+3600))
+	req, _ := http.NewRequest("PUT", "/api/v1/events/deadbeef", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	if count := h.countNotifications(model.TypeWaitingListPromoted); count != 1 {
+		t.Errorf("Expected 1 %s notification. Got %d", model.TypeWaitingListPromoted, count)
+	}
+}
+
+func TestParticipateConcurrently(t *testing.T) {
+	h.clearTables()
+	start := futureEventStart()
+	h.addEvent("deadbeef", "taller", start, start+3600)
+	h.setEventCapacity("deadbeef", 2)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for i := 0; i < 6; i++ {
+		uuid := fmt.Sprintf("aabbcc%02d", i)
+		h.addMember(uuid, "Member", uuid, "", "", "", "baix", "member", uuid+"@test.ca", "")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := model.Participation{EventUUID: "deadbeef", MemberUUID: uuid, Answer: "yes"}
+			if err := p.Participate(context.Background()); err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				errs = append(errs, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(errs) != 0 {
+		t.Fatalf("Expected the answers to wait for each other. Got %v", errs)
+	}
+	if n := h.countRows("SELECT COUNT(*) FROM participation WHERE event_uuid = 'deadbeef' AND answer = 'yes' AND waitlisted_at IS NULL"); n != 2 {
+		t.Errorf("Expected 2 confirmed members. Got %d", n)
+	}
+	if n := h.countRows("SELECT COUNT(*) FROM participation WHERE event_uuid = 'deadbeef' AND answer = 'yes' AND waitlisted_at IS NOT NULL"); n != 4 {
+		t.Errorf("Expected 4 members on the waiting list. Got %d", n)
+	}
+}
+
+func TestPromoteFromWaitingListConcurrently(t *testing.T) {
+	h.clearTables()
+	start := futureEventStart()
+	h.addEvent("deadbeef", "taller", start, start+3600)
+	h.setEventCapacity("deadbeef", 2)
+	for i := 0; i < 5; i++ {
+		uuid := fmt.Sprintf("aabbcc%02d", i)
+		h.addMember(uuid, "Member", uuid, "", "", "", "baix", "member", uuid+"@test.ca", "")
+		h.execSQL("INSERT INTO participation (event_uuid, member_uuid, answer, presence, waitlisted_at) VALUES (?, ?, ?, '', ?)",
+			"deadbeef", uuid, "yes", i+1)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	promoted := []string{}
+	var errs []error
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			members, err := model.PromoteFromWaitingList(context.Background(), "deadbeef")
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+			}
+			promoted = append(promoted, members...)
+		}()
+	}
+	wg.Wait()
+	if len(errs) != 0 {
+		t.Fatalf("Expected the promotions to wait for each other. Got %v", errs)
+	}
+	// The first 2 members waiting are promoted, once
+	if len(promoted) != 2 || promoted[0] == promoted[1] || promoted[0] > "aabbcc01" || promoted[1] > "aabbcc01" {
+		t.Errorf("Expected the 2 first members to be promoted once. Got %v", promoted)
+	}
+	if n := h.countRows("SELECT COUNT(*) FROM participation WHERE event_uuid = 'deadbeef' AND waitlisted_at IS NULL"); n != 2 {
+		t.Errorf("Expected 2 confirmed members. Got %d", n)
+	}
+}
+
+func (test *TestHelper) setEventAnswerDeadline(uuid string, deadline int) {
+	db, err := sql.Open("sqlite3", testDbName)
+	if err != nil {
+		tFatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec("UPDATE events SET answerDeadline = ? WHERE uuid = ?", deadline, uuid)
+	tFatal(err)
+}
+
+func TestParticipateEventAfterDeadline(t *testing.T) {
+	h.clearTables()
+	accessTokenAdmin := h.addAnAdmin()
+	accessTokenMember := h.addAMember()
+	start := futureEventStart()
+	h.addEvent("deadbeef", "diada", start, start+3600)
+	h.setEventAnswerDeadline("deadbeef", int(time.Now().Unix())-60)
+
+	payload := []byte(`{"answer":"yes"}`)
+	req, _ := http.NewRequest("POST", "/api/v1/members/events/deadbeef", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessTokenMember)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusForbidden, response.Code); err != nil {
+		t.Error(err)
+	}
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["error"] != controller.ERRORANSWERDEADLINE {
+		t.Errorf("Expected error to be '%s'. Got '%v'", controller.ERRORANSWERDEADLINE, m["error"])
+	}
+
+	// An admin can still change the answer, the other admins are told
+	h.answer(accessTokenAdmin, "deadbeef", "deadbeef", "yes")
+	if count := h.countNotifications(model.TypeLateParticipationChanges); count != 1 {
+		t.Errorf("Expected 1 %s notification. Got %d", model.TypeLateParticipationChanges, count)
+	}
+	changes, err := model.GetLateParticipationChanges(context.Background(), "deadbeef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].MemberUUID != "deadbeef" || changes[0].AuthorUUID != "deadfeed" || changes[0].Answer != "yes" {
+		t.Errorf("Expected the late change to be recorded. Got '%v'", changes)
+	}
+}
+
+func TestParticipateEventBeforeDeadline(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAMember()
+	start := futureEventStart()
+	h.addEvent("deadbeef", "diada", start, start+3600)
+	h.setEventAnswerDeadline("deadbeef", start-3600)
+
+	h.answer(accessToken, "deadbeef", "deadbeef", "yes")
+	if count := h.countNotifications(model.TypeLateParticipationChanges); count != 0 {
+		t.Errorf("Expected no %s notification. Got %d", model.TypeLateParticipationChanges, count)
+	}
+}
+
+// BenchmarkGetEventParticipation compares reading the participation of 150
+// members to an event one member at a time and with a single query:
+// go test ./tests -run NONE -bench GetEventParticipation
+func BenchmarkGetEventParticipation(b *testing.B) {
+	h.clearTables()
+	h.addEvent("deadbeef", "diada", 1528048800, 1528059600)
+	for i := 0; i < 150; i++ {
+		uuid := fmt.Sprintf("%08x", i)
+		h.addMember(uuid, "Ramon", "Gerard", "", "", "", "baix", "member", uuid+"@gerard.ca", "")
+		if i%2 == 0 {
+			h.addParticipation(uuid, "deadbeef", "yes")
+		}
+	}
+	ctx := context.Background()
+	m := model.Member{}
+
+	b.Run("PerMember", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			members, err := m.GetAll(ctx, []string{}, []string{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			for index, member := range members {
+				p := model.Participation{EventUUID: "deadbeef", MemberUUID: member.UUID}
+				if err := p.GetParticipation(ctx); err != nil && err != sql.ErrNoRows {
+					b.Fatal(err)
+				}
+				members[index].Participation = p.Answer
+			}
+		}
+	})
+	b.Run("SingleQuery", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			if _, err := m.GetAllWithParticipation(ctx, "deadbeef", []string{}, []string{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestGetAllWithParticipation(t *testing.T) {
+	h.clearTables()
+	h.addAMember()
+	h.addAnAdmin()
+	h.addEvent("deadbeef", "diada", 1528048800, 1528059600)
+	h.addEvent("deadbee2", "diada", 1528135200, 1528146000)
+	h.addParticipation("deadbeef", "deadbeef", "yes")
+	h.addParticipation("deadfeed", "deadbee2", "no")
+
+	m := model.Member{}
+	members, err := m.GetAllWithParticipation(context.Background(), "deadbeef", []string{}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 {
+		t.Fatalf("Expected 2 members. Got '%v'", members)
+	}
+	for _, member := range members {
+		expected := ""
+		if member.UUID == "deadbeef" {
+			expected = "yes"
+			if member.FirstName != "Ramon" {
+				t.Errorf("Expected the member to be decrypted. Got '%s'", member.FirstName)
+			}
+		}
+		if member.Participation != expected {
+			t.Errorf("Expected the answer of %s to be '%s'. Got '%s'", member.UUID, expected, member.Participation)
+		}
+	}
+}
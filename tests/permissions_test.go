@@ -0,0 +1,206 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/vilisseranen/castellers/model"
+)
+
+func (test *TestHelper) login(username, password string) string {
+	payload, _ := json.Marshal(map[string]string{"username": username, "password": password})
+	req, _ := http.NewRequest("POST", "/api/v1/login", bytes.NewBuffer(payload))
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		tFatal(err)
+	}
+	var t map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &t)
+	return t["access_token"].(string)
+}
+
+func (test *TestHelper) setMemberPermissionSets(accessToken, uuid string, sets ...string) int {
+	payload, _ := json.Marshal(map[string][]string{"sets": sets})
+	req, _ := http.NewRequest("PUT", "/api/v1/members/"+uuid+"/permissions", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	return h.executeRequest(req).Code
+}
+
+func TestPermissionSetGrantsRoute(t *testing.T) {
+	h.clearTables()
+	adminToken := h.addAnAdmin()
+	memberToken := h.addAMember()
+	start := futureEventStart()
+	h.addEvent("deadbee1", "diada", start, start+3600)
+
+	sendReminders := func(accessToken string) int {
+		payload := []byte(`{"audience":"default"}`)
+		req, _ := http.NewRequest("POST", "/api/v1/events/deadbee1/reminders", bytes.NewBuffer(payload))
+		req.Header.Add("Authorization", "Bearer "+accessToken)
+		return h.executeRequest(req).Code
+	}
+	if code := sendReminders(memberToken); code != http.StatusUnauthorized {
+		t.Errorf("Expected a member to be refused. Got %d", code)
+	}
+
+	if code := h.setMemberPermissionSets(adminToken, "deadbeef", "communications"); code != http.StatusOK {
+		t.Fatalf("Expected response code %d. Got %d", http.StatusOK, code)
+	}
+	memberToken = h.login("member", "member")
+	if code := sendReminders(memberToken); code != http.StatusAccepted {
+		t.Errorf("Expected the communications set to allow sending reminders. Got %d", code)
+	}
+	// Other routes are still refused
+	req, _ := http.NewRequest("DELETE", "/api/v1/events/deadbee1", nil)
+	req.Header.Add("Authorization", "Bearer "+memberToken)
+	if code := h.executeRequest(req).Code; code != http.StatusUnauthorized {
+		t.Errorf("Expected deleting an event to be refused. Got %d", code)
+	}
+
+	// The permissions are removed with the set
+	h.setMemberPermissionSets(adminToken, "deadbeef")
+	memberToken = h.login("member", "member")
+	if code := sendReminders(memberToken); code != http.StatusUnauthorized {
+		t.Errorf("Expected a member without sets to be refused. Got %d", code)
+	}
+}
+
+func TestPermissionMembersReadSensitive(t *testing.T) {
+	h.clearTables()
+	adminToken := h.addAnAdmin()
+	h.addAMember()
+	h.setMemberPermissionSets(adminToken, "deadbeef", "canalla")
+	memberToken := h.login("member", "member")
+
+	req, _ := http.NewRequest("GET", "/api/v1/members/deadfeed", nil)
+	req.Header.Add("Authorization", "Bearer "+memberToken)
+	response := h.executeRequest(req)
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["email"] != "romà@eric.ca" {
+		t.Errorf("Expected the full profile of the admin. Got '%v'", m)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/members", nil)
+	req.Header.Add("Authorization", "Bearer "+memberToken)
+	response = h.executeRequest(req)
+	var members []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &members)
+	for _, member := range members {
+		if member["email"] == "" {
+			t.Errorf("Expected the full profile of every member. Got '%v'", member)
+		}
+	}
+}
+
+func TestSavePermissionSet(t *testing.T) {
+	h.clearTables()
+	adminToken := h.addAnAdmin()
+	h.addMember("aabbccdd", "Pau", "Petit", "", "", "", "enxaneta", "canalla", "", "")
+
+	save := func(name, body string) int {
+		req, _ := http.NewRequest("PUT", "/api/v1/permissions/sets/"+name, bytes.NewBufferString(body))
+		req.Header.Add("Authorization", "Bearer "+adminToken)
+		return h.executeRequest(req).Code
+	}
+	if code := save("planning", `{"permissions":["castells:write","members:fly"]}`); code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown permission to be refused. Got %d", code)
+	}
+	if code := save("Planning Team", `{"permissions":["castells:write"]}`); code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid name to be refused. Got %d", code)
+	}
+	if code := save("planning", `{"permissions":["reminders:send","castells:write"]}`); code != http.StatusOK {
+		t.Fatalf("Expected response code %d. Got %d", http.StatusOK, code)
+	}
+
+	req, _ := http.NewRequest("GET", "/api/v1/permissions", nil)
+	req.Header.Add("Authorization", "Bearer "+adminToken)
+	response := h.executeRequest(req)
+	var list struct {
+		Permissions []string              `json:"permissions"`
+		Sets        []model.PermissionSet `json:"sets"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &list)
+	found := false
+	for _, set := range list.Sets {
+		if set.Name == "planning" {
+			found = true
+			if len(set.Permissions) != 2 || set.Permissions[0] != model.PERMISSIONCASTELLSWRITE {
+				t.Errorf("Expected the permissions of the set to be sorted. Got %v", set.Permissions)
+			}
+		}
+	}
+	if !found || len(list.Permissions) != len(model.ValidPermissions) {
+		t.Errorf("Expected the permissions and the new set. Got %+v", list)
+	}
+
+	if code := h.setMemberPermissionSets(adminToken, "deadfeed", "unknown"); code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown set to be refused. Got %d", code)
+	}
+	if code := h.setMemberPermissionSets(adminToken, "aabbccdd", "planning"); code != http.StatusBadRequest {
+		t.Errorf("Expected a canalla to be refused. Got %d", code)
+	}
+	h.setMemberPermissionSets(adminToken, "deadfeed", "planning")
+
+	req, _ = http.NewRequest("DELETE", "/api/v1/permissions/sets/planning", nil)
+	req.Header.Add("Authorization", "Bearer "+adminToken)
+	if code := h.executeRequest(req).Code; code != http.StatusOK {
+		t.Errorf("Expected response code %d. Got %d", http.StatusOK, code)
+	}
+	if count := h.countRows("SELECT COUNT(*) FROM member_permission_sets WHERE permission_set = 'planning'"); count != 0 {
+		t.Errorf("Expected the assignments of the set to be removed. Got %d", count)
+	}
+	req, _ = http.NewRequest("DELETE", "/api/v1/permissions/sets/planning", nil)
+	req.Header.Add("Authorization", "Bearer "+adminToken)
+	if code := h.executeRequest(req).Code; code != http.StatusNotFound {
+		t.Errorf("Expected response code %d. Got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestPermissionsNonAdmin(t *testing.T) {
+	h.clearTables()
+	memberToken := h.addAMember()
+
+	req, _ := http.NewRequest("GET", "/api/v1/permissions", nil)
+	req.Header.Add("Authorization", "Bearer "+memberToken)
+	if code := h.executeRequest(req).Code; code != http.StatusUnauthorized {
+		t.Errorf("Expected response code %d. Got %d", http.StatusUnauthorized, code)
+	}
+	if code := h.setMemberPermissionSets(memberToken, "deadbeef", "technical"); code != http.StatusUnauthorized {
+		t.Errorf("Expected response code %d. Got %d", http.StatusUnauthorized, code)
+	}
+}
+
+func TestPermissionDependentsWrite(t *testing.T) {
+	h.clearTables()
+	adminToken := h.addAnAdmin()
+	h.addAMember()
+	h.addMember("aabbccdd", "Ada", "Lovelace", "", "", "", "", "member", "ada@test.ca", "")
+	h.addMember("123", "child1_first_name", "child1_last_name", "", "", "", "", "canalla", "", "")
+	h.setMemberPermissionSets(adminToken, "deadbeef", "canalla")
+	memberToken := h.login("member", "member")
+
+	addDependent := func(responsible, dependent string) int {
+		req, _ := http.NewRequest("POST", "/api/v1/members/"+responsible+"/dependents/"+dependent, nil)
+		req.Header.Add("Authorization", "Bearer "+memberToken)
+		return h.executeRequest(req).Code
+	}
+	// Adopting an admin would give their data export and their answers
+	if code := addDependent("deadbeef", "deadfeed"); code != http.StatusUnauthorized {
+		t.Errorf("Expected adopting an admin to be refused. Got %d", code)
+	}
+	if code := addDependent("aabbccdd", "deadfeed"); code != http.StatusUnauthorized {
+		t.Errorf("Expected linking an admin to be refused. Got %d", code)
+	}
+	if code := addDependent("deadbeef", "123"); code != http.StatusUnauthorized {
+		t.Errorf("Expected adopting a canalla to be refused. Got %d", code)
+	}
+	if code := addDependent("aabbccdd", "123"); code != http.StatusCreated {
+		t.Errorf("Expected linking a canalla to another member to be allowed. Got %d", code)
+	}
+	if n := h.countRows("SELECT COUNT(*) FROM members_dependent WHERE responsible_uuid = 'deadbeef'"); n != 0 {
+		t.Errorf("Expected the member not to be responsible of anyone. Got %d", n)
+	}
+}
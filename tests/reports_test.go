@@ -0,0 +1,318 @@
+package tests
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vilisseranen/castellers/common"
+	"github.com/vilisseranen/castellers/model"
+)
+
+func (test *TestHelper) addAttendanceData() string {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+	h.addMember("deadbeef", "Ramon", "Gerard", "", "", "", "baix", "member", "ramon@gerard.ca", "")
+	h.addEvent("deadbee1", "assaig", 1528048800, 1528059600)
+	h.addEvent("deadbee2", "diada", 1528135200, 1528146000)
+	h.addEvent("deadbee3", "outside", 1600000000, 1600003600)
+	h.addParticipation("deadbeef", "deadbee1", "yes")
+	h.addParticipation("deadbeef", "deadbee2", "yes")
+	h.addParticipation("deadfeed", "deadbee2", "no")
+
+	// Ramon said yes but did not come to the diada
+	payload := []byte(`{"presence":"no"}`)
+	req, _ := http.NewRequest("POST", "/api/v1/events/deadbee2/members/deadbeef", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	if err := h.checkResponseCode(http.StatusCreated, h.executeRequest(req).Code); err != nil {
+		tFatal(err)
+	}
+	return accessToken
+}
+
+func TestGetAttendanceReport(t *testing.T) {
+	accessToken := h.addAttendanceData()
+
+	req, _ := http.NewRequest("GET", "/api/v1/reports/attendance?start=1528000000&end=1529000000", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	var report model.AttendanceReport
+	json.Unmarshal(response.Body.Bytes(), &report)
+
+	if len(report.Events) != 2 || report.Events[0].UUID != "deadbee1" || report.Events[1].UUID != "deadbee2" {
+		t.Fatalf("Expected the 2 events of the period in order. Got '%v'", report.Events)
+	}
+	if len(report.Members) != 2 {
+		t.Fatalf("Expected 2 members. Got '%v'", report.Members)
+	}
+	for _, member := range report.Members {
+		if len(member.Participations) != 2 {
+			t.Errorf("Expected 2 participations for %s. Got '%v'", member.UUID, member.Participations)
+		}
+		switch member.UUID {
+		case "deadbeef":
+			if member.FirstName != "Ramon" {
+				t.Errorf("Expected names to be decrypted. Got '%s'", member.FirstName)
+			}
+			if member.Participations[1].Answer != "yes" || member.Participations[1].Presence != "no" {
+				t.Errorf("Expected Ramon to have answered yes and be absent. Got '%v'", member.Participations[1])
+			}
+			if member.Attended != 1 || member.AttendanceRate != 0.5 {
+				t.Errorf("Expected Ramon to have attended 1 event out of 2. Got %d (%f)", member.Attended, member.AttendanceRate)
+			}
+		case "deadfeed":
+			if member.Attended != 0 || member.AttendanceRate != 0 {
+				t.Errorf("Expected the admin to have attended no event. Got %d (%f)", member.Attended, member.AttendanceRate)
+			}
+		}
+	}
+}
+
+func TestGetAttendanceReportFilters(t *testing.T) {
+	accessToken := h.addAttendanceData()
+
+	req, _ := http.NewRequest("GET", "/api/v1/reports/attendance?start=1528000000&end=1529000000&type=member&eventType=practice", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	var report model.AttendanceReport
+	json.Unmarshal(response.Body.Bytes(), &report)
+	if len(report.Events) != 0 || len(report.Members) != 0 {
+		t.Errorf("Expected no practice in the period. Got '%v'", report)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/reports/attendance?eventType=party", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response = h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusBadRequest, response.Code); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetAttendanceReportCSV(t *testing.T) {
+	accessToken := h.addAttendanceData()
+
+	req, _ := http.NewRequest("GET", "/api/v1/reports/attendance?start=1528000000&end=1529000000&type=member&format=csv", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(response.Header().Get("Content-Type"), "text/csv") {
+		t.Errorf("Expected a CSV file. Got '%s'", response.Header().Get("Content-Type"))
+	}
+	records, err := csv.NewReader(response.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected a header and 1 member. Got '%v'", records)
+	}
+	expected := []string{"deadbeef", "Ramon", "Gerard", "member", "yes", "", "yes", "no", "1", "0.5"}
+	if strings.Join(records[1], ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected '%v'. Got '%v'", expected, records[1])
+	}
+}
+
+func TestGetAttendanceReportFutureEvents(t *testing.T) {
+	accessToken := h.addAttendanceData()
+	start := futureEventStart()
+	h.addEvent("deadbee4", "future", start, start+3600)
+	h.addParticipation("deadbeef", "deadbee4", "yes")
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/api/v1/reports/attendance?start=1528000000&end=%d&type=member", start+1), nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	var report model.AttendanceReport
+	json.Unmarshal(response.Body.Bytes(), &report)
+	if len(report.Events) != 4 || len(report.Members) != 1 {
+		t.Fatalf("Expected 4 events and 1 member. Got '%v'", report)
+	}
+	// The yes to the future event is not counted
+	if member := report.Members[0]; member.Attended != 1 || member.AttendanceRate != float64(1)/3 {
+		t.Errorf("Expected Ramon to have attended 1 event out of 3. Got %d (%f)", member.Attended, member.AttendanceRate)
+	}
+}
+
+func TestGetAttendanceReportCSVFormula(t *testing.T) {
+	accessToken := h.addAttendanceData()
+	h.addMember("aabbccdd", "=HYPERLINK(\"http://evil.example\")", "-Gerard", "", "", "", "baix", "member", "jordi@gerard.ca", "")
+
+	req, _ := http.NewRequest("GET", "/api/v1/reports/attendance?start=1528000000&end=1529000000&type=member&format=csv", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(response.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("Expected a header and 2 members. Got '%v'", records)
+	}
+	// The members are sorted by last name
+	if records[1][1] != "'=HYPERLINK(\"http://evil.example\")" || records[1][2] != "'-Gerard" {
+		t.Errorf("Expected the names to be kept as text. Got '%v'", records[1])
+	}
+	if records[2][1] != "Ramon" {
+		t.Errorf("Expected the other names to be left alone. Got '%v'", records[2])
+	}
+}
+
+func TestGetAttendanceReportXLSX(t *testing.T) {
+	accessToken := h.addAttendanceData()
+
+	req, _ := http.NewRequest("GET", "/api/v1/reports/attendance?start=1528000000&end=1529000000&format=xlsx", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	body := response.Body.Bytes()
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, file := range archive.File {
+		if file.Name != "xl/worksheets/sheet1.xml" {
+			continue
+		}
+		found = true
+		f, _ := file.Open()
+		sheet, _ := io.ReadAll(f)
+		f.Close()
+		if !strings.Contains(string(sheet), "Ramon") || !strings.Contains(string(sheet), `<c r="J2"><v>0.5</v></c>`) &&
+			!strings.Contains(string(sheet), `<c r="J3"><v>0.5</v></c>`) {
+			t.Errorf("Expected the sheet to contain the report. Got '%s'", sheet)
+		}
+	}
+	if !found {
+		t.Error("Expected the workbook to have a worksheet")
+	}
+}
+
+func TestGetAttendanceReportNonAdmin(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAMember()
+
+	req, _ := http.NewRequest("GET", "/api/v1/reports/attendance", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusUnauthorized, response.Code); err != nil {
+		t.Error(err)
+	}
+}
+
+func (test *TestHelper) addStatusChange(uuid, from, to, cause string, changedAt time.Time) {
+	db, err := sql.Open("sqlite3", testDbName)
+	if err != nil {
+		tFatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Exec(
+		"INSERT INTO member_status_history (member_uuid, status_from, status_to, cause, changed_at) VALUES (?, ?, ?, ?, ?)",
+		uuid, from, to, cause, changedAt.Unix()); err != nil {
+		tFatal(err)
+	}
+}
+
+func TestGetRetentionReport(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+	location, err := common.LoadLocation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	year := time.Now().In(location).Year()
+	date := func(yearsAgo int, month time.Month, day int) time.Time {
+		return time.Date(year-yearsAgo, month, day, 12, 0, 0, 0, location)
+	}
+	h.addMember("aaaaaaa1", "Ada", "Lovelace", "", "", "", "baix", "member", "ada@test.ca", "")
+	h.addMember("aaaaaaa2", "Grace", "Hopper", "", "", "", "baix", "member", "grace@test.ca", "")
+	h.addMember("aaaaaaa3", "Alan", "Turing", "", "", "", "baix", "member", "alan@test.ca", "")
+
+	// Ada joined two seasons ago and left the same season
+	h.addStatusChange("aaaaaaa1", "", model.MEMBERSSTATUSACTIVATED, model.STATUSCAUSECREATION, date(2, time.January, 10))
+	h.addStatusChange("aaaaaaa1", model.MEMBERSSTATUSACTIVATED, model.MEMBERSSTATUSPAUSED, model.STATUSCAUSEAUTOPAUSE, date(2, time.June, 1))
+	// Grace joined two seasons ago and stayed
+	h.addStatusChange("aaaaaaa2", "", model.MEMBERSSTATUSACTIVATED, model.STATUSCAUSECREATION, date(2, time.March, 1))
+	// Alan joined last season, paused and came back this season
+	h.addStatusChange("aaaaaaa3", "", model.MEMBERSSTATUSACTIVATED, model.STATUSCAUSECREATION, date(1, time.February, 1))
+	h.addStatusChange("aaaaaaa3", model.MEMBERSSTATUSACTIVATED, model.MEMBERSSTATUSPAUSED, model.STATUSCAUSEMANUAL, date(1, time.March, 1))
+	h.addStatusChange("aaaaaaa3", model.MEMBERSSTATUSPAUSED, model.MEMBERSSTATUSACTIVATED, model.STATUSCAUSEPARTICIPATION,
+		time.Date(year, time.January, 1, 1, 0, 0, 0, location))
+
+	req, _ := http.NewRequest("GET", "/api/v1/reports/retention?seasons=3", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	var report model.RetentionReport
+	if err := json.Unmarshal(response.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Seasons) != 3 {
+		t.Fatalf("Expected 3 seasons. Got %v", report.Seasons)
+	}
+	expected := []struct {
+		name        string
+		joined      int
+		active      int
+		retention   []int
+		transitions map[string]int
+	}{
+		{fmt.Sprint(year - 2), 2, 2, []int{2, 1, 1}, map[string]int{model.STATUSCAUSECREATION: 2, model.STATUSCAUSEAUTOPAUSE: 1}},
+		{fmt.Sprint(year - 1), 1, 2, []int{1, 1}, map[string]int{model.STATUSCAUSECREATION: 1, model.STATUSCAUSEMANUAL: 1}},
+		{fmt.Sprint(year), 0, 2, []int{0}, map[string]int{model.STATUSCAUSEPARTICIPATION: 1}},
+	}
+	for i, season := range report.Seasons {
+		if season.Name != expected[i].name || season.Joined != expected[i].joined || season.Active != expected[i].active ||
+			fmt.Sprint(season.Retention) != fmt.Sprint(expected[i].retention) ||
+			fmt.Sprint(season.Transitions) != fmt.Sprint(expected[i].transitions) {
+			t.Errorf("Expected season %d to be %+v. Got %+v", i, expected[i], season)
+		}
+	}
+	// Ada was active from January to June
+	if days := report.Seasons[0].AverageActiveDays; days < 200 {
+		t.Errorf("Expected the first cohort to be active more than 200 days on average. Got %f", days)
+	}
+
+	// Only the guests
+	req, _ = http.NewRequest("GET", "/api/v1/reports/retention?seasons=3&type=guest", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response = h.executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &report)
+	if report.Seasons[0].Joined != 0 || report.Seasons[2].Active != 0 {
+		t.Errorf("Expected no guest in the report. Got %+v", report.Seasons)
+	}
+}
+
+func TestGetRetentionReportInvalidSeasons(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+
+	req, _ := http.NewRequest("GET", "/api/v1/reports/retention?seasons=0", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	if err := h.checkResponseCode(http.StatusBadRequest, h.executeRequest(req).Code); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,195 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// loginWithAgent logs in from a device and returns the tokens.
+func (test *TestHelper) loginWithAgent(username, password, userAgent string) map[string]string {
+	payload, _ := json.Marshal(map[string]string{"username": username, "password": password})
+	req, _ := http.NewRequest("POST", "/api/v1/login", bytes.NewBuffer(payload))
+	req.Header.Set("User-Agent", userAgent)
+	req.RemoteAddr = testIP
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		tFatal(err)
+	}
+	var tokens map[string]string
+	json.Unmarshal(response.Body.Bytes(), &tokens)
+	return tokens
+}
+
+func (test *TestHelper) getSessions(accessToken, url string) (int, []map[string]interface{}) {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	var sessions []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &sessions)
+	return response.Code, sessions
+}
+
+func (test *TestHelper) deleteWithToken(accessToken, url string) int {
+	req, _ := http.NewRequest("DELETE", url, nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	return h.executeRequest(req).Code
+}
+
+func TestSessionsListAndRevoke(t *testing.T) {
+	h.clearTables()
+	h.addAMember()
+	laptop := h.loginWithAgent("member", "member", "laptop")
+	phone := h.loginWithAgent("member", "member", "phone")
+
+	code, sessions := h.getSessions(laptop["access_token"], "/api/v1/sessions")
+	if err := h.checkResponseCode(http.StatusOK, code); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 3 {
+		t.Fatalf("Expected 3 sessions. Got %d", len(sessions))
+	}
+	phoneID := ""
+	for _, session := range sessions {
+		if session["userAgent"] == "laptop" && session["current"] != true {
+			t.Errorf("Expected the session of the laptop to be current. Got %v", session)
+		}
+		if session["userAgent"] == "phone" {
+			phoneID = session["id"].(string)
+			if session["ip"] != "192.0.2.1" || session["createdAt"] == 0.0 {
+				t.Errorf("Unexpected session metadata: %v", session)
+			}
+		}
+	}
+
+	// The lost phone is logged out
+	if code := h.deleteWithToken(laptop["access_token"], "/api/v1/sessions/"+phoneID); code != http.StatusOK {
+		t.Errorf("Expected response code %d. Got %d", http.StatusOK, code)
+	}
+	if code, _ := h.getSessions(phone["access_token"], "/api/v1/sessions"); code != http.StatusUnauthorized {
+		t.Errorf("Expected the access token of the revoked session to be refused. Got %d", code)
+	}
+	if code := h.refresh(phone["refresh_token"]).StatusCode; code != http.StatusUnauthorized {
+		t.Errorf("Expected the refresh token of the revoked session to be refused. Got %d", code)
+	}
+	if code := h.deleteWithToken(laptop["access_token"], "/api/v1/sessions/"+phoneID); code != http.StatusNotFound {
+		t.Errorf("Expected response code %d. Got %d", http.StatusNotFound, code)
+	}
+	if _, sessions := h.getSessions(laptop["access_token"], "/api/v1/sessions"); len(sessions) != 2 {
+		t.Errorf("Expected 2 sessions. Got %d", len(sessions))
+	}
+}
+
+func (test *TestHelper) refresh(refreshToken string) *http.Response {
+	payload, _ := json.Marshal(map[string]string{"refresh_token": refreshToken})
+	req, _ := http.NewRequest("POST", "/api/v1/refresh", bytes.NewBuffer(payload))
+	return h.executeRequest(req).Result()
+}
+
+func TestSessionRefreshAndLogout(t *testing.T) {
+	h.clearTables()
+	h.addAMember()
+	laptop := h.loginWithAgent("member", "member", "laptop")
+	_, before := h.getSessions(laptop["access_token"], "/api/v1/sessions")
+
+	response := h.refresh(laptop["refresh_token"])
+	if err := h.checkResponseCode(http.StatusCreated, response.StatusCode); err != nil {
+		t.Fatal(err)
+	}
+	var tokens map[string]string
+	json.NewDecoder(response.Body).Decode(&tokens)
+	// The session continues with the new tokens
+	if code, _ := h.getSessions(laptop["access_token"], "/api/v1/sessions"); code != http.StatusUnauthorized {
+		t.Errorf("Expected the replaced access token to be refused. Got %d", code)
+	}
+	_, after := h.getSessions(tokens["access_token"], "/api/v1/sessions")
+	if len(after) != len(before) {
+		t.Fatalf("Expected the refresh to keep %d sessions. Got %d", len(before), len(after))
+	}
+	for _, session := range after {
+		if session["current"] == true && session["createdAt"].(float64) > session["lastUsedAt"].(float64) {
+			t.Errorf("Expected the session to keep its creation date. Got %v", session)
+		}
+	}
+
+	req, _ := http.NewRequest("POST", "/api/v1/logout", nil)
+	req.Header.Add("Authorization", "Bearer "+tokens["access_token"])
+	if code := h.executeRequest(req).Code; code != http.StatusAccepted {
+		t.Errorf("Expected response code %d. Got %d", http.StatusAccepted, code)
+	}
+	if code, _ := h.getSessions(tokens["access_token"], "/api/v1/sessions"); code != http.StatusUnauthorized {
+		t.Errorf("Expected the token to be refused after the logout. Got %d", code)
+	}
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	h.clearTables()
+	memberToken := h.addAMember()
+	h.loginWithAgent("member", "member", "phone")
+	laptop := h.loginWithAgent("member", "member", "laptop")
+
+	req, _ := http.NewRequest("DELETE", "/api/v1/sessions", nil)
+	req.Header.Add("Authorization", "Bearer "+laptop["access_token"])
+	response := h.executeRequest(req)
+	var result map[string]int
+	json.Unmarshal(response.Body.Bytes(), &result)
+	if result["revoked"] != 2 {
+		t.Errorf("Expected 2 sessions to be revoked. Got %v", result)
+	}
+	if code, sessions := h.getSessions(laptop["access_token"], "/api/v1/sessions"); code != http.StatusOK || len(sessions) != 1 {
+		t.Errorf("Expected only the current session. Got %d, %v", code, sessions)
+	}
+	if code, _ := h.getSessions(memberToken, "/api/v1/sessions"); code != http.StatusUnauthorized {
+		t.Errorf("Expected the other sessions to be revoked. Got %d", code)
+	}
+}
+
+func TestAdminRevokeMemberSessions(t *testing.T) {
+	h.clearTables()
+	adminToken := h.addAnAdmin()
+	memberToken := h.addAMember()
+	h.loginWithAgent("member", "member", "phone")
+
+	if code, _ := h.getSessions(memberToken, "/api/v1/members/deadbeef/sessions"); code != http.StatusUnauthorized {
+		t.Errorf("Expected a member to be refused. Got %d", code)
+	}
+	code, sessions := h.getSessions(adminToken, "/api/v1/members/deadbeef/sessions")
+	if code != http.StatusOK || len(sessions) != 2 {
+		t.Fatalf("Expected the 2 sessions of the member. Got %d, %v", code, sessions)
+	}
+	if code := h.deleteWithToken(adminToken, "/api/v1/members/deadbeef/sessions/"+sessions[0]["id"].(string)); code != http.StatusOK {
+		t.Errorf("Expected response code %d. Got %d", http.StatusOK, code)
+	}
+	if code := h.deleteWithToken(adminToken, "/api/v1/members/deadbeef/sessions"); code != http.StatusOK {
+		t.Errorf("Expected response code %d. Got %d", http.StatusOK, code)
+	}
+	if code, _ := h.getSessions(memberToken, "/api/v1/sessions"); code != http.StatusUnauthorized {
+		t.Errorf("Expected the member to be logged out. Got %d", code)
+	}
+	if code, _ := h.getSessions(adminToken, "/api/v1/sessions"); code != http.StatusOK {
+		t.Errorf("Expected the admin to stay logged in. Got %d", code)
+	}
+	if code := h.deleteWithToken(adminToken, "/api/v1/members/deadc0de/sessions"); code != http.StatusNotFound {
+		t.Errorf("Expected response code %d. Got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestChangePasswordRevokesSessions(t *testing.T) {
+	h.clearTables()
+	memberToken := h.addAMember()
+	phone := h.loginWithAgent("member", "member", "phone")
+
+	payload := []byte(`{"password":"new password"}`)
+	req, _ := http.NewRequest("POST", "/api/v1/change_password", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+memberToken)
+	if code := h.executeRequest(req).Code; code != http.StatusOK {
+		t.Fatalf("Expected response code %d. Got %d", http.StatusOK, code)
+	}
+	if code, _ := h.getSessions(phone["access_token"], "/api/v1/sessions"); code != http.StatusUnauthorized {
+		t.Errorf("Expected the other sessions to be logged out. Got %d", code)
+	}
+	if code, _ := h.getSessions(memberToken, "/api/v1/sessions"); code != http.StatusOK {
+		t.Errorf("Expected the session changing the password to stay logged in. Got %d", code)
+	}
+}
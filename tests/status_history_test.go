@@ -0,0 +1,149 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/vilisseranen/castellers/controller"
+	"github.com/vilisseranen/castellers/model"
+)
+
+func (test *TestHelper) getStatusHistory(accessToken, uuid string) []model.StatusChange {
+	req, _ := http.NewRequest("GET", "/api/v1/members/"+uuid+"/status/history", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusOK, response.Code); err != nil {
+		tFatal(err)
+	}
+	history := []model.StatusChange{}
+	if err := json.Unmarshal(response.Body.Bytes(), &history); err != nil {
+		tFatal(err)
+	}
+	return history
+}
+
+func checkStatusHistory(t *testing.T, history []model.StatusChange, expected [][3]string) {
+	if len(history) != len(expected) {
+		t.Fatalf("Expected %d changes of status. Got %v", len(expected), history)
+	}
+	for i, change := range history {
+		if change.From != expected[i][0] || change.To != expected[i][1] || change.Cause != expected[i][2] {
+			t.Errorf("Expected change %d to be %v. Got %s -> %s (%s)", i, expected[i], change.From, change.To, change.Cause)
+		}
+		if change.ChangedAt == 0 {
+			t.Errorf("Expected change %d to have a date", i)
+		}
+	}
+}
+
+func TestMemberStatusHistory(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+
+	payload := []byte(`{"firstName":"Ada","lastName":"Lovelace","roles":["baix"],"type":"member","email":"ada@test.ca","language":"fr"}`)
+	req, _ := http.NewRequest("POST", "/api/v1/members", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	response := h.executeRequest(req)
+	if err := h.checkResponseCode(http.StatusCreated, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	uuid := m["uuid"].(string)
+
+	// Paused by an admin
+	payload = []byte(`{"status":"paused"}`)
+	req, _ = http.NewRequest("PUT", "/api/v1/members/"+uuid+"/status", bytes.NewBuffer(payload))
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	if err := h.checkResponseCode(http.StatusAccepted, h.executeRequest(req).Code); err != nil {
+		t.Error(err)
+	}
+
+	// Reactivated by answering yes to an event
+	start := futureEventStart()
+	h.addEvent("deadbee1", "assaig", start, start+3600)
+	h.answer(accessToken, uuid, "deadbee1", "yes")
+
+	h.deleteMember(accessToken, uuid)
+
+	checkStatusHistory(t, h.getStatusHistory(accessToken, uuid), [][3]string{
+		{"", model.MEMBERSSTATUSCREATED, model.STATUSCAUSECREATION},
+		{model.MEMBERSSTATUSCREATED, model.MEMBERSSTATUSPAUSED, model.STATUSCAUSEMANUAL},
+		{model.MEMBERSSTATUSPAUSED, model.MEMBERSSTATUSACTIVATED, model.STATUSCAUSEPARTICIPATION},
+		{model.MEMBERSSTATUSACTIVATED, model.MEMBERSSTATUSDELETED, model.STATUSCAUSEDELETION},
+	})
+}
+
+func TestMemberStatusHistoryAutoPause(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+	h.addAMember()
+	h.setMemberStatus("deadbeef", model.MEMBERSSTATUSACTIVATED)
+	h.setMemberLastActivityDate("deadbeef", 0)
+
+	controller.RunPauseAbsentMembersOnce()
+	// Setting the same status again is not a change
+	controller.RunPauseAbsentMembersOnce()
+
+	checkStatusHistory(t, h.getStatusHistory(accessToken, "deadbeef"), [][3]string{
+		{model.MEMBERSSTATUSACTIVATED, model.MEMBERSSTATUSPAUSED, model.STATUSCAUSEAUTOPAUSE},
+	})
+}
+
+func TestMemberStatusHistoryConcurrently(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAnAdmin()
+	h.addAMember()
+	h.setMemberStatus("deadbeef", model.MEMBERSSTATUSACTIVATED)
+
+	// Another change of status holds the write lock
+	db, err := sql.Open("sqlite3", testDbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(ctx, "UPDATE members SET status = ? WHERE uuid = 'deadbeef'", model.MEMBERSSTATUSPAUSED); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		m := model.Member{UUID: "deadbeef"}
+		done <- m.SetStatus(ctx, model.MEMBERSSTATUSACTIVATED, model.STATUSCAUSEMANUAL)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("Expected the change to wait for the other one. Got %v", err)
+	}
+	checkStatusHistory(t, h.getStatusHistory(accessToken, "deadbeef"), [][3]string{
+		{model.MEMBERSSTATUSPAUSED, model.MEMBERSSTATUSACTIVATED, model.STATUSCAUSEMANUAL},
+	})
+}
+
+func TestMemberStatusHistoryNonAdmin(t *testing.T) {
+	h.clearTables()
+	accessToken := h.addAMember()
+
+	req, _ := http.NewRequest("GET", "/api/v1/members/deadbeef/status/history", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	if err := h.checkResponseCode(http.StatusUnauthorized, h.executeRequest(req).Code); err != nil {
+		t.Error(err)
+	}
+}
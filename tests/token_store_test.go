@@ -0,0 +1,139 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vilisseranen/castellers/controller"
+	"github.com/vilisseranen/castellers/model"
+)
+
+// useSQLiteTokenStore keeps the tokens in the database until the returned
+// function switches back to Redis.
+func (test *TestHelper) useSQLiteTokenStore() func() {
+	os.Setenv("APP_TOKEN_STORE", controller.TokenStoreSQLite)
+	controller.InitializeTokenStore()
+	return func() {
+		os.Unsetenv("APP_TOKEN_STORE")
+		controller.InitializeTokenStore()
+	}
+}
+
+func TestSQLiteTokenStoreSessions(t *testing.T) {
+	h.clearTables()
+	defer h.useSQLiteTokenStore()()
+	h.addAMember()
+
+	laptop := h.loginWithAgent("member", "member", "laptop")
+	phone := h.loginWithAgent("member", "member", "phone")
+	if keys := mockRedis.Keys(); len(keys) != 0 {
+		t.Errorf("Expected nothing in Redis. Got %v", keys)
+	}
+	// With the login of addAMember
+	if n := h.countRows("SELECT COUNT(*) FROM token_store_sets WHERE key = 'sessions:deadbeef'"); n != 3 {
+		t.Errorf("Expected 3 sessions in the database. Got %d", n)
+	}
+	if err := h.checkResponseCode(http.StatusOK, h.getWithToken(laptop["access_token"], "/api/v1/members/deadbeef")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The refresh rotates the session
+	response := h.refresh(phone["refresh_token"])
+	if err := h.checkResponseCode(http.StatusCreated, response.StatusCode); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.checkResponseCode(http.StatusUnauthorized, h.getWithToken(phone["access_token"], "/api/v1/members/deadbeef")); err != nil {
+		t.Error(err)
+	}
+	code, sessions := h.getSessions(laptop["access_token"], "/api/v1/sessions")
+	if err := h.checkResponseCode(http.StatusOK, code); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 3 {
+		t.Fatalf("Expected 3 sessions. Got %d", len(sessions))
+	}
+
+	if err := h.checkResponseCode(http.StatusOK, h.deleteWithToken(laptop["access_token"], "/api/v1/sessions")); err != nil {
+		t.Fatal(err)
+	}
+	code, sessions = h.getSessions(laptop["access_token"], "/api/v1/sessions")
+	if code != http.StatusOK || len(sessions) != 1 {
+		t.Errorf("Expected only the current session. Got %d %v", code, sessions)
+	}
+}
+
+func TestSQLiteTokenStoreLoginLockout(t *testing.T) {
+	h.clearTables()
+	defer h.useSQLiteTokenStore()()
+	h.addAMember()
+	os.Setenv("APP_LOGIN_PROTECTION_DELAY_SECONDS", "0")
+	defer os.Unsetenv("APP_LOGIN_PROTECTION_DELAY_SECONDS")
+
+	for i := 0; i < 10; i++ {
+		h.loginFrom(testIP, "member", "wrong")
+	}
+	response := h.loginFrom(testIP, "member", "member")
+	if err := h.checkResponseCode(http.StatusTooManyRequests, response.Code); err != nil {
+		t.Fatal(err)
+	}
+	if retryAfter := response.Header().Get("Retry-After"); retryAfter != "1800" {
+		t.Errorf("Expected to retry after 30 minutes. Got %s", retryAfter)
+	}
+
+	// The expired lockout is ignored, then deleted
+	h.execSQL("UPDATE token_store SET expires_at = ? WHERE key LIKE 'login_protection:lock:%'", time.Now().Add(-time.Second).UnixMilli())
+	if err := h.checkResponseCode(http.StatusOK, h.loginFrom(testIP, "member", "member").Code); err != nil {
+		t.Error(err)
+	}
+	expired := h.countRows("SELECT COUNT(*) FROM token_store WHERE expires_at > 0 AND expires_at <= ?", time.Now().UnixMilli())
+	if expired == 0 {
+		t.Fatal("Expected expired tokens")
+	}
+	valid := h.countRows("SELECT COUNT(*) FROM token_store WHERE expires_at = 0 OR expires_at > ?", time.Now().UnixMilli())
+	controller.RunDeleteExpiredTokensOnce()
+	if n := h.countRows("SELECT COUNT(*) FROM token_store"); n != valid {
+		t.Errorf("Expected the %d valid tokens to remain. Got %d", valid, n)
+	}
+}
+
+func TestSQLiteTokenStoreConcurrentWrites(t *testing.T) {
+	h.clearTables()
+	ctx := context.Background()
+	if err := model.SetStoredToken(ctx, "session", "deadbeef", 0); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	var deleted int64
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, incrErr := model.IncrStoredToken(ctx, "counter", 0)
+			n, deleteErr := model.DeleteStoredTokens(ctx, "session")
+			mu.Lock()
+			defer mu.Unlock()
+			for _, err := range []error{incrErr, deleteErr} {
+				if err != nil {
+					errs = append(errs, err)
+				}
+			}
+			deleted += n
+		}()
+	}
+	wg.Wait()
+	if len(errs) != 0 {
+		t.Fatalf("Expected the writes to wait for each other. Got %v", errs)
+	}
+	if value, _, err := model.GetStoredToken(ctx, "counter"); err != nil || value != "20" {
+		t.Errorf("Expected the counter to be 20. Got '%s' (%v)", value, err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expected the key to be deleted once. Got %d", deleted)
+	}
+}